@@ -0,0 +1,361 @@
+// Package api implements the local REST API. It exposes the state of the
+// charger and of the power sensors, the last decision of the state worker
+// and the configuration, and allows changing the mode, overriding the
+// current for a while, and pausing control altogether.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/health"
+	"solar-ev-charger/metrics"
+	"solar-ev-charger/worker"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.api")
+
+// maxBodySize caps the size of request bodies.
+const maxBodySize = 64 * 1024
+
+// NewServer returns a new API server, controlling stateWorker.
+func NewServer(ctx context.Context, cfg *config.Config, stateWorker *worker.Worker) (*Server, error) {
+	if err := cfg.API.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating api config")
+	}
+	redacted, err := redactedConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "redacting config")
+	}
+
+	s := &Server{
+		ctx:      ctx,
+		cfg:      cfg.API,
+		worker:   stateWorker,
+		redacted: redacted,
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/state", s.handleState)
+	mux.HandleFunc("/api/v1/decision", s.handleDecision)
+	mux.HandleFunc("/api/v1/config", s.handleConfig)
+	mux.HandleFunc("/api/v1/health", s.handleHealth)
+	mux.HandleFunc("/api/v1/mode", s.handleMode)
+	mux.HandleFunc("/api/v1/override", s.handleOverride)
+	mux.HandleFunc("/api/v1/pause", s.handlePause)
+	mux.HandleFunc("/api/v1/resume", s.handleResume)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.srv = &http.Server{
+		Handler:           s.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Server serves the local REST API.
+type Server struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	cfg      config.APISettings
+	worker   *worker.Worker
+	redacted map[string]interface{}
+
+	srv *http.Server
+}
+
+// listenAddresses returns the addresses we listen on. If an interface is
+// configured, we listen on each of its addresses.
+func (s *Server) listenAddresses() ([]string, error) {
+	if s.cfg.Interface == "" {
+		return []string{s.cfg.ListenAddress}, nil
+	}
+
+	_, port, err := net.SplitHostPort(s.cfg.ListenAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing listen_address")
+	}
+	iface, err := net.InterfaceByName(s.cfg.Interface)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching interface %s", s.cfg.Interface)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching addresses of %s", s.cfg.Interface)
+	}
+
+	var ret []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// Link local addresses need a zone, and are of little use to
+		// clients anyway.
+		if ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ret = append(ret, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", s.cfg.Interface)
+	}
+	return ret, nil
+}
+
+// authenticate rejects requests without the configured token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.cfg.Token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + s.cfg.Token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="solar-ev-charger"`)
+			writeError(rw, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, code int, val interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(val); err != nil {
+		log.Debugf("failed to write response: %q", err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, map[string]string{"error": err.Error()})
+}
+
+// allowMethods returns true if the method of req is one of methods. If it
+// is not, it writes an error response.
+func allowMethods(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	return false
+}
+
+func decodeBody(rw http.ResponseWriter, req *http.Request, target interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(target); err != nil {
+		return errors.Wrap(err, "decoding request")
+	}
+	return nil
+}
+
+func (s *Server) handleState(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.worker.Status())
+}
+
+func (s *Server) handleDecision(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	decision := s.worker.Status().Decision
+	if decision == nil {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("no decision was made yet"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, decision)
+}
+
+func (s *Server) handleConfig(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.redacted)
+}
+
+func (s *Server) handleHealth(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	code := http.StatusOK
+	if !health.Healthy() {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, code, health.All())
+}
+
+type modeRequest struct {
+	Mode worker.Mode `json:"mode"`
+}
+
+func (s *Server) handleMode(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		var body modeRequest
+		if err := decodeBody(rw, req, &body); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.worker.SetMode(body.Mode); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(rw, http.StatusOK, modeRequest{Mode: s.worker.Status().Mode})
+}
+
+type overrideRequest struct {
+	// Current is the current in Amps. Zero switches the charger off.
+	Current *float64 `json:"current"`
+	// Duration is the duration of the override in seconds.
+	Duration uint `json:"duration"`
+}
+
+func (s *Server) handleOverride(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch req.Method {
+	case http.MethodPut, http.MethodPost:
+		var body overrideRequest
+		if err := decodeBody(rw, req, &body); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if body.Current == nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("missing current"))
+			return
+		}
+		override, err := s.worker.SetOverride(*body.Current, time.Duration(body.Duration)*time.Second)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, override)
+		return
+	case http.MethodDelete:
+		s.worker.ClearOverride()
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	override := s.worker.Status().Override
+	if override == nil {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("no override is set"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, override)
+}
+
+type pausedResponse struct {
+	Paused bool `json:"paused"`
+}
+
+func (s *Server) handlePause(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+	s.worker.Pause()
+	writeJSON(rw, http.StatusOK, pausedResponse{Paused: true})
+}
+
+func (s *Server) handleResume(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+	s.worker.Resume()
+	writeJSON(rw, http.StatusOK, pausedResponse{Paused: false})
+}
+
+func (s *Server) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	s.worker.CollectMetrics()
+	rw.Header().Set("Content-Type", metrics.ContentType)
+	if err := metrics.Write(rw); err != nil {
+		log.Debugf("failed to write metrics: %q", err)
+	}
+}
+
+func (s *Server) loop() {
+	defer close(s.closed)
+
+	select {
+	case <-s.ctx.Done():
+	case <-s.quit:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		log.Errorf("failed to shut down api server: %q", err)
+	}
+}
+
+func (s *Server) Start() error {
+	addresses, err := s.listenAddresses()
+	if err != nil {
+		return errors.Wrap(err, "fetching listen addresses")
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return errors.Wrap(err, "starting api server")
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		log.Infof("api listening on %s", listener.Addr())
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && s.cfg.Token == "" && !addr.IP.IsLoopback() {
+			log.Warningf("api on %s has no token set; anyone able to reach it can control the charger", addr)
+		}
+		go func(listener net.Listener) {
+			if err := s.srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("api server failed: %q", err)
+			}
+		}(listener)
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Server) Stop() error {
+	close(s.quit)
+	select {
+	case <-s.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for api server to exit")
+	}
+}
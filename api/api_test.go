@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/health"
+	"solar-ev-charger/metrics"
+	"solar-ev-charger/worker"
+)
+
+type nopClient struct{}
+
+func (nopClient) Start() error         { return nil }
+func (nopClient) Stop() error          { return nil }
+func (nopClient) SetAmp(float64) error { return nil }
+func (nopClient) Capabilities() (common.Capabilities, error) {
+	return common.DefaultCapabilities(), nil
+}
+
+// newTestServer returns an API server controlling a worker which is not
+// started.
+func newTestServer(t *testing.T, token string) (*Server, *worker.Worker) {
+	t.Helper()
+	cfg := &config.Config{
+		ConfiguredCharger: "OpenEVSE",
+		API:               config.APISettings{Token: token},
+	}
+	w, err := worker.NewWorker(context.Background(), cfg, nopClient{}, nil, nil)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	s, err := NewServer(context.Background(), cfg, w)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	return s, w
+}
+
+// do sends a request to the API, and returns the response.
+func do(s *Server, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := newTestServer(t, "secret")
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "wrong", http.StatusUnauthorized},
+		{"valid token", "secret", http.StatusOK},
+	}
+	for _, tc := range tests {
+		rec := do(s, http.MethodGet, "/api/v1/state", "", tc.token)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.code, rec.Code)
+		}
+		if tc.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", tc.name)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodPost, "/api/v1/state", "GET"},
+		{http.MethodPost, "/api/v1/decision", "GET"},
+		{http.MethodPut, "/api/v1/config", "GET"},
+		{http.MethodDelete, "/api/v1/health", "GET"},
+		{http.MethodDelete, "/api/v1/mode", "GET, PUT, POST"},
+		{http.MethodPatch, "/api/v1/override", "GET, PUT, POST, DELETE"},
+		{http.MethodGet, "/api/v1/pause", "POST"},
+		{http.MethodGet, "/api/v1/resume", "POST"},
+		{http.MethodPost, "/metrics", "GET"},
+	}
+	for _, tc := range tests {
+		rec := do(s, tc.method, tc.path, "", "")
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected status 405, got %d", tc.method, tc.path, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tc.method, tc.path, tc.allow, got)
+		}
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	health.Set("api test", health.StateOK, nil)
+	s, w := newTestServer(t, "")
+	// The requests run in order, against the same worker.
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		// contains is a string the response must contain.
+		contains string
+	}{
+		{http.MethodGet, "/api/v1/state", "", http.StatusOK, `"mode": "solar"`},
+		{http.MethodGet, "/api/v1/decision", "", http.StatusNotFound, "no decision was made yet"},
+		{http.MethodGet, "/api/v1/config", "", http.StatusOK, `"configured_charger": "OpenEVSE"`},
+		{http.MethodGet, "/api/v1/health", "", http.StatusOK, `"name": "api test"`},
+		{http.MethodGet, "/api/v1/mode", "", http.StatusOK, `"mode": "solar"`},
+		{http.MethodPut, "/api/v1/mode", `{"mode": "max"}`, http.StatusOK, `"mode": "max"`},
+		{http.MethodPost, "/api/v1/mode", `{"mode": "turbo"}`, http.StatusBadRequest, "invalid mode"},
+		{http.MethodPost, "/api/v1/mode", `{"mode": "off", "boost": true}`, http.StatusBadRequest, "unknown field"},
+		{http.MethodPost, "/api/v1/mode", `{"mode":`, http.StatusBadRequest, "decoding request"},
+		{http.MethodGet, "/api/v1/mode", "", http.StatusOK, `"mode": "max"`},
+		{http.MethodGet, "/api/v1/override", "", http.StatusNotFound, "no override is set"},
+		{http.MethodPost, "/api/v1/override", `{"duration": 60}`, http.StatusBadRequest, "missing current"},
+		{http.MethodPost, "/api/v1/override", `{"current": 16}`, http.StatusBadRequest, "invalid duration"},
+		{http.MethodPost, "/api/v1/override", `{"current": -1, "duration": 60}`, http.StatusBadRequest, "invalid current"},
+		{http.MethodPost, "/api/v1/override", `{"current": 16, "until": 60}`, http.StatusBadRequest, "unknown field"},
+		{http.MethodPut, "/api/v1/override", `{"current": 16, "duration": 60}`, http.StatusOK, `"current": 16`},
+		{http.MethodGet, "/api/v1/override", "", http.StatusOK, `"current": 16`},
+		{http.MethodDelete, "/api/v1/override", "", http.StatusNoContent, ""},
+		{http.MethodGet, "/api/v1/override", "", http.StatusNotFound, "no override is set"},
+		{http.MethodPost, "/api/v1/pause", "", http.StatusOK, `"paused": true`},
+		{http.MethodGet, "/api/v1/state", "", http.StatusOK, `"paused": true`},
+		{http.MethodPost, "/api/v1/resume", "", http.StatusOK, `"paused": false`},
+		{http.MethodGet, "/api/v1/state", "", http.StatusOK, `"paused": false`},
+		{http.MethodGet, "/metrics", "", http.StatusOK, "# TYPE"},
+	}
+	for _, tc := range tests {
+		rec := do(s, tc.method, tc.path, tc.body, "")
+		if rec.Code != tc.code {
+			t.Errorf("%s %s %s: expected status %d, got %d: %s", tc.method, tc.path, tc.body, tc.code, rec.Code, rec.Body)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.contains) {
+			t.Errorf("%s %s %s: expected the response to contain %q, got %s", tc.method, tc.path, tc.body, tc.contains, rec.Body)
+		}
+	}
+
+	if status := w.Status(); status.Mode != worker.ModeMax || status.Override != nil || status.Paused {
+		t.Errorf("unexpected worker state: %+v", status)
+	}
+	rec := do(s, http.MethodGet, "/metrics", "", "")
+	if got := rec.Header().Get("Content-Type"); got != metrics.ContentType {
+		t.Errorf("expected metrics content type %q, got %q", metrics.ContentType, got)
+	}
+}
+
+func TestHealthUnavailable(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	health.Set("charger", health.StateOffline, nil)
+	defer health.Set("charger", health.StateOK, nil)
+
+	rec := do(s, http.MethodGet, "/api/v1/health", "", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 with an offline component, got %d", rec.Code)
+	}
+}
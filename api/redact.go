@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// redacted replaces secrets in the config we return.
+const redacted = "REDACTED"
+
+// secretKeys are the config keys holding secrets.
+var secretKeys = map[string]bool{
+	"password": true,
+	"token":    true,
+}
+
+// secretHeaders are fragments of names of headers which usually hold
+// secrets.
+var secretHeaders = []string{"authorization", "cookie", "token", "key", "secret", "password"}
+
+// redactedConfig returns the config as a map keyed by the names used in the
+// config file, with passwords, tokens and credentials in URLs replaced. Of
+// the charger sections, only the one of the configured charger is kept.
+func redactedConfig(cfg *config.Config) (map[string]interface{}, error) {
+	ret, err := toMap(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "converting config")
+	}
+
+	// The sections of the other drivers only hold defaults, or settings
+	// left over from a previous charger.
+	for _, name := range common.DriverNames() {
+		if driver, err := common.GetDriver(name); err == nil {
+			delete(ret, driver.ConfigSection)
+		}
+	}
+	if driver, err := common.GetDriver(cfg.ConfiguredCharger); err == nil {
+		settings, err := toMap(driver.Settings(cfg))
+		if err != nil {
+			return nil, errors.Wrapf(err, "converting [%s] section", driver.ConfigSection)
+		}
+		ret[driver.ConfigSection] = settings
+	}
+	redactMap(ret, false)
+	return ret, nil
+}
+
+// toMap converts a struct to a map keyed by its toml names.
+func toMap(val interface{}) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(val); err != nil {
+		return nil, errors.Wrap(err, "encoding")
+	}
+	ret := map[string]interface{}{}
+	if _, err := toml.Decode(buf.String(), &ret); err != nil {
+		return nil, errors.Wrap(err, "decoding")
+	}
+	return ret, nil
+}
+
+// redactMap redacts the values in m. If headers is true, m holds HTTP
+// headers.
+func redactMap(m map[string]interface{}, headers bool) {
+	for key, val := range m {
+		if str, ok := val.(string); ok && str != "" && isSecret(key, headers) {
+			m[key] = redacted
+			continue
+		}
+		m[key] = redactValue(val, key == "headers")
+	}
+}
+
+func redactValue(val interface{}, headers bool) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		redactMap(v, headers)
+	case []map[string]interface{}:
+		for _, m := range v {
+			redactMap(m, false)
+		}
+	case []interface{}:
+		for idx := range v {
+			v[idx] = redactValue(v[idx], false)
+		}
+	case string:
+		return redactURL(v)
+	}
+	return val
+}
+
+func isSecret(key string, header bool) bool {
+	key = strings.ToLower(key)
+	if !header {
+		return secretKeys[key]
+	}
+	for _, fragment := range secretHeaders {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL removes the password from URLs with credentials. Other values
+// are returned unchanged.
+func redactURL(val string) string {
+	if !strings.Contains(val, "://") {
+		return val
+	}
+	u, err := url.Parse(val)
+	if err != nil || u.User == nil {
+		return val
+	}
+	return u.Redacted()
+}
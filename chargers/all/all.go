@@ -0,0 +1,14 @@
+// Package all registers every charger driver. Import it for its side
+// effects, to make all drivers available through the common registry.
+package all
+
+import (
+	_ "solar-ev-charger/chargers/eCharger"
+	_ "solar-ev-charger/chargers/generic"
+	_ "solar-ev-charger/chargers/keba"
+	_ "solar-ev-charger/chargers/modbus"
+	_ "solar-ev-charger/chargers/ocpp"
+	_ "solar-ev-charger/chargers/openEVSE"
+	_ "solar-ev-charger/chargers/relay"
+	_ "solar-ev-charger/chargers/victronEVCS"
+)
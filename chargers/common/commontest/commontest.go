@@ -0,0 +1,82 @@
+// Package commontest holds helpers shared by the tests of charger drivers.
+package commontest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// StateTimeout is the amount of time WaitForState waits for a matching
+// state. Drivers polling their charger send a state every 5 seconds.
+const StateTimeout = 15 * time.Second
+
+// NewWorkerFunc creates the status worker of a driver.
+type NewWorkerFunc func(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error)
+
+// StartWorker creates and starts a status worker for cfg, and returns it
+// along with the client controlling the charger and the channel receiving
+// its state. The worker is stopped when the test ends.
+func StartWorker(t *testing.T, newWorker NewWorkerFunc, cfg *config.Config) (common.BasicWorker, common.Client, chan params.ChargerState) {
+	t.Helper()
+	stateChan := make(chan params.ChargerState, 10)
+	w, err := newWorker(context.Background(), cfg, stateChan)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	provider, ok := w.(common.ClientProvider)
+	if !ok {
+		t.Fatalf("worker does not provide a client")
+	}
+	cli, err := provider.ChargerClient()
+	if err != nil {
+		t.Fatalf("fetching charger client: %v", err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatalf("starting worker: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := w.Stop(); err != nil {
+			t.Errorf("stopping worker: %v", err)
+		}
+	})
+	return w, cli, stateChan
+}
+
+// WaitForState returns the first state received on stateChan for which
+// cond returns true. The test fails if there is none within StateTimeout.
+func WaitForState(t *testing.T, stateChan chan params.ChargerState, what string, cond func(params.ChargerState) bool) params.ChargerState {
+	t.Helper()
+	timeout := time.After(StateTimeout)
+	for {
+		select {
+		case state := <-stateChan:
+			if cond(state) {
+				return state
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// AnyState matches every state.
+func AnyState(params.ChargerState) bool {
+	return true
+}
+
+// FreeAddress returns a local address nobody listens on.
+func FreeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -8,5 +8,70 @@ type BasicWorker interface {
 type Client interface {
 	Start() error
 	Stop() error
-	SetAmp(newVal uint64) error
+	// SetAmp sets the charge current, in Amps. The value is rounded to the
+	// CurrentStep advertised by Capabilities by the caller.
+	SetAmp(newVal float64) error
+	// Capabilities returns what the charger is able to do. Clients may query
+	// the station to determine them.
+	Capabilities() (Capabilities, error)
+}
+
+// Capabilities describes the features of a charger. The zero value
+// describes a charger that can neither be switched nor adjusted.
+type Capabilities struct {
+	// MinCurrent is the lowest current, in Amps, the charger accepts. A
+	// value of 0 means unknown.
+	MinCurrent float64 `json:"min_current"`
+	// MaxCurrent is the highest current, in Amps, the charger accepts. A
+	// value of 0 means unknown.
+	MaxCurrent float64 `json:"max_current"`
+	// CurrentStep is the granularity of the current setting, in Amps. A
+	// value of 0 means the current can not be adjusted.
+	CurrentStep float64 `json:"current_step"`
+	// Phases is the number of phases the charger draws power from. A value
+	// of 0 means unknown, in which case charger_phases from the config is
+	// used.
+	Phases int `json:"phases"`
+	// Toggle is true if the charger can be started and stopped.
+	Toggle bool `json:"toggle"`
+	// SessionEnergy is true if the charger reports the energy charged in
+	// the current session.
+	SessionEnergy bool `json:"session_energy"`
+	// PlugDetection is true if the charger reports whether a vehicle is
+	// plugged in.
+	PlugDetection bool `json:"plug_detection"`
+}
+
+// Adjustable returns true if the charge current can be set.
+func (c Capabilities) Adjustable() bool {
+	return c.CurrentStep > 0
+}
+
+// DefaultCapabilities returns the capabilities of a charger that accepts
+// whole Amps between 6 and 32, and can be started and stopped. This matches
+// most AC chargers.
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		MinCurrent:  6,
+		MaxCurrent:  32,
+		CurrentStep: 1,
+		Toggle:      true,
+	}
+}
+
+// ClientProvider is implemented by status workers that are able to hand out
+// a Client to control the charger they monitor. This allows the Client to
+// share the connection to the station with the worker.
+type ClientProvider interface {
+	ChargerClient() (Client, error)
+}
+
+// SurplusFeeder is implemented by clients of chargers that decide the charge
+// current themselves, based on the power production and grid import/export
+// readings we feed them. Such clients are not asked to start, stop or set
+// the current of the charger.
+type SurplusFeeder interface {
+	// FeedSurplus sends the total power production and the grid import
+	// (positive) or export (negative), in Watts.
+	FeedSurplus(production, gridImport float64) error
 }
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+
+	"github.com/pkg/errors"
+)
+
+// Factory creates the status worker of a charger, and the client used to
+// control it. The worker sends status updates on stateChan.
+type Factory func(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (BasicWorker, Client, error)
+
+// Driver describes a charger driver.
+type Driver struct {
+	// Name is the value of configured_charger which selects the driver.
+	Name string
+	// ConfigSection is the name of the config section holding the
+	// settings of the driver.
+	ConfigSection string
+	// Settings returns the settings of the driver, held by cfg. The local
+	// API shows them in place of the sections of all drivers.
+	Settings func(cfg *config.Config) interface{}
+	// Validate validates the settings of the driver, and sets defaults.
+	Validate func(cfg *config.Config) error
+	// New creates the status worker and the client of the charger.
+	New Factory
+}
+
+var (
+	driversMux sync.Mutex
+	drivers    = map[string]Driver{}
+)
+
+// RegisterDriver makes a driver available by name. It is meant to be called
+// from the init function of driver packages, and panics if the driver is
+// incomplete or registered twice.
+func RegisterDriver(driver Driver) {
+	driversMux.Lock()
+	defer driversMux.Unlock()
+
+	if driver.Name == "" || driver.New == nil || driver.Validate == nil || driver.Settings == nil {
+		panic(fmt.Sprintf("incomplete charger driver %q", driver.Name))
+	}
+	if _, ok := drivers[driver.Name]; ok {
+		panic(fmt.Sprintf("charger driver %q registered twice", driver.Name))
+	}
+	drivers[driver.Name] = driver
+}
+
+// DriverNames returns the names of all registered drivers, sorted.
+func DriverNames() []string {
+	driversMux.Lock()
+	defer driversMux.Unlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetDriver returns the driver registered under name.
+func GetDriver(name string) (Driver, error) {
+	driversMux.Lock()
+	driver, ok := drivers[name]
+	driversMux.Unlock()
+
+	if !ok {
+		return Driver{}, fmt.Errorf("unknown charger %q (available: %s)", name, strings.Join(DriverNames(), ", "))
+	}
+	return driver, nil
+}
+
+// ValidateDriverConfig validates the settings of the configured charger.
+func ValidateDriverConfig(cfg *config.Config) error {
+	if cfg.ConfiguredCharger == "" {
+		return fmt.Errorf("configured_charger is not set (available: %s)", strings.Join(DriverNames(), ", "))
+	}
+	driver, err := GetDriver(cfg.ConfiguredCharger)
+	if err != nil {
+		return err
+	}
+	if err := driver.Validate(cfg); err != nil {
+		return errors.Wrapf(err, "validating [%s] section", driver.ConfigSection)
+	}
+	return nil
+}
+
+// NewCharger validates the settings of the configured charger, and creates
+// its status worker and client.
+func NewCharger(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (BasicWorker, Client, error) {
+	if err := ValidateDriverConfig(cfg); err != nil {
+		return nil, nil, err
+	}
+	driver, err := GetDriver(cfg.ConfiguredCharger)
+	if err != nil {
+		return nil, nil, err
+	}
+	worker, client, err := driver.New(ctx, cfg, stateChan)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "creating %s charger", driver.Name)
+	}
+	if worker == nil || client == nil {
+		return nil, nil, fmt.Errorf("charger driver %s returned no worker or client", driver.Name)
+	}
+	return worker, client, nil
+}
+
+// ProviderFactory returns a Factory for drivers whose status worker hands
+// out the client, by implementing ClientProvider.
+func ProviderFactory(newWorker func(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (BasicWorker, error)) Factory {
+	return func(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (BasicWorker, Client, error) {
+		worker, err := newWorker(ctx, cfg, stateChan)
+		if err != nil {
+			return nil, nil, err
+		}
+		provider, ok := worker.(ClientProvider)
+		if !ok {
+			return nil, nil, fmt.Errorf("charger worker does not provide a client")
+		}
+		client, err := provider.ChargerClient()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "fetching charger client")
+		}
+		return worker, client, nil
+	}
+}
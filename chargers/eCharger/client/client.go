@@ -1,30 +1,37 @@
 package client
 
 import (
+	"context"
 	"fmt"
-	"net/http"
+	"math"
 	"solar-ev-charger/chargers/common"
-
-	"github.com/pkg/errors"
+	"solar-ev-charger/httpclient"
 )
 
-func NewChargerClient(addr string) common.Client {
+func NewChargerClient(addr string, cli *httpclient.Client) common.Client {
 	return &httpClient{
 		addr: addr,
+		cli:  cli,
 	}
 }
 
 type httpClient struct {
 	addr string
+	cli  *httpclient.Client
 }
 
 func (h *httpClient) doGet(setting string, value uint64) error {
 	uri := fmt.Sprintf("http://%s/mqtt?payload=%s=%d", h.addr, setting, value)
-	resp, err := http.Get(uri)
-	if err != nil {
-		return errors.Wrap(err, "sending request")
+	// The station responds with its status, after applying the setting.
+	// All values are strings.
+	var status map[string]interface{}
+	if err := h.cli.GetJSON(context.Background(), uri, &status); err != nil {
+		return err
+	}
+	expected := fmt.Sprintf("%d", value)
+	if got := fmt.Sprint(status[setting]); got != expected {
+		return fmt.Errorf("station reports %s=%s after setting it to %s", setting, got, expected)
 	}
-	defer resp.Body.Close()
 	return nil
 }
 
@@ -36,6 +43,50 @@ func (h *httpClient) Stop() error {
 	return h.doGet("alw", 0)
 }
 
-func (h *httpClient) SetAmp(amp uint64) error {
-	return h.doGet("amp", amp)
+func (h *httpClient) SetAmp(amp float64) error {
+	return h.doGet("amp", uint64(math.Round(amp)))
+}
+
+func (h *httpClient) Capabilities() (common.Capabilities, error) {
+	return Capabilities(), nil
+}
+
+// Capabilities returns the capabilities of a go-eCharger running API v1.
+func Capabilities() common.Capabilities {
+	caps := common.DefaultCapabilities()
+	caps.PlugDetection = true
+	return caps
+}
+
+// CapabilitiesV2 returns the capabilities of a go-eCharger running API v2,
+// charging on the given number of phases. These stations report the session
+// energy.
+func CapabilitiesV2(phases int) common.Capabilities {
+	caps := Capabilities()
+	caps.SessionEnergy = true
+	caps.Phases = phases
+	return caps
+}
+
+// Values accepted by the "psm" (phase switch mode) key.
+const (
+	PhaseSwitchAuto  = 0
+	PhaseSwitchOne   = 1
+	PhaseSwitchThree = 2
+)
+
+// PhasesV2 returns the number of phases a station charges on, from its phase
+// switch mode and the "pha" key. The first three values of pha tell which
+// phases are connected to the station. Zero is returned if unknown.
+func PhasesV2(phaseSwitchMode int, pha []bool) int {
+	var wired int
+	for idx := 0; idx < 3 && idx < len(pha); idx++ {
+		if pha[idx] {
+			wired++
+		}
+	}
+	if phaseSwitchMode == PhaseSwitchOne && wired > 0 {
+		return 1
+	}
+	return wired
 }
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+)
+
+func TestPhasesV2(t *testing.T) {
+	tests := []struct {
+		mode     int
+		pha      []bool
+		expected int
+	}{
+		{PhaseSwitchAuto, nil, 0},
+		{PhaseSwitchAuto, []bool{true, false, false, true, false, false}, 1},
+		{PhaseSwitchAuto, []bool{true, true, true, false, false, false}, 3},
+		{PhaseSwitchThree, []bool{true, true, true, true, true, true}, 3},
+		{PhaseSwitchOne, []bool{true, true, true, true, false, false}, 1},
+		// Phases after the contactor are ignored.
+		{PhaseSwitchAuto, []bool{false, false, false, true, true, true}, 0},
+	}
+	for _, tc := range tests {
+		if got := PhasesV2(tc.mode, tc.pha); got != tc.expected {
+			t.Errorf("PhasesV2(%d, %v) = %d, expected %d", tc.mode, tc.pha, got, tc.expected)
+		}
+	}
+}
+
+func TestCapabilitiesV2Phases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/status" || req.URL.Query().Get("filter") != "psm,pha" {
+			http.NotFound(rw, req)
+			return
+		}
+		fmt.Fprint(rw, `{"psm":0,"pha":[true,true,true,false,false,false]}`)
+	}))
+	defer srv.Close()
+
+	cli := NewChargerClientV2(strings.TrimPrefix(srv.URL, "http://"), httpclient.New("test", config.HTTPClientSettings{}))
+	caps, err := cli.Capabilities()
+	if err != nil {
+		t.Fatalf("fetching capabilities: %v", err)
+	}
+	if caps.Phases != 3 {
+		t.Errorf("expected 3 phases, got %d", caps.Phases)
+	}
+	if !caps.SessionEnergy {
+		t.Errorf("expected session energy to be reported")
+	}
+}
+
+func TestDetectAPIVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		v2Status int
+		v2Body   string
+		v1Status int
+		expected APIVersion
+	}{
+		{"v2", http.StatusOK, `{"sse":"012345"}`, http.StatusNotFound, APIv2},
+		{"v1", http.StatusNotFound, "", http.StatusOK, APIv1},
+		{"neither", http.StatusNotFound, "", http.StatusNotFound, 0},
+		// Stations failing to answer on the v2 endpoint are not taken
+		// for v1 stations.
+		{"v2 failing", http.StatusInternalServerError, "", http.StatusOK, 0},
+		{"v2 unauthorized", http.StatusUnauthorized, "", http.StatusOK, 0},
+		{"v2 without serial", http.StatusOK, `{}`, http.StatusOK, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/api/status":
+					rw.WriteHeader(tc.v2Status)
+					fmt.Fprint(rw, tc.v2Body)
+				case "/status":
+					rw.WriteHeader(tc.v1Status)
+					fmt.Fprint(rw, `{"sse":"012345"}`)
+				default:
+					http.NotFound(rw, req)
+				}
+			}))
+			defer srv.Close()
+
+			cli := httpclient.New("test", config.HTTPClientSettings{Attempts: 1})
+			version, err := DetectAPIVersion(strings.TrimPrefix(srv.URL, "http://"), cli)
+			if tc.expected == 0 {
+				if err == nil {
+					t.Errorf("expected an error, got v%d", version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tc.expected {
+				t.Errorf("expected v%d, got v%d", tc.expected, version)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/httpclient"
+
+	"github.com/pkg/errors"
+)
+
+// APIVersion is the version of the HTTP API exposed by a go-eCharger.
+type APIVersion int
+
+const (
+	// APIv1 is the legacy API (/status, /mqtt?payload=).
+	// See: https://github.com/goecharger/go-eCharger-API-v1
+	APIv1 APIVersion = 1
+	// APIv2 is the API used by newer hardware (/api/status, /api/set).
+	// See: https://github.com/goecharger/go-eCharger-API-v2
+	APIv2 APIVersion = 2
+)
+
+// ResolveAPIVersion returns the API version we should use, based on the
+// configured charger type. If the charger type does not pin a version,
+// we attempt to detect it.
+func ResolveAPIVersion(chargerType, addr string, cli *httpclient.Client) (APIVersion, error) {
+	switch chargerType {
+	case "eChargerV1":
+		return APIv1, nil
+	case "eChargerV2":
+		return APIv2, nil
+	case "eCharger":
+		return DetectAPIVersion(addr, cli)
+	default:
+		return 0, fmt.Errorf("invalid eCharger type: %s", chargerType)
+	}
+}
+
+// DetectAPIVersion queries the station and returns the API version it
+// supports. Stations that support v2 are preferred over v1. We only fall
+// back to v1 if the station does not know the v2 endpoint, so a v2 station
+// that fails to respond is not mistaken for a v1 one.
+func DetectAPIVersion(addr string, cli *httpclient.Client) (APIVersion, error) {
+	ctx := context.Background()
+	var status map[string]interface{}
+	err := cli.GetJSON(ctx, fmt.Sprintf("http://%s/api/status?filter=sse", addr), &status)
+	if err == nil {
+		if _, ok := status["sse"]; ok {
+			return APIv2, nil
+		}
+		return 0, fmt.Errorf("detecting api version: missing serial number in v2 status")
+	}
+	if !httpclient.IsStatus(err, http.StatusNotFound) {
+		return 0, errors.Wrap(err, "detecting api version")
+	}
+
+	if _, err := cli.Get(ctx, fmt.Sprintf("http://%s/status", addr)); err != nil {
+		return 0, errors.Wrap(err, "detecting api version")
+	}
+	return APIv1, nil
+}
+
+// NewChargerClientForVersion returns a new client for the requested API version.
+func NewChargerClientForVersion(addr string, version APIVersion, cli *httpclient.Client) (common.Client, error) {
+	switch version {
+	case APIv1:
+		return NewChargerClient(addr, cli), nil
+	case APIv2:
+		return NewChargerClientV2(addr, cli), nil
+	default:
+		return nil, fmt.Errorf("unsupported api version: %d", version)
+	}
+}
+
+// Values accepted by the "frc" (force state) key.
+const (
+	ForceStateNeutral uint64 = 0
+	ForceStateOff     uint64 = 1
+	ForceStateOn      uint64 = 2
+)
+
+func NewChargerClientV2(addr string, cli *httpclient.Client) common.Client {
+	return &httpClientV2{
+		addr: addr,
+		cli:  cli,
+	}
+}
+
+type httpClientV2 struct {
+	addr string
+	cli  *httpclient.Client
+}
+
+func (h *httpClientV2) set(values url.Values) error {
+	uri := fmt.Sprintf("http://%s/api/set?%s", h.addr, values.Encode())
+	// The station responds with an object holding each key we set. The value
+	// is true if the key was set, or an error message otherwise.
+	var result map[string]interface{}
+	if err := h.cli.GetJSON(context.Background(), uri, &result); err != nil {
+		return err
+	}
+
+	for key := range values {
+		val, ok := result[key]
+		if !ok {
+			return fmt.Errorf("station did not acknowledge %s", key)
+		}
+		if ok, isBool := val.(bool); !isBool || !ok {
+			return fmt.Errorf("failed to set %s: %v", key, val)
+		}
+	}
+	return nil
+}
+
+func (h *httpClientV2) Start() error {
+	// Neutral lets the station decide, based on its own access control
+	// and scheduling settings.
+	return h.set(url.Values{"frc": []string{fmt.Sprintf("%d", ForceStateNeutral)}})
+}
+
+func (h *httpClientV2) Stop() error {
+	return h.set(url.Values{"frc": []string{fmt.Sprintf("%d", ForceStateOff)}})
+}
+
+func (h *httpClientV2) SetAmp(amp float64) error {
+	return h.set(url.Values{"amp": []string{fmt.Sprintf("%.0f", math.Round(amp))}})
+}
+
+// Capabilities fetches the phases the station charges on.
+func (h *httpClientV2) Capabilities() (common.Capabilities, error) {
+	var status struct {
+		PhaseSwitchMode int    `json:"psm"`
+		Phases          []bool `json:"pha"`
+	}
+	uri := fmt.Sprintf("http://%s/api/status?filter=psm,pha", h.addr)
+	if err := h.cli.GetJSON(context.Background(), uri, &status); err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "fetching phases")
+	}
+	return CapabilitiesV2(PhasesV2(status.PhaseSwitchMode, status.Phases)), nil
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"sync"
 	"time"
 
 	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/eCharger/client"
 	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/mqttclient"
 	"solar-ev-charger/params"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -20,14 +21,63 @@ import (
 
 var log = loggo.GetLogger("sevc.eCharger")
 
+func init() {
+	// The API version is detected for eCharger, and forced by the others.
+	for _, name := range []string{"eCharger", "eChargerV1", "eChargerV2"} {
+		common.RegisterDriver(common.Driver{
+			Name:          name,
+			ConfigSection: "eCharger",
+			Settings:      func(cfg *config.Config) interface{} { return &cfg.Charger },
+			Validate:      func(cfg *config.Config) error { return cfg.Charger.Validate() },
+			New:           common.ProviderFactory(NewWorker),
+		})
+	}
+}
+
+// detectRetryInterval is the amount of time we wait before detecting the
+// API version of a station again.
+const detectRetryInterval = 10 * time.Second
+
+// NewWorker returns a new status worker for the API version used by the
+// configured charger. If the version needs to be detected, we keep trying
+// until the station responds, so a station that is offline at startup
+// does not stop us.
 func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	httpCli := httpclient.New("eCharger", cfg.ChargerHTTP)
+	var version client.APIVersion
+	for {
+		var err error
+		version, err = client.ResolveAPIVersion(cfg.ConfiguredCharger, cfg.Charger.StationAddress, httpCli)
+		if err == nil {
+			break
+		}
+		log.Warningf("failed to determine api version, retrying in %s: %q", detectRetryInterval, err)
+		select {
+		case <-time.After(detectRetryInterval):
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "determining api version")
+		}
+	}
+	log.Infof("using go-eCharger API v%d", version)
+
+	switch version {
+	case client.APIv1:
+		return newWorkerV1(ctx, cfg, stateChan, httpCli)
+	case client.APIv2:
+		return newWorkerV2(ctx, cfg, stateChan, httpCli)
+	default:
+		return nil, fmt.Errorf("unsupported api version: %d", version)
+	}
+}
+
+func newWorkerV1(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState, httpCli *httpclient.Client) (common.BasicWorker, error) {
 	return &Worker{
-		stateChanged:     stateChan,
-		ctx:              ctx,
-		cfg:              *cfg,
-		closed:           make(chan struct{}),
-		quit:             make(chan struct{}),
-		mqttDisconnected: make(chan struct{}),
+		httpCli:      httpCli,
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
 	}, nil
 }
 
@@ -36,12 +86,27 @@ type chargerStatus struct {
 	SerialNumber  string  `json:"sse"`
 	Amp           int     `json:"amp,string"`
 	AllowCharging int     `json:"alw,string"`
-	MQTTEnabled   int     `json:"mce"`
+	CarState      int     `json:"car,string"`
+	MQTTEnabled   int     `json:"mce,string"`
 	MQTTServer    string  `json:"mcs"`
-	MQTTPort      int     `json:"mcp"`
+	MQTTPort      int     `json:"mcp,string"`
 	MQTTUsername  string  `json:"mcu"`
 	MQTTKey       string  `json:"mck"`
-	MQTTConnected int     `json:"mcc"`
+	MQTTConnected int     `json:"mcc,string"`
+}
+
+// stationMQTT returns the mqtt settings of the station.
+func (c chargerStatus) stationMQTT() stationMQTT {
+	return stationMQTT{
+		enabled:   c.MQTTEnabled == 1,
+		connected: c.MQTTConnected == 1,
+		settings: config.MQTTSettings{
+			Broker:   c.MQTTServer,
+			Port:     c.MQTTPort,
+			Username: c.MQTTUsername,
+			Password: c.MQTTKey,
+		},
+	}
 }
 
 type Worker struct {
@@ -50,31 +115,96 @@ type Worker struct {
 	quit   chan struct{}
 
 	stateChanged     chan params.ChargerState
+	httpCli          *httpclient.Client
 	status           chargerStatus
 	stateInitialized bool
 	mux              sync.Mutex
 
 	cfg config.Config
 
-	client           mqtt.Client
-	mqttDisconnected chan struct{}
-	mqttTopic        string
+	mqttCli   *mqttclient.Manager
+	mqttTopic string
+	commands  commandWaiters
+	link      stationLink
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	if w.cfg.Charger.UseMQTTCommands {
+		return &mqttClientV1{worker: w}, nil
+	}
+	return client.NewChargerClient(w.cfg.Charger.StationAddress, w.httpCli), nil
+}
+
+func (w *Worker) sendMQTTCommand(key string, value uint64) error {
+	w.mux.Lock()
+	mqttCli := w.mqttCli
+	// See: https://github.com/goecharger/go-eCharger-API-v1/blob/master/go-eCharger%20API%20v1%20EN.md#mqtt-api
+	topic := fmt.Sprintf("go-eCharger/%s/cmd/req", w.status.SerialNumber)
+	w.mux.Unlock()
+
+	applied := func() bool {
+		switch key {
+		case "amp":
+			return uint64(w.status.Amp) == value
+		case "alw":
+			return uint64(w.status.AllowCharging) == value
+		}
+		return false
+	}
+	if err := w.commands.publishAndWait(mqttCli, topic, fmt.Sprintf("%s=%d", key, value), applied); err != nil {
+		return errors.Wrapf(err, "setting %s", key)
+	}
+	return nil
 }
 
-func (w *Worker) mqttOnConnect(client mqtt.Client) {
-	log.Infof("Connected to %s", w.cfg.Charger.MQTT.Broker)
+// Values of the car key, in both API v1 and v2.
+const (
+	carStateIdle     = 1
+	carStateCharging = 2
+	carStateWaitCar  = 3
+	carStateComplete = 4
+	carStateError    = 5
+)
+
+// vehicleState maps the car state to a vehicle state. Stations also report
+// the car as complete while charging is held (alw=0 on v1, frc=1 on v2),
+// which is how we stop them. The vehicle is then only connected, so we keep
+// controlling the charger and start it again once there is enough surplus.
+func vehicleState(car int, held bool) params.VehicleState {
+	switch car {
+	case carStateIdle:
+		return params.VehicleDisconnected
+	case carStateCharging:
+		return params.VehicleCharging
+	case carStateWaitCar:
+		return params.VehicleConnected
+	case carStateComplete:
+		if held {
+			return params.VehicleConnected
+		}
+		return params.VehicleFinished
+	case carStateError:
+		return params.VehicleError
+	}
+	return params.VehicleUnknown
 }
 
-func (w *Worker) mqttConnectionLostHandler(client mqtt.Client, err error) {
-	log.Infof("Connection to %s has been lost: %q", w.cfg.Charger.MQTT.Broker, err)
+// sendState sends state to the worker, and must be called without holding
+// the lock, so status updates and commands waiting for them are not blocked
+// while the worker is busy.
+func sendState(stateChan chan params.ChargerState, state params.ChargerState) error {
 	select {
-	case <-w.mqttDisconnected:
-	default:
-		close(w.mqttDisconnected)
+	case stateChan <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
 	}
+	return nil
 }
 
-func (w *Worker) sendLocalState() error {
+// localState returns the state of the charger. Must be called with the lock
+// held.
+func (w *Worker) localState() params.ChargerState {
 	// Divide by 10. See "nrg" table: https://github.com/goecharger/go-eCharger-API-v1/blob/master/go-eCharger%20API%20v1%20EN.md
 	totalUsage := w.status.SensorData[4] + w.status.SensorData[5] + w.status.SensorData[6]
 	if totalUsage > 0 {
@@ -83,28 +213,22 @@ func (w *Worker) sendLocalState() error {
 		totalUsage = 0
 	}
 	currentUsage := float64(uint64(totalUsage) * w.cfg.ElectricalPresure)
-	state := params.ChargerState{
+	return params.ChargerState{
 		Active:            w.status.AllowCharging == 1,
 		CurrentUsage:      currentUsage,
 		CurrentAmpSetting: float64(w.status.Amp),
+		Vehicle:           vehicleState(w.status.CarState, w.status.AllowCharging == 0),
 	}
-	select {
-	case w.stateChanged <- state:
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("sending state timed out after 30 seconds")
-	}
-	return nil
 }
 
 func (w *Worker) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
-	w.mux.Lock()
-	defer w.mux.Unlock()
-
 	payload := msg.Payload()
 	topic := msg.Topic()
 
+	w.mux.Lock()
 	if topic != w.mqttTopic {
 		log.Debugf("got new message on topic %v; configured topic is %v", topic, w.mqttTopic)
+		w.mux.Unlock()
 		return
 	}
 
@@ -112,65 +236,108 @@ func (w *Worker) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
 	var x chargerStatus
 	if err := json.Unmarshal(payload, &x); err != nil {
 		log.Errorf("failed to decode status: %q", err)
+		w.mux.Unlock()
 		return
 	}
 	// update internal state
 	w.status = x
+	w.link.update(x.MQTTConnected == 1)
+	w.commands.notify()
+	state := w.localState()
+	w.mux.Unlock()
 
-	if err := w.sendLocalState(); err != nil {
+	if err := sendState(w.stateChanged, state); err != nil {
 		log.Errorf("failed to send state: %q", err)
 	}
 }
 
-func (w *Worker) connectMQTT() (mqtt.Client, error) {
+// setupMQTT creates the mqtt client. If no broker is configured, we use the
+// one the station is configured with.
+func (w *Worker) setupMQTT() error {
+	// The topic contains the serial number of the station, which we fetch
+	// over HTTP along with its mqtt settings.
 	if err := w.initState(); err != nil {
-		return nil, errors.Wrap(err, "initializing state")
+		return errors.Wrap(err, "initializing state")
+	}
+	w.mux.Lock()
+	station := w.status.stationMQTT()
+	w.link.update(station.connected)
+	w.mux.Unlock()
+
+	settings, err := mqttSettings(w.cfg.Charger.MQTT, station)
+	if err != nil {
+		// Fetch the status again on the next attempt, in case the station
+		// was reconfigured in the meantime.
+		w.mux.Lock()
+		w.stateInitialized = false
+		w.mux.Unlock()
+		return errors.Wrap(err, "determining mqtt settings")
 	}
-	opts, err := w.cfg.Charger.MQTT.ClientOptions()
+	mqttCli, err := mqttclient.New("eCharger MQTT", settings)
 	if err != nil {
-		return nil, errors.Wrap(err, "fetching client options")
+		return errors.Wrap(err, "creating mqtt client")
 	}
-	opts.OnConnect = w.mqttOnConnect
-	opts.OnConnectionLost = w.mqttConnectionLostHandler
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
-	if token.Error() != nil {
-		return nil, token.Error()
+	if err := mqttCli.Subscribe(w.mqttTopic, 1, w.mqttNewMessageHandler); err != nil {
+		return errors.Wrap(err, "subscribing to status topic")
 	}
-	log.Infof("subscribing to %s", w.mqttTopic)
-	token = client.Subscribe(w.mqttTopic, 1, w.mqttNewMessageHandler)
-	token.Wait()
-	if token.Error() != nil {
-		return nil, errors.Wrap(err, "subscribing to topic")
+
+	w.mux.Lock()
+	w.mqttCli = mqttCli
+	w.mux.Unlock()
+	return nil
+}
+
+// checkStationLink checks over HTTP whether the station is connected to the
+// broker.
+func (w *Worker) checkStationLink() {
+	status, err := w.fetchStatusFromAPI()
+	if err != nil {
+		log.Debugf("failed to fetch status: %q", err)
+		return
 	}
-	return client, nil
+	w.mux.Lock()
+	w.link.update(status.stationMQTT().connected)
+	w.mux.Unlock()
 }
 
 func (w *Worker) loopMQTT() {
-	defer func() {
-		w.client.Disconnect(1000)
-		close(w.closed)
-	}()
+	defer close(w.closed)
+
 	for {
-		if w.client == nil {
-			client, err := w.connectMQTT()
-			if err != nil {
-				log.Errorf("failed to connect to mqtt: %q", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			w.client = client
-			w.mqttDisconnected = make(chan struct{})
+		err := w.setupMQTT()
+		if err == nil {
+			break
 		}
+		log.Errorf("failed to set up mqtt: %q", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+
+	if err := w.mqttCli.Start(); err != nil {
+		log.Errorf("failed to start mqtt client: %q", err)
+		return
+	}
+	defer func() {
+		if err := w.mqttCli.Stop(); err != nil {
+			log.Errorf("failed to stop mqtt client: %q", err)
+		}
+	}()
 
+	ticker := time.NewTicker(stationCheckInterval)
+	defer ticker.Stop()
+	for {
 		select {
+		case <-ticker.C:
+			w.checkStationLink()
 		case <-w.ctx.Done():
 			return
 		case <-w.quit:
 			return
-		case <-w.mqttDisconnected:
-			w.client = nil
 		}
 	}
 }
@@ -189,18 +356,22 @@ func (w *Worker) loopHTTP() {
 		case <-w.quit:
 			return
 		case <-timer.C:
-			w.mux.Lock()
-			state, err := w.fetchStatusFromAPI()
+			status, err := w.fetchStatusFromAPI()
 			if err != nil {
-				log.Errorf("failed to fetch status: %q", err)
-				w.mux.Unlock()
+				if httpclient.IsOffline(err) {
+					log.Debugf("failed to fetch status: %q", err)
+				} else {
+					log.Errorf("failed to fetch status: %q", err)
+				}
 				continue
 			}
-			w.status = state
+			w.mux.Lock()
+			w.status = status
+			state := w.localState()
 			w.mux.Unlock()
 
-			if err := w.sendLocalState(); err != nil {
-				log.Errorf("failed to send state:%q", err)
+			if err := sendState(w.stateChanged, state); err != nil {
+				log.Errorf("failed to send state: %q", err)
 			}
 		}
 	}
@@ -208,18 +379,9 @@ func (w *Worker) loopHTTP() {
 
 func (w *Worker) fetchStatusFromAPI() (chargerStatus, error) {
 	stationAPI := fmt.Sprintf("http://%s/status", w.cfg.Charger.StationAddress)
-	resp, err := http.Get(stationAPI)
-	if err != nil {
-		return chargerStatus{}, errors.Wrap(err, "fetching status")
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return chargerStatus{}, errors.Wrap(err, "reading response")
-	}
 	var status chargerStatus
-	if err := json.Unmarshal(body, &status); err != nil {
-		return status, errors.Wrap(err, "decoding status")
+	if err := w.httpCli.GetJSON(w.ctx, stationAPI, &status); err != nil {
+		return chargerStatus{}, errors.Wrap(err, "fetching status")
 	}
 	return status, nil
 }
@@ -0,0 +1,139 @@
+package eCharger
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/params"
+)
+
+func TestVehicleState(t *testing.T) {
+	tests := []struct {
+		car      int
+		held     bool
+		expected params.VehicleState
+	}{
+		{0, false, params.VehicleUnknown},
+		{carStateIdle, false, params.VehicleDisconnected},
+		{carStateCharging, false, params.VehicleCharging},
+		{carStateWaitCar, false, params.VehicleConnected},
+		{carStateComplete, false, params.VehicleFinished},
+		// Stations report the car as complete while we hold charging.
+		{carStateComplete, true, params.VehicleConnected},
+		{carStateError, true, params.VehicleError},
+	}
+	for _, tc := range tests {
+		if got := vehicleState(tc.car, tc.held); got != tc.expected {
+			t.Errorf("vehicleState(%d, %v) = %s, expected %s", tc.car, tc.held, got, tc.expected)
+		}
+	}
+}
+
+func TestNewWorkerRetriesDetection(t *testing.T) {
+	// Nothing listens on the address of the station.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	cfg := &config.Config{
+		ConfiguredCharger: "eCharger",
+		ChargerHTTP:       config.HTTPClientSettings{Attempts: 1},
+		Charger:           config.Charger{StationAddress: addr},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewWorker(ctx, cfg, make(chan params.ChargerState, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected detection to be retried, got %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for NewWorker to give up")
+	}
+}
+
+func TestLoopHTTPReleasesLock(t *testing.T) {
+	served := make(chan struct{}, 1)
+	station := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			select {
+			case served <- struct{}{}:
+			default:
+			}
+		}()
+		fmt.Fprint(rw, `{"sse": "012345", "amp": 10, "frc": 0, "car": 2, "psm": 1, "pha": [true, true, true]}`)
+	}))
+	defer station.Close()
+
+	cfg := &config.Config{
+		Charger: config.Charger{
+			StationAddress:  strings.TrimPrefix(station.URL, "http://"),
+			UseMQTTCommands: true,
+		},
+	}
+	// Nobody reads the state, as if the worker was busy.
+	stateChan := make(chan params.ChargerState)
+	bw, err := newWorkerV2(context.Background(), cfg, stateChan, httpclient.New("eCharger test", cfg.ChargerHTTP))
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	w := bw.(*WorkerV2)
+	if err := w.Start(); err != nil {
+		t.Fatalf("starting worker: %v", err)
+	}
+
+	// Wait for the first status, and for the state to be pending.
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the status to be fetched")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The client reads the status while the state is waiting to be sent.
+	cli, err := w.ChargerClient()
+	if err != nil {
+		t.Fatalf("fetching client: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if caps, err := cli.Capabilities(); err != nil || caps.Phases != 1 {
+			t.Errorf("unexpected capabilities %+v: %v", caps, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the lock is held while sending the state")
+	}
+
+	if state := <-stateChan; state.CurrentAmpSetting != 10 || state.Vehicle != params.VehicleCharging {
+		t.Errorf("unexpected state: %+v", state)
+	}
+	if err := w.Stop(); err != nil {
+		t.Errorf("stopping worker: %v", err)
+	}
+}
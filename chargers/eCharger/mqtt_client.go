@@ -0,0 +1,139 @@
+package eCharger
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/eCharger/client"
+	"solar-ev-charger/mqttclient"
+)
+
+// commandTimeout is the amount of time we wait for the station to report
+// the new value of a setting we published over MQTT.
+var commandTimeout = 30 * time.Second
+
+type statusWaiter struct {
+	applied func() bool
+	done    chan struct{}
+}
+
+// commandWaiters tracks commands that were published over MQTT and are
+// waiting for the station to confirm them in a subsequent status message.
+type commandWaiters struct {
+	mux     sync.Mutex
+	waiters []*statusWaiter
+}
+
+func (c *commandWaiters) add(applied func() bool) *statusWaiter {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	waiter := &statusWaiter{
+		applied: applied,
+		done:    make(chan struct{}),
+	}
+	c.waiters = append(c.waiters, waiter)
+	return waiter
+}
+
+func (c *commandWaiters) remove(waiter *statusWaiter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for idx, w := range c.waiters {
+		if w == waiter {
+			c.waiters = append(c.waiters[:idx], c.waiters[idx+1:]...)
+			return
+		}
+	}
+}
+
+// notify must be called by the status workers after each status update,
+// while holding the lock that guards the status.
+func (c *commandWaiters) notify() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	remaining := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.applied() {
+			close(waiter.done)
+			continue
+		}
+		remaining = append(remaining, waiter)
+	}
+	c.waiters = remaining
+}
+
+// publishAndWait publishes payload on topic and waits for the next status
+// message in which applied() returns true.
+func (c *commandWaiters) publishAndWait(mqttCli *mqttclient.Manager, topic, payload string, applied func() bool) error {
+	if mqttCli == nil {
+		return mqttclient.ErrNotConnected
+	}
+
+	waiter := c.add(applied)
+	defer c.remove(waiter)
+
+	log.Debugf("publishing %q on %s", payload, topic)
+	if err := mqttCli.Publish(topic, 1, false, payload); err != nil {
+		return err
+	}
+
+	select {
+	case <-waiter.done:
+		return nil
+	case <-time.After(commandTimeout):
+		return fmt.Errorf("station did not acknowledge %q after %v", payload, commandTimeout)
+	}
+}
+
+// mqttClientV1 controls a station using API v1, by publishing commands
+// over the MQTT connection of the status worker.
+type mqttClientV1 struct {
+	worker *Worker
+}
+
+func (m *mqttClientV1) Start() error {
+	return m.worker.sendMQTTCommand("alw", 1)
+}
+
+func (m *mqttClientV1) Stop() error {
+	return m.worker.sendMQTTCommand("alw", 0)
+}
+
+func (m *mqttClientV1) SetAmp(amp float64) error {
+	return m.worker.sendMQTTCommand("amp", uint64(math.Round(amp)))
+}
+
+func (m *mqttClientV1) Capabilities() (common.Capabilities, error) {
+	return client.Capabilities(), nil
+}
+
+// mqttClientV2 controls a station using API v2, by publishing to the per key
+// set topics, over the MQTT connection of the status worker.
+type mqttClientV2 struct {
+	worker *WorkerV2
+}
+
+func (m *mqttClientV2) Start() error {
+	return m.worker.sendMQTTCommand("frc", client.ForceStateNeutral)
+}
+
+func (m *mqttClientV2) Stop() error {
+	return m.worker.sendMQTTCommand("frc", client.ForceStateOff)
+}
+
+func (m *mqttClientV2) SetAmp(amp float64) error {
+	return m.worker.sendMQTTCommand("amp", uint64(math.Round(amp)))
+}
+
+func (m *mqttClientV2) Capabilities() (common.Capabilities, error) {
+	m.worker.mux.Lock()
+	defer m.worker.mux.Unlock()
+	status := m.worker.status
+	return client.CapabilitiesV2(client.PhasesV2(status.PhaseSwitchMode, status.Phases)), nil
+}
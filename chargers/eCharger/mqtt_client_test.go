@@ -0,0 +1,193 @@
+package eCharger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/mqttclient"
+	"solar-ev-charger/mqttclient/fake"
+	"solar-ev-charger/params"
+)
+
+const testPrefix = "go-eCharger/012345/"
+
+// waitFor polls cond until it returns true, or fails the test.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startMQTTWorker returns a worker receiving the status of a station over
+// the broker, once it subscribed to the status topics. The station answers
+// the commands published on the set topics by publishing the value returned
+// by apply on the status topic of the key.
+func startMQTTWorker(t *testing.T, apply func(key, value string) string) (*WorkerV2, *fake.Broker) {
+	t.Helper()
+	broker := fake.NewBroker()
+	t.Cleanup(func() { broker.Close() })
+	port, err := broker.Listen("tcp", nil)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+	broker.Handle(testPrefix+"+/set", func(msg fake.Message) {
+		key := strings.TrimSuffix(strings.TrimPrefix(msg.Topic, testPrefix), "/set")
+		broker.Publish(testPrefix+key, []byte(apply(key, string(msg.Payload))), true)
+	})
+
+	w := &WorkerV2{
+		stateChanged:    make(chan params.ChargerState, 100),
+		status:          chargerStatusV2{Amp: 16, ForceState: 0},
+		mqttTopicPrefix: testPrefix,
+	}
+	mqttCli, err := mqttclient.New("eCharger MQTT test", config.MQTTSettings{Broker: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatalf("creating mqtt client: %v", err)
+	}
+	if err := mqttCli.Subscribe(testPrefix+"+", 1, w.mqttNewMessageHandler); err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	if err := mqttCli.Start(); err != nil {
+		t.Fatalf("starting mqtt client: %v", err)
+	}
+	t.Cleanup(func() { mqttCli.Stop() })
+	waitFor(t, "subscription", func() bool {
+		return mqttCli.Connected() && broker.Subscribed(testPrefix+"amp")
+	})
+	w.mqttCli = mqttCli
+	return w, broker
+}
+
+func TestSendMQTTCommandV2(t *testing.T) {
+	w, broker := startMQTTWorker(t, func(key, value string) string { return value })
+	w.cfg.Charger.UseMQTTCommands = true
+	cli, err := w.ChargerClient()
+	if err != nil {
+		t.Fatalf("fetching client: %v", err)
+	}
+	if _, ok := cli.(*mqttClientV2); !ok {
+		t.Fatalf("expected an MQTT client with use_mqtt_commands, got %T", cli)
+	}
+
+	if err := cli.SetAmp(9.6); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	w.mux.Lock()
+	status := w.status
+	w.mux.Unlock()
+	if status.Amp != 10 || status.ForceState != 1 {
+		t.Errorf("expected the status to be updated, got amp %d and frc %d", status.Amp, status.ForceState)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	var commands []string
+	for _, msg := range broker.Published() {
+		if strings.HasSuffix(msg.Topic, "/set") {
+			commands = append(commands, strings.TrimPrefix(msg.Topic, testPrefix)+"="+string(msg.Payload))
+		}
+	}
+	expected := "amp/set=10 frc/set=1 frc/set=0"
+	if got := strings.Join(commands, " "); got != expected {
+		t.Errorf("expected commands %q, got %q", expected, got)
+	}
+	if waiting := w.commands.pending(); waiting != 0 {
+		t.Errorf("expected no command to be waiting, got %d", waiting)
+	}
+}
+
+func TestSendMQTTCommandV2NotApplied(t *testing.T) {
+	defer func(timeout time.Duration) { commandTimeout = timeout }(commandTimeout)
+	commandTimeout = 500 * time.Millisecond
+
+	// The station limits the current to 16 A.
+	w, broker := startMQTTWorker(t, func(key, value string) string {
+		if key == "amp" {
+			return "16"
+		}
+		return value
+	})
+	err := w.sendMQTTCommand("amp", 20)
+	if err == nil || !strings.Contains(err.Error(), `setting amp: station did not acknowledge "20"`) {
+		t.Errorf("expected the command to time out, got %v", err)
+	}
+	if len(broker.Published()) == 0 {
+		t.Errorf("expected the command to be published")
+	}
+	if w.commands.pending() != 0 {
+		t.Errorf("expected the waiter to be removed after the timeout")
+	}
+
+	// A command the station applies still succeeds.
+	if err := w.sendMQTTCommand("amp", 16); err != nil {
+		t.Errorf("setting 16 A: %v", err)
+	}
+}
+
+func TestSendMQTTCommandNotConnected(t *testing.T) {
+	w := &WorkerV2{mqttTopicPrefix: testPrefix}
+	err := w.sendMQTTCommand("amp", 10)
+	if err == nil || !strings.Contains(err.Error(), mqttclient.ErrNotConnected.Error()) {
+		t.Errorf("expected %q, got %v", mqttclient.ErrNotConnected, err)
+	}
+
+	// The manager refuses to publish until it is connected.
+	mqttCli, err := mqttclient.New("eCharger MQTT test", config.MQTTSettings{Broker: "127.0.0.1", Port: 1})
+	if err != nil {
+		t.Fatalf("creating mqtt client: %v", err)
+	}
+	w.mqttCli = mqttCli
+	if err := w.sendMQTTCommand("amp", 10); err == nil || !strings.Contains(err.Error(), mqttclient.ErrNotConnected.Error()) {
+		t.Errorf("expected %q, got %v", mqttclient.ErrNotConnected, err)
+	}
+}
+
+// pending returns the number of commands waiting for the station.
+func (c *commandWaiters) pending() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.waiters)
+}
+
+func TestCommandWaiters(t *testing.T) {
+	var c commandWaiters
+	applied := false
+	first := c.add(func() bool { return applied })
+	second := c.add(func() bool { return false })
+
+	c.notify()
+	select {
+	case <-first.done:
+		t.Fatalf("expected the command not to be applied yet")
+	default:
+	}
+
+	applied = true
+	c.notify()
+	select {
+	case <-first.done:
+	default:
+		t.Fatalf("expected the command to be applied")
+	}
+	if len(c.waiters) != 1 || c.waiters[0] != second {
+		t.Errorf("expected only the second waiter to remain")
+	}
+
+	// Removing a waiter which was already notified is a no-op.
+	c.remove(first)
+	c.remove(second)
+	if len(c.waiters) != 0 {
+		t.Errorf("expected no waiter to remain, got %d", len(c.waiters))
+	}
+}
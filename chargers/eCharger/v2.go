@@ -0,0 +1,362 @@
+package eCharger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/eCharger/client"
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/mqttclient"
+	"solar-ev-charger/params"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// statusFilterV2 is the list of keys we request from the station. Fetching
+// the full status is slow and returns several kilobytes of data.
+var statusFilterV2 = []string{
+	"sse", "amp", "frc", "car", "nrg", "psm", "pha", "alw", "acu", "wh",
+	"mce", "mcu", "mcs",
+}
+
+func newWorkerV2(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState, httpCli *httpclient.Client) (common.BasicWorker, error) {
+	return &WorkerV2{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+		cli:          httpCli,
+	}, nil
+}
+
+// chargerStatusV2 holds the subset of the API v2 status we care about.
+// See: https://github.com/goecharger/go-eCharger-API-v2/blob/main/apikeys-en.md
+type chargerStatusV2 struct {
+	SerialNumber string `json:"sse"`
+	// Amp is the requested current in Ampere.
+	Amp int `json:"amp"`
+	// ForceState is 0 (neutral), 1 (off) or 2 (on).
+	ForceState int `json:"frc"`
+	// CarState is 0 (unknown), 1 (idle), 2 (charging), 3 (wait car),
+	// 4 (complete) or 5 (error).
+	CarState int `json:"car"`
+	// Energy holds voltages, currents and power for each phase. Index 11
+	// is the total power in Watts.
+	Energy []float64 `json:"nrg"`
+	// PhaseSwitchMode is 0 (auto), 1 (force single phase) or 2 (force three phases).
+	PhaseSwitchMode int `json:"psm"`
+	// Phases tells which phases are connected, before and after the
+	// contactor.
+	Phases []bool `json:"pha"`
+	// AllowCharging is true if the car is allowed to charge at the moment.
+	AllowCharging bool `json:"alw"`
+	// ActualCurrent is the current in Ampere the car is allowed to draw.
+	ActualCurrent *int `json:"acu"`
+	// SessionEnergy is the energy in Wh charged since the car was connected.
+	SessionEnergy float64 `json:"wh"`
+	// MQTTEnabled is true if MQTT is enabled on the station.
+	MQTTEnabled bool `json:"mce"`
+	// MQTTBroker is the URL of the broker the station connects to.
+	MQTTBroker string `json:"mcu"`
+	// MQTTConnected is true while the station is connected to the broker.
+	MQTTConnected bool `json:"mcs"`
+}
+
+// stationMQTT returns the mqtt settings of the station.
+func (c chargerStatusV2) stationMQTT() stationMQTT {
+	settings, err := parseBrokerURL(c.MQTTBroker)
+	return stationMQTT{
+		enabled:   c.MQTTEnabled,
+		connected: c.MQTTConnected,
+		settings:  settings,
+		err:       err,
+	}
+}
+
+// WorkerV2 fetches the state of a go-eCharger using API v2.
+type WorkerV2 struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged     chan params.ChargerState
+	status           chargerStatusV2
+	stateInitialized bool
+	mux              sync.Mutex
+
+	cfg config.Config
+	cli *httpclient.Client
+
+	mqttCli         *mqttclient.Manager
+	mqttTopicPrefix string
+	commands        commandWaiters
+	link            stationLink
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *WorkerV2) ChargerClient() (common.Client, error) {
+	if w.cfg.Charger.UseMQTTCommands {
+		return &mqttClientV2{worker: w}, nil
+	}
+	return client.NewChargerClientV2(w.cfg.Charger.StationAddress, w.cli), nil
+}
+
+func (w *WorkerV2) sendMQTTCommand(key string, value uint64) error {
+	w.mux.Lock()
+	mqttCli := w.mqttCli
+	topic := fmt.Sprintf("%s%s/set", w.mqttTopicPrefix, key)
+	w.mux.Unlock()
+
+	applied := func() bool {
+		switch key {
+		case "amp":
+			return uint64(w.status.Amp) == value
+		case "frc":
+			return uint64(w.status.ForceState) == value
+		}
+		return false
+	}
+	if err := w.commands.publishAndWait(mqttCli, topic, fmt.Sprintf("%d", value), applied); err != nil {
+		return errors.Wrapf(err, "setting %s", key)
+	}
+	return nil
+}
+
+// localState returns the state of the charger. Must be called with the lock
+// held.
+func (w *WorkerV2) localState() params.ChargerState {
+	var currentUsage float64
+	if len(w.status.Energy) > 11 && w.status.Energy[11] > 0 {
+		currentUsage = w.status.Energy[11]
+	}
+	return params.ChargerState{
+		Active:            uint64(w.status.ForceState) != client.ForceStateOff,
+		CurrentUsage:      currentUsage,
+		CurrentAmpSetting: float64(w.status.Amp),
+		Vehicle:           vehicleState(w.status.CarState, uint64(w.status.ForceState) == client.ForceStateOff),
+		SessionEnergy:     w.status.SessionEnergy,
+	}
+}
+
+func (w *WorkerV2) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+
+	w.mux.Lock()
+	if !strings.HasPrefix(topic, w.mqttTopicPrefix) {
+		log.Debugf("got new message on topic %v; configured prefix is %v", topic, w.mqttTopicPrefix)
+		w.mux.Unlock()
+		return
+	}
+
+	key := strings.TrimPrefix(topic, w.mqttTopicPrefix)
+	var relevant bool
+	for _, k := range statusFilterV2 {
+		if k == key {
+			relevant = true
+			break
+		}
+	}
+	if !relevant {
+		w.mux.Unlock()
+		return
+	}
+
+	// API v2 publishes each key on its own topic, as a JSON value. Decoding
+	// a single key object into the existing status only updates that key.
+	wrapped := fmt.Sprintf(`{%q:%s}`, key, msg.Payload())
+	if err := json.Unmarshal([]byte(wrapped), &w.status); err != nil {
+		log.Errorf("failed to decode %s: %q", key, err)
+		w.mux.Unlock()
+		return
+	}
+	w.link.update(w.status.MQTTConnected)
+	w.commands.notify()
+	state := w.localState()
+	w.mux.Unlock()
+
+	if err := sendState(w.stateChanged, state); err != nil {
+		log.Errorf("failed to send state: %q", err)
+	}
+}
+
+// setupMQTT creates the mqtt client. If no broker is configured, we use the
+// one the station is configured with.
+func (w *WorkerV2) setupMQTT() error {
+	// The topic contains the serial number of the station, which we fetch
+	// over HTTP along with its mqtt settings.
+	if err := w.initState(); err != nil {
+		return errors.Wrap(err, "initializing state")
+	}
+	w.mux.Lock()
+	station := w.status.stationMQTT()
+	w.link.update(station.connected)
+	w.mux.Unlock()
+
+	settings, err := mqttSettings(w.cfg.Charger.MQTT, station)
+	if err != nil {
+		// Fetch the status again on the next attempt, in case the station
+		// was reconfigured in the meantime.
+		w.mux.Lock()
+		w.stateInitialized = false
+		w.mux.Unlock()
+		return errors.Wrap(err, "determining mqtt settings")
+	}
+	mqttCli, err := mqttclient.New("eCharger MQTT", settings)
+	if err != nil {
+		return errors.Wrap(err, "creating mqtt client")
+	}
+	topic := fmt.Sprintf("%s+", w.mqttTopicPrefix)
+	if err := mqttCli.Subscribe(topic, 1, w.mqttNewMessageHandler); err != nil {
+		return errors.Wrap(err, "subscribing to status topic")
+	}
+
+	w.mux.Lock()
+	w.mqttCli = mqttCli
+	w.mux.Unlock()
+	return nil
+}
+
+// checkStationLink checks over HTTP whether the station is connected to the
+// broker.
+func (w *WorkerV2) checkStationLink() {
+	status, err := w.fetchStatusFromAPI()
+	if err != nil {
+		log.Debugf("failed to fetch status: %q", err)
+		return
+	}
+	w.mux.Lock()
+	w.link.update(status.stationMQTT().connected)
+	w.mux.Unlock()
+}
+
+func (w *WorkerV2) loopMQTT() {
+	defer close(w.closed)
+
+	for {
+		err := w.setupMQTT()
+		if err == nil {
+			break
+		}
+		log.Errorf("failed to set up mqtt: %q", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+
+	if err := w.mqttCli.Start(); err != nil {
+		log.Errorf("failed to start mqtt client: %q", err)
+		return
+	}
+	defer func() {
+		if err := w.mqttCli.Stop(); err != nil {
+			log.Errorf("failed to stop mqtt client: %q", err)
+		}
+	}()
+
+	ticker := time.NewTicker(stationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.checkStationLink()
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *WorkerV2) loopHTTP() {
+	timer := time.NewTicker(5 * time.Second)
+
+	defer func() {
+		timer.Stop()
+		close(w.closed)
+	}()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		case <-timer.C:
+			status, err := w.fetchStatusFromAPI()
+			if err != nil {
+				if httpclient.IsOffline(err) {
+					log.Debugf("failed to fetch status: %q", err)
+				} else {
+					log.Errorf("failed to fetch status: %q", err)
+				}
+				continue
+			}
+			w.mux.Lock()
+			w.status = status
+			state := w.localState()
+			w.mux.Unlock()
+
+			if err := sendState(w.stateChanged, state); err != nil {
+				log.Errorf("failed to send state: %q", err)
+			}
+		}
+	}
+}
+
+func (w *WorkerV2) fetchStatusFromAPI() (chargerStatusV2, error) {
+	stationAPI := fmt.Sprintf("http://%s/api/status?filter=%s", w.cfg.Charger.StationAddress, strings.Join(statusFilterV2, ","))
+	var status chargerStatusV2
+	if err := w.cli.GetJSON(w.ctx, stationAPI, &status); err != nil {
+		return chargerStatusV2{}, errors.Wrap(err, "fetching status")
+	}
+	log.Tracef("car state: %d, phase switch mode: %d, session energy: %.2f Wh", status.CarState, status.PhaseSwitchMode, status.SessionEnergy)
+	return status, nil
+}
+
+func (w *WorkerV2) initState() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.stateInitialized {
+		return nil
+	}
+
+	status, err := w.fetchStatusFromAPI()
+	if err != nil {
+		return errors.Wrap(err, "initializing state")
+	}
+	w.status = status
+	w.stateInitialized = true
+	w.mqttTopicPrefix = fmt.Sprintf("go-eCharger/%s/", w.status.SerialNumber)
+	return nil
+}
+
+func (w *WorkerV2) Start() error {
+	if w.cfg.Charger.UseMQTT {
+		go w.loopMQTT()
+	} else {
+		go w.loopHTTP()
+	}
+	return nil
+}
+
+func (w *WorkerV2) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
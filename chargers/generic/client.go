@@ -0,0 +1,54 @@
+package generic
+
+import (
+	"solar-ev-charger/chargers/common"
+
+	"github.com/pkg/errors"
+)
+
+// genericClient sends the configured commands.
+type genericClient struct {
+	worker *Worker
+}
+
+func (c *genericClient) lastAmps() float64 {
+	c.worker.mux.Lock()
+	defer c.worker.mux.Unlock()
+	return c.worker.amps
+}
+
+func (c *genericClient) Start() error {
+	if err := c.worker.send(c.worker.start, c.lastAmps()); err != nil {
+		return errors.Wrap(err, "starting charger")
+	}
+	return nil
+}
+
+func (c *genericClient) Stop() error {
+	if err := c.worker.send(c.worker.stop, c.lastAmps()); err != nil {
+		return errors.Wrap(err, "stopping charger")
+	}
+	return nil
+}
+
+func (c *genericClient) SetAmp(amp float64) error {
+	if err := c.worker.send(c.worker.setCurrent, amp); err != nil {
+		return errors.Wrap(err, "setting current")
+	}
+	c.worker.mux.Lock()
+	c.worker.amps = amp
+	c.worker.mux.Unlock()
+	return nil
+}
+
+// Capabilities returns the current limits from the config.
+func (c *genericClient) Capabilities() (common.Capabilities, error) {
+	cfg := c.worker.cfg.Generic
+	return common.Capabilities{
+		MinCurrent:    cfg.MinCurrent,
+		MaxCurrent:    cfg.MaxCurrent,
+		CurrentStep:   cfg.CurrentStep,
+		Toggle:        true,
+		PlugDetection: cfg.Status.ConnectedPath != "" && (len(cfg.Status.DisconnectedValues) > 0 || len(cfg.Status.ConnectedValues) == 0),
+	}, nil
+}
@@ -0,0 +1,352 @@
+// Package generic implements a charger driver configured entirely in TOML.
+// Commands are sent as templated HTTP requests or MQTT messages, and the
+// status is extracted from a JSON document using paths.
+package generic
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/jsonpath"
+	"solar-ev-charger/mqttclient"
+	"solar-ev-charger/params"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.generic")
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "Generic",
+		ConfigSection: "Generic",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.Generic },
+		Validate:      func(cfg *config.Config) error { return cfg.Generic.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.Generic.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating generic charger config")
+	}
+
+	// The generic charger has its own timeout setting, which takes
+	// precedence over the shared one.
+	httpSettings := cfg.ChargerHTTP
+	httpSettings.Timeout = cfg.Generic.Timeout
+	w := &Worker{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		httpCli:      httpclient.New("Generic", httpSettings),
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+		amps:         float64(cfg.MinAmpThreshold),
+	}
+
+	requests := map[string]struct {
+		cfg  config.GenericRequest
+		dest **request
+	}{
+		"start":       {cfg.Generic.Start, &w.start},
+		"stop":        {cfg.Generic.Stop, &w.stop},
+		"set_current": {cfg.Generic.SetCurrent, &w.setCurrent},
+		"status":      {cfg.Generic.Status.GenericRequest, &w.status},
+	}
+	for name, req := range requests {
+		parsed, err := newRequest(req.cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", name)
+		}
+		*req.dest = parsed
+	}
+
+	status := cfg.Generic.Status
+	paths := map[string]struct {
+		expr string
+		dest *jsonpath.Path
+	}{
+		"active_path":          {status.ActivePath, &w.activePath},
+		"power_path":           {status.PowerPath, &w.powerPath},
+		"current_path":         {status.CurrentPath, &w.currentPath},
+		"current_setting_path": {status.CurrentSettingPath, &w.currentSettingPath},
+		"connected_path":       {status.ConnectedPath, &w.connectedPath},
+	}
+	for name, path := range paths {
+		if path.expr == "" {
+			continue
+		}
+		parsed, err := jsonpath.Parse(path.expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", name)
+		}
+		*path.dest = parsed
+	}
+
+	if cfg.Generic.UsesMQTT() {
+		mqttCli, err := mqttclient.New("Generic MQTT", cfg.Generic.MQTT)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating mqtt client")
+		}
+		if w.status.isMQTT() {
+			if err := mqttCli.Subscribe(w.status.cfg.Topic, 1, w.mqttNewMessageHandler); err != nil {
+				return nil, errors.Wrap(err, "subscribing to status topic")
+			}
+		}
+		w.mqttCli = mqttCli
+	}
+	return w, nil
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	cfg          config.Config
+	httpCli      *httpclient.Client
+
+	start      *request
+	stop       *request
+	setCurrent *request
+	status     *request
+
+	activePath         jsonpath.Path
+	powerPath          jsonpath.Path
+	currentPath        jsonpath.Path
+	currentSettingPath jsonpath.Path
+	connectedPath      jsonpath.Path
+
+	mqttCli *mqttclient.Manager
+
+	mux sync.Mutex
+	// amps is the last current limit we were asked to set.
+	amps  float64
+	state params.ChargerState
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &genericClient{worker: w}, nil
+}
+
+func (w *Worker) templateData(amps float64) templateData {
+	return templateData{
+		Amps:      amps,
+		MilliAmps: uint64(math.Round(amps * 1000)),
+		Watts:     amps * float64(w.cfg.ElectricalPresure),
+	}
+}
+
+// send sends a command request.
+func (w *Worker) send(req *request, amps float64) error {
+	data := w.templateData(amps)
+	if !req.isMQTT() {
+		_, err := req.doHTTP(w.ctx, w.httpCli, w.cfg.Generic.Auth, data)
+		return err
+	}
+
+	payload, err := render(req.payload, data)
+	if err != nil {
+		return err
+	}
+	return w.mqttCli.Publish(req.cfg.Topic, 1, req.cfg.Retain, payload)
+}
+
+// matches returns true if val is one of values. If values is empty, any
+// non zero number or true matches.
+func matches(val interface{}, values []string) bool {
+	if len(values) == 0 {
+		num, err := jsonpath.AsFloat(val)
+		return err == nil && num != 0
+	}
+	var str string
+	switch v := val.(type) {
+	case string:
+		str = v
+	case float64:
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		str = fmt.Sprint(v)
+	}
+	for _, candidate := range values {
+		if str == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// vehicleState maps the value of connected_path to a vehicle state. Values
+// not listed leave the state unknown, so the charger is still controlled.
+func vehicleState(val interface{}, status config.GenericStatus) params.VehicleState {
+	switch {
+	case len(status.ErrorValues) > 0 && matches(val, status.ErrorValues):
+		return params.VehicleError
+	case len(status.ChargingValues) > 0 && matches(val, status.ChargingValues):
+		return params.VehicleCharging
+	case len(status.FinishedValues) > 0 && matches(val, status.FinishedValues):
+		return params.VehicleFinished
+	case len(status.DisconnectedValues) > 0 && matches(val, status.DisconnectedValues):
+		return params.VehicleDisconnected
+	case matches(val, status.ConnectedValues):
+		return params.VehicleConnected
+	case len(status.ConnectedValues) == 0 && len(status.DisconnectedValues) == 0:
+		// The path holds a boolean or a number, and zero or false
+		// explicitly means no vehicle is connected.
+		if num, err := jsonpath.AsFloat(val); err == nil && num == 0 {
+			return params.VehicleDisconnected
+		}
+	}
+	return params.VehicleUnknown
+}
+
+// updateState extracts the configured values from a status document.
+// Values missing from the document are left unchanged, which allows the
+// status to be assembled from several MQTT messages.
+func (w *Worker) updateState(doc interface{}) {
+	status := w.cfg.Generic.Status
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if val, err := w.activePath.Lookup(doc); err == nil {
+		w.state.Active = matches(val, status.ActiveValues)
+	} else {
+		log.Debugf("failed to extract active state: %q", err)
+	}
+	if val, err := w.currentSettingPath.LookupFloat(doc); err == nil {
+		w.state.CurrentAmpSetting = val * status.CurrentSettingMultiplier
+	} else {
+		log.Debugf("failed to extract current setting: %q", err)
+	}
+	if status.PowerPath != "" {
+		if val, err := w.powerPath.LookupFloat(doc); err == nil {
+			w.state.CurrentUsage = val * status.PowerMultiplier
+		}
+	} else if status.CurrentPath != "" {
+		if val, err := w.currentPath.LookupFloat(doc); err == nil {
+			w.state.CurrentUsage = val * status.CurrentMultiplier * float64(w.cfg.ElectricalPresure)
+		}
+	}
+	if status.ConnectedPath != "" {
+		if val, err := w.connectedPath.Lookup(doc); err == nil {
+			w.state.Vehicle = vehicleState(val, status)
+		}
+	}
+}
+
+func (w *Worker) sendLocalState() error {
+	w.mux.Lock()
+	state := w.state
+	w.mux.Unlock()
+
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) poll() error {
+	w.mux.Lock()
+	amps := w.amps
+	w.mux.Unlock()
+
+	body, err := w.status.doHTTP(w.ctx, w.httpCli, w.cfg.Generic.Auth, w.templateData(amps))
+	if err != nil {
+		return errors.Wrap(err, "fetching status")
+	}
+	doc, err := jsonpath.Decode(body)
+	if err != nil {
+		return errors.Wrap(err, "decoding status")
+	}
+	w.updateState(doc)
+	return w.sendLocalState()
+}
+
+func (w *Worker) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	doc, err := jsonpath.Decode(msg.Payload())
+	if err != nil {
+		log.Errorf("failed to decode status: %q", err)
+		return
+	}
+	w.updateState(doc)
+	if err := w.sendLocalState(); err != nil {
+		log.Errorf("failed to send state: %q", err)
+	}
+}
+
+func (w *Worker) loop() {
+	defer close(w.closed)
+
+	var pollTimer <-chan time.Time
+	if !w.status.isMQTT() {
+		ticker := time.NewTicker(time.Duration(w.cfg.Generic.PollInterval) * time.Second)
+		defer ticker.Stop()
+		pollTimer = ticker.C
+		if err := w.poll(); err != nil {
+			if httpclient.IsOffline(err) {
+				log.Debugf("failed to poll charger: %q", err)
+			} else {
+				log.Errorf("failed to poll charger: %q", err)
+			}
+		}
+	}
+
+	if w.mqttCli != nil {
+		if err := w.mqttCli.Start(); err != nil {
+			log.Errorf("failed to start mqtt client: %q", err)
+			return
+		}
+		defer func() {
+			if err := w.mqttCli.Stop(); err != nil {
+				log.Errorf("failed to stop mqtt client: %q", err)
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-pollTimer:
+			if err := w.poll(); err != nil {
+				if httpclient.IsOffline(err) {
+					log.Debugf("failed to poll charger: %q", err)
+				} else {
+					log.Errorf("failed to poll charger: %q", err)
+				}
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
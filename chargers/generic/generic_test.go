@@ -0,0 +1,396 @@
+package generic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/jsonpath"
+	mqttfake "solar-ev-charger/mqttclient/fake"
+	"solar-ev-charger/params"
+)
+
+func TestVehicleState(t *testing.T) {
+	lists := config.GenericStatus{
+		ConnectedValues:    []string{"connected", "charging", "full"},
+		DisconnectedValues: []string{"idle"},
+		ChargingValues:     []string{"charging"},
+		FinishedValues:     []string{"full"},
+		ErrorValues:        []string{"fault"},
+	}
+	connectedOnly := config.GenericStatus{
+		ConnectedValues: []string{"connected"},
+	}
+
+	tests := []struct {
+		name     string
+		status   config.GenericStatus
+		val      interface{}
+		expected params.VehicleState
+	}{
+		{"listed disconnected", lists, "idle", params.VehicleDisconnected},
+		{"listed connected", lists, "connected", params.VehicleConnected},
+		{"listed charging", lists, "charging", params.VehicleCharging},
+		{"listed finished", lists, "full", params.VehicleFinished},
+		{"listed error", lists, "fault", params.VehicleError},
+		{"not listed", lists, "booting", params.VehicleUnknown},
+		{"no disconnected list", connectedOnly, "idle", params.VehicleUnknown},
+		{"boolean true", config.GenericStatus{}, true, params.VehicleConnected},
+		{"boolean false", config.GenericStatus{}, false, params.VehicleDisconnected},
+		{"number", config.GenericStatus{}, float64(0), params.VehicleDisconnected},
+		{"unparsable", config.GenericStatus{}, "unknown", params.VehicleUnknown},
+	}
+	for _, tc := range tests {
+		if got := vehicleState(tc.val, tc.status); got != tc.expected {
+			t.Errorf("%s: vehicleState(%v) = %s, expected %s", tc.name, tc.val, got, tc.expected)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := templateData{Amps: 10.5, MilliAmps: 10500, Watts: 2415}
+	tests := []struct {
+		text     string
+		expected string
+		// parseErr and renderErr are set if parsing or rendering fails.
+		parseErr  bool
+		renderErr bool
+	}{
+		{text: "/set?amps={{.Amps}}", expected: "/set?amps=10.5"},
+		{text: `{"current": {{.MilliAmps}}, "power": {{.Watts}}}`, expected: `{"current": 10500, "power": 2415}`},
+		{text: "", expected: ""},
+		{text: "{{.Amperes}}", renderErr: true},
+		{text: "{{.Amps", parseErr: true},
+	}
+	for _, tc := range tests {
+		tpl, err := parseTemplate("test", tc.text)
+		if tc.parseErr != (err != nil) {
+			t.Errorf("%q: expected parse error %v, got %v", tc.text, tc.parseErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, err := render(tpl, data)
+		if tc.renderErr != (err != nil) {
+			t.Errorf("%q: expected render error %v, got %v", tc.text, tc.renderErr, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.text, tc.expected, got)
+		}
+	}
+}
+
+// received is a request received by a test server.
+type received struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func TestDoHTTP(t *testing.T) {
+	var got received
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = received{req.Method, req.URL.RequestURI(), req.Header, string(body)}
+		fmt.Fprint(rw, `{"ok": true}`)
+	}))
+	defer srv.Close()
+
+	cfg := config.GenericRequest{
+		URL:     srv.URL + "/current?ma={{.MilliAmps}}",
+		Headers: map[string]string{"X-Amps": "{{.Amps}}"},
+		Body:    `{"watts": {{.Watts}}}`,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validating request: %v", err)
+	}
+	req, err := newRequest(cfg)
+	if err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+
+	tests := []struct {
+		auth   config.HTTPAuth
+		header string
+	}{
+		{config.HTTPAuth{}, ""},
+		{config.HTTPAuth{Type: config.BasicAuth, Username: "admin", Password: "secret"}, "Basic YWRtaW46c2VjcmV0"},
+		{config.HTTPAuth{Type: config.BearerAuth, Token: "token"}, "Bearer token"},
+	}
+	cli := httpclient.New("test", config.HTTPClientSettings{})
+	for _, tc := range tests {
+		body, err := req.doHTTP(context.Background(), cli, tc.auth, templateData{Amps: 10, MilliAmps: 10000, Watts: 2300})
+		if err != nil {
+			t.Fatalf("%s: sending request: %v", tc.auth.Type, err)
+		}
+		if string(body) != `{"ok": true}` {
+			t.Errorf("%s: unexpected response %q", tc.auth.Type, body)
+		}
+		if got.method != http.MethodPost || got.path != "/current?ma=10000" || got.body != `{"watts": 2300}` {
+			t.Errorf("%s: unexpected request %+v", tc.auth.Type, got)
+		}
+		if got.header.Get("X-Amps") != "10" || got.header.Get("Authorization") != tc.header {
+			t.Errorf("%s: unexpected headers %v", tc.auth.Type, got.header)
+		}
+	}
+
+	// Templates failing to render are not sent.
+	bad, err := newRequest(config.GenericRequest{Method: http.MethodGet, URL: srv.URL + "/{{.Volts}}"})
+	if err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+	got = received{}
+	if _, err := bad.doHTTP(context.Background(), cli, config.HTTPAuth{}, templateData{}); err == nil {
+		t.Errorf("expected an error rendering a missing key")
+	}
+	if got.method != "" {
+		t.Errorf("expected no request, got %+v", got)
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   config.GenericStatus
+		doc      string
+		expected params.ChargerState
+	}{
+		{
+			name: "power in kW and current in mA",
+			status: config.GenericStatus{
+				ActivePath:               "charging.enabled",
+				PowerPath:                "meter.power",
+				PowerMultiplier:          1000,
+				CurrentSettingPath:       "limit",
+				CurrentSettingMultiplier: 0.001,
+				ConnectedPath:            "car",
+				ConnectedValues:          []string{"connected", "charging"},
+				DisconnectedValues:       []string{"idle"},
+				ChargingValues:           []string{"charging"},
+			},
+			doc: `{"charging": {"enabled": true}, "meter": {"power": 2.3}, "limit": 10000, "car": "charging"}`,
+			expected: params.ChargerState{
+				Active:            true,
+				CurrentUsage:      2300,
+				CurrentAmpSetting: 10,
+				Vehicle:           params.VehicleCharging,
+			},
+		},
+		{
+			name: "current per phase",
+			status: config.GenericStatus{
+				ActivePath:         "state",
+				ActiveValues:       []string{"2", "3"},
+				CurrentPath:        "amps[1]",
+				CurrentSettingPath: "max",
+			},
+			doc: `{"state": 3, "amps": [0, 8, 0], "max": 16}`,
+			expected: params.ChargerState{
+				Active:            true,
+				CurrentUsage:      8 * 230,
+				CurrentAmpSetting: 16,
+			},
+		},
+		{
+			name: "inactive",
+			status: config.GenericStatus{
+				ActivePath:         "state",
+				ActiveValues:       []string{"2", "3"},
+				CurrentSettingPath: "max",
+				ConnectedPath:      "plugged",
+			},
+			doc: `{"state": 1, "max": 6, "plugged": false}`,
+			expected: params.ChargerState{
+				CurrentAmpSetting: 6,
+				Vehicle:           params.VehicleDisconnected,
+			},
+		},
+	}
+	for _, tc := range tests {
+		if err := tc.status.Validate(); err != nil {
+			t.Fatalf("%s: validating status: %v", tc.name, err)
+		}
+		w := &Worker{cfg: config.Config{ElectricalPresure: 230, Generic: config.GenericCharger{Status: tc.status}}}
+		for expr, dest := range map[string]*jsonpath.Path{
+			tc.status.ActivePath:         &w.activePath,
+			tc.status.PowerPath:          &w.powerPath,
+			tc.status.CurrentPath:        &w.currentPath,
+			tc.status.CurrentSettingPath: &w.currentSettingPath,
+			tc.status.ConnectedPath:      &w.connectedPath,
+		} {
+			if expr == "" {
+				continue
+			}
+			path, err := jsonpath.Parse(expr)
+			if err != nil {
+				t.Fatalf("%s: parsing %s: %v", tc.name, expr, err)
+			}
+			*dest = path
+		}
+		doc, err := jsonpath.Decode([]byte(tc.doc))
+		if err != nil {
+			t.Fatalf("%s: decoding: %v", tc.name, err)
+		}
+		w.updateState(doc)
+		if w.state != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, w.state)
+		}
+
+		// Values missing from later documents are left unchanged.
+		doc, _ = jsonpath.Decode([]byte(`{}`))
+		w.updateState(doc)
+		if w.state != tc.expected {
+			t.Errorf("%s: expected an empty document to change nothing, got %+v", tc.name, w.state)
+		}
+	}
+}
+
+// charger is a charger with an HTTP API, for the worker tests.
+type charger struct {
+	mux     sync.Mutex
+	enabled bool
+	limit   float64
+}
+
+func (c *charger) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch req.URL.Path {
+	case "/status":
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"enabled": c.enabled,
+			"limit":   c.limit,
+			"vehicle": "connected",
+		})
+	case "/start":
+		c.enabled = true
+	case "/stop":
+		c.enabled = false
+	case "/limit":
+		var body struct {
+			Amps float64 `json:"amps"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.limit = body.Amps
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestWorkerHTTP(t *testing.T) {
+	evse := &charger{limit: 16}
+	srv := httptest.NewServer(evse)
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		Generic: config.GenericCharger{
+			PollInterval: 1,
+			Start:        config.GenericRequest{URL: srv.URL + "/start"},
+			Stop:         config.GenericRequest{URL: srv.URL + "/stop"},
+			SetCurrent:   config.GenericRequest{URL: srv.URL + "/limit", Body: `{"amps": {{.Amps}}}`},
+			Status: config.GenericStatus{
+				GenericRequest:     config.GenericRequest{URL: srv.URL + "/status"},
+				ActivePath:         "enabled",
+				CurrentSettingPath: "limit",
+				ConnectedPath:      "vehicle",
+				ConnectedValues:    []string{"connected"},
+			},
+		},
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	expected := params.ChargerState{CurrentAmpSetting: 16, Vehicle: params.VehicleConnected}
+	if state != expected {
+		t.Errorf("expected initial state %+v, got %+v", expected, state)
+	}
+
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "enabled charger", func(state params.ChargerState) bool {
+		return state.Active && state.CurrentAmpSetting == 10
+	})
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "disabled charger", func(state params.ChargerState) bool {
+		return !state.Active
+	})
+}
+
+func TestWorkerMQTT(t *testing.T) {
+	broker := mqttfake.NewBroker()
+	t.Cleanup(func() { broker.Close() })
+	port, err := broker.Listen("tcp", nil)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		Generic: config.GenericCharger{
+			MQTT:       config.MQTTSettings{Broker: "127.0.0.1", Port: port},
+			Start:      config.GenericRequest{Topic: "evse/set/enabled", Payload: "1"},
+			Stop:       config.GenericRequest{Topic: "evse/set/enabled", Payload: "0"},
+			SetCurrent: config.GenericRequest{Topic: "evse/set/limit", Payload: "{{.MilliAmps}}", Retain: true},
+			Status: config.GenericStatus{
+				GenericRequest:           config.GenericRequest{Topic: "evse/status"},
+				ActivePath:               "enabled",
+				PowerPath:                "power",
+				CurrentSettingPath:       "limit",
+				CurrentSettingMultiplier: 0.001,
+			},
+		},
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+
+	// The status is received from the topic we subscribe to.
+	for i := 0; !broker.Subscribed("evse/status"); i++ {
+		if i == 500 {
+			t.Fatalf("timed out waiting for the worker to subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker.Publish("evse/status", []byte(`{"enabled": 1, "power": 2300, "limit": 10000}`), false)
+	state := commontest.WaitForState(t, stateChan, "published state", commontest.AnyState)
+	expected := params.ChargerState{Active: true, CurrentUsage: 2300, CurrentAmpSetting: 10}
+	if state != expected {
+		t.Errorf("expected state %+v, got %+v", expected, state)
+	}
+
+	if err := cli.SetAmp(6.5); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	var published []string
+	for _, msg := range broker.Published() {
+		published = append(published, fmt.Sprintf("%s=%s retained:%v", msg.Topic, msg.Payload, msg.Retained))
+	}
+	want := "evse/set/limit=6500 retained:true,evse/set/enabled=0 retained:false"
+	if got := strings.Join(published, ","); got != want {
+		t.Errorf("expected messages %s, got %s", want, got)
+	}
+}
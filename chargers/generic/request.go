@@ -0,0 +1,105 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+
+	"github.com/pkg/errors"
+)
+
+// templateData holds the values available to request templates.
+type templateData struct {
+	Amps      float64
+	MilliAmps uint64
+	Watts     float64
+}
+
+// request is a parsed config.GenericRequest.
+type request struct {
+	cfg     config.GenericRequest
+	url     *template.Template
+	body    *template.Template
+	payload *template.Template
+	headers map[string]*template.Template
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s template", name)
+	}
+	return tpl, nil
+}
+
+func newRequest(cfg config.GenericRequest) (*request, error) {
+	req := &request{
+		cfg:     cfg,
+		headers: map[string]*template.Template{},
+	}
+	var err error
+	if req.url, err = parseTemplate("url", cfg.URL); err != nil {
+		return nil, err
+	}
+	if req.body, err = parseTemplate("body", cfg.Body); err != nil {
+		return nil, err
+	}
+	if req.payload, err = parseTemplate("payload", cfg.Payload); err != nil {
+		return nil, err
+	}
+	for key, val := range cfg.Headers {
+		if req.headers[key], err = parseTemplate(key, val); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func render(tpl *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "rendering %s", tpl.Name())
+	}
+	return buf.String(), nil
+}
+
+// isMQTT returns true if the request is an MQTT message.
+func (r *request) isMQTT() bool {
+	return r.cfg.Topic != ""
+}
+
+// doHTTP sends the HTTP request and returns the response body.
+func (r *request) doHTTP(ctx context.Context, cli *httpclient.Client, auth config.HTTPAuth, data templateData) ([]byte, error) {
+	url, err := render(r.url, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := render(r.body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.cfg.Method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	for key, tpl := range r.headers {
+		val, err := render(tpl, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(key, val)
+	}
+	auth.Apply(req)
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
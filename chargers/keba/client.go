@@ -0,0 +1,60 @@
+package keba
+
+import (
+	"fmt"
+	"math"
+
+	"solar-ev-charger/chargers/common"
+
+	"github.com/pkg/errors"
+)
+
+// kebaClient controls the charger through the connection of the worker.
+type kebaClient struct {
+	conn *connection
+	// energyLimit is the session energy limit in kWh, set when charging
+	// is enabled.
+	energyLimit float64
+}
+
+// Start enables charging. If an energy limit is configured, it is set
+// first, so it applies to the session.
+func (c *kebaClient) Start() error {
+	if c.energyLimit > 0 {
+		// setenergy takes 0.1 Wh units.
+		limit := uint64(math.Round(c.energyLimit * 10000))
+		if err := c.conn.Command(fmt.Sprintf("setenergy %d", limit)); err != nil {
+			return err
+		}
+	}
+	return c.conn.Command("ena 1")
+}
+
+func (c *kebaClient) Stop() error {
+	return c.conn.Command("ena 0")
+}
+
+// SetAmp sets the current limit. The charger takes the value in mA.
+func (c *kebaClient) SetAmp(amp float64) error {
+	return c.conn.Command(fmt.Sprintf("curr %d", uint64(math.Round(amp*1000))))
+}
+
+// Capabilities reads the hardware current limit from report 2. The charger
+// accepts the current in mA, but rounds it down to 0.1 A internally.
+func (c *kebaClient) Capabilities() (common.Capabilities, error) {
+	report, err := c.conn.Report("2")
+	if err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "fetching report 2")
+	}
+	caps := common.Capabilities{
+		MinCurrent:    6,
+		CurrentStep:   0.1,
+		Toggle:        true,
+		SessionEnergy: true,
+		PlugDetection: true,
+	}
+	if report.CurrHW != nil {
+		caps.MaxCurrent = *report.CurrHW / 1000
+	}
+	return caps, nil
+}
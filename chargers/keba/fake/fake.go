@@ -0,0 +1,230 @@
+// Package fake implements a stand-in for the UDP interface of a KEBA
+// KeContact P30. It is meant to be used in tests, and when developing
+// without access to a real charging station.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Values of Plug.
+const (
+	PlugUnplugged  = 0
+	PlugLockedAtEV = 7
+)
+
+// voltage is the voltage of the simulated single phase supply.
+const voltage = 230
+
+// NewServer starts a new fake charger on a random local UDP port.
+func NewServer() (*Server, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:       conn,
+		enableUser: 1,
+		maxCurrent: 32000,
+		currUser:   32000,
+	}
+	go s.serve()
+	return s, nil
+}
+
+type Server struct {
+	conn *net.UDPConn
+
+	mux sync.Mutex
+	// client is the address broadcasts are sent to. It is the sender of
+	// the last command.
+	client     *net.UDPAddr
+	plug       int
+	enableUser int
+	maxCurrent uint64
+	// currUser is the current set with curr, in mA.
+	currUser uint64
+	// setEnergy is the energy limit set with setenergy, in 0.1 Wh.
+	setEnergy uint64
+	commands  []string
+}
+
+// Addr returns the address the charger listens on.
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Close stops the charger.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// SetPlug sets the plug state and broadcasts it.
+func (s *Server) SetPlug(plug int) {
+	s.mux.Lock()
+	s.plug = plug
+	s.mux.Unlock()
+	s.broadcast(map[string]interface{}{"Plug": plug})
+}
+
+// Enabled returns true if charging was enabled with ena.
+func (s *Server) Enabled() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.enableUser == 1
+}
+
+// Current returns the current set with curr, in mA.
+func (s *Server) Current() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.currUser
+}
+
+// EnergyLimit returns the energy limit set with setenergy, in 0.1 Wh.
+func (s *Server) EnergyLimit() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.setEnergy
+}
+
+// Commands returns the commands received so far.
+func (s *Server) Commands() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *Server) send(addr *net.UDPAddr, payload interface{}) {
+	var data []byte
+	switch val := payload.(type) {
+	case string:
+		data = []byte(val)
+	default:
+		data, _ = json.Marshal(val)
+	}
+	s.conn.WriteToUDP(data, addr)
+}
+
+func (s *Server) broadcast(payload interface{}) {
+	s.mux.Lock()
+	client := s.client
+	s.mux.Unlock()
+	if client != nil {
+		s.send(client, payload)
+	}
+}
+
+// state returns the simulated charger state. Must be called with the lock
+// held.
+func (s *Server) state() int {
+	switch {
+	case s.plug < 5:
+		return 1
+	case s.enableUser == 0:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// power returns the simulated active power in mW. Must be called with the
+// lock held.
+func (s *Server) power() uint64 {
+	if s.state() != 3 {
+		return 0
+	}
+	current := s.currUser
+	if current > s.maxCurrent {
+		current = s.maxCurrent
+	}
+	return current * voltage
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.mux.Lock()
+		s.client = addr
+		s.mux.Unlock()
+
+		reply, broadcast := s.handle(strings.TrimSpace(string(buf[:n])))
+		s.send(addr, reply)
+		if broadcast != nil {
+			s.send(addr, broadcast)
+		}
+	}
+}
+
+// handle returns the reply to a command, and an optional broadcast.
+func (s *Server) handle(cmd string) (interface{}, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.commands = append(s.commands, cmd)
+
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "TCH-ERR", nil
+	}
+	var arg uint64
+	if len(fields) > 1 {
+		var err error
+		if arg, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return "TCH-ERR", nil
+		}
+	}
+
+	switch fields[0] {
+	case "i":
+		return `"Firmware":"P30 fake"`, nil
+	case "report":
+		switch arg {
+		case 1:
+			return map[string]interface{}{"ID": "1", "Product": "KC-P30-FAKE", "Serial": "12345678"}, nil
+		case 2:
+			return map[string]interface{}{
+				"ID":          "2",
+				"State":       s.state(),
+				"Error1":      0,
+				"Plug":        s.plug,
+				"Enable sys":  s.enableUser,
+				"Enable user": s.enableUser,
+				"Max curr":    s.maxCurrent,
+				"Curr user":   s.currUser,
+				"Setenergy":   s.setEnergy,
+			}, nil
+		case 3:
+			return map[string]interface{}{
+				"ID": "3",
+				"U1": voltage,
+				"I1": s.power() / voltage,
+				"P":  s.power(),
+			}, nil
+		}
+	case "ena":
+		if arg > 1 {
+			return "TCH-ERR", nil
+		}
+		s.enableUser = int(arg)
+		return "TCH-OK :done", map[string]interface{}{"Enable sys": s.enableUser}
+	case "curr":
+		if arg < 6000 || arg > 63000 {
+			return "TCH-ERR", nil
+		}
+		s.currUser = arg
+		return "TCH-OK :done", map[string]interface{}{"Max curr": arg}
+	case "setenergy":
+		s.setEnergy = arg
+		return "TCH-OK :done", nil
+	}
+	return fmt.Sprintf("TCH-ERR unknown command %s", fields[0]), nil
+}
@@ -0,0 +1,192 @@
+// Package keba implements a driver for KEBA KeContact P20/P30 chargers,
+// using their local UDP protocol.
+package keba
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.keba")
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "KEBA",
+		ConfigSection: "KEBA",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.KEBA },
+		Validate:      func(cfg *config.Config) error { return cfg.KEBA.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.KEBA.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating KEBA config")
+	}
+	conn, err := newConnection(cfg.KEBA.Address, cfg.KEBA.ListenAddress, time.Duration(cfg.KEBA.Timeout)*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to charger")
+	}
+	return &Worker{
+		conn:         conn,
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+		refresh:      make(chan struct{}, 1),
+	}, nil
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	cfg          config.Config
+	conn         *connection
+	// refresh signals that the charger broadcast a change, and we should
+	// request new reports.
+	refresh chan struct{}
+
+	mux   sync.Mutex
+	state params.ChargerState
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &kebaClient{conn: w.conn, energyLimit: w.cfg.KEBA.EnergyLimit}, nil
+}
+
+func (w *Worker) onBroadcast(data []byte) {
+	log.Debugf("got broadcast %s", data)
+	select {
+	case w.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) readState() (params.ChargerState, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	report2, err := w.conn.Report("2")
+	if err != nil {
+		return w.state, errors.Wrap(err, "fetching report 2")
+	}
+	report3, err := w.conn.Report("3")
+	if err != nil {
+		return w.state, errors.Wrap(err, "fetching report 3")
+	}
+
+	if report2.EnableUser != nil {
+		w.state.Active = *report2.EnableUser == 1
+	}
+	if report2.CurrUser != nil {
+		w.state.CurrentAmpSetting = *report2.CurrUser / 1000
+	}
+	if report2.Plug != nil {
+		w.state.Vehicle = vehicleState(*report2.Plug, report2.State)
+	}
+	if report2.State != nil && *report2.State == stateError {
+		var code int
+		if report2.Error1 != nil {
+			code = *report2.Error1
+		}
+		log.Warningf("charger is in error state (error code %d)", code)
+	}
+	if report3.P != nil {
+		w.state.CurrentUsage = *report3.P / 1000
+	}
+	if report3.EPres != nil {
+		w.state.SessionEnergy = *report3.EPres / 10
+	}
+	return w.state, nil
+}
+
+// vehicleState maps the plug and charging state of report 2 to a vehicle
+// state.
+func vehicleState(plug int, state *int) params.VehicleState {
+	if plug < plugConnectedAtEV {
+		return params.VehicleDisconnected
+	}
+	if state == nil {
+		return params.VehicleConnected
+	}
+	switch *state {
+	case stateCharging:
+		return params.VehicleCharging
+	case stateError:
+		return params.VehicleError
+	}
+	return params.VehicleConnected
+}
+
+func (w *Worker) poll() error {
+	state, err := w.readState()
+	if err != nil {
+		return err
+	}
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) loop() {
+	timer := time.NewTicker(time.Duration(w.cfg.KEBA.PollInterval) * time.Second)
+	defer func() {
+		timer.Stop()
+		w.conn.Close()
+		close(w.closed)
+	}()
+
+	if err := w.poll(); err != nil {
+		log.Errorf("failed to poll charger: %q", err)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if err := w.poll(); err != nil {
+				log.Errorf("failed to poll charger: %q", err)
+			}
+		case <-w.refresh:
+			if err := w.poll(); err != nil {
+				log.Errorf("failed to poll charger: %q", err)
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.conn.readLoop(w.onBroadcast)
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
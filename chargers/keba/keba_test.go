@@ -0,0 +1,128 @@
+package keba
+
+import (
+	"testing"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/chargers/keba/fake"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+func TestIsReply(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected bool
+	}{
+		{"TCH-OK :done", true},
+		{"TCH-ERR", true},
+		{`"Firmware":"P30 v3.10.16"`, true},
+		{`{"ID": "2", "State": 3}`, true},
+		{`{"Plug": 7}`, false},
+		{`{"Max curr": 10000}`, false},
+	}
+	for _, tc := range tests {
+		if got := isReply([]byte(tc.data)); got != tc.expected {
+			t.Errorf("isReply(%s) = %v, expected %v", tc.data, got, tc.expected)
+		}
+	}
+}
+
+// newServer starts a fake charger, which is closed after the worker using
+// it is stopped.
+func newServer(t *testing.T) *fake.Server {
+	t.Helper()
+	srv, err := fake.NewServer()
+	if err != nil {
+		t.Fatalf("starting charger: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// startWorker starts a worker for the charger served by srv, and returns
+// the client controlling it along with the channel receiving its state.
+// Polling is slow enough that state updates are driven by broadcasts.
+func startWorker(t *testing.T, srv *fake.Server, energyLimit float64) (common.Client, chan params.ChargerState) {
+	t.Helper()
+	cfg := &config.Config{
+		KEBA: config.KEBACharger{
+			Address:       srv.Addr(),
+			ListenAddress: "127.0.0.1:0",
+			PollInterval:  60,
+			EnergyLimit:   energyLimit,
+		},
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+	return cli, stateChan
+}
+
+func TestWorkerBroadcasts(t *testing.T) {
+	srv := newServer(t)
+	cli, stateChan := startWorker(t, srv, 0)
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	expected := params.ChargerState{
+		Active:            true,
+		CurrentAmpSetting: 32,
+		Vehicle:           params.VehicleDisconnected,
+	}
+	if state != expected {
+		t.Errorf("expected initial state %+v, got %+v", expected, state)
+	}
+
+	// Plugging in is broadcast, and picked up without waiting for the
+	// next poll.
+	srv.SetPlug(fake.PlugLockedAtEV)
+	commontest.WaitForState(t, stateChan, "charging vehicle", func(state params.ChargerState) bool {
+		return state.Vehicle == params.VehicleCharging && state.CurrentUsage == 32*230
+	})
+
+	if err := cli.SetAmp(10.5); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if srv.Current() != 10500 {
+		t.Errorf("expected 10500 mA on the charger, got %d", srv.Current())
+	}
+	commontest.WaitForState(t, stateChan, "new current", func(state params.ChargerState) bool {
+		return state.CurrentAmpSetting == 10.5 && state.CurrentUsage == 10.5*230
+	})
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "disabled charger", func(state params.ChargerState) bool {
+		return !state.Active && state.Vehicle == params.VehicleConnected && state.CurrentUsage == 0
+	})
+
+	// The charger rejects currents below 6 A.
+	if err := cli.SetAmp(5); err == nil {
+		t.Errorf("expected an error setting 5 A")
+	}
+}
+
+func TestEnergyLimit(t *testing.T) {
+	srv := newServer(t)
+	cli, stateChan := startWorker(t, srv, 5)
+	commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if srv.EnergyLimit() != 50000 {
+		t.Errorf("expected an energy limit of 50000 (0.1 Wh), got %d", srv.EnergyLimit())
+	}
+	commands := srv.Commands()
+	if len(commands) < 2 || commands[len(commands)-2] != "setenergy 50000" || commands[len(commands)-1] != "ena 1" {
+		t.Errorf("expected the energy limit to be set before enabling, got %v", commands)
+	}
+
+	caps, err := cli.Capabilities()
+	if err != nil {
+		t.Fatalf("fetching capabilities: %v", err)
+	}
+	if caps.MinCurrent != 6 || caps.CurrentStep != 0.1 || !caps.SessionEnergy || !caps.PlugDetection {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+}
@@ -0,0 +1,200 @@
+package keba
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPort is the UDP port KEBA chargers listen and respond on.
+const DefaultPort = "7090"
+
+// commandInterval is the minimum amount of time between two commands. The
+// charger drops commands sent in quick succession.
+const commandInterval = 100 * time.Millisecond
+
+// Report is the union of the fields of report 2, report 3 and broadcasts
+// we use. Fields not present in a datagram are nil.
+type Report struct {
+	ID         *string `json:"ID"`
+	State      *int    `json:"State"`
+	Plug       *int    `json:"Plug"`
+	EnableSys  *int    `json:"Enable sys"`
+	EnableUser *int    `json:"Enable user"`
+	// CurrHW is the current limit of the hardware, set with the DIP
+	// switches, in mA.
+	CurrHW *float64 `json:"Curr HW"`
+	// MaxCurr is the current limit in effect, in mA.
+	MaxCurr *float64 `json:"Max curr"`
+	// CurrUser is the current limit set with the curr command, in mA.
+	CurrUser *float64 `json:"Curr user"`
+	// P is the active power, in mW.
+	P *float64 `json:"P"`
+	// EPres is the energy of the current session, in 0.1 Wh.
+	EPres  *float64 `json:"E pres"`
+	Error1 *int     `json:"Error1"`
+}
+
+// Values of State.
+const (
+	// stateCharging is the value of State while the vehicle is charging.
+	stateCharging = 3
+	// stateError is the value of State while the charger is in an error
+	// state.
+	stateError = 4
+)
+
+// plugConnectedAtEV is the lowest value of Plug which means the cable is
+// plugged in at the vehicle.
+const plugConnectedAtEV = 5
+
+// connection sends commands to the charger and dispatches the datagrams
+// it receives.
+type connection struct {
+	udp     *net.UDPConn
+	remote  *net.UDPAddr
+	timeout time.Duration
+
+	// mux serializes commands, as responses carry no request ID.
+	mux      sync.Mutex
+	lastSent time.Time
+	replies  chan []byte
+}
+
+func newConnection(address, listenAddress string, timeout time.Duration) (*connection, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+	remote, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving charger address")
+	}
+	local, err := net.ResolveUDPAddr("udp4", listenAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving listen address")
+	}
+	udp, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, errors.Wrap(err, "listening for charger responses")
+	}
+	return &connection{
+		udp:     udp,
+		remote:  remote,
+		timeout: timeout,
+		replies: make(chan []byte, 10),
+	}, nil
+}
+
+func (c *connection) Close() error {
+	return c.udp.Close()
+}
+
+// isReply returns true if the datagram is a response to a command, as
+// opposed to a broadcast sent by the charger on its own.
+func isReply(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("TCH-")) {
+		return true
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		// Text responses, like the one to the i command.
+		return true
+	}
+	return report.ID != nil
+}
+
+// readLoop reads datagrams from the charger until the connection is
+// closed. Replies are dispatched to the pending command, broadcasts are
+// passed to onBroadcast.
+func (c *connection) readLoop(onBroadcast func(data []byte)) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(c.remote.IP) {
+			log.Tracef("ignoring datagram from %s", addr)
+			continue
+		}
+		data := bytes.TrimSpace(append([]byte(nil), buf[:n]...))
+		log.Tracef("got %s from charger", data)
+		if !isReply(data) {
+			onBroadcast(data)
+			continue
+		}
+		select {
+		case c.replies <- data:
+		default:
+			log.Warningf("dropping unexpected response %s", data)
+		}
+	}
+}
+
+// send sends a command and returns the response accepted by match.
+func (c *connection) send(cmd string, match func(data []byte) bool) ([]byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// Drop late responses to earlier commands.
+	for len(c.replies) > 0 {
+		<-c.replies
+	}
+	if wait := commandInterval - time.Since(c.lastSent); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	log.Debugf("sending %q to charger", cmd)
+	if _, err := c.udp.WriteToUDP([]byte(cmd), c.remote); err != nil {
+		return nil, errors.Wrapf(err, "sending %s", cmd)
+	}
+	c.lastSent = time.Now()
+
+	timeout := time.After(c.timeout)
+	for {
+		select {
+		case data := <-c.replies:
+			if match(data) {
+				return data, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for response to %s", cmd)
+		}
+	}
+}
+
+// Report requests a report from the charger.
+func (c *connection) Report(id string) (Report, error) {
+	var report Report
+	data, err := c.send("report "+id, func(data []byte) bool {
+		var r Report
+		return json.Unmarshal(data, &r) == nil && r.ID != nil && *r.ID == id
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, errors.Wrapf(err, "decoding report %s", id)
+	}
+	return report, nil
+}
+
+// Command sends a command which is acknowledged with TCH-OK.
+func (c *connection) Command(cmd string) error {
+	data, err := c.send(cmd, func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("TCH-"))
+	})
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(data), "TCH-OK") {
+		return fmt.Errorf("%s failed: %s", cmd, data)
+	}
+	return nil
+}
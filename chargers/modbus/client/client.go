@@ -0,0 +1,249 @@
+// Package client implements a minimal Modbus-TCP client, supporting the
+// function codes needed to monitor and control charging stations.
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Function codes.
+const (
+	ReadCoils              byte = 0x01
+	ReadHoldingRegisters   byte = 0x03
+	ReadInputRegisters     byte = 0x04
+	WriteSingleCoil        byte = 0x05
+	WriteSingleRegister    byte = 0x06
+	WriteMultipleRegisters byte = 0x10
+)
+
+// DefaultPort is the default Modbus-TCP port.
+const DefaultPort = "502"
+
+// maxPDULength is the maximum length of a Modbus PDU.
+const maxPDULength = 253
+
+// Exception is an exception returned by a Modbus server.
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("modbus exception %d on function %d", e.Code, e.Function)
+}
+
+// NewClient returns a new Modbus-TCP client for the server at addr. The
+// connection is established on first use, and re-established after errors.
+func NewClient(addr string, unitID byte, timeout time.Duration) *Client {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+	return &Client{
+		addr:    addr,
+		unitID:  unitID,
+		timeout: timeout,
+	}
+}
+
+type Client struct {
+	addr    string
+	unitID  byte
+	timeout time.Duration
+
+	mux           sync.Mutex
+	conn          net.Conn
+	transactionID uint16
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// ReadHoldingRegisters reads count holding registers, starting at address.
+func (c *Client) ReadHoldingRegisters(address, count uint16) ([]uint16, error) {
+	return c.readRegisters(ReadHoldingRegisters, address, count)
+}
+
+// ReadInputRegisters reads count input registers, starting at address.
+func (c *Client) ReadInputRegisters(address, count uint16) ([]uint16, error) {
+	return c.readRegisters(ReadInputRegisters, address, count)
+}
+
+// ReadCoil reads a single coil.
+func (c *Client) ReadCoil(address uint16) (bool, error) {
+	resp, err := c.send(ReadCoils, request(address, 1))
+	if err != nil {
+		return false, err
+	}
+	if len(resp) != 2 || resp[0] != 1 {
+		return false, fmt.Errorf("invalid response length")
+	}
+	return resp[1]&0x01 == 1, nil
+}
+
+// WriteCoil sets the value of a single coil.
+func (c *Client) WriteCoil(address uint16, value bool) error {
+	var val uint16
+	if value {
+		val = 0xFF00
+	}
+	payload := request(address, val)
+	resp, err := c.send(WriteSingleCoil, payload)
+	if err != nil {
+		return err
+	}
+	return checkEcho(payload, resp)
+}
+
+// WriteRegister writes a single holding register.
+func (c *Client) WriteRegister(address, value uint16) error {
+	payload := request(address, value)
+	resp, err := c.send(WriteSingleRegister, payload)
+	if err != nil {
+		return err
+	}
+	return checkEcho(payload, resp)
+}
+
+// WriteRegisters writes consecutive holding registers, starting at address.
+func (c *Client) WriteRegisters(address uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > 123 {
+		return fmt.Errorf("invalid register count %d", len(values))
+	}
+	payload := request(address, uint16(len(values)))
+	payload = append(payload, byte(len(values)*2))
+	for _, val := range values {
+		payload = append(payload, byte(val>>8), byte(val))
+	}
+	resp, err := c.send(WriteMultipleRegisters, payload)
+	if err != nil {
+		return err
+	}
+	return checkEcho(payload[:4], resp)
+}
+
+func (c *Client) readRegisters(function byte, address, count uint16) ([]uint16, error) {
+	if count == 0 || count > 125 {
+		return nil, fmt.Errorf("invalid register count %d", count)
+	}
+	resp, err := c.send(function, request(address, count))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 1+int(count)*2 || int(resp[0]) != int(count)*2 {
+		return nil, fmt.Errorf("invalid response length")
+	}
+	values := make([]uint16, count)
+	for idx := range values {
+		values[idx] = binary.BigEndian.Uint16(resp[1+idx*2:])
+	}
+	return values, nil
+}
+
+func request(address, value uint16) []byte {
+	payload := make([]byte, 4, 8)
+	binary.BigEndian.PutUint16(payload, address)
+	binary.BigEndian.PutUint16(payload[2:], value)
+	return payload
+}
+
+func checkEcho(expected, resp []byte) error {
+	if string(resp) != string(expected) {
+		return fmt.Errorf("unexpected response to write")
+	}
+	return nil
+}
+
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return errors.Wrap(err, "connecting to modbus server")
+	}
+	c.conn = conn
+	return nil
+}
+
+// send sends a request PDU and returns the data of the response PDU.
+func (c *Client) send(function byte, data []byte) ([]byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(function, data)
+	if err != nil {
+		if _, ok := err.(*Exception); !ok {
+			// The connection may be out of sync. Start over.
+			c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) exchange(function byte, data []byte) ([]byte, error) {
+	c.transactionID++
+	frame := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(frame, c.transactionID)
+	// Protocol ID is always 0.
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)+2))
+	frame[6] = c.unitID
+	frame[7] = function
+	frame = append(frame, data...)
+
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, errors.Wrap(err, "setting deadline")
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		return nil, errors.Wrap(err, "sending request")
+	}
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return nil, errors.Wrap(err, "reading response")
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length > maxPDULength+1 {
+			return nil, fmt.Errorf("invalid response length %d", length)
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(c.conn, pdu); err != nil {
+			return nil, errors.Wrap(err, "reading response")
+		}
+		if binary.BigEndian.Uint16(header) != c.transactionID {
+			// Late response to a request that timed out.
+			continue
+		}
+		if pdu[0] == function|0x80 {
+			if len(pdu) < 2 {
+				return nil, fmt.Errorf("invalid exception response")
+			}
+			return nil, &Exception{Function: function, Code: pdu[1]}
+		}
+		if pdu[0] != function {
+			return nil, fmt.Errorf("unexpected function %d in response", pdu[0])
+		}
+		return pdu[1:], nil
+	}
+}
@@ -0,0 +1,89 @@
+package modbus
+
+import (
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+
+	"github.com/pkg/errors"
+)
+
+// modbusClient controls the charger polled by the worker.
+type modbusClient struct {
+	worker *Worker
+}
+
+// Start enables charging. Chargers without an enable register are started
+// by restoring the last current limit.
+func (c *modbusClient) Start() error {
+	w := c.worker
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.regs.Enable != nil {
+		if err := writeValue(w.cli, w.regs.Enable, w.regs.EnableValue); err != nil {
+			return errors.Wrap(err, "enabling charger")
+		}
+		return nil
+	}
+	if err := w.setCurrent(w.lastAmps); err != nil {
+		return err
+	}
+	w.stopped = false
+	w.stoppedKnown = true
+	return nil
+}
+
+// Stop disables charging. Chargers without an enable register are stopped
+// by setting the current limit to zero.
+func (c *modbusClient) Stop() error {
+	w := c.worker
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.regs.Enable != nil {
+		if err := writeValue(w.cli, w.regs.Enable, w.regs.DisableValue); err != nil {
+			return errors.Wrap(err, "disabling charger")
+		}
+		return nil
+	}
+	if err := w.setCurrent(0); err != nil {
+		return err
+	}
+	w.stopped = true
+	w.stoppedKnown = true
+	return nil
+}
+
+// SetAmp sets the current limit. If the charger was stopped by setting its
+// limit to zero, the new limit is applied when it is started, and reported
+// as the current setting until then.
+func (c *modbusClient) SetAmp(amp float64) error {
+	w := c.worker
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.lastAmps = amp
+	if w.regs.Enable == nil && w.stopped {
+		return nil
+	}
+	return w.setCurrent(amp)
+}
+
+// Capabilities derives the current step from the format of the set_current
+// register. Chargers taking floating point values accept tenths of an Amp.
+func (c *modbusClient) Capabilities() (common.Capabilities, error) {
+	regs := c.worker.regs
+	step := 1.0
+	switch {
+	case regs.SetCurrent.Format == config.Float32Format:
+		step = 0.1
+	case regs.SetCurrent.Scale < 1:
+		step = regs.SetCurrent.Scale
+	}
+	return common.Capabilities{
+		MinCurrent:    6,
+		CurrentStep:   step,
+		Toggle:        true,
+		PlugDetection: regs.Status != nil && len(regs.DisconnectedStatus) > 0,
+	}, nil
+}
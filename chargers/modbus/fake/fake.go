@@ -0,0 +1,230 @@
+// Package fake implements a stand-in Modbus-TCP server. It is meant to be
+// used in tests, and when developing register maps without access to a
+// real charging station. Registers that were never set read as zero.
+package fake
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"solar-ev-charger/chargers/modbus/client"
+)
+
+// Exception codes.
+const (
+	illegalFunction    byte = 0x01
+	illegalDataAddress byte = 0x02
+	illegalDataValue   byte = 0x03
+)
+
+// NewServer starts a new fake Modbus-TCP server on a random local port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: listener,
+		holding:  map[uint16]uint16{},
+		input:    map[uint16]uint16{},
+		coils:    map[uint16]bool{},
+		conns:    map[net.Conn]struct{}{},
+	}
+	go s.serve()
+	return s, nil
+}
+
+type Server struct {
+	listener net.Listener
+
+	mux     sync.Mutex
+	holding map[uint16]uint16
+	input   map[uint16]uint16
+	coils   map[uint16]bool
+	writes  int
+	conns   map[net.Conn]struct{}
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// SetHoldingRegisters sets consecutive holding registers, starting at address.
+func (s *Server) SetHoldingRegisters(address uint16, values ...uint16) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for idx, val := range values {
+		s.holding[address+uint16(idx)] = val
+	}
+}
+
+// HoldingRegisters returns count holding registers, starting at address.
+func (s *Server) HoldingRegisters(address, count uint16) []uint16 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	values := make([]uint16, count)
+	for idx := range values {
+		values[idx] = s.holding[address+uint16(idx)]
+	}
+	return values
+}
+
+// SetInputRegisters sets consecutive input registers, starting at address.
+func (s *Server) SetInputRegisters(address uint16, values ...uint16) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for idx, val := range values {
+		s.input[address+uint16(idx)] = val
+	}
+}
+
+// SetCoil sets the value of a coil.
+func (s *Server) SetCoil(address uint16, value bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.coils[address] = value
+}
+
+// Coil returns the value of a coil.
+func (s *Server) Coil(address uint16) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.coils[address]
+}
+
+// Writes returns the number of write requests served.
+func (s *Server) Writes() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.writes
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mux.Lock()
+		s.conns[conn] = struct{}{}
+		s.mux.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, conn)
+		s.mux.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.handle(pdu[0], pdu[1:])
+		frame := make([]byte, 7, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(resp)+1))
+		frame[6] = header[6]
+		frame = append(frame, resp...)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func exception(function, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
+
+// handle returns the response PDU to a request.
+func (s *Server) handle(function byte, data []byte) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(data) < 4 {
+		return exception(function, illegalDataValue)
+	}
+	address := binary.BigEndian.Uint16(data)
+	value := binary.BigEndian.Uint16(data[2:])
+
+	switch function {
+	case client.ReadCoils:
+		if value == 0 || value > 2000 {
+			return exception(function, illegalDataValue)
+		}
+		resp := []byte{function, byte((value + 7) / 8)}
+		resp = append(resp, make([]byte, (value+7)/8)...)
+		for idx := uint16(0); idx < value; idx++ {
+			if s.coils[address+idx] {
+				resp[2+idx/8] |= 1 << (idx % 8)
+			}
+		}
+		return resp
+	case client.ReadHoldingRegisters, client.ReadInputRegisters:
+		if value == 0 || value > 125 {
+			return exception(function, illegalDataValue)
+		}
+		registers := s.holding
+		if function == client.ReadInputRegisters {
+			registers = s.input
+		}
+		resp := []byte{function, byte(value * 2)}
+		for idx := uint16(0); idx < value; idx++ {
+			val := registers[address+idx]
+			resp = append(resp, byte(val>>8), byte(val))
+		}
+		return resp
+	case client.WriteSingleCoil:
+		if value != 0 && value != 0xFF00 {
+			return exception(function, illegalDataValue)
+		}
+		s.coils[address] = value == 0xFF00
+		s.writes++
+		return append([]byte{function}, data[:4]...)
+	case client.WriteSingleRegister:
+		s.holding[address] = value
+		s.writes++
+		return append([]byte{function}, data[:4]...)
+	case client.WriteMultipleRegisters:
+		if len(data) < 5 || int(data[4]) != int(value)*2 || len(data) != 5+int(value)*2 {
+			return exception(function, illegalDataValue)
+		}
+		if int(address)+int(value) > 0x10000 {
+			return exception(function, illegalDataAddress)
+		}
+		for idx := uint16(0); idx < value; idx++ {
+			s.holding[address+idx] = binary.BigEndian.Uint16(data[5+idx*2:])
+		}
+		s.writes++
+		return append([]byte{function}, data[:4]...)
+	}
+	return exception(function, illegalFunction)
+}
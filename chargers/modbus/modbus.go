@@ -0,0 +1,266 @@
+// Package modbus implements a driver for charging stations controlled over
+// Modbus-TCP, using either a built in or a configured register map.
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/modbus/client"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.modbus")
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "Modbus",
+		ConfigSection: "Modbus",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.Modbus },
+		Validate:      func(cfg *config.Config) error { return cfg.Modbus.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.Modbus.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating modbus config")
+	}
+	regs, err := registerMap(cfg.Modbus)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading register map")
+	}
+	unitID := cfg.Modbus.UnitID
+	if unitID == 0 {
+		unitID = defaultUnitIDs[cfg.Modbus.Model]
+	}
+
+	return &Worker{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		regs:         regs,
+		cli:          client.NewClient(cfg.Modbus.Address, unitID, time.Duration(cfg.Modbus.Timeout)*time.Second),
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+		lastAmps:     float64(cfg.MinAmpThreshold),
+	}, nil
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	cfg          config.Config
+	regs         config.ModbusRegisterMap
+	cli          *client.Client
+
+	mux         sync.Mutex
+	initialized bool
+	// stopped is used for chargers without an enable register, which are
+	// stopped by setting the current limit to zero.
+	stopped      bool
+	stoppedKnown bool
+	// lastAmps is the last current limit we were asked to set.
+	lastAmps float64
+	// written is the last current limit we wrote, which is zero while the
+	// charger is stopped. It is written again every refresh_interval.
+	written    float64
+	writtenSet bool
+	writtenAt  time.Time
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &modbusClient{worker: w}, nil
+}
+
+// setCurrent writes the current limit. Must be called with the lock held.
+func (w *Worker) setCurrent(amps float64) error {
+	if err := writeValue(w.cli, w.regs.SetCurrent, amps); err != nil {
+		return errors.Wrap(err, "writing current limit")
+	}
+	w.written = amps
+	w.writtenSet = true
+	w.writtenAt = time.Now()
+	return nil
+}
+
+// initialize writes the init registers of the register map.
+func (w *Worker) initialize() error {
+	for _, write := range w.regs.Init {
+		if err := writeValue(w.cli, &write.ModbusRegister, write.Value); err != nil {
+			return errors.Wrapf(err, "writing init register %d", write.Address)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) readState() (params.ChargerState, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if !w.initialized {
+		if err := w.initialize(); err != nil {
+			return params.ChargerState{}, err
+		}
+		w.initialized = true
+	}
+
+	// Stations with a validity timer fall back to their safe current when
+	// the limit is not refreshed. This includes the zero limit we stop
+	// chargers without an enable register with.
+	if w.regs.RefreshInterval > 0 && w.writtenSet {
+		if time.Since(w.writtenAt) >= time.Duration(w.regs.RefreshInterval)*time.Second {
+			if err := w.setCurrent(w.written); err != nil {
+				return params.ChargerState{}, errors.Wrap(err, "refreshing current limit")
+			}
+		}
+	}
+
+	var state params.ChargerState
+	settingReg := w.regs.CurrentSetting
+	if settingReg == nil {
+		settingReg = w.regs.SetCurrent
+	}
+	setting, err := readValue(w.cli, settingReg)
+	if err != nil {
+		return state, errors.Wrap(err, "reading current setting")
+	}
+	state.CurrentAmpSetting = setting
+
+	if w.regs.Enable != nil {
+		enabled, err := readValue(w.cli, w.regs.Enable)
+		if err != nil {
+			return state, errors.Wrap(err, "reading enable register")
+		}
+		state.Active = enabled == w.regs.EnableValue
+	} else {
+		if !w.stoppedKnown {
+			w.stopped = setting == 0
+			w.stoppedKnown = true
+		}
+		state.Active = !w.stopped
+		if w.stopped {
+			// The register holds the zero limit we stopped the charger
+			// with. Report the limit SetAmp deferred until we start it
+			// again, so the worker sees its command applied.
+			state.CurrentAmpSetting = w.lastAmps
+		}
+	}
+
+	if w.regs.Power != nil {
+		power, err := readValue(w.cli, w.regs.Power)
+		if err != nil {
+			return state, errors.Wrap(err, "reading power")
+		}
+		state.CurrentUsage = power
+	} else if w.regs.Current != nil {
+		current, err := readValue(w.cli, w.regs.Current)
+		if err != nil {
+			return state, errors.Wrap(err, "reading current")
+		}
+		state.CurrentUsage = current * float64(w.cfg.ElectricalPresure)
+	}
+
+	if w.regs.Status != nil {
+		status, err := readStatus(w.cli, w.regs.Status)
+		if err != nil {
+			return state, errors.Wrap(err, "reading status")
+		}
+		log.Tracef("charger status is %q", status)
+		state.Vehicle = vehicleState(w.regs, status)
+	}
+	return state, nil
+}
+
+// vehicleState maps the value of the status register to a vehicle state.
+// Values the register map does not list leave the state unknown, so the
+// charger is still controlled.
+func vehicleState(regs config.ModbusRegisterMap, status string) params.VehicleState {
+	switch {
+	case contains(regs.ErrorStatus, status):
+		return params.VehicleError
+	case contains(regs.ChargingStatus, status):
+		return params.VehicleCharging
+	case contains(regs.FinishedStatus, status):
+		return params.VehicleFinished
+	case contains(regs.ConnectedStatus, status):
+		return params.VehicleConnected
+	case contains(regs.DisconnectedStatus, status):
+		return params.VehicleDisconnected
+	}
+	return params.VehicleUnknown
+}
+
+func contains(values []string, val string) bool {
+	for _, v := range values {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Worker) poll() error {
+	state, err := w.readState()
+	if err != nil {
+		return err
+	}
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) loop() {
+	timer := time.NewTicker(time.Duration(w.cfg.Modbus.PollInterval) * time.Second)
+	defer func() {
+		timer.Stop()
+		w.cli.Close()
+		close(w.closed)
+	}()
+
+	if err := w.poll(); err != nil {
+		log.Errorf("failed to poll charger: %q", err)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if err := w.poll(); err != nil {
+				log.Errorf("failed to poll charger: %q", err)
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
@@ -0,0 +1,271 @@
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/modbus/fake"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+func TestVehicleState(t *testing.T) {
+	regs, err := registerMap(config.ModbusCharger{Model: config.ModbusAlfen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := config.ModbusRegisterMap{
+		ConnectedStatus: []string{"1"},
+	}
+
+	tests := []struct {
+		regs     config.ModbusRegisterMap
+		status   string
+		expected params.VehicleState
+	}{
+		{regs, "A", params.VehicleDisconnected},
+		{regs, "B1", params.VehicleConnected},
+		{regs, "C2", params.VehicleCharging},
+		{regs, "E", params.VehicleError},
+		{regs, "X", params.VehicleUnknown},
+		// Values missing from incomplete lists do not stop control.
+		{partial, "1", params.VehicleConnected},
+		{partial, "0", params.VehicleUnknown},
+	}
+	for _, tc := range tests {
+		if got := vehicleState(tc.regs, tc.status); got != tc.expected {
+			t.Errorf("vehicleState(%q) = %s, expected %s", tc.status, got, tc.expected)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		reg   config.ModbusRegister
+		value float64
+		words []uint16
+	}{
+		{config.ModbusRegister{Format: config.Uint16Format, Scale: 1}, 16, []uint16{16}},
+		{config.ModbusRegister{Format: config.Uint16Format, Scale: 0.1}, 10.5, []uint16{105}},
+		{config.ModbusRegister{Format: config.Int16Format, Scale: 1}, -2, []uint16{0xfffe}},
+		{config.ModbusRegister{Format: config.Uint32Format, Scale: 1}, 70000, []uint16{0x1, 0x1170}},
+		{config.ModbusRegister{Format: config.Uint32Format, Scale: 1, WordSwap: true}, 70000, []uint16{0x1170, 0x1}},
+		{config.ModbusRegister{Format: config.Float32Format, Scale: 1}, 10.5, []uint16{0x4128, 0x0}},
+		{config.ModbusRegister{Format: config.Float32Format, Scale: 1, WordSwap: true}, 10.5, []uint16{0x0, 0x4128}},
+	}
+	for _, tc := range tests {
+		reg := tc.reg
+		words, err := encode(&reg, tc.value)
+		if err != nil {
+			t.Errorf("%+v: unexpected error encoding: %v", reg, err)
+			continue
+		}
+		if !equalWords(words, tc.words) {
+			t.Errorf("%+v: encode(%v) = %x, expected %x", reg, tc.value, words, tc.words)
+		}
+		value, err := decode(&reg, tc.words)
+		if err != nil {
+			t.Errorf("%+v: unexpected error decoding: %v", reg, err)
+			continue
+		}
+		if value != tc.value {
+			t.Errorf("%+v: decode(%x) = %v, expected %v", reg, tc.words, value, tc.value)
+		}
+	}
+}
+
+func equalWords(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// newTestWorker returns a worker for the charger served by srv. The worker
+// is not started; tests drive it through readState and the client.
+func newTestWorker(t *testing.T, srv *fake.Server, settings config.ModbusCharger) (*Worker, common.Client) {
+	t.Helper()
+	settings.Address = srv.Addr()
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		MinAmpThreshold:   6,
+		Modbus:            settings,
+	}
+	bw, err := NewWorker(context.Background(), cfg, make(chan params.ChargerState, 1))
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	w := bw.(*Worker)
+	t.Cleanup(func() { w.cli.Close() })
+	cli, err := w.ChargerClient()
+	if err != nil {
+		t.Fatalf("fetching charger client: %v", err)
+	}
+	return w, cli
+}
+
+func TestAlfenFloatRegisters(t *testing.T) {
+	srv, err := fake.NewServer()
+	if err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Close()
+	w, cli := newTestWorker(t, srv, config.ModbusCharger{Model: config.ModbusAlfen})
+
+	if err := cli.SetAmp(10.5); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if got := srv.HoldingRegisters(1210, 2); !equalWords(got, []uint16{0x4128, 0x0}) {
+		t.Errorf("expected 10.5 A as float32 in the set_current registers, got %x", got)
+	}
+
+	// The station reports the applied limit, its current and the IEC
+	// 61851 state as text.
+	srv.SetHoldingRegisters(1206, 0x4128, 0x0)
+	srv.SetHoldingRegisters(320, 0x4120, 0x0)
+	srv.SetHoldingRegisters(344, 0x4510, 0x0)
+	srv.SetHoldingRegisters(1201, 0x4332)
+	state, err := w.readState()
+	if err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	expected := params.ChargerState{
+		Active:            true,
+		CurrentAmpSetting: 10.5,
+		CurrentUsage:      2304,
+		Vehicle:           params.VehicleCharging,
+	}
+	if state != expected {
+		t.Errorf("expected state %+v, got %+v", expected, state)
+	}
+}
+
+func TestStoppedWithoutEnableRegister(t *testing.T) {
+	srv, err := fake.NewServer()
+	if err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Close()
+	w, cli := newTestWorker(t, srv, config.ModbusCharger{
+		Model: config.ModbusCustom,
+		Registers: config.ModbusRegisterMap{
+			SetCurrent:      &config.ModbusRegister{Address: 100},
+			Current:         &config.ModbusRegister{Address: 101, Scale: 0.1},
+			RefreshInterval: 10,
+		},
+	})
+
+	if err := cli.SetAmp(16); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	if got := srv.HoldingRegisters(100, 1)[0]; got != 0 {
+		t.Fatalf("expected a zero limit after stopping, got %d", got)
+	}
+
+	// While stopped, a new limit is kept for later and reported as the
+	// current setting.
+	if err := cli.SetAmp(8); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if got := srv.HoldingRegisters(100, 1)[0]; got != 0 {
+		t.Errorf("expected the zero limit to be kept while stopped, got %d", got)
+	}
+	state, err := w.readState()
+	if err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	if state.Active || state.CurrentAmpSetting != 8 {
+		t.Errorf("expected a stopped charger reporting 8 A, got %+v", state)
+	}
+
+	// The zero limit is refreshed like any other.
+	writes := srv.Writes()
+	srv.SetHoldingRegisters(100, 16)
+	w.mux.Lock()
+	w.writtenAt = w.writtenAt.Add(-10 * time.Second)
+	w.mux.Unlock()
+	if _, err := w.readState(); err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	if srv.Writes() != writes+1 {
+		t.Errorf("expected the limit to be refreshed")
+	}
+	if got := srv.HoldingRegisters(100, 1)[0]; got != 0 {
+		t.Errorf("expected the zero limit to be refreshed, got %d", got)
+	}
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if got := srv.HoldingRegisters(100, 1)[0]; got != 8 {
+		t.Errorf("expected the deferred limit of 8 A after starting, got %d", got)
+	}
+	srv.SetHoldingRegisters(101, 75)
+	state, err = w.readState()
+	if err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	if !state.Active || state.CurrentAmpSetting != 8 || state.CurrentUsage != 7.5*230 {
+		t.Errorf("expected an active charger at 8 A using 7.5 A, got %+v", state)
+	}
+}
+
+func TestEnableCoil(t *testing.T) {
+	srv, err := fake.NewServer()
+	if err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Close()
+	w, cli := newTestWorker(t, srv, config.ModbusCharger{Model: config.ModbusPhoenix})
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if !srv.Coil(400) {
+		t.Errorf("expected the enable coil to be set")
+	}
+	if err := cli.SetAmp(13); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if got := srv.HoldingRegisters(528, 1)[0]; got != 13 {
+		t.Errorf("expected a limit of 13 A, got %d", got)
+	}
+
+	// Current and power are word swapped input registers.
+	srv.SetInputRegisters(114, 13000, 0)
+	srv.SetInputRegisters(120, 2990, 0)
+	srv.SetInputRegisters(100, 0x4300)
+	state, err := w.readState()
+	if err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	expected := params.ChargerState{
+		Active:            true,
+		CurrentAmpSetting: 13,
+		CurrentUsage:      2990,
+		Vehicle:           params.VehicleCharging,
+	}
+	if state != expected {
+		t.Errorf("expected state %+v, got %+v", expected, state)
+	}
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	if srv.Coil(400) {
+		t.Errorf("expected the enable coil to be cleared")
+	}
+	if got := srv.HoldingRegisters(528, 1)[0]; got != 13 {
+		t.Errorf("expected the limit to be left alone, got %d", got)
+	}
+}
@@ -0,0 +1,210 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"solar-ev-charger/chargers/modbus/client"
+	"solar-ev-charger/config"
+)
+
+// defaultUnitIDs holds the unit ID used by each model, unless configured.
+var defaultUnitIDs = map[config.ModbusModel]uint8{
+	config.ModbusAlfen:   1,
+	config.ModbusVictron: 1,
+	config.ModbusPhoenix: 180,
+	config.ModbusCustom:  1,
+}
+
+// registerMap returns the register map of the configured model.
+func registerMap(cfg config.ModbusCharger) (config.ModbusRegisterMap, error) {
+	var regs config.ModbusRegisterMap
+	switch cfg.Model {
+	case config.ModbusAlfen:
+		// Alfen Eve, with "Active load balancing" set to "Modbus TCP/IP
+		// EMS". The station falls back to its safe current unless the
+		// limit is written again within the validity time (60s default).
+		regs = config.ModbusRegisterMap{
+			SetCurrent:         &config.ModbusRegister{Address: 1210, Format: config.Float32Format},
+			CurrentSetting:     &config.ModbusRegister{Address: 1206, Format: config.Float32Format},
+			Current:            &config.ModbusRegister{Address: 320, Format: config.Float32Format},
+			Power:              &config.ModbusRegister{Address: 344, Format: config.Float32Format},
+			Status:             &config.ModbusRegister{Address: 1201, Format: config.StringFormat, Length: 5},
+			DisconnectedStatus: []string{"A"},
+			ConnectedStatus:    []string{"B1", "B2", "C1", "C2", "D1", "D2"},
+			ChargingStatus:     []string{"C2", "D2"},
+			ErrorStatus:        []string{"E", "F"},
+			RefreshInterval:    30,
+		}
+	case config.ModbusVictron:
+		// Victron EV Charging Station. Remote control requires manual mode.
+		regs = config.ModbusRegisterMap{
+			SetCurrent:         &config.ModbusRegister{Address: 5016},
+			Power:              &config.ModbusRegister{Address: 5014},
+			Enable:             &config.ModbusRegister{Address: 5010},
+			Status:             &config.ModbusRegister{Address: 5015},
+			DisconnectedStatus: []string{"0"},
+			ConnectedStatus:    []string{"1", "2", "3", "4", "5", "6", "7"},
+			ChargingStatus:     []string{"2"},
+			FinishedStatus:     []string{"3"},
+			ErrorStatus:        []string{"8", "9", "10", "11", "12", "13", "14"},
+			Init: []config.ModbusWrite{
+				{ModbusRegister: config.ModbusRegister{Address: 5009}, Value: 0},
+			},
+		}
+	case config.ModbusPhoenix:
+		// Phoenix Contact EV Charge Control. The status register holds
+		// the IEC 61851 state as an ASCII character.
+		regs = config.ModbusRegisterMap{
+			SetCurrent:         &config.ModbusRegister{Address: 528},
+			Current:            &config.ModbusRegister{Address: 114, Type: config.InputRegister, Format: config.Uint32Format, WordSwap: true, Scale: 0.001},
+			Power:              &config.ModbusRegister{Address: 120, Type: config.InputRegister, Format: config.Uint32Format, WordSwap: true},
+			Enable:             &config.ModbusRegister{Address: 400, Type: config.Coil},
+			Status:             &config.ModbusRegister{Address: 100, Type: config.InputRegister, Format: config.StringFormat, Length: 1},
+			DisconnectedStatus: []string{"A"},
+			ConnectedStatus:    []string{"B", "C", "D"},
+			ChargingStatus:     []string{"C", "D"},
+			ErrorStatus:        []string{"E", "F"},
+		}
+	case config.ModbusCustom:
+		regs = cfg.Registers
+	default:
+		return regs, fmt.Errorf("invalid model: %q", cfg.Model)
+	}
+	if err := regs.Validate(); err != nil {
+		return regs, err
+	}
+	return regs, nil
+}
+
+// decode converts raw register values to the value they hold, in the
+// units of the register.
+func decode(reg *config.ModbusRegister, words []uint16) (float64, error) {
+	if len(words) != int(reg.Words()) {
+		return 0, fmt.Errorf("expected %d registers, got %d", reg.Words(), len(words))
+	}
+	var raw float64
+	switch reg.Format {
+	case config.Uint16Format:
+		raw = float64(words[0])
+	case config.Int16Format:
+		raw = float64(int16(words[0]))
+	case config.Uint32Format, config.Int32Format, config.Float32Format:
+		hi, lo := words[0], words[1]
+		if reg.WordSwap {
+			hi, lo = lo, hi
+		}
+		val := uint32(hi)<<16 | uint32(lo)
+		switch reg.Format {
+		case config.Uint32Format:
+			raw = float64(val)
+		case config.Int32Format:
+			raw = float64(int32(val))
+		default:
+			raw = float64(math.Float32frombits(val))
+		}
+	default:
+		return 0, fmt.Errorf("cannot decode %s register as a number", reg.Format)
+	}
+	return raw * reg.Scale, nil
+}
+
+// decodeString converts raw register values holding ASCII text to a
+// string, stripping padding.
+func decodeString(words []uint16) string {
+	data := make([]byte, len(words)*2)
+	for idx, word := range words {
+		binary.BigEndian.PutUint16(data[idx*2:], word)
+	}
+	return strings.Trim(string(data), "\x00 ")
+}
+
+// encode converts a value to raw register values.
+func encode(reg *config.ModbusRegister, value float64) ([]uint16, error) {
+	raw := value / reg.Scale
+	var val uint32
+	switch reg.Format {
+	case config.Uint16Format:
+		return []uint16{uint16(math.Round(raw))}, nil
+	case config.Int16Format:
+		return []uint16{uint16(int16(math.Round(raw)))}, nil
+	case config.Uint32Format:
+		val = uint32(math.Round(raw))
+	case config.Int32Format:
+		val = uint32(int32(math.Round(raw)))
+	case config.Float32Format:
+		val = math.Float32bits(float32(raw))
+	default:
+		return nil, fmt.Errorf("cannot encode %s register", reg.Format)
+	}
+	hi, lo := uint16(val>>16), uint16(val)
+	if reg.WordSwap {
+		hi, lo = lo, hi
+	}
+	return []uint16{hi, lo}, nil
+}
+
+func readWords(cli *client.Client, reg *config.ModbusRegister) ([]uint16, error) {
+	switch reg.Type {
+	case config.InputRegister:
+		return cli.ReadInputRegisters(reg.Address, reg.Words())
+	case config.Coil:
+		on, err := cli.ReadCoil(reg.Address)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			return []uint16{1}, nil
+		}
+		return []uint16{0}, nil
+	default:
+		return cli.ReadHoldingRegisters(reg.Address, reg.Words())
+	}
+}
+
+// readValue reads a numeric register.
+func readValue(cli *client.Client, reg *config.ModbusRegister) (float64, error) {
+	words, err := readWords(cli, reg)
+	if err != nil {
+		return 0, err
+	}
+	if reg.Type == config.Coil {
+		return float64(words[0]), nil
+	}
+	return decode(reg, words)
+}
+
+// readStatus reads a register as a string. Numeric values are formatted
+// in decimal.
+func readStatus(cli *client.Client, reg *config.ModbusRegister) (string, error) {
+	if reg.Format == config.StringFormat && reg.Type != config.Coil {
+		words, err := readWords(cli, reg)
+		if err != nil {
+			return "", err
+		}
+		return decodeString(words), nil
+	}
+	val, err := readValue(cli, reg)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64), nil
+}
+
+// writeValue writes a value to a holding register or coil.
+func writeValue(cli *client.Client, reg *config.ModbusRegister, value float64) error {
+	if reg.Type == config.Coil {
+		return cli.WriteCoil(reg.Address, value != 0)
+	}
+	words, err := encode(reg, value)
+	if err != nil {
+		return err
+	}
+	if len(words) == 1 {
+		return cli.WriteRegister(reg.Address, words[0])
+	}
+	return cli.WriteRegisters(reg.Address, words)
+}
@@ -0,0 +1,134 @@
+package ocpp
+
+import (
+	"fmt"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+
+	"github.com/pkg/errors"
+)
+
+// chargingProfileID is the ID of the charging profile we install. Reusing
+// the same ID replaces our previous profile on the charge point.
+const chargingProfileID = 4242
+
+// chargePointClient controls the charge point connected to the worker.
+type chargePointClient struct {
+	worker *Worker
+}
+
+// Start remotely starts a transaction, unless one is already active.
+func (c *chargePointClient) Start() error {
+	w := c.worker
+	w.mux.Lock()
+	active := w.transactionID != 0
+	w.mux.Unlock()
+	if active {
+		return nil
+	}
+
+	conn, err := w.currentConnection()
+	if err != nil {
+		return err
+	}
+	req := RemoteStartTransactionRequest{
+		ConnectorID: w.cfg.OCPP.ConnectorID,
+		IDTag:       w.cfg.OCPP.IDTag,
+	}
+	var resp StatusResponse
+	if err := conn.call("RemoteStartTransaction", req, &resp); err != nil {
+		return err
+	}
+	if resp.Status != StatusAccepted {
+		return fmt.Errorf("remote start %s", resp.Status)
+	}
+	return nil
+}
+
+// Stop remotely stops the active transaction.
+func (c *chargePointClient) Stop() error {
+	w := c.worker
+	w.mux.Lock()
+	txID := w.transactionID
+	w.mux.Unlock()
+	if txID == 0 {
+		return nil
+	}
+
+	conn, err := w.currentConnection()
+	if err != nil {
+		return err
+	}
+	var resp StatusResponse
+	if err := conn.call("RemoteStopTransaction", RemoteStopTransactionRequest{TransactionID: txID}, &resp); err != nil {
+		return err
+	}
+	if resp.Status != StatusAccepted {
+		return fmt.Errorf("remote stop %s", resp.Status)
+	}
+	return nil
+}
+
+// SetAmp limits the current through a charging profile. If a transaction
+// is active, the limit is set through a TxProfile. Otherwise we set a
+// TxDefaultProfile, which applies to the next transaction.
+func (c *chargePointClient) SetAmp(amp float64) error {
+	w := c.worker
+	conn, err := w.currentConnection()
+	if err != nil {
+		return err
+	}
+
+	w.mux.Lock()
+	txID := w.transactionID
+	w.mux.Unlock()
+
+	profile := ChargingProfile{
+		ChargingProfileID:      chargingProfileID,
+		StackLevel:             1,
+		ChargingProfilePurpose: "TxDefaultProfile",
+		ChargingProfileKind:    "Absolute",
+		ChargingSchedule: ChargingSchedule{
+			StartSchedule:    &Time{time.Now().Add(-time.Minute)},
+			ChargingRateUnit: "A",
+			ChargingSchedulePeriod: []ChargingSchedulePeriod{
+				{StartPeriod: 0, Limit: amp},
+			},
+		},
+	}
+	if txID != 0 {
+		profile.ChargingProfilePurpose = "TxProfile"
+		profile.TransactionID = txID
+	}
+	req := SetChargingProfileRequest{
+		ConnectorID:        w.cfg.OCPP.ConnectorID,
+		CSChargingProfiles: profile,
+	}
+	var resp StatusResponse
+	if err := conn.call("SetChargingProfile", req, &resp); err != nil {
+		return errors.Wrap(err, "setting charging profile")
+	}
+	if resp.Status != StatusAccepted {
+		return fmt.Errorf("charging profile %s", resp.Status)
+	}
+
+	w.mux.Lock()
+	w.limit = amp
+	w.limitSet = true
+	w.mux.Unlock()
+	w.notifyState()
+	return nil
+}
+
+// Capabilities reports the limits of the charging profiles we send. The
+// charge point does not report its hardware limits, and most accept limits
+// with one decimal.
+func (c *chargePointClient) Capabilities() (common.Capabilities, error) {
+	return common.Capabilities{
+		MinCurrent:    6,
+		CurrentStep:   0.1,
+		Toggle:        true,
+		PlugDetection: true,
+	}, nil
+}
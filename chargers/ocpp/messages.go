@@ -0,0 +1,254 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OCPP-J message types.
+// See: OCPP-J 1.6 specification, section 4.
+const (
+	MessageTypeCall       = 2
+	MessageTypeCallResult = 3
+	MessageTypeCallError  = 4
+)
+
+// Subprotocol is the websocket subprotocol of OCPP 1.6J.
+const Subprotocol = "ocpp1.6"
+
+// Message is a decoded OCPP-J message.
+type Message struct {
+	Type             int
+	ID               string
+	Action           string
+	Payload          json.RawMessage
+	ErrorCode        string
+	ErrorDescription string
+}
+
+// ParseMessage decodes an OCPP-J message.
+func ParseMessage(data []byte) (Message, error) {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Message{}, errors.Wrap(err, "decoding message")
+	}
+	if len(fields) < 3 {
+		return Message{}, fmt.Errorf("invalid message: %s", data)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(fields[0], &msg.Type); err != nil {
+		return Message{}, errors.Wrap(err, "decoding message type")
+	}
+	if err := json.Unmarshal(fields[1], &msg.ID); err != nil {
+		return Message{}, errors.Wrap(err, "decoding message id")
+	}
+
+	switch msg.Type {
+	case MessageTypeCall:
+		if len(fields) != 4 {
+			return Message{}, fmt.Errorf("invalid call: %s", data)
+		}
+		if err := json.Unmarshal(fields[2], &msg.Action); err != nil {
+			return Message{}, errors.Wrap(err, "decoding action")
+		}
+		msg.Payload = fields[3]
+	case MessageTypeCallResult:
+		msg.Payload = fields[2]
+	case MessageTypeCallError:
+		if len(fields) < 4 {
+			return Message{}, fmt.Errorf("invalid call error: %s", data)
+		}
+		json.Unmarshal(fields[2], &msg.ErrorCode)
+		json.Unmarshal(fields[3], &msg.ErrorDescription)
+	default:
+		return Message{}, fmt.Errorf("invalid message type %d", msg.Type)
+	}
+	return msg, nil
+}
+
+// NewCall encodes a call.
+func NewCall(id, action string, payload interface{}) ([]byte, error) {
+	return json.Marshal([]interface{}{MessageTypeCall, id, action, payload})
+}
+
+// NewCallResult encodes the result of a call.
+func NewCallResult(id string, payload interface{}) ([]byte, error) {
+	return json.Marshal([]interface{}{MessageTypeCallResult, id, payload})
+}
+
+// NewCallError encodes an error response to a call.
+func NewCallError(id, code, description string) ([]byte, error) {
+	return json.Marshal([]interface{}{MessageTypeCallError, id, code, description, map[string]interface{}{}})
+}
+
+// Time is a timestamp, encoded as RFC 3339.
+type Time struct {
+	time.Time
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(time.RFC3339))
+}
+
+func (t *Time) UnmarshalJSON(data []byte) error {
+	var val string
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Status values used by charge points and the central system.
+const (
+	StatusAccepted = "Accepted"
+	StatusRejected = "Rejected"
+)
+
+// Connector states reported in StatusNotification.
+const (
+	ConnectorAvailable     = "Available"
+	ConnectorPreparing     = "Preparing"
+	ConnectorCharging      = "Charging"
+	ConnectorSuspendedEV   = "SuspendedEV"
+	ConnectorSuspendedEVSE = "SuspendedEVSE"
+	ConnectorFinishing     = "Finishing"
+	ConnectorReserved      = "Reserved"
+	ConnectorUnavailable   = "Unavailable"
+	ConnectorFaulted       = "Faulted"
+)
+
+// Measurands we request in MeterValues.
+const (
+	MeasurandPowerActiveImport = "Power.Active.Import"
+	MeasurandCurrentImport     = "Current.Import"
+	MeasurandCurrentOffered    = "Current.Offered"
+	MeasurandEnergyRegister    = "Energy.Active.Import.Register"
+)
+
+type BootNotificationRequest struct {
+	ChargePointVendor string `json:"chargePointVendor"`
+	ChargePointModel  string `json:"chargePointModel"`
+	FirmwareVersion   string `json:"firmwareVersion,omitempty"`
+}
+
+type BootNotificationResponse struct {
+	Status      string `json:"status"`
+	CurrentTime Time   `json:"currentTime"`
+	Interval    int    `json:"interval"`
+}
+
+type HeartbeatResponse struct {
+	CurrentTime Time `json:"currentTime"`
+}
+
+type StatusNotificationRequest struct {
+	ConnectorID int    `json:"connectorId"`
+	ErrorCode   string `json:"errorCode"`
+	Status      string `json:"status"`
+}
+
+type IDTagInfo struct {
+	Status string `json:"status"`
+}
+
+type AuthorizeRequest struct {
+	IDTag string `json:"idTag"`
+}
+
+type AuthorizeResponse struct {
+	IDTagInfo IDTagInfo `json:"idTagInfo"`
+}
+
+type StartTransactionRequest struct {
+	ConnectorID int    `json:"connectorId"`
+	IDTag       string `json:"idTag"`
+	MeterStart  int    `json:"meterStart"`
+	Timestamp   Time   `json:"timestamp"`
+}
+
+type StartTransactionResponse struct {
+	TransactionID int       `json:"transactionId"`
+	IDTagInfo     IDTagInfo `json:"idTagInfo"`
+}
+
+type StopTransactionRequest struct {
+	TransactionID int    `json:"transactionId"`
+	MeterStop     int    `json:"meterStop"`
+	Timestamp     Time   `json:"timestamp"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+type StopTransactionResponse struct {
+	IDTagInfo *IDTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type SampledValue struct {
+	Value     string `json:"value"`
+	Measurand string `json:"measurand,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+type MeterValue struct {
+	Timestamp    Time           `json:"timestamp"`
+	SampledValue []SampledValue `json:"sampledValue"`
+}
+
+type MeterValuesRequest struct {
+	ConnectorID   int          `json:"connectorId"`
+	TransactionID *int         `json:"transactionId,omitempty"`
+	MeterValue    []MeterValue `json:"meterValue"`
+}
+
+type RemoteStartTransactionRequest struct {
+	ConnectorID int    `json:"connectorId,omitempty"`
+	IDTag       string `json:"idTag"`
+}
+
+type RemoteStopTransactionRequest struct {
+	TransactionID int `json:"transactionId"`
+}
+
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+type ChangeConfigurationRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type ChargingSchedulePeriod struct {
+	StartPeriod  int     `json:"startPeriod"`
+	Limit        float64 `json:"limit"`
+	NumberPhases int     `json:"numberPhases,omitempty"`
+}
+
+type ChargingSchedule struct {
+	StartSchedule          *Time                    `json:"startSchedule,omitempty"`
+	ChargingRateUnit       string                   `json:"chargingRateUnit"`
+	ChargingSchedulePeriod []ChargingSchedulePeriod `json:"chargingSchedulePeriod"`
+}
+
+type ChargingProfile struct {
+	ChargingProfileID      int              `json:"chargingProfileId"`
+	TransactionID          int              `json:"transactionId,omitempty"`
+	StackLevel             int              `json:"stackLevel"`
+	ChargingProfilePurpose string           `json:"chargingProfilePurpose"`
+	ChargingProfileKind    string           `json:"chargingProfileKind"`
+	ChargingSchedule       ChargingSchedule `json:"chargingSchedule"`
+}
+
+type SetChargingProfileRequest struct {
+	ConnectorID        int             `json:"connectorId"`
+	CSChargingProfiles ChargingProfile `json:"csChargingProfiles"`
+}
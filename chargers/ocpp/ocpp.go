@@ -0,0 +1,580 @@
+// Package ocpp implements a minimal OCPP 1.6J central system, which lets
+// us control any OCPP compliant charge point on the local network.
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+
+	"github.com/gorilla/websocket"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.ocpp")
+
+// callTimeout is the amount of time we wait for the charge point to respond
+// to a call.
+const callTimeout = 30 * time.Second
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "OCPP",
+		ConfigSection: "OCPP",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.OCPP },
+		Validate:      func(cfg *config.Config) error { return cfg.OCPP.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.OCPP.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating ocpp config")
+	}
+	return &Worker{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+		stateUpdated: make(chan struct{}, 1),
+		// Transaction IDs must be unique across restarts.
+		nextTxID: int(time.Now().Unix()),
+	}, nil
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	// stateUpdated signals that the state must be sent. The state is sent
+	// from the worker loop, so that the connection is never blocked by a
+	// consumer which waits on a call to the charge point.
+	stateUpdated chan struct{}
+	cfg          config.Config
+	srv          *http.Server
+
+	mux  sync.Mutex
+	conn *connection
+
+	connectorStatus string
+	transactionID   int
+	nextTxID        int
+	// power is the active power reported in MeterValues, in Watts.
+	power float64
+	// currentImport is the current drawn by the vehicle, in Amps.
+	currentImport float64
+	// currentOffered is the current offered to the vehicle, in Amps, and
+	// offeredReported is true once the charge point reported it.
+	currentOffered  float64
+	offeredReported bool
+	// limit is the last current limit we set.
+	limit    float64
+	limitSet bool
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &chargePointClient{worker: w}, nil
+}
+
+// connection is a websocket connection to a charge point.
+type connection struct {
+	id string
+	ws *websocket.Conn
+
+	writeMux sync.Mutex
+	msgID    uint64
+
+	pendingMux sync.Mutex
+	pending    map[string]chan Message
+}
+
+func (c *connection) write(data []byte) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// call sends a call to the charge point and decodes the result into resp.
+func (c *connection) call(action string, req, resp interface{}) error {
+	id := strconv.FormatUint(atomic.AddUint64(&c.msgID, 1), 10)
+	data, err := NewCall(id, action, req)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s", action)
+	}
+
+	result := make(chan Message, 1)
+	c.pendingMux.Lock()
+	c.pending[id] = result
+	c.pendingMux.Unlock()
+	defer func() {
+		c.pendingMux.Lock()
+		delete(c.pending, id)
+		c.pendingMux.Unlock()
+	}()
+
+	log.Debugf("sending %s to %s: %s", action, c.id, data)
+	if err := c.write(data); err != nil {
+		return errors.Wrapf(err, "sending %s", action)
+	}
+
+	select {
+	case msg := <-result:
+		if msg.Type == MessageTypeCallError {
+			return fmt.Errorf("%s failed: %s: %s", action, msg.ErrorCode, msg.ErrorDescription)
+		}
+		if resp != nil {
+			if err := json.Unmarshal(msg.Payload, resp); err != nil {
+				return errors.Wrapf(err, "decoding %s response", action)
+			}
+		}
+		return nil
+	case <-time.After(callTimeout):
+		return fmt.Errorf("timed out waiting for %s response", action)
+	}
+}
+
+func (c *connection) resolve(msg Message) {
+	c.pendingMux.Lock()
+	defer c.pendingMux.Unlock()
+	if result, ok := c.pending[msg.ID]; ok {
+		result <- msg
+		return
+	}
+	log.Warningf("got response to unknown call %s from %s", msg.ID, c.id)
+}
+
+// currentConnection returns the connection to the charge point, if any.
+func (w *Worker) currentConnection() (*connection, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.conn == nil {
+		return nil, fmt.Errorf("charge point is not connected")
+	}
+	return w.conn, nil
+}
+
+// localState must be called with the lock held.
+func (w *Worker) localState() params.ChargerState {
+	usage := w.power
+	if usage == 0 && w.currentImport > 0 {
+		usage = w.currentImport * float64(w.cfg.ElectricalPresure)
+	}
+	// We report the current the charge point offers, so the state worker
+	// sees whether our charging profiles were applied. Charge points that
+	// do not sample Current.Offered leave us with the limit we set.
+	ampSetting := w.currentOffered
+	if !w.offeredReported && w.limitSet {
+		ampSetting = w.limit
+	}
+	return params.ChargerState{
+		Active:            w.transactionID != 0,
+		CurrentUsage:      usage,
+		CurrentAmpSetting: ampSetting,
+		Vehicle:           vehicleState(w.connectorStatus),
+	}
+}
+
+// vehicleState maps the status of the connector to a vehicle state. A
+// vehicle that suspends charging on its own is usually full.
+func vehicleState(status string) params.VehicleState {
+	switch status {
+	case ConnectorAvailable, ConnectorReserved:
+		return params.VehicleDisconnected
+	case ConnectorPreparing, ConnectorSuspendedEVSE, ConnectorFinishing:
+		return params.VehicleConnected
+	case ConnectorCharging:
+		return params.VehicleCharging
+	case ConnectorSuspendedEV:
+		return params.VehicleFinished
+	case ConnectorFaulted:
+		return params.VehicleError
+	}
+	return params.VehicleUnknown
+}
+
+// notifyState schedules sending the local state.
+func (w *Worker) notifyState() {
+	select {
+	case w.stateUpdated <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) sendLocalState() error {
+	w.mux.Lock()
+	state := w.localState()
+	w.mux.Unlock()
+
+	select {
+	case w.stateChanged <- state:
+	case <-w.quit:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) authorized(id string, r *http.Request) bool {
+	if id != w.cfg.OCPP.ChargePointID {
+		return false
+	}
+	if w.cfg.OCPP.Password == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && user == id && pass == w.cfg.OCPP.Password
+}
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{Subprotocol},
+}
+
+func (w *Worker) handleConnection(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := parts[len(parts)-1]
+	if id == "" || !w.authorized(id, r) {
+		log.Warningf("rejecting connection from %s (charge point %q)", r.RemoteAddr, id)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// Only the charge point already connected may replace its connection.
+	w.mux.Lock()
+	var connected string
+	if w.conn != nil {
+		connected = w.conn.id
+	}
+	w.mux.Unlock()
+	if connected != "" && connected != id {
+		log.Warningf("rejecting charge point %s; %s is connected", id, connected)
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		log.Errorf("failed to upgrade connection: %q", err)
+		return
+	}
+	defer ws.Close()
+	if ws.Subprotocol() != Subprotocol {
+		log.Errorf("charge point %s does not support %s", id, Subprotocol)
+		return
+	}
+
+	conn := &connection{
+		id:      id,
+		ws:      ws,
+		pending: map[string]chan Message{},
+	}
+	w.mux.Lock()
+	if w.conn != nil {
+		// The charge point reconnected before we noticed the old
+		// connection was gone.
+		log.Infof("replacing existing connection to %s", w.conn.id)
+		w.conn.ws.Close()
+	}
+	w.conn = conn
+	w.mux.Unlock()
+	log.Infof("charge point %s connected from %s", id, r.RemoteAddr)
+
+	defer func() {
+		w.mux.Lock()
+		if w.conn == conn {
+			w.conn = nil
+		}
+		w.mux.Unlock()
+		log.Infof("charge point %s disconnected", id)
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := ParseMessage(data)
+		if err != nil {
+			log.Errorf("invalid message from %s: %q", id, err)
+			continue
+		}
+		log.Debugf("got message from %s: %s", id, data)
+
+		switch msg.Type {
+		case MessageTypeCallResult, MessageTypeCallError:
+			conn.resolve(msg)
+		case MessageTypeCall:
+			var reply []byte
+			resp, err := w.handleCall(conn, msg)
+			if err != nil {
+				log.Errorf("failed to handle %s from %s: %q", msg.Action, id, err)
+				code := "InternalError"
+				if errors.Is(err, errNotImplemented) {
+					code = "NotImplemented"
+				}
+				reply, err = NewCallError(msg.ID, code, err.Error())
+			} else {
+				reply, err = NewCallResult(msg.ID, resp)
+			}
+			if err != nil {
+				log.Errorf("failed to encode response: %q", err)
+				continue
+			}
+			if err := conn.write(reply); err != nil {
+				log.Errorf("failed to send response to %s: %q", id, err)
+				return
+			}
+		}
+	}
+}
+
+var errNotImplemented = fmt.Errorf("not implemented")
+
+// handleCall handles a call made by the charge point and returns the
+// response payload.
+func (w *Worker) handleCall(conn *connection, msg Message) (interface{}, error) {
+	now := Time{time.Now()}
+	switch msg.Action {
+	case "BootNotification":
+		var req BootNotificationRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, errors.Wrap(err, "decoding request")
+		}
+		log.Infof("charge point %s booted: %s %s (firmware %s)", conn.id, req.ChargePointVendor, req.ChargePointModel, req.FirmwareVersion)
+		// The charge point only accepts calls after we respond.
+		go w.configureChargePoint(conn)
+		return BootNotificationResponse{
+			Status:      StatusAccepted,
+			CurrentTime: now,
+			Interval:    int(w.cfg.OCPP.HeartbeatInterval),
+		}, nil
+	case "Heartbeat":
+		return HeartbeatResponse{CurrentTime: now}, nil
+	case "Authorize":
+		return AuthorizeResponse{IDTagInfo: IDTagInfo{Status: StatusAccepted}}, nil
+	case "StatusNotification":
+		var req StatusNotificationRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, errors.Wrap(err, "decoding request")
+		}
+		if req.ConnectorID == w.cfg.OCPP.ConnectorID {
+			w.mux.Lock()
+			w.connectorStatus = req.Status
+			if req.Status == ConnectorAvailable {
+				// The vehicle was unplugged.
+				w.power = 0
+				w.currentImport = 0
+			}
+			w.notifyState()
+			w.mux.Unlock()
+		}
+		return struct{}{}, nil
+	case "StartTransaction":
+		var req StartTransactionRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, errors.Wrap(err, "decoding request")
+		}
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		w.nextTxID++
+		txID := w.nextTxID
+		if req.ConnectorID == w.cfg.OCPP.ConnectorID {
+			w.transactionID = txID
+			w.notifyState()
+		}
+		log.Infof("transaction %d started on connector %d", txID, req.ConnectorID)
+		return StartTransactionResponse{
+			TransactionID: txID,
+			IDTagInfo:     IDTagInfo{Status: StatusAccepted},
+		}, nil
+	case "StopTransaction":
+		var req StopTransactionRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, errors.Wrap(err, "decoding request")
+		}
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		if req.TransactionID == w.transactionID {
+			w.transactionID = 0
+			w.power = 0
+			w.currentImport = 0
+			w.notifyState()
+		}
+		log.Infof("transaction %d stopped (%s)", req.TransactionID, req.Reason)
+		return StopTransactionResponse{}, nil
+	case "MeterValues":
+		var req MeterValuesRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, errors.Wrap(err, "decoding request")
+		}
+		if req.ConnectorID == w.cfg.OCPP.ConnectorID {
+			w.handleMeterValues(req)
+		}
+		return struct{}{}, nil
+	case "DataTransfer":
+		return StatusResponse{Status: "UnknownVendorId"}, nil
+	case "DiagnosticsStatusNotification", "FirmwareStatusNotification":
+		return struct{}{}, nil
+	default:
+		return nil, errors.Wrap(errNotImplemented, msg.Action)
+	}
+}
+
+func (w *Worker) handleMeterValues(req MeterValuesRequest) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if req.TransactionID != nil && w.transactionID == 0 {
+		// The transaction was started before we came up.
+		log.Infof("resuming transaction %d", *req.TransactionID)
+		w.transactionID = *req.TransactionID
+	}
+
+	// Values may be reported per phase. Power is summed up, unless a total
+	// is reported. We work with the current of a single phase, so we keep
+	// the highest one.
+	var power, currentImport, currentOffered float64
+	var havePower, powerTotal, haveImport, haveOffered bool
+	for _, meterValue := range req.MeterValue {
+		for _, sample := range meterValue.SampledValue {
+			val, err := strconv.ParseFloat(sample.Value, 64)
+			if err != nil {
+				log.Warningf("invalid meter value %q for %s", sample.Value, sample.Measurand)
+				continue
+			}
+			switch sample.Measurand {
+			case MeasurandPowerActiveImport:
+				if sample.Unit == "kW" {
+					val *= 1000
+				}
+				havePower = true
+				switch {
+				case powerTotal:
+				case sample.Phase == "":
+					power, powerTotal = val, true
+				default:
+					power += val
+				}
+			case MeasurandCurrentImport:
+				if !haveImport || val > currentImport {
+					currentImport, haveImport = val, true
+				}
+			case MeasurandCurrentOffered:
+				if !haveOffered || val > currentOffered {
+					currentOffered, haveOffered = val, true
+				}
+			}
+		}
+	}
+	if havePower {
+		w.power = power
+	}
+	if haveImport {
+		w.currentImport = currentImport
+	}
+	if haveOffered {
+		w.currentOffered = currentOffered
+		w.offeredReported = true
+	}
+	w.notifyState()
+}
+
+// configureChargePoint asks the charge point to send the meter values we
+// need, at the configured interval.
+func (w *Worker) configureChargePoint(conn *connection) {
+	settings := []ChangeConfigurationRequest{
+		{Key: "MeterValueSampleInterval", Value: fmt.Sprintf("%d", w.cfg.OCPP.MeterValueInterval)},
+		{Key: "MeterValuesSampledData", Value: strings.Join([]string{
+			MeasurandPowerActiveImport, MeasurandCurrentImport, MeasurandCurrentOffered,
+		}, ",")},
+	}
+	for _, setting := range settings {
+		var resp StatusResponse
+		if err := conn.call("ChangeConfiguration", setting, &resp); err != nil {
+			log.Warningf("failed to set %s on %s: %q", setting.Key, conn.id, err)
+			continue
+		}
+		if resp.Status != StatusAccepted && resp.Status != "RebootRequired" {
+			log.Warningf("charge point %s did not accept %s: %s", conn.id, setting.Key, resp.Status)
+		}
+	}
+}
+
+func (w *Worker) shutdown() {
+	w.mux.Lock()
+	if w.conn != nil {
+		w.conn.ws.Close()
+	}
+	w.mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.srv.Shutdown(ctx); err != nil {
+		log.Errorf("failed to shut down ocpp server: %q", err)
+	}
+}
+
+func (w *Worker) loop() {
+	defer func() {
+		w.shutdown()
+		close(w.closed)
+	}()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		case <-w.stateUpdated:
+			if err := w.sendLocalState(); err != nil {
+				log.Errorf("failed to send state: %q", err)
+			}
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	listener, err := net.Listen("tcp", w.cfg.OCPP.ListenAddress)
+	if err != nil {
+		return errors.Wrap(err, "starting ocpp central system")
+	}
+	w.srv = &http.Server{
+		Handler: http.HandlerFunc(w.handleConnection),
+	}
+	log.Infof("ocpp central system listening on %s", listener.Addr())
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && w.cfg.OCPP.Password == "" && !addr.IP.IsLoopback() {
+		log.Warningf("ocpp on %s has no password set; anyone able to reach it can pose as %s", addr, w.cfg.OCPP.ChargePointID)
+	}
+	go func() {
+		if err := w.srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("ocpp server failed: %q", err)
+		}
+	}()
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
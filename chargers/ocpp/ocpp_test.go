@@ -0,0 +1,101 @@
+package ocpp_test
+
+import (
+	"testing"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/chargers/ocpp"
+	"solar-ev-charger/chargers/ocpp/simulator"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// startCentralSystem starts a worker for a charge point identified as
+// wallbox, and returns the URL charge points connect to, the client
+// controlling the charge point and the channel receiving its state.
+func startCentralSystem(t *testing.T) (string, common.Client, chan params.ChargerState) {
+	t.Helper()
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		OCPP: config.OCPPCharger{
+			ListenAddress:      commontest.FreeAddress(t),
+			ChargePointID:      "wallbox",
+			Password:           "secret",
+			MeterValueInterval: 1,
+		},
+	}
+	_, cli, stateChan := commontest.StartWorker(t, ocpp.NewWorker, cfg)
+	return "ws://" + cfg.OCPP.ListenAddress, cli, stateChan
+}
+
+func TestChargingSession(t *testing.T) {
+	url, cli, stateChan := startCentralSystem(t)
+
+	cp := simulator.New(url, "wallbox", "secret")
+	if err := cp.Connect(); err != nil {
+		t.Fatalf("connecting charge point: %v", err)
+	}
+	defer cp.Close()
+	commontest.WaitForState(t, stateChan, "available connector", func(state params.ChargerState) bool {
+		return state.Vehicle == params.VehicleDisconnected
+	})
+
+	if err := cp.PlugIn(); err != nil {
+		t.Fatalf("plugging in: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "plugged in vehicle", func(state params.ChargerState) bool {
+		return state.Vehicle == params.VehicleConnected && !state.Active
+	})
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "transaction", func(state params.ChargerState) bool {
+		return state.Active && state.Vehicle == params.VehicleCharging
+	})
+	if cp.TransactionID() == 0 {
+		t.Errorf("expected the charge point to have a transaction")
+	}
+
+	// The limit is reported from the Current.Offered meter value.
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if cp.Limit() != 10 {
+		t.Errorf("expected a limit of 10 A on the charge point, got %v", cp.Limit())
+	}
+	commontest.WaitForState(t, stateChan, "new current", func(state params.ChargerState) bool {
+		return state.CurrentAmpSetting == 10 && state.CurrentUsage == 10*230
+	})
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "stopped transaction", func(state params.ChargerState) bool {
+		return !state.Active && state.CurrentUsage == 0
+	})
+	if cp.TransactionID() != 0 {
+		t.Errorf("expected the transaction to be stopped")
+	}
+}
+
+func TestRejectsUnknownChargePoints(t *testing.T) {
+	url, _, _ := startCentralSystem(t)
+
+	tests := []struct {
+		id       string
+		password string
+	}{
+		{"other", "secret"},
+		{"wallbox", "wrong"},
+		{"wallbox", ""},
+	}
+	for _, tc := range tests {
+		cp := simulator.New(url, tc.id, tc.password)
+		if err := cp.Connect(); err == nil {
+			t.Errorf("%s/%s: expected the connection to be rejected", tc.id, tc.password)
+		}
+		cp.Close()
+	}
+}
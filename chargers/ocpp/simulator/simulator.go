@@ -0,0 +1,409 @@
+// Package simulator implements a simulated OCPP 1.6J charge point. It is
+// meant to be used in tests, and when developing against the OCPP central
+// system without access to a real charging station.
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/ocpp"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// connectorID is the only connector of the simulated charge point.
+	connectorID = 1
+	// maxCurrent is the current the simulated vehicle draws, if allowed.
+	maxCurrent = 16
+	// voltage is the voltage of the simulated single phase supply.
+	voltage = 230
+	// callTimeout is the amount of time we wait for the central system.
+	callTimeout = 10 * time.Second
+)
+
+// New returns a new simulated charge point with the given identity. URL is
+// the address of the central system, without the charge point identity.
+// If password is not empty, basic auth is used to connect.
+func New(url, id, password string) *ChargePoint {
+	return &ChargePoint{
+		url:           url,
+		id:            id,
+		password:      password,
+		limit:         maxCurrent,
+		meterInterval: 10 * time.Second,
+		pending:       map[string]chan ocpp.Message{},
+		done:          make(chan struct{}),
+	}
+}
+
+type ChargePoint struct {
+	url      string
+	id       string
+	password string
+
+	ws       *websocket.Conn
+	writeMux sync.Mutex
+	msgID    uint64
+	pending  map[string]chan ocpp.Message
+	done     chan struct{}
+
+	mux           sync.Mutex
+	pluggedIn     bool
+	status        string
+	transactionID int
+	limit         float64
+	meterInterval time.Duration
+	meterWh       float64
+}
+
+// Connect connects to the central system and boots the charge point.
+func (c *ChargePoint) Connect() error {
+	header := http.Header{}
+	if c.password != "" {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		req.SetBasicAuth(c.id, c.password)
+		header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{ocpp.Subprotocol},
+		HandshakeTimeout: callTimeout,
+	}
+	ws, _, err := dialer.Dial(c.url+"/"+c.id, header)
+	if err != nil {
+		return errors.Wrap(err, "connecting to central system")
+	}
+	c.ws = ws
+	go c.readLoop()
+
+	var resp ocpp.BootNotificationResponse
+	boot := ocpp.BootNotificationRequest{
+		ChargePointVendor: "solar-ev-charger",
+		ChargePointModel:  "simulator",
+	}
+	if err := c.call("BootNotification", boot, &resp); err != nil {
+		return err
+	}
+	if resp.Status != ocpp.StatusAccepted {
+		return fmt.Errorf("boot notification %s", resp.Status)
+	}
+	if err := c.setStatus(ocpp.ConnectorAvailable); err != nil {
+		return err
+	}
+	go c.meterLoop()
+	return nil
+}
+
+// Close disconnects from the central system.
+func (c *ChargePoint) Close() error {
+	close(c.done)
+	if c.ws == nil {
+		return nil
+	}
+	return c.ws.Close()
+}
+
+// PlugIn simulates plugging in a vehicle.
+func (c *ChargePoint) PlugIn() error {
+	c.mux.Lock()
+	c.pluggedIn = true
+	c.mux.Unlock()
+	return c.setStatus(ocpp.ConnectorPreparing)
+}
+
+// Unplug simulates unplugging the vehicle, which ends the transaction.
+func (c *ChargePoint) Unplug() error {
+	c.mux.Lock()
+	c.pluggedIn = false
+	c.mux.Unlock()
+	if err := c.stopTransaction("EVDisconnected"); err != nil {
+		return err
+	}
+	return c.setStatus(ocpp.ConnectorAvailable)
+}
+
+// Limit returns the current limit set through charging profiles.
+func (c *ChargePoint) Limit() float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.limit
+}
+
+// TransactionID returns the ID of the active transaction, or zero.
+func (c *ChargePoint) TransactionID() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.transactionID
+}
+
+// Status returns the status of the connector.
+func (c *ChargePoint) Status() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.status
+}
+
+func (c *ChargePoint) write(data []byte) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *ChargePoint) call(action string, req, resp interface{}) error {
+	c.writeMux.Lock()
+	c.msgID++
+	id := strconv.FormatUint(c.msgID, 10)
+	c.writeMux.Unlock()
+
+	data, err := ocpp.NewCall(id, action, req)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s", action)
+	}
+	result := make(chan ocpp.Message, 1)
+	c.mux.Lock()
+	c.pending[id] = result
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		delete(c.pending, id)
+		c.mux.Unlock()
+	}()
+
+	if err := c.write(data); err != nil {
+		return errors.Wrapf(err, "sending %s", action)
+	}
+	select {
+	case msg := <-result:
+		if msg.Type == ocpp.MessageTypeCallError {
+			return fmt.Errorf("%s failed: %s", action, msg.ErrorCode)
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Payload, resp)
+	case <-time.After(callTimeout):
+		return fmt.Errorf("timed out waiting for %s response", action)
+	}
+}
+
+func (c *ChargePoint) setStatus(status string) error {
+	c.mux.Lock()
+	c.status = status
+	c.mux.Unlock()
+	req := ocpp.StatusNotificationRequest{
+		ConnectorID: connectorID,
+		ErrorCode:   "NoError",
+		Status:      status,
+	}
+	return c.call("StatusNotification", req, nil)
+}
+
+func (c *ChargePoint) startTransaction(idTag string) error {
+	c.mux.Lock()
+	meterStart := int(c.meterWh)
+	c.mux.Unlock()
+
+	req := ocpp.StartTransactionRequest{
+		ConnectorID: connectorID,
+		IDTag:       idTag,
+		MeterStart:  meterStart,
+		Timestamp:   ocpp.Time{Time: time.Now()},
+	}
+	var resp ocpp.StartTransactionResponse
+	if err := c.call("StartTransaction", req, &resp); err != nil {
+		return err
+	}
+	c.mux.Lock()
+	c.transactionID = resp.TransactionID
+	c.mux.Unlock()
+	return c.setStatus(ocpp.ConnectorCharging)
+}
+
+func (c *ChargePoint) stopTransaction(reason string) error {
+	c.mux.Lock()
+	txID := c.transactionID
+	meterStop := int(c.meterWh)
+	c.transactionID = 0
+	c.mux.Unlock()
+	if txID == 0 {
+		return nil
+	}
+
+	req := ocpp.StopTransactionRequest{
+		TransactionID: txID,
+		MeterStop:     meterStop,
+		Timestamp:     ocpp.Time{Time: time.Now()},
+		Reason:        reason,
+	}
+	return c.call("StopTransaction", req, nil)
+}
+
+// current returns the current drawn by the simulated vehicle.
+func (c *ChargePoint) current() float64 {
+	if c.transactionID == 0 {
+		return 0
+	}
+	if c.limit < maxCurrent {
+		return c.limit
+	}
+	return maxCurrent
+}
+
+func (c *ChargePoint) sendMeterValues() error {
+	c.mux.Lock()
+	current := c.current()
+	limit := c.limit
+	c.meterWh += current * voltage * c.meterInterval.Hours()
+	req := ocpp.MeterValuesRequest{
+		ConnectorID: connectorID,
+		MeterValue: []ocpp.MeterValue{
+			{
+				Timestamp: ocpp.Time{Time: time.Now()},
+				SampledValue: []ocpp.SampledValue{
+					{Measurand: ocpp.MeasurandPowerActiveImport, Value: fmt.Sprintf("%.1f", current*voltage), Unit: "W"},
+					{Measurand: ocpp.MeasurandCurrentImport, Value: fmt.Sprintf("%.1f", current), Unit: "A", Phase: "L1"},
+					{Measurand: ocpp.MeasurandCurrentOffered, Value: fmt.Sprintf("%.1f", limit), Unit: "A"},
+					{Measurand: ocpp.MeasurandEnergyRegister, Value: fmt.Sprintf("%.0f", c.meterWh), Unit: "Wh"},
+				},
+			},
+		},
+	}
+	if c.transactionID != 0 {
+		txID := c.transactionID
+		req.TransactionID = &txID
+	}
+	c.mux.Unlock()
+	return c.call("MeterValues", req, nil)
+}
+
+func (c *ChargePoint) meterLoop() {
+	for {
+		c.mux.Lock()
+		interval := c.meterInterval
+		c.mux.Unlock()
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(interval):
+			if err := c.sendMeterValues(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *ChargePoint) readLoop() {
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := ocpp.ParseMessage(data)
+		if err != nil {
+			continue
+		}
+
+		if msg.Type != ocpp.MessageTypeCall {
+			c.mux.Lock()
+			if result, ok := c.pending[msg.ID]; ok {
+				result <- msg
+			}
+			c.mux.Unlock()
+			continue
+		}
+
+		var reply []byte
+		resp, after, err := c.handleCall(msg)
+		if err != nil {
+			reply, _ = ocpp.NewCallError(msg.ID, "NotImplemented", err.Error())
+		} else {
+			reply, _ = ocpp.NewCallResult(msg.ID, resp)
+		}
+		if err := c.write(reply); err != nil {
+			return
+		}
+		if after != nil {
+			go after()
+		}
+	}
+}
+
+// handleCall handles calls from the central system. The returned function,
+// if not nil, is run after the response is sent.
+func (c *ChargePoint) handleCall(msg ocpp.Message) (interface{}, func(), error) {
+	accepted := ocpp.StatusResponse{Status: ocpp.StatusAccepted}
+	rejected := ocpp.StatusResponse{Status: ocpp.StatusRejected}
+
+	switch msg.Action {
+	case "RemoteStartTransaction":
+		var req ocpp.RemoteStartTransactionRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, nil, err
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if !c.pluggedIn || c.transactionID != 0 {
+			return rejected, nil, nil
+		}
+		return accepted, func() { c.startTransaction(req.IDTag) }, nil
+	case "RemoteStopTransaction":
+		var req ocpp.RemoteStopTransactionRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, nil, err
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if req.TransactionID == 0 || req.TransactionID != c.transactionID {
+			return rejected, nil, nil
+		}
+		return accepted, func() {
+			if err := c.stopTransaction("Remote"); err == nil {
+				c.setStatus(ocpp.ConnectorFinishing)
+			}
+		}, nil
+	case "SetChargingProfile":
+		var req ocpp.SetChargingProfileRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, nil, err
+		}
+		profile := req.CSChargingProfiles
+		periods := profile.ChargingSchedule.ChargingSchedulePeriod
+		if profile.ChargingSchedule.ChargingRateUnit != "A" || len(periods) == 0 {
+			return rejected, nil, nil
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if profile.ChargingProfilePurpose == "TxProfile" && profile.TransactionID != c.transactionID {
+			return rejected, nil, nil
+		}
+		c.limit = periods[0].Limit
+		return accepted, nil, nil
+	case "ChangeConfiguration":
+		var req ocpp.ChangeConfigurationRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return nil, nil, err
+		}
+		switch req.Key {
+		case "MeterValueSampleInterval":
+			seconds, err := strconv.Atoi(req.Value)
+			if err != nil || seconds <= 0 {
+				return rejected, nil, nil
+			}
+			c.mux.Lock()
+			c.meterInterval = time.Duration(seconds) * time.Second
+			c.mux.Unlock()
+			return accepted, nil, nil
+		case "MeterValuesSampledData":
+			return accepted, nil, nil
+		}
+		return ocpp.StatusResponse{Status: "NotSupported"}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("%s is not supported", msg.Action)
+}
@@ -1,42 +1,61 @@
 package client
 
 import (
-	b64 "encoding/base64"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 
 	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/httpclient"
 
 	"github.com/pkg/errors"
 )
 
-func NewChargerClient(addr, username, password string) common.Client {
-	return &OpenEVSEClient{
-		addr:     addr,
-		username: username,
-		password: password,
-		cli:      &http.Client{},
-	}
+func NewChargerClient(addr, username, password string, cli *httpclient.Client) common.Client {
+	return NewOpenEVSEClient(addr, username, password, cli)
+}
+
+// NewOpenEVSEClient returns a client that sends RAPI commands through the
+// HTTP API of the OpenEVSE WiFi module.
+func NewOpenEVSEClient(addr, username, password string, cli *httpclient.Client) *OpenEVSEClient {
+	return NewRAPIClient(NewHTTPTransport(addr, username, password, cli))
 }
 
-func NewOpenEVSEClient(addr, username, password string) *OpenEVSEClient {
+// NewRAPIClient returns a client that sends RAPI commands over transport.
+func NewRAPIClient(transport Transport) *OpenEVSEClient {
 	return &OpenEVSEClient{
-		addr:     addr,
-		username: username,
-		password: password,
-		cli:      &http.Client{},
+		transport: transport,
 	}
 }
 
 type OpenEVSEClient struct {
-	addr     string
-	username string
-	password string
-	cli      *http.Client
+	transport Transport
+
+	// eepromCurrentWrites makes SetAmp persist the current to EEPROM, for
+	// firmware that does not support volatile writes.
+	eepromCurrentWrites bool
+
+	mux sync.Mutex
+	// eepromWrites counts the number of writes to EEPROM we triggered.
+	eepromWrites uint64
+}
+
+// SetEEPROMCurrentWrites makes SetAmp persist the current to EEPROM. This
+// wears the flash of the controller and should only be enabled for old
+// firmware that does not support volatile current changes.
+func (h *OpenEVSEClient) SetEEPROMCurrentWrites(enabled bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.eepromCurrentWrites = enabled
+}
+
+// EEPROMWrites returns the number of EEPROM writes this client triggered.
+func (h *OpenEVSEClient) EEPROMWrites() uint64 {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.eepromWrites
 }
 
 type RapiResponse struct {
@@ -70,104 +89,109 @@ type GetStateResponse struct {
 	VFlags     uint64
 }
 
-func (h *OpenEVSEClient) authHeaders() string {
-	creds := fmt.Sprintf("%s:%s", h.username, h.password)
-	encoded := b64.StdEncoding.EncodeToString([]byte(creds))
-	header := fmt.Sprintf("Basic %s", encoded)
-	return header
-}
-
-func (h *OpenEVSEClient) url(cmd string) string {
-	encoded := url.QueryEscape(cmd)
-	return fmt.Sprintf("http://%s/r?json=1&rapi=%s", h.addr, encoded)
-}
-
-func (h *OpenEVSEClient) doGet(setting string) (RapiResponse, error) {
-	req, err := http.NewRequest("GET", h.url(setting), nil)
+// command sends cmd over the transport, validates the response and returns
+// it without the checksum and sequence ID.
+func (h *OpenEVSEClient) command(cmd string) (string, error) {
+	ret, err := h.transport.Send(cmd)
 	if err != nil {
-		return RapiResponse{}, err
+		return "", errors.Wrap(err, "sending command")
 	}
-	req.Header.Set("Authorization", h.authHeaders())
+	ret = TrimResponse(ret)
 
-	resp, err := h.cli.Do(req)
-	if err != nil {
-		return RapiResponse{}, errors.Wrap(err, "sending request")
+	if strings.HasPrefix(ret, "$NK") {
+		return "", fmt.Errorf("got error response from RAPI: %q", ret)
 	}
-	defer resp.Body.Close()
 
-	var ret RapiResponse
-	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
-		return RapiResponse{}, errors.Wrap(err, "unmarshaling response")
+	if !strings.HasPrefix(ret, "$OK") {
+		return "", fmt.Errorf("unexpected response from RAPI: %q", ret)
 	}
-
 	return ret, nil
 }
 
-func (h *OpenEVSEClient) validateRAPIResponse(resp RapiResponse) error {
-	if resp.Error != "" {
-		return fmt.Errorf("error starting evse: %q", resp.Error)
+// TrimResponse removes the checksum and sequence ID from a RAPI response.
+func TrimResponse(ret string) string {
+	ret = strings.TrimSpace(ret)
+	if idx := strings.IndexAny(ret, "^*"); idx >= 0 {
+		ret = ret[:idx]
 	}
-
-	if strings.HasPrefix(resp.Ret, "$NK") {
-		return fmt.Errorf("got error response from RAPI: %q", resp.Ret)
+	if idx := strings.Index(ret, " :"); idx >= 0 {
+		ret = ret[:idx]
 	}
-
-	return nil
+	return strings.TrimSpace(ret)
 }
 
 func (h *OpenEVSEClient) Start() error {
-	response, err := h.doGet("$FE")
-	if err != nil {
+	if _, err := h.command("$FE"); err != nil {
 		return errors.Wrap(err, "starting evse")
 	}
-
-	if err := h.validateRAPIResponse(response); err != nil {
-		return errors.Wrap(err, "validating response")
-	}
 	return nil
 }
 
 func (h *OpenEVSEClient) Stop() error {
-	response, err := h.doGet("$FS")
-	if err != nil {
-		return errors.Wrap(err, "starting evse")
-	}
-
-	if err := h.validateRAPIResponse(response); err != nil {
-		return errors.Wrap(err, "validating response")
+	if _, err := h.command("$FS"); err != nil {
+		return errors.Wrap(err, "stopping evse")
 	}
 	return nil
 }
 
-func (h *OpenEVSEClient) SetAmp(amp uint64) error {
-	response, err := h.doGet(fmt.Sprintf("$SC %d", amp))
-	if err != nil {
-		return errors.Wrap(err, "starting evse")
+// SetAmp sets the active current. The value is not saved to EEPROM, and
+// will revert to the persisted value when the controller restarts.
+func (h *OpenEVSEClient) SetAmp(newVal float64) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	amp := uint64(math.Round(newVal))
+	if h.eepromCurrentWrites {
+		return h.persistAmp(amp)
 	}
 
-	if err := h.validateRAPIResponse(response); err != nil {
-		return errors.Wrap(err, "validating response")
+	// The V flag sets the value without committing it to EEPROM.
+	if _, err := h.command(fmt.Sprintf("$SC %d V", amp)); err != nil {
+		return errors.Wrap(err, "setting current")
 	}
+	return nil
+}
+
+// PersistAmp sets the current and saves it to EEPROM. Use sparingly.
+func (h *OpenEVSEClient) PersistAmp(amp uint64) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.persistAmp(amp)
+}
 
-	if response.Ret == "" || !strings.HasPrefix(response.Ret, "$OK") {
-		return fmt.Errorf("error response from RAPI: %s", response.Ret)
+func (h *OpenEVSEClient) persistAmp(amp uint64) error {
+	if _, err := h.command(fmt.Sprintf("$SC %d", amp)); err != nil {
+		return errors.Wrap(err, "persisting current")
 	}
+	h.eepromWrites++
 	return nil
 }
 
+// Capabilities returns the current limits of the controller, as reported
+// by $GC. The EVSE accepts whole Amps only.
+func (h *OpenEVSEClient) Capabilities() (common.Capabilities, error) {
+	info, err := h.GetCurrentCapacityInfo()
+	if err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "fetching capabilities")
+	}
+	return common.Capabilities{
+		MinCurrent:    float64(info.MinAmps),
+		MaxCurrent:    float64(info.MaxAmps),
+		CurrentStep:   1,
+		Toggle:        true,
+		PlugDetection: true,
+	}, nil
+}
+
 func (h *OpenEVSEClient) GetCurrentCapacityInfo() (CurrentCapacityInfo, error) {
-	response, err := h.doGet("$GC")
+	response, err := h.command("$GC")
 	if err != nil {
 		return CurrentCapacityInfo{}, errors.Wrap(err, "fetching current capacity info")
 	}
 
-	if err := h.validateRAPIResponse(response); err != nil {
-		return CurrentCapacityInfo{}, errors.Wrap(err, "validating response")
-	}
-
-	values := strings.Split(response.Ret, " ")
+	values := strings.Split(response, " ")
 	if len(values) != 5 {
-		return CurrentCapacityInfo{}, fmt.Errorf("unexpected response: %s", response.Ret)
+		return CurrentCapacityInfo{}, fmt.Errorf("unexpected response: %s", response)
 	}
 
 	minAmps, err := strconv.ParseUint(values[1], 10, 64)
@@ -185,7 +209,7 @@ func (h *OpenEVSEClient) GetCurrentCapacityInfo() (CurrentCapacityInfo, error) {
 		return CurrentCapacityInfo{}, errors.Wrap(err, "parsing pilot amps")
 	}
 
-	currentMaxAmps, err := strconv.ParseUint(strings.Split(values[4], "^")[0], 10, 64)
+	currentMaxAmps, err := strconv.ParseUint(values[4], 10, 64)
 	if err != nil {
 		return CurrentCapacityInfo{}, errors.Wrap(err, "parsing currentMaxAmps amps")
 	}
@@ -199,18 +223,14 @@ func (h *OpenEVSEClient) GetCurrentCapacityInfo() (CurrentCapacityInfo, error) {
 }
 
 func (h *OpenEVSEClient) GetChargeCurrentAndVoltage() (uint64, uint64, error) {
-	response, err := h.doGet("$GG")
+	response, err := h.command("$GG")
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "fetching charge current and voltage")
 	}
 
-	if err := h.validateRAPIResponse(response); err != nil {
-		return 0, 0, errors.Wrap(err, "validating response")
-	}
-
-	values := strings.Split(response.Ret, " ")
+	values := strings.Split(response, " ")
 	if len(values) != 3 {
-		return 0, 0, fmt.Errorf("unexpected response: %s", response.Ret)
+		return 0, 0, fmt.Errorf("unexpected response: %s", response)
 	}
 
 	milliAmps, err := strconv.ParseUint(values[1], 10, 64)
@@ -218,7 +238,7 @@ func (h *OpenEVSEClient) GetChargeCurrentAndVoltage() (uint64, uint64, error) {
 		return 0, 0, errors.Wrap(err, "parsing milliAmps")
 	}
 
-	milliVolts, err := strconv.ParseUint(strings.Split(values[2], "^")[0], 10, 64)
+	milliVolts, err := strconv.ParseUint(values[2], 10, 64)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "parsing milliVolts")
 	}
@@ -227,18 +247,14 @@ func (h *OpenEVSEClient) GetChargeCurrentAndVoltage() (uint64, uint64, error) {
 }
 
 func (h *OpenEVSEClient) GetState() (GetStateResponse, error) {
-	response, err := h.doGet("$GS")
+	response, err := h.command("$GS")
 	if err != nil {
-		return GetStateResponse{}, errors.Wrap(err, "starting evse")
-	}
-
-	if err := h.validateRAPIResponse(response); err != nil {
-		return GetStateResponse{}, errors.Wrap(err, "validating response")
+		return GetStateResponse{}, errors.Wrap(err, "fetching state")
 	}
 
-	values := strings.Split(response.Ret, " ")
+	values := strings.Split(response, " ")
 	if len(values) != 5 {
-		return GetStateResponse{}, fmt.Errorf("unexpected response: %s", response.Ret)
+		return GetStateResponse{}, fmt.Errorf("unexpected response: %s", response)
 	}
 
 	state, err := strconv.ParseUint(values[1], 16, 64)
@@ -256,7 +272,7 @@ func (h *OpenEVSEClient) GetState() (GetStateResponse, error) {
 		return GetStateResponse{}, errors.Wrap(err, "parsing pilotState")
 	}
 
-	vflags, err := strconv.ParseUint(strings.Split(values[4], "^")[0], 10, 64)
+	vflags, err := strconv.ParseUint(values[4], 10, 64)
 	if err != nil {
 		return GetStateResponse{}, errors.Wrap(err, "parsing vflags")
 	}
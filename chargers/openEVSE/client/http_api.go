@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/httpclient"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ClaimStateActive allows the EVSE to charge.
+	ClaimStateActive = "active"
+	// ClaimStateDisabled prevents the EVSE from charging.
+	ClaimStateDisabled = "disabled"
+
+	// DefaultClaimClientID is the client ID we use for our claim, unless
+	// one is configured.
+	DefaultClaimClientID uint32 = 0x00020001
+	// DefaultClaimPriority is lower than the priority of manual overrides
+	// (1000) set from the OpenEVSE UI or app, and higher than the priority
+	// of the built in timer and divert modes.
+	DefaultClaimPriority uint = 500
+)
+
+// Claim holds the properties of an EVSE claim. Claims are the mechanism
+// the OpenEVSE WiFi firmware (v4+) uses to arbitrate between the different
+// services that want to control the EVSE (manual override, scheduler,
+// divert, external clients). The claim with the highest priority wins.
+// See: https://openevse.stoplight.io/docs/openevse-wifi-v4/
+type Claim struct {
+	State         string `json:"state,omitempty"`
+	ChargeCurrent uint64 `json:"charge_current,omitempty"`
+	Priority      uint   `json:"priority,omitempty"`
+	AutoRelease   bool   `json:"auto_release"`
+}
+
+// Status holds the subset of the /status response we care about.
+type Status struct {
+	// Amp is the current drawn by the vehicle, in milliamps.
+	Amp float64 `json:"amp"`
+	// Voltage is the voltage reported by the EVSE, in Volts.
+	Voltage float64 `json:"voltage"`
+	// Pilot is the current advertised to the vehicle, in Amps.
+	Pilot uint64 `json:"pilot"`
+	// State is the EVSE state, as reported by RAPI $GS.
+	State uint64 `json:"state"`
+	// Vehicle is 1 if a vehicle is connected.
+	Vehicle int `json:"vehicle"`
+	// Status is "active" or "disabled".
+	Status string `json:"status"`
+	// ManualOverride is 1 if a manual override is in effect.
+	ManualOverride int `json:"manual_override"`
+	// SessionEnergy is the energy delivered in this session, in Wh.
+	SessionEnergy float64 `json:"session_energy"`
+}
+
+// Config holds the subset of the /config response we care about.
+type Config struct {
+	MinCurrentHard uint64 `json:"min_current_hard"`
+	MaxCurrentHard uint64 `json:"max_current_hard"`
+	MaxCurrentSoft uint64 `json:"max_current_soft"`
+	Firmware       string `json:"firmware"`
+	Version        string `json:"version"`
+	// DivertEnabled is true if the built in solar divert (eco mode) is enabled.
+	DivertEnabled bool `json:"divert_enabled"`
+}
+
+// DivertInputs holds the readings the built in solar divert uses to decide
+// the charge current. Only one of them needs to be set.
+type DivertInputs struct {
+	// Solar is the solar production in Watts.
+	Solar *float64 `json:"solar,omitempty"`
+	// GridIE is the grid import (positive) or export (negative) in Watts.
+	GridIE *float64 `json:"grid_ie,omitempty"`
+}
+
+// NewHTTPAPIClient returns a client that controls the EVSE through the REST
+// API of the OpenEVSE WiFi firmware, using a claim identified by clientID.
+func NewHTTPAPIClient(addr, username, password string, clientID uint32, priority uint, cli *httpclient.Client) *HTTPAPIClient {
+	if clientID == 0 {
+		clientID = DefaultClaimClientID
+	}
+	if priority == 0 {
+		priority = DefaultClaimPriority
+	}
+	return &HTTPAPIClient{
+		addr:     addr,
+		username: username,
+		password: password,
+		clientID: clientID,
+		claim: Claim{
+			Priority: priority,
+		},
+		cli: cli,
+	}
+}
+
+type HTTPAPIClient struct {
+	addr     string
+	username string
+	password string
+	clientID uint32
+	cli      *httpclient.Client
+
+	// claim is the last claim we made. Start, Stop and SetAmp each update
+	// one property of the claim, but the whole claim is sent every time.
+	claim Claim
+	mux   sync.Mutex
+}
+
+func (h *HTTPAPIClient) do(method, path string, body interface{}, target interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		asJs, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "encoding request body")
+		}
+		reqBody = bytes.NewReader(asJs)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", h.addr, path), reqBody)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	resp, err := h.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	if target != nil {
+		return resp.DecodeJSON(target)
+	}
+	return nil
+}
+
+func (h *HTTPAPIClient) claimPath() string {
+	return fmt.Sprintf("/claims/%d", h.clientID)
+}
+
+// GetStatus returns the status of the EVSE.
+func (h *HTTPAPIClient) GetStatus() (Status, error) {
+	var status Status
+	if err := h.do(http.MethodGet, "/status", nil, &status); err != nil {
+		return Status{}, errors.Wrap(err, "fetching status")
+	}
+	return status, nil
+}
+
+// GetConfig returns the configuration of the EVSE.
+func (h *HTTPAPIClient) GetConfig() (Config, error) {
+	var cfg Config
+	if err := h.do(http.MethodGet, "/config", nil, &cfg); err != nil {
+		return Config{}, errors.Wrap(err, "fetching config")
+	}
+	return cfg, nil
+}
+
+// SetDivertInputs feeds solar production or grid import/export readings to
+// the built in solar divert.
+func (h *HTTPAPIClient) SetDivertInputs(inputs DivertInputs) error {
+	if err := h.do(http.MethodPost, "/status", inputs, nil); err != nil {
+		return errors.Wrap(err, "setting divert inputs")
+	}
+	return nil
+}
+
+// GetOverride returns the manual override currently in effect, if any.
+func (h *HTTPAPIClient) GetOverride() (Claim, bool, error) {
+	var override Claim
+	if err := h.do(http.MethodGet, "/override", nil, &override); err != nil {
+		if httpclient.IsStatus(err, http.StatusNotFound) {
+			return Claim{}, false, nil
+		}
+		return Claim{}, false, errors.Wrap(err, "fetching override")
+	}
+	return override, override.State != "" || override.ChargeCurrent != 0, nil
+}
+
+// GetClaim returns our claim, as seen by the EVSE.
+func (h *HTTPAPIClient) GetClaim() (Claim, bool, error) {
+	var claim Claim
+	if err := h.do(http.MethodGet, h.claimPath(), nil, &claim); err != nil {
+		if httpclient.IsStatus(err, http.StatusNotFound) {
+			return Claim{}, false, nil
+		}
+		return Claim{}, false, errors.Wrap(err, "fetching claim")
+	}
+	return claim, true, nil
+}
+
+// ReleaseClaim removes our claim, handing control back to the EVSE.
+func (h *HTTPAPIClient) ReleaseClaim() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	err := h.do(http.MethodDelete, h.claimPath(), nil, nil)
+	if err != nil && !httpclient.IsStatus(err, http.StatusNotFound) {
+		return errors.Wrap(err, "releasing claim")
+	}
+	h.claim.State = ""
+	h.claim.ChargeCurrent = 0
+	return nil
+}
+
+func (h *HTTPAPIClient) updateClaim(update func(claim *Claim)) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	claim := h.claim
+	update(&claim)
+	if err := h.do(http.MethodPost, h.claimPath(), claim, nil); err != nil {
+		return errors.Wrap(err, "updating claim")
+	}
+	h.claim = claim
+	return nil
+}
+
+func (h *HTTPAPIClient) Start() error {
+	return h.updateClaim(func(claim *Claim) {
+		claim.State = ClaimStateActive
+	})
+}
+
+func (h *HTTPAPIClient) Stop() error {
+	return h.updateClaim(func(claim *Claim) {
+		claim.State = ClaimStateDisabled
+	})
+}
+
+func (h *HTTPAPIClient) SetAmp(amp float64) error {
+	return h.updateClaim(func(claim *Claim) {
+		claim.ChargeCurrent = uint64(math.Round(amp))
+	})
+}
+
+// Capabilities returns the hardware current limits from /config. The
+// firmware reports the energy delivered in the current session.
+func (h *HTTPAPIClient) Capabilities() (common.Capabilities, error) {
+	cfg, err := h.GetConfig()
+	if err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "fetching capabilities")
+	}
+	return common.Capabilities{
+		MinCurrent:    float64(cfg.MinCurrentHard),
+		MaxCurrent:    float64(cfg.MaxCurrentHard),
+		CurrentStep:   1,
+		Toggle:        true,
+		SessionEnergy: true,
+		PlugDetection: true,
+	}, nil
+}
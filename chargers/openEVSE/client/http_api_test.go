@@ -0,0 +1,119 @@
+package client_test
+
+import (
+	"testing"
+
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/chargers/openEVSE/fake"
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+)
+
+func newHTTPAPIClient(srv *fake.Server, password string) *client.HTTPAPIClient {
+	cli := httpclient.New("OpenEVSE test", config.HTTPClientSettings{})
+	return client.NewHTTPAPIClient(srv.Addr(), "admin", password, 0, 0, cli)
+}
+
+func TestClaimRoundTrip(t *testing.T) {
+	srv := fake.NewServer("admin", "secret")
+	defer srv.Close()
+	cli := newHTTPAPIClient(srv, "secret")
+
+	if _, ok, err := cli.GetClaim(); err != nil || ok {
+		t.Fatalf("expected no claim, got %v, %v", ok, err)
+	}
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	if err := cli.SetAmp(9.6); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+
+	// Each call sends the whole claim, so setting the current keeps the
+	// state set before.
+	expected := client.Claim{
+		State:         client.ClaimStateDisabled,
+		ChargeCurrent: 10,
+		Priority:      client.DefaultClaimPriority,
+	}
+	if got := srv.Claims()[client.DefaultClaimClientID]; got != expected {
+		t.Errorf("expected claim %+v on the station, got %+v", expected, got)
+	}
+	claim, ok, err := cli.GetClaim()
+	if err != nil || !ok {
+		t.Fatalf("fetching claim: %v, %v", ok, err)
+	}
+	if claim != expected {
+		t.Errorf("expected claim %+v, got %+v", expected, claim)
+	}
+	if state, current := srv.Target(); state != client.ClaimStateDisabled || current != 10 {
+		t.Errorf("expected target disabled at 10 A, got %s at %d A", state, current)
+	}
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if state, current := srv.Target(); state != client.ClaimStateActive || current != 10 {
+		t.Errorf("expected target active at 10 A, got %s at %d A", state, current)
+	}
+
+	// A manual override takes precedence over our claim.
+	srv.SetOverride(&client.Claim{ChargeCurrent: 20})
+	override, ok, err := cli.GetOverride()
+	if err != nil || !ok || override.ChargeCurrent != 20 {
+		t.Errorf("expected override of 20 A, got %+v, %v, %v", override, ok, err)
+	}
+	if _, current := srv.Target(); current != 20 {
+		t.Errorf("expected override current of 20 A, got %d A", current)
+	}
+	srv.SetOverride(nil)
+
+	if err := cli.ReleaseClaim(); err != nil {
+		t.Fatalf("releasing claim: %v", err)
+	}
+	if len(srv.Claims()) != 0 {
+		t.Errorf("expected no claims, got %+v", srv.Claims())
+	}
+	// Releasing a claim that is gone is not an error.
+	if err := cli.ReleaseClaim(); err != nil {
+		t.Errorf("releasing claim again: %v", err)
+	}
+
+	// After a release, the claim starts over.
+	if err := cli.SetAmp(12); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	expected = client.Claim{ChargeCurrent: 12, Priority: client.DefaultClaimPriority}
+	if got := srv.Claims()[client.DefaultClaimClientID]; got != expected {
+		t.Errorf("expected claim %+v, got %+v", expected, got)
+	}
+}
+
+func TestHTTPAPIAuth(t *testing.T) {
+	srv := fake.NewServer("admin", "secret")
+	defer srv.Close()
+
+	if err := newHTTPAPIClient(srv, "wrong").Start(); err == nil {
+		t.Errorf("expected an error with the wrong password")
+	}
+	if len(srv.Claims()) != 0 {
+		t.Errorf("expected no claims, got %+v", srv.Claims())
+	}
+}
+
+func TestHTTPAPICapabilities(t *testing.T) {
+	srv := fake.NewServer("", "")
+	defer srv.Close()
+
+	caps, err := newHTTPAPIClient(srv, "").Capabilities()
+	if err != nil {
+		t.Fatalf("fetching capabilities: %v", err)
+	}
+	if caps.MinCurrent != 6 || caps.MaxCurrent != 32 || caps.CurrentStep != 1 {
+		t.Errorf("unexpected current limits: %+v", caps)
+	}
+	if !caps.Toggle || !caps.SessionEnergy || !caps.PlugDetection {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// serialPort is a serial port that supports read deadlines.
+type serialPort interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// NewSerialTransport returns a transport that sends RAPI commands over the
+// serial port of the OpenEVSE controller. The port is opened on first use
+// and reopened after an I/O error.
+func NewSerialTransport(port string, baudRate int, timeout time.Duration) Transport {
+	return &serialTransport{
+		port:     port,
+		baudRate: baudRate,
+		timeout:  timeout,
+	}
+}
+
+type serialTransport struct {
+	port     string
+	baudRate int
+	timeout  time.Duration
+
+	conn   serialPort
+	reader *bufio.Reader
+	seq    byte
+	mux    sync.Mutex
+}
+
+// Checksum returns the XOR checksum of a RAPI frame.
+func Checksum(frame string) byte {
+	var sum byte
+	for i := 0; i < len(frame); i++ {
+		sum ^= frame[i]
+	}
+	return sum
+}
+
+// nextSequenceID returns the next sequence ID. The controller echoes it in
+// the response, which lets us discard responses to earlier commands that
+// arrived after we gave up on them. 0xFF is reserved as an invalid ID.
+func (s *serialTransport) nextSequenceID() byte {
+	s.seq++
+	if s.seq == 0 || s.seq == 0xFF {
+		s.seq = 1
+	}
+	return s.seq
+}
+
+// parseFrame validates the checksum of a response line and returns the
+// response and its sequence ID, if any.
+func parseFrame(line string) (string, int, error) {
+	seq := -1
+	if idx := strings.LastIndex(line, "^"); idx >= 0 {
+		expected, err := strconv.ParseUint(line[idx+1:], 16, 8)
+		if err != nil {
+			return "", seq, errors.Wrapf(err, "parsing checksum of %q", line)
+		}
+		if Checksum(line[:idx]) != byte(expected) {
+			return "", seq, fmt.Errorf("invalid checksum for %q", line)
+		}
+		line = line[:idx]
+	}
+
+	if idx := strings.LastIndex(line, " :"); idx >= 0 {
+		id, err := strconv.ParseUint(line[idx+2:], 16, 8)
+		if err != nil {
+			return "", seq, errors.Wrapf(err, "parsing sequence id of %q", line)
+		}
+		seq = int(id)
+		line = line[:idx]
+	}
+	return line, seq, nil
+}
+
+func (s *serialTransport) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = nil
+	s.reader = nil
+}
+
+func (s *serialTransport) Send(cmd string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		conn, err := openSerialPort(s.port, s.baudRate)
+		if err != nil {
+			return "", errors.Wrapf(err, "opening %s", s.port)
+		}
+		s.conn = conn
+		s.reader = bufio.NewReader(conn)
+	}
+
+	seq := s.nextSequenceID()
+	frame := fmt.Sprintf("%s :%02X", cmd, seq)
+	frame = fmt.Sprintf("%s^%02X\r", frame, Checksum(frame))
+	if _, err := s.conn.Write([]byte(frame)); err != nil {
+		s.close()
+		return "", errors.Wrapf(err, "writing to %s", s.port)
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		s.close()
+		return "", errors.Wrap(err, "setting read deadline")
+	}
+	for {
+		line, err := s.reader.ReadString('\r')
+		if err != nil {
+			s.close()
+			return "", errors.Wrapf(err, "waiting for response to %s", cmd)
+		}
+		line = strings.TrimSpace(line)
+		// The controller also sends asynchronous notifications ($AT, $AB,
+		// $WF, ...). We only care about responses.
+		if !strings.HasPrefix(line, "$OK") && !strings.HasPrefix(line, "$NK") {
+			continue
+		}
+		response, respSeq, err := parseFrame(line)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing response")
+		}
+		if respSeq >= 0 && respSeq != int(seq) {
+			// Response to a previous command.
+			continue
+		}
+		return response, nil
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// cbaud is the mask of the baud rate bits in c_cflag. Not exported by syscall.
+const cbaud = 0x100f
+
+var baudRates = map[int]uint32{
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+func openSerialPort(port string, baudRate int) (serialPort, error) {
+	speed, ok := baudRates[baudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate: %d", baudRate)
+	}
+
+	f, err := os.OpenFile(port, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening serial port")
+	}
+
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "fetching raw connection")
+	}
+
+	var ioctlErr syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var tio syscall.Termios
+		if _, _, ioctlErr = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&tio))); ioctlErr != 0 {
+			return
+		}
+		// Raw mode, 8N1.
+		tio.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		tio.Oflag &^= syscall.OPOST
+		tio.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		tio.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | cbaud
+		tio.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+		tio.Ispeed = speed
+		tio.Ospeed = speed
+		tio.Cc[syscall.VMIN] = 1
+		tio.Cc[syscall.VTIME] = 0
+		_, _, ioctlErr = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&tio)))
+	})
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "configuring serial port")
+	}
+	if ioctlErr != 0 {
+		f.Close()
+		return nil, errors.Wrap(ioctlErr, "configuring serial port")
+	}
+	return f, nil
+}
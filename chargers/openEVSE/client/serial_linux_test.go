@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/chargers/openEVSE/fake"
+)
+
+func TestSerialTransport(t *testing.T) {
+	srv := fake.NewServer("", "")
+	defer srv.Close()
+	port, err := srv.ServeSerial()
+	if err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	}
+
+	cli := client.NewRAPIClient(client.NewSerialTransport(port, 115200, 2*time.Second))
+	info, err := cli.GetCurrentCapacityInfo()
+	if err != nil {
+		t.Fatalf("fetching current capacity: %v", err)
+	}
+	expected := client.CurrentCapacityInfo{MinAmps: 6, MaxAmps: 32, PilotAmps: 16, CurrentMaxAmps: 16}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+
+	// Volatile changes show up in the pilot current only.
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if info, err = cli.GetCurrentCapacityInfo(); err != nil {
+		t.Fatalf("fetching current capacity: %v", err)
+	}
+	if info.PilotAmps != 10 || info.CurrentMaxAmps != 16 {
+		t.Errorf("expected a pilot of 10 A and 16 A saved, got %+v", info)
+	}
+	if srv.EEPROMWrites() != 0 || cli.EEPROMWrites() != 0 {
+		t.Errorf("expected no EEPROM writes, got %d on the station, %d counted", srv.EEPROMWrites(), cli.EEPROMWrites())
+	}
+
+	if err := cli.PersistAmp(20); err != nil {
+		t.Fatalf("persisting current: %v", err)
+	}
+	if srv.EEPROMWrites() != 1 || cli.EEPROMWrites() != 1 {
+		t.Errorf("expected one EEPROM write, got %d on the station, %d counted", srv.EEPROMWrites(), cli.EEPROMWrites())
+	}
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	state, err := cli.GetState()
+	if err != nil {
+		t.Fatalf("fetching state: %v", err)
+	}
+	if state.State != fake.StateSleeping {
+		t.Errorf("expected the station to sleep, got state %d", state.State)
+	}
+
+	// The controller refuses currents outside its limits.
+	if err := cli.SetAmp(40); err == nil {
+		t.Errorf("expected an error setting 40 A")
+	}
+}
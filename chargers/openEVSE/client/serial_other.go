@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import "fmt"
+
+func openSerialPort(port string, baudRate int) (serialPort, error) {
+	return nil, fmt.Errorf("serial ports are only supported on linux")
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		line     string
+		response string
+		seq      int
+		valid    bool
+	}{
+		{"$OK^20", "$OK", -1, true},
+		{"$OK 6 32 16 16^" + fmt.Sprintf("%02X", Checksum("$OK 6 32 16 16")), "$OK 6 32 16 16", -1, true},
+		{"$OK 16 :2A^" + fmt.Sprintf("%02X", Checksum("$OK 16 :2A")), "$OK 16", 0x2A, true},
+		{"$NK :01^" + fmt.Sprintf("%02X", Checksum("$NK :01")), "$NK", 1, true},
+		// Responses without a checksum are accepted.
+		{"$OK :05", "$OK", 5, true},
+		{"$OK^21", "", -1, false},
+		{"$OK^ZZ", "", -1, false},
+		{"$OK :ZZ", "", -1, false},
+	}
+	for _, tc := range tests {
+		response, seq, err := parseFrame(tc.line)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.line, err)
+			continue
+		}
+		if response != tc.response || seq != tc.seq {
+			t.Errorf("%q: got %q, %d, expected %q, %d", tc.line, response, seq, tc.response, tc.seq)
+		}
+	}
+}
+
+func TestNextSequenceID(t *testing.T) {
+	s := &serialTransport{seq: 0xFD}
+	for _, expected := range []byte{0xFE, 1, 2} {
+		if got := s.nextSequenceID(); got != expected {
+			t.Errorf("expected sequence id %02X, got %02X", expected, got)
+		}
+	}
+}
+
+func frame(response string) string {
+	return fmt.Sprintf("%s^%02X\r", response, Checksum(response))
+}
+
+// TestSerialSkipsStaleResponses feeds the transport a notification and the
+// late response to an earlier command, before the response to the command
+// it sent.
+func TestSerialSkipsStaleResponses(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := &serialTransport{
+		port:    "pipe",
+		timeout: 2 * time.Second,
+		conn:    local,
+		reader:  bufio.NewReader(local),
+		seq:     4,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(remote).ReadString('\r')
+		if err != nil {
+			errs <- err
+			return
+		}
+		expected := "$GC :05"
+		if !strings.HasPrefix(line, expected+"^") {
+			errs <- fmt.Errorf("expected %q, got %q", expected, line)
+			return
+		}
+		if want := frame(expected); line != want {
+			errs <- fmt.Errorf("expected frame %q, got %q", want, line)
+			return
+		}
+		_, err = remote.Write([]byte(frame("$AT 3 3 32 0") + frame("$OK 6 32 10 10 :04") + frame("$OK 6 32 16 16 :05")))
+		errs <- err
+	}()
+
+	response, err := s.Send("$GC")
+	if err != nil {
+		t.Fatalf("sending command: %v", err)
+	}
+	if response != "$OK 6 32 16 16" {
+		t.Errorf("unexpected response %q", response)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSerialRejectsBadChecksum(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := &serialTransport{
+		port:    "pipe",
+		timeout: 2 * time.Second,
+		conn:    local,
+		reader:  bufio.NewReader(local),
+	}
+
+	go func() {
+		bufio.NewReader(remote).ReadString('\r')
+		remote.Write([]byte("$OK :01^00\r"))
+	}()
+	if _, err := s.Send("$FE"); err == nil {
+		t.Errorf("expected an error for an invalid checksum")
+	}
+}
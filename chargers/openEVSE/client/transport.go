@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"solar-ev-charger/httpclient"
+
+	"github.com/pkg/errors"
+)
+
+// Transport sends RAPI commands to the EVSE.
+type Transport interface {
+	// Send sends a RAPI command (eg: "$SC 16") and returns the raw response
+	// line (eg: "$OK^20").
+	Send(cmd string) (string, error)
+}
+
+// NewHTTPTransport returns a transport that wraps RAPI commands in requests
+// to the HTTP API of the OpenEVSE WiFi module.
+func NewHTTPTransport(addr, username, password string, cli *httpclient.Client) Transport {
+	return &httpTransport{
+		addr:     addr,
+		username: username,
+		password: password,
+		cli:      cli,
+	}
+}
+
+type httpTransport struct {
+	addr     string
+	username string
+	password string
+	cli      *httpclient.Client
+}
+
+func (h *httpTransport) url(cmd string) string {
+	encoded := url.QueryEscape(cmd)
+	return fmt.Sprintf("http://%s/r?json=1&rapi=%s", h.addr, encoded)
+}
+
+func (h *httpTransport) Send(cmd string) (string, error) {
+	req, err := http.NewRequest("GET", h.url(cmd), nil)
+	if err != nil {
+		return "", err
+	}
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	resp, err := h.cli.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "sending request")
+	}
+
+	var ret RapiResponse
+	if err := resp.DecodeJSON(&ret); err != nil {
+		return "", err
+	}
+
+	if ret.Error != "" {
+		return "", fmt.Errorf("error sending %s: %q", cmd, ret.Error)
+	}
+	return ret.Ret, nil
+}
@@ -0,0 +1,79 @@
+package openEVSE
+
+import (
+	"fmt"
+	"strconv"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/config"
+	"solar-ev-charger/mqttclient"
+
+	"github.com/pkg/errors"
+)
+
+// divertClient feeds power readings to the built in solar divert (eco mode)
+// of the station. In this mode the station decides the charge current, so
+// Start, Stop and SetAmp are not supported.
+type divertClient struct {
+	worker *Worker
+}
+
+func (d *divertClient) topic() string {
+	if d.worker.cfg.OpenEVSE.DivertFeed == config.DivertFeedSolar {
+		return d.worker.cfg.OpenEVSE.DivertSolarTopic
+	}
+	return d.worker.cfg.OpenEVSE.DivertGridIETopic
+}
+
+func (d *divertClient) publish(topic string, value float64) error {
+	w := d.worker
+	if w.mqttCli == nil {
+		return mqttclient.ErrNotConnected
+	}
+
+	payload := strconv.FormatFloat(value, 'f', 0, 64)
+	log.Tracef("publishing %s on %s", payload, topic)
+	return w.mqttCli.Publish(topic, 0, false, payload)
+}
+
+// FeedSurplus implements common.SurplusFeeder.
+func (d *divertClient) FeedSurplus(production, gridImport float64) error {
+	value := gridImport
+	if d.worker.cfg.OpenEVSE.DivertFeed == config.DivertFeedSolar {
+		value = production
+	}
+
+	if topic := d.topic(); d.worker.cfg.OpenEVSE.UseMQTT && topic != "" {
+		return d.publish(topic, value)
+	}
+
+	var inputs client.DivertInputs
+	if d.worker.cfg.OpenEVSE.DivertFeed == config.DivertFeedSolar {
+		inputs.Solar = &value
+	} else {
+		inputs.GridIE = &value
+	}
+	if err := d.worker.apiCli.SetDivertInputs(inputs); err != nil {
+		return errors.Wrap(err, "feeding divert inputs")
+	}
+	return nil
+}
+
+func (d *divertClient) Start() error {
+	return fmt.Errorf("not supported in divert mode")
+}
+
+func (d *divertClient) Stop() error {
+	return fmt.Errorf("not supported in divert mode")
+}
+
+func (d *divertClient) SetAmp(amp float64) error {
+	return fmt.Errorf("not supported in divert mode")
+}
+
+// Capabilities returns the zero value. The station decides the current
+// and state itself.
+func (d *divertClient) Capabilities() (common.Capabilities, error) {
+	return common.Capabilities{}, nil
+}
@@ -0,0 +1,164 @@
+package openEVSE
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/chargers/openEVSE/fake"
+	"solar-ev-charger/config"
+	mqttfake "solar-ev-charger/mqttclient/fake"
+)
+
+// format returns a readable form of divert inputs.
+func format(inputs client.DivertInputs) string {
+	value := func(v *float64) string {
+		if v == nil {
+			return "none"
+		}
+		return fmt.Sprint(*v)
+	}
+	return fmt.Sprintf("solar %s, grid_ie %s", value(inputs.Solar), value(inputs.GridIE))
+}
+
+func TestDivert(t *testing.T) {
+	tests := []struct {
+		name        string
+		feed        config.DivertFeed
+		useMQTT     bool
+		solarTopic  string
+		gridIETopic string
+		// published is the message we expect on the broker, if any.
+		published string
+		// inputs are the readings we expect to be posted to /status.
+		inputs string
+	}{
+		{
+			name:   "grid import over http",
+			feed:   config.DivertFeedGridIE,
+			inputs: "solar none, grid_ie -1200",
+		}, {
+			name:   "solar over http",
+			feed:   config.DivertFeedSolar,
+			inputs: "solar 3000, grid_ie none",
+		}, {
+			name:        "grid import over mqtt",
+			feed:        config.DivertFeedGridIE,
+			useMQTT:     true,
+			solarTopic:  "emon/solar",
+			gridIETopic: "emon/grid_ie",
+			published:   "emon/grid_ie=-1200",
+			inputs:      "solar none, grid_ie none",
+		}, {
+			name:        "solar over mqtt",
+			feed:        config.DivertFeedSolar,
+			useMQTT:     true,
+			solarTopic:  "emon/solar",
+			gridIETopic: "emon/grid_ie",
+			published:   "emon/solar=3000",
+			inputs:      "solar none, grid_ie none",
+		}, {
+			// Without a topic for the reading, it is posted to /status
+			// even if mqtt is used.
+			name:        "solar over mqtt without a topic",
+			feed:        config.DivertFeedSolar,
+			useMQTT:     true,
+			gridIETopic: "emon/grid_ie",
+			inputs:      "solar 3000, grid_ie none",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			broker := mqttfake.NewBroker()
+			t.Cleanup(func() { broker.Close() })
+			port, err := broker.Listen("tcp", nil)
+			if err != nil {
+				t.Fatalf("starting broker: %v", err)
+			}
+			srv := fake.NewServer("admin", "secret")
+			t.Cleanup(srv.Close)
+			srv.SetDivertEnabled(true)
+			srv.ServeMQTT(broker, "openevse")
+
+			cfg := &config.Config{
+				ElectricalPresure: 230,
+				OpenEVSE: config.OpenEVSECharger{
+					Address:           srv.Addr(),
+					Username:          "admin",
+					Password:          "secret",
+					API:               config.OpenEVSERAPI,
+					Mode:              config.OpenEVSEDivert,
+					DivertFeed:        tc.feed,
+					DivertSolarTopic:  tc.solarTopic,
+					DivertGridIETopic: tc.gridIETopic,
+					BaseTopic:         "openevse",
+					UseMQTT:           tc.useMQTT,
+					MQTT: config.MQTTSettings{
+						Broker: "127.0.0.1",
+						Port:   port,
+					},
+				},
+			}
+			if err := cfg.OpenEVSE.MQTT.Validate(); err != nil {
+				t.Fatalf("validating mqtt settings: %v", err)
+			}
+			_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+			commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+
+			feeder, ok := cli.(common.SurplusFeeder)
+			if !ok {
+				t.Fatalf("expected a surplus feeder in divert mode, got %T", cli)
+			}
+			// Readings are published once we are connected to the broker.
+			deadline := time.Now().Add(commontest.StateTimeout)
+			for {
+				err := feeder.FeedSurplus(3000, -1200)
+				if err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("feeding surplus: %v", err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			// The broker receives the reading asynchronously.
+			var published string
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				for _, msg := range broker.Published() {
+					if msg.Topic == tc.solarTopic || msg.Topic == tc.gridIETopic {
+						published = fmt.Sprintf("%s=%s", msg.Topic, msg.Payload)
+					}
+				}
+				if published != "" || tc.published == "" || time.Now().After(deadline) {
+					break
+				}
+			}
+			if published != tc.published {
+				t.Errorf("expected %q to be published, got %q", tc.published, published)
+			}
+			if got := format(srv.DivertInputs()); got != tc.inputs {
+				t.Errorf("expected inputs %q, got %q", tc.inputs, got)
+			}
+
+			// The station decides the current and state itself.
+			if err := cli.Start(); err == nil {
+				t.Errorf("expected starting to fail in divert mode")
+			}
+			if err := cli.Stop(); err == nil {
+				t.Errorf("expected stopping to fail in divert mode")
+			}
+			if err := cli.SetAmp(10); err == nil {
+				t.Errorf("expected setting the current to fail in divert mode")
+			}
+			if caps, err := cli.Capabilities(); err != nil || caps != (common.Capabilities{}) {
+				t.Errorf("expected no capabilities, got %+v, %v", caps, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,581 @@
+// Package fake implements a stand-in for the HTTP and MQTT APIs of an
+// OpenEVSE WiFi module. It is meant to be used in tests, and when developing drivers
+// without access to a real charging station.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"solar-ev-charger/chargers/openEVSE/client"
+	mqttfake "solar-ev-charger/mqttclient/fake"
+
+	"github.com/gorilla/websocket"
+)
+
+// EVSE states, as reported by RAPI $GS.
+const (
+	StateNotConnected uint64 = 1
+	StateConnected    uint64 = 2
+	StateCharging     uint64 = 3
+	StateSleeping     uint64 = 254
+	StateDisabled     uint64 = 255
+)
+
+// manualOverridePriority is the priority the firmware assigns to manual overrides.
+const manualOverridePriority = 1000
+
+// NewServer starts a new fake OpenEVSE. If username is not empty, requests
+// must use basic auth.
+func NewServer(username, password string) *Server {
+	s := &Server{
+		username:        username,
+		password:        password,
+		enabled:         true,
+		minAmps:         6,
+		maxAmps:         32,
+		currentCapacity: 16,
+		voltage:         230,
+		claims:          map[uint32]client.Claim{},
+		subscribers:     map[chan []byte]struct{}{},
+		done:            make(chan struct{}),
+	}
+	s.srv = httptest.NewServer(s.handler())
+	return s
+}
+
+type Server struct {
+	srv *httptest.Server
+	mux sync.Mutex
+
+	username string
+	password string
+
+	// enabled is toggled by RAPI $FE and $FS.
+	enabled bool
+	vehicle bool
+	minAmps uint64
+	maxAmps uint64
+	// currentCapacity is the current saved to EEPROM with RAPI $SC.
+	currentCapacity uint64
+	// volatileCapacity is the current set with RAPI $SC N V. Zero if unset.
+	volatileCapacity uint64
+	eepromWrites     uint64
+	voltage          float64
+
+	claims   map[uint32]client.Claim
+	override *client.Claim
+
+	divertEnabled bool
+	divertInputs  client.DivertInputs
+
+	// broker is the MQTT broker the station publishes its state to, if
+	// set with ServeMQTT.
+	broker    *mqttfake.Broker
+	baseTopic string
+
+	// subscribers receive status updates pushed over /ws.
+	subscribers map[chan []byte]struct{}
+	done        chan struct{}
+	// closers are closed when the server shuts down.
+	closers []io.Closer
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return strings.TrimPrefix(s.srv.URL, "http://")
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	close(s.done)
+	s.srv.Close()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+}
+
+// SetVehicleConnected simulates plugging in or unplugging a vehicle.
+func (s *Server) SetVehicleConnected(connected bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.vehicle = connected
+	s.broadcast()
+}
+
+// SetOverride simulates a manual override set from the OpenEVSE UI or app.
+// Passing nil clears the override.
+func (s *Server) SetOverride(override *client.Claim) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.override = override
+	s.broadcast()
+}
+
+// SetDivertEnabled enables or disables the built in solar divert.
+func (s *Server) SetDivertEnabled(enabled bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.divertEnabled = enabled
+}
+
+// DivertInputs returns the last solar and grid import/export readings
+// posted to /status.
+func (s *Server) DivertInputs() client.DivertInputs {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.divertInputs
+}
+
+// EEPROMWrites returns the number of times the current was saved to EEPROM.
+func (s *Server) EEPROMWrites() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.eepromWrites
+}
+
+// Claims returns a copy of the claims currently held on the EVSE.
+func (s *Server) Claims() map[uint32]client.Claim {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	ret := make(map[uint32]client.Claim, len(s.claims))
+	for id, claim := range s.claims {
+		ret[id] = claim
+	}
+	return ret
+}
+
+// Target returns the effective state and charge current, after all claims
+// have been taken into account.
+func (s *Server) Target() (string, uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.target()
+}
+
+// target resolves the claims. Each property is taken from the claim with the
+// highest priority that sets it. Must be called with the lock held.
+func (s *Server) target() (string, uint64) {
+	claims := make([]client.Claim, 0, len(s.claims)+1)
+	for _, claim := range s.claims {
+		claims = append(claims, claim)
+	}
+	if s.override != nil {
+		override := *s.override
+		override.Priority = manualOverridePriority
+		claims = append(claims, override)
+	}
+	sort.SliceStable(claims, func(i, j int) bool {
+		return claims[i].Priority > claims[j].Priority
+	})
+
+	state := client.ClaimStateDisabled
+	if s.enabled {
+		state = client.ClaimStateActive
+	}
+	current := s.currentCapacity
+	if s.volatileCapacity != 0 {
+		current = s.volatileCapacity
+	}
+	var stateSet, currentSet bool
+	for _, claim := range claims {
+		if !stateSet && claim.State != "" {
+			state = claim.State
+			stateSet = true
+		}
+		if !currentSet && claim.ChargeCurrent != 0 {
+			current = claim.ChargeCurrent
+			currentSet = true
+		}
+	}
+	if current > s.maxAmps {
+		current = s.maxAmps
+	}
+	return state, current
+}
+
+// evseState returns the RAPI state, pilot current and charge current in
+// milliamps. Must be called with the lock held.
+func (s *Server) evseState() (uint64, uint64, uint64) {
+	state, pilot := s.target()
+	switch {
+	case state == client.ClaimStateDisabled:
+		return StateSleeping, pilot, 0
+	case !s.vehicle:
+		return StateNotConnected, pilot, 0
+	default:
+		return StateCharging, pilot, pilot * 1000
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.username == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && user == s.username && pass == s.password
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/override", s.handleOverride)
+	mux.HandleFunc("/claims", s.handleClaims)
+	mux.HandleFunc("/claims/", s.handleClaim)
+	mux.HandleFunc("/r", s.handleRAPI)
+	mux.HandleFunc("/ws", s.handleWebSocket)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.status())
+	case http.MethodPost:
+		var inputs client.DivertInputs
+		if err := json.NewDecoder(r.Body).Decode(&inputs); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"msg": err.Error()})
+			return
+		}
+		if inputs.Solar != nil {
+			s.divertInputs.Solar = inputs.Solar
+		}
+		if inputs.GridIE != nil {
+			s.divertInputs.GridIE = inputs.GridIE
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"msg": "done"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// status returns the current status. Must be called with the lock held.
+func (s *Server) status() client.Status {
+	state, pilot, milliAmps := s.evseState()
+	status := "active"
+	if state == StateSleeping || state == StateDisabled {
+		status = "disabled"
+	}
+	var vehicle, override int
+	if s.vehicle {
+		vehicle = 1
+	}
+	if s.override != nil {
+		override = 1
+	}
+	return client.Status{
+		Amp:            float64(milliAmps),
+		Voltage:        s.voltage,
+		Pilot:          pilot,
+		State:          state,
+		Vehicle:        vehicle,
+		Status:         status,
+		ManualOverride: override,
+	}
+}
+
+// broadcast pushes the current status to all websocket clients, and
+// publishes it over MQTT. Must be called with the lock held.
+func (s *Server) broadcast() {
+	s.publishState()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	msg, err := json.Marshal(s.status())
+	if err != nil {
+		return
+	}
+	for sub := range s.subscribers {
+		select {
+		case sub <- msg:
+		default:
+			// Slow consumer. Drop the update.
+		}
+	}
+}
+
+// ServeMQTT makes the station answer RAPI commands published through broker
+// on <baseTopic>/rapi/in/<command>, and publish its state on
+// <baseTopic>/state, <baseTopic>/amp and <baseTopic>/vehicle, like the WiFi
+// module does.
+func (s *Server) ServeMQTT(broker *mqttfake.Broker, baseTopic string) {
+	s.mux.Lock()
+	s.broker = broker
+	s.baseTopic = baseTopic
+	s.mux.Unlock()
+	broker.Handle(baseTopic+"/rapi/in/#", s.handleMQTTRAPI)
+}
+
+func (s *Server) handleMQTTRAPI(msg mqttfake.Message) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	cmd := strings.TrimPrefix(msg.Topic, s.baseTopic+"/rapi/in/")
+	if len(msg.Payload) > 0 {
+		cmd = fmt.Sprintf("%s %s", cmd, msg.Payload)
+	}
+	ret := s.rapi(cmd)
+	s.broadcast()
+	s.broker.Publish(s.baseTopic+"/rapi/out", []byte(fmt.Sprintf("%s^%02X", ret, client.Checksum(ret))), false)
+}
+
+// publishState publishes the state over MQTT, if ServeMQTT was called. Must
+// be called with the lock held.
+func (s *Server) publishState() {
+	if s.broker == nil {
+		return
+	}
+	state, _, milliAmps := s.evseState()
+	vehicle := "0"
+	if s.vehicle {
+		vehicle = "1"
+	}
+	s.broker.Publish(s.baseTopic+"/state", []byte(strconv.FormatUint(state, 10)), false)
+	s.broker.Publish(s.baseTopic+"/amp", []byte(strconv.FormatUint(milliAmps, 10)), false)
+	s.broker.Publish(s.baseTopic+"/vehicle", []byte(vehicle), false)
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	updates := make(chan []byte, 10)
+	s.mux.Lock()
+	s.subscribers[updates] = struct{}{}
+	s.broadcast()
+	s.mux.Unlock()
+
+	defer func() {
+		s.mux.Lock()
+		delete(s.subscribers, updates)
+		s.mux.Unlock()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-updates:
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	writeJSON(w, http.StatusOK, client.Config{
+		MinCurrentHard: s.minAmps,
+		MaxCurrentHard: s.maxAmps,
+		MaxCurrentSoft: s.currentCapacity,
+		Firmware:       "7.1.3",
+		Version:        "v4.1.2",
+		DivertEnabled:  s.divertEnabled,
+	})
+}
+
+func (s *Server) handleOverride(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if s.override == nil {
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.override)
+	case http.MethodPost:
+		var override client.Claim
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"msg": err.Error()})
+			return
+		}
+		s.override = &override
+		s.broadcast()
+		writeJSON(w, http.StatusOK, map[string]string{"msg": "done"})
+	case http.MethodDelete:
+		s.override = nil
+		s.broadcast()
+		writeJSON(w, http.StatusOK, map[string]string{"msg": "done"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleClaims(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	ret := map[string]client.Claim{}
+	for id, claim := range s.claims {
+		ret[strconv.FormatUint(uint64(id), 10)] = claim
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (s *Server) handleClaim(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/claims/")
+	if idStr == "target" {
+		state, current := s.target()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"properties": client.Claim{
+				State:         state,
+				ChargeCurrent: current,
+			},
+		})
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"msg": "invalid client id"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		claim, ok := s.claims[uint32(id)]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"msg": "no claim"})
+			return
+		}
+		writeJSON(w, http.StatusOK, claim)
+	case http.MethodPost:
+		var claim client.Claim
+		if err := json.NewDecoder(r.Body).Decode(&claim); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"msg": err.Error()})
+			return
+		}
+		if claim.State != "" && claim.State != client.ClaimStateActive && claim.State != client.ClaimStateDisabled {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"msg": "invalid state"})
+			return
+		}
+		s.claims[uint32(id)] = claim
+		s.broadcast()
+		writeJSON(w, http.StatusOK, map[string]string{"msg": "done"})
+	case http.MethodDelete:
+		if _, ok := s.claims[uint32(id)]; !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"msg": "no claim"})
+			return
+		}
+		delete(s.claims, uint32(id))
+		s.broadcast()
+		writeJSON(w, http.StatusOK, map[string]string{"msg": "done"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleRAPI(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	cmd := r.URL.Query().Get("rapi")
+	ret := s.rapi(cmd)
+	s.broadcast()
+	writeJSON(w, http.StatusOK, client.RapiResponse{
+		Cmd: cmd,
+		Ret: fmt.Sprintf("%s^%02X", ret, client.Checksum(ret)),
+	})
+}
+
+// rapi executes a RAPI command and returns the response, without the
+// checksum. Must be called with the lock held.
+func (s *Server) rapi(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "$NK"
+	}
+
+	switch fields[0] {
+	case "$FE":
+		s.enabled = true
+		return "$OK"
+	case "$FS":
+		s.enabled = false
+		return "$OK"
+	case "$SC":
+		if len(fields) < 2 {
+			return "$NK"
+		}
+		amps, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil || amps < s.minAmps || amps > s.maxAmps {
+			return "$NK"
+		}
+		if len(fields) > 2 && fields[2] == "V" {
+			s.volatileCapacity = amps
+			return fmt.Sprintf("$OK %d", amps)
+		}
+		s.currentCapacity = amps
+		s.volatileCapacity = 0
+		s.eepromWrites++
+		return fmt.Sprintf("$OK %d", amps)
+	case "$GC":
+		_, pilot := s.target()
+		return fmt.Sprintf("$OK %d %d %d %d", s.minAmps, s.maxAmps, pilot, s.currentCapacity)
+	case "$GG":
+		_, _, milliAmps := s.evseState()
+		return fmt.Sprintf("$OK %d %d", milliAmps, uint64(s.voltage*1000))
+	case "$GS":
+		state, _, _ := s.evseState()
+		pilotState := state
+		if pilotState == StateSleeping {
+			pilotState = StateConnected
+		}
+		return fmt.Sprintf("$OK %x 0 %x 0", state, pilotState)
+	default:
+		return "$NK"
+	}
+}
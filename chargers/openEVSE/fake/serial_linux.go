@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package fake
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"solar-ev-charger/chargers/openEVSE/client"
+
+	"github.com/pkg/errors"
+)
+
+// ServeSerial exposes the RAPI command processor of the server on a pseudo
+// terminal, emulating the serial port of a controller without a WiFi module.
+// It returns the path of the terminal a serial transport should open.
+func (s *Server) ServeSerial() (string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "opening pty master")
+	}
+
+	conn, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return "", errors.Wrap(err, "fetching raw connection")
+	}
+
+	var ptyNum uint32
+	var ioctlErr syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var unlock int32
+		if _, _, ioctlErr = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); ioctlErr != 0 {
+			return
+		}
+		_, _, ioctlErr = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNum)))
+	})
+	if err == nil && ioctlErr != 0 {
+		err = ioctlErr
+	}
+	if err != nil {
+		master.Close()
+		return "", errors.Wrap(err, "setting up pty")
+	}
+
+	s.mux.Lock()
+	s.closers = append(s.closers, master)
+	s.mux.Unlock()
+
+	go s.serveSerial(master)
+	return fmt.Sprintf("/dev/pts/%d", ptyNum), nil
+}
+
+// parseCommand validates the checksum of a command frame and returns the
+// command and its sequence ID, if any.
+func parseCommand(frame string) (string, string, bool) {
+	if idx := strings.LastIndexAny(frame, "^*"); idx >= 0 {
+		expected, err := strconv.ParseUint(frame[idx+1:], 16, 8)
+		if err != nil {
+			return "", "", false
+		}
+		var sum byte
+		if frame[idx] == '^' {
+			sum = client.Checksum(frame[:idx])
+		} else {
+			for i := 0; i < idx; i++ {
+				sum += frame[i]
+			}
+		}
+		if sum != byte(expected) {
+			return "", "", false
+		}
+		frame = frame[:idx]
+	}
+
+	var seq string
+	if idx := strings.LastIndex(frame, " :"); idx >= 0 {
+		seq = frame[idx+2:]
+		frame = frame[:idx]
+	}
+	return frame, seq, true
+}
+
+func (s *Server) serveSerial(master *os.File) {
+	reader := bufio.NewReader(master)
+	for {
+		line, err := reader.ReadString('\r')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		cmd, seq, ok := parseCommand(line)
+		ret := "$NK"
+		if ok {
+			s.mux.Lock()
+			ret = s.rapi(cmd)
+			s.broadcast()
+			s.mux.Unlock()
+		}
+		if seq != "" {
+			ret = fmt.Sprintf("%s :%s", ret, seq)
+		}
+		response := fmt.Sprintf("%s^%02X\r", ret, client.Checksum(ret))
+		if _, err := master.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
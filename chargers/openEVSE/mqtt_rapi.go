@@ -0,0 +1,61 @@
+package openEVSE
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"solar-ev-charger/mqttclient"
+)
+
+// rapiTimeout is the amount of time we wait for a response to a RAPI command
+// sent over MQTT.
+const rapiTimeout = 10 * time.Second
+
+// mqttTransport sends RAPI commands over MQTT, using the connection of the
+// status worker. Commands are published on <base_topic>/rapi/in/<command> and
+// the station publishes the response on <base_topic>/rapi/out. Responses
+// carry no identifier we could use to match them to a command, so commands
+// are sent one at a time.
+type mqttTransport struct {
+	worker *Worker
+	mux    sync.Mutex
+}
+
+// Send implements client.Transport.
+func (m *mqttTransport) Send(cmd string) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	w := m.worker
+	if w.mqttCli == nil {
+		return "", mqttclient.ErrNotConnected
+	}
+
+	// Drop any stale response, received after a previous command timed out.
+	select {
+	case <-w.rapiResponses:
+	default:
+	}
+
+	name := cmd
+	var payload string
+	if idx := strings.Index(cmd, " "); idx >= 0 {
+		name = cmd[:idx]
+		payload = cmd[idx+1:]
+	}
+
+	topic := fmt.Sprintf("%s/rapi/in/%s", w.cfg.OpenEVSE.BaseTopic, name)
+	log.Debugf("publishing %q on %s", payload, topic)
+	if err := w.mqttCli.Publish(topic, 1, false, payload); err != nil {
+		return "", err
+	}
+
+	select {
+	case resp := <-w.rapiResponses:
+		return resp, nil
+	case <-time.After(rapiTimeout):
+		return "", fmt.Errorf("no response to %s after %v", name, rapiTimeout)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"solar-ev-charger/chargers/common"
 	"solar-ev-charger/chargers/openEVSE/client"
 	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/mqttclient"
 	"solar-ev-charger/params"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -19,18 +21,55 @@ import (
 
 var log = loggo.GetLogger("sevc.OpenEVSE")
 
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "OpenEVSE",
+		ConfigSection: "OpenEVSE",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.OpenEVSE },
+		Validate:      func(cfg *config.Config) error { return cfg.OpenEVSE.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
 func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
-	evseCli := client.NewOpenEVSEClient(cfg.OpenEVSE.Address, cfg.OpenEVSE.Username, cfg.OpenEVSE.Password)
-	return &Worker{
-		stateChanged:     stateChan,
-		ctx:              ctx,
-		cfg:              *cfg,
-		closed:           make(chan struct{}),
-		quit:             make(chan struct{}),
-		mqttDisconnected: make(chan struct{}),
-		evseCli:          evseCli,
-		mqttTopic:        fmt.Sprintf("%s/#", cfg.OpenEVSE.BaseTopic),
-	}, nil
+	httpCli := httpclient.New("OpenEVSE", cfg.ChargerHTTP)
+	var transport client.Transport
+	if cfg.OpenEVSE.SerialPort != "" {
+		transport = client.NewSerialTransport(
+			cfg.OpenEVSE.SerialPort, cfg.OpenEVSE.SerialBaudRate,
+			time.Duration(cfg.OpenEVSE.SerialTimeout)*time.Second)
+	} else {
+		transport = client.NewHTTPTransport(cfg.OpenEVSE.Address, cfg.OpenEVSE.Username, cfg.OpenEVSE.Password, httpCli)
+	}
+	rapiCli := client.NewRAPIClient(transport)
+	apiCli := client.NewHTTPAPIClient(
+		cfg.OpenEVSE.Address, cfg.OpenEVSE.Username, cfg.OpenEVSE.Password,
+		cfg.OpenEVSE.ClaimClientID, cfg.OpenEVSE.ClaimPriority, httpCli)
+	w := &Worker{
+		stateChanged:  stateChan,
+		ctx:           ctx,
+		cfg:           *cfg,
+		closed:        make(chan struct{}),
+		quit:          make(chan struct{}),
+		apiCli:        apiCli,
+		rapiResponses: make(chan string, 1),
+		mqttTopic:     fmt.Sprintf("%s/#", cfg.OpenEVSE.BaseTopic),
+		mqttConnected: make(chan struct{}, 1),
+	}
+	if cfg.OpenEVSE.UseMQTT {
+		mqttCli, err := mqttclient.New("OpenEVSE MQTT", cfg.OpenEVSE.MQTT)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating mqtt client")
+		}
+		w.mqttCli = mqttCli
+	}
+
+	w.rapiCli = rapiCli
+	if cfg.OpenEVSE.UseMQTTCommands {
+		w.rapiCli = client.NewRAPIClient(&mqttTransport{worker: w})
+	}
+	w.rapiCli.SetEEPROMCurrentWrites(cfg.OpenEVSE.EEPROMCurrentWrites)
+	return w, nil
 }
 
 type chargerStatus struct {
@@ -40,6 +79,14 @@ type chargerStatus struct {
 	currentUsage float64
 	// enabled indicates the current state of the charger
 	enabled bool
+	// sessionEnergy is the energy delivered in this session, in Wh. Only
+	// reported by the /status API.
+	sessionEnergy float64
+	// vehicle is the state of the vehicle.
+	vehicle params.VehicleState
+	// manualOverride is set while an override set from the UI or app is
+	// in effect. Only reported by the /status API.
+	manualOverride bool
 }
 
 type Worker struct {
@@ -54,31 +101,115 @@ type Worker struct {
 
 	cfg config.Config
 
-	client           mqtt.Client
-	evseCli          *client.OpenEVSEClient
-	mqttDisconnected chan struct{}
-	mqttTopic        string
+	// rapiCli is the client we use to send RAPI commands, over HTTP, the
+	// serial port or MQTT.
+	rapiCli   *client.OpenEVSEClient
+	apiCli    *client.HTTPAPIClient
+	mqttCli   *mqttclient.Manager
+	mqttTopic string
+	// mqttConnected is signaled every time we (re)connect to the broker.
+	mqttConnected chan struct{}
+
+	// statusAPI is true if the firmware exposes the /status JSON endpoint.
+	// Older firmware only supports RAPI.
+	statusAPI bool
+	// apiStatus is the last status received from /status or /ws.
+	apiStatus client.Status
+	// wsConnected is true while we receive push updates over /ws.
+	wsConnected bool
+	wsStarted   bool
+
+	// rapiResponses receives responses to RAPI commands sent over MQTT.
+	rapiResponses chan string
+	// defaultAmpsPersisted is true once the default current was saved to EEPROM.
+	defaultAmpsPersisted bool
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	if w.cfg.OpenEVSE.Mode == config.OpenEVSEDivert {
+		if evseCfg, err := w.apiCli.GetConfig(); err != nil {
+			log.Warningf("failed to fetch station config: %q", err)
+		} else if !evseCfg.DivertEnabled {
+			log.Warningf("solar divert is not enabled on the station; readings we send will be ignored")
+		}
+		return &divertClient{worker: w}, nil
+	}
+	if w.cfg.OpenEVSE.API == config.OpenEVSEHTTP {
+		return w.apiCli, nil
+	}
+	return w.rapiCli, nil
+}
+
+// ampSetting returns the current setting of the station, as reported by $GC.
+// When we control the station through RAPI, the current is changed with
+// volatile writes, which show up in the pilot current but not in the value
+// saved to EEPROM.
+func (w *Worker) ampSetting(info client.CurrentCapacityInfo) uint64 {
+	if w.cfg.OpenEVSE.API == config.OpenEVSEHTTP || w.cfg.OpenEVSE.Mode == config.OpenEVSEDivert {
+		return info.CurrentMaxAmps
+	}
+	return info.PilotAmps
+}
+
+// persistDefaultAmps saves the configured default current to EEPROM, if it
+// differs from the value already saved. This is done once, after we connect
+// to the station. It must be called without holding the lock.
+func (w *Worker) persistDefaultAmps() error {
+	defaultAmps := w.cfg.OpenEVSE.PersistDefaultAmps
+	if w.defaultAmpsPersisted || defaultAmps == 0 || w.cfg.OpenEVSE.API == config.OpenEVSEHTTP || w.cfg.OpenEVSE.Mode == config.OpenEVSEDivert {
+		return nil
+	}
+
+	info, err := w.rapiCli.GetCurrentCapacityInfo()
+	if err != nil {
+		return errors.Wrap(err, "fetching current capacity info")
+	}
+	if info.CurrentMaxAmps != defaultAmps {
+		log.Infof("saving default current of %d A to EEPROM (was %d A)", defaultAmps, info.CurrentMaxAmps)
+		if err := w.rapiCli.PersistAmp(defaultAmps); err != nil {
+			return errors.Wrap(err, "persisting default current")
+		}
+	}
+	w.defaultAmpsPersisted = true
+	return nil
 }
 
-func (w *Worker) mqttOnConnect(client mqtt.Client) {
-	log.Infof("Connected to %s", w.cfg.OpenEVSE.MQTT.Broker)
+// releaseClaim removes the claim we hold on the station, if any, so it
+// falls back to its own schedule and settings once we stop controlling it.
+func (w *Worker) releaseClaim() {
+	if w.cfg.OpenEVSE.API != config.OpenEVSEHTTP || w.cfg.OpenEVSE.Mode == config.OpenEVSEDivert {
+		return
+	}
+	if err := w.apiCli.ReleaseClaim(); err != nil {
+		log.Errorf("failed to release claim: %q", err)
+	}
 }
 
-func (w *Worker) mqttConnectionLostHandler(client mqtt.Client, err error) {
-	log.Infof("Connection to %s has been lost: %q", w.cfg.OpenEVSE.MQTT.Broker, err)
+func (w *Worker) mqttOnConnect() {
 	select {
-	case <-w.mqttDisconnected:
+	case w.mqttConnected <- struct{}{}:
 	default:
-		close(w.mqttDisconnected)
 	}
 }
 
-func (w *Worker) sendLocalState() error {
-	state := params.ChargerState{
+// localState returns the state of the charger. Must be called with the lock
+// held.
+func (w *Worker) localState() params.ChargerState {
+	return params.ChargerState{
 		Active:            w.status.enabled,
 		CurrentUsage:      w.status.currentUsage,
 		CurrentAmpSetting: float64(w.status.currentAmpSetting),
+		Vehicle:           w.status.vehicle,
+		SessionEnergy:     w.status.sessionEnergy,
+		EEPROMWrites:      w.rapiCli.EEPROMWrites(),
+		ManualOverride:    w.status.manualOverride,
 	}
+}
+
+// sendState sends state to the worker. Must be called without holding the
+// lock, so status updates are not blocked while the worker is busy.
+func (w *Worker) sendState(state params.ChargerState) error {
 	select {
 	case w.stateChanged <- state:
 	case <-time.After(30 * time.Second):
@@ -88,12 +219,23 @@ func (w *Worker) sendLocalState() error {
 }
 
 func (w *Worker) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
-	w.mux.Lock()
-	defer w.mux.Unlock()
-
 	payload := msg.Payload()
 	topic := msg.Topic()
 
+	if topic == fmt.Sprintf("%s/rapi/out", w.cfg.OpenEVSE.BaseTopic) {
+		// Handed to the command waiting for it, which does not hold the
+		// lock.
+		select {
+		case w.rapiResponses <- string(payload):
+		default:
+			log.Debugf("dropping unsolicited RAPI response: %s", string(payload))
+		}
+		return
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
 	switch topic {
 	case fmt.Sprintf("%s/amp", w.cfg.OpenEVSE.BaseTopic):
 		val, err := strconv.ParseFloat(string(payload), 64)
@@ -113,36 +255,22 @@ func (w *Worker) mqttNewMessageHandler(client mqtt.Client, msg mqtt.Message) {
 			return
 		}
 		w.status.enabled = val != 254 && val != 255
+		if state := vehicleState(val, 0); state != params.VehicleUnknown {
+			w.status.vehicle = state
+		}
+	case fmt.Sprintf("%s/vehicle", w.cfg.OpenEVSE.BaseTopic):
+		// The EVSE state does not tell whether a vehicle is plugged in
+		// while sleeping or disabled.
+		if string(payload) == "0" {
+			w.status.vehicle = params.VehicleDisconnected
+		} else if !w.status.vehicle.PluggedIn() {
+			w.status.vehicle = params.VehicleConnected
+		}
 	default:
 		return
 	}
 }
 
-func (w *Worker) connectMQTT() (mqtt.Client, error) {
-	if err := w.initState(); err != nil {
-		return nil, errors.Wrap(err, "initializing state")
-	}
-	opts, err := w.cfg.OpenEVSE.MQTT.ClientOptions()
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching client options")
-	}
-	opts.OnConnect = w.mqttOnConnect
-	opts.OnConnectionLost = w.mqttConnectionLostHandler
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
-	if token.Error() != nil {
-		return nil, token.Error()
-	}
-	log.Infof("subscribing to %s", w.mqttTopic)
-	token = client.Subscribe(w.mqttTopic, 1, w.mqttNewMessageHandler)
-	token.Wait()
-	if token.Error() != nil {
-		return nil, errors.Wrap(err, "subscribing to topic")
-	}
-	return client, nil
-}
-
 func (w *Worker) loopMQTT() {
 	// Use a minimum of 5 second sample rate and attempt to adjust upwards
 	// for BackoffThreshold.
@@ -154,59 +282,132 @@ func (w *Worker) loopMQTT() {
 
 	defer func() {
 		timer.Stop()
-		w.client.Disconnect(1000)
+		w.releaseClaim()
 		close(w.closed)
 	}()
-	for {
-		if w.client == nil {
-			client, err := w.connectMQTT()
-			if err != nil {
-				log.Errorf("failed to connect to mqtt: %q", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			w.client = client
-			w.mqttDisconnected = make(chan struct{})
+
+	// With use_mqtt_commands, the state is initialized through the broker
+	// once we are connected to it.
+	for !w.cfg.OpenEVSE.UseMQTTCommands {
+		err := w.initState()
+		if err == nil {
+			break
 		}
+		log.Errorf("failed to initialize state: %q", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+
+	if err := w.mqttCli.Subscribe(w.mqttTopic, 1, w.mqttNewMessageHandler); err != nil {
+		log.Errorf("failed to subscribe to %s: %q", w.mqttTopic, err)
+	}
+	w.mqttCli.OnConnect(w.mqttOnConnect)
+	if err := w.mqttCli.Start(); err != nil {
+		log.Errorf("failed to start mqtt client: %q", err)
+		return
+	}
+	defer func() {
+		if err := w.mqttCli.Stop(); err != nil {
+			log.Errorf("failed to stop mqtt client: %q", err)
+		}
+	}()
 
+	for {
 		select {
+		case <-w.mqttConnected:
+			if err := w.persistDefaultAmps(); err != nil {
+				log.Errorf("failed to persist default current: %q", err)
+			}
 		case <-timer.C:
-			w.mux.Lock()
-
-			currentState, err := w.evseCli.GetCurrentCapacityInfo()
-			if err != nil {
-				log.Errorf("failed to get current state from RAPI: %+v", err)
-				w.mux.Unlock()
+			if err := w.initState(); err != nil {
+				log.Errorf("failed to initialize state: %q", err)
 				continue
 			}
-			w.status.currentAmpSetting = currentState.CurrentMaxAmps
 
-			if err := w.sendLocalState(); err != nil {
-				log.Errorf("failed to send state: %q", err)
+			w.mux.Lock()
+			wsConnected := w.wsConnected
+			w.mux.Unlock()
+			// Usage, state and vehicle are published over MQTT, which
+			// does not report them on its own. The current setting is
+			// pushed over the websocket while it is connected.
+			if !wsConnected {
+				if err := w.pollAmpSetting(); err != nil {
+					log.Errorf("failed to poll current setting: %q", err)
+					continue
+				}
 			}
+			w.mux.Lock()
+			state := w.localState()
 			w.mux.Unlock()
+			if err := w.sendState(state); err != nil {
+				log.Errorf("failed to send state: %q", err)
+			}
 		case <-w.ctx.Done():
 			return
 		case <-w.quit:
 			return
-		case <-w.mqttDisconnected:
-			w.client = nil
 		}
 	}
 }
 
+// pollAmpSetting fetches the current setting of the station, which is not
+// published over MQTT. The station is queried without holding the lock,
+// which the MQTT message handler needs.
+func (w *Worker) pollAmpSetting() error {
+	if w.statusAPI {
+		status, err := w.apiCli.GetStatus()
+		if err != nil {
+			return errors.Wrap(err, "getting status")
+		}
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		w.apiStatus = status
+		w.status.currentAmpSetting = status.Pilot
+		w.status.manualOverride = status.ManualOverride == 1
+		return nil
+	}
+
+	info, err := w.rapiCli.GetCurrentCapacityInfo()
+	if err != nil {
+		return errors.Wrap(err, "getting current capacity info")
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.status.currentAmpSetting = w.ampSetting(info)
+	return nil
+}
+
+// fetchStatusFromAPI queries the station, and records the response of
+// /status for the websocket updates. Must be called without holding the
+// lock.
 func (w *Worker) fetchStatusFromAPI() (chargerStatus, error) {
-	milliAmps, _, err := w.evseCli.GetChargeCurrentAndVoltage()
+	if w.statusAPI {
+		status, err := w.apiCli.GetStatus()
+		if err != nil {
+			return chargerStatus{}, errors.Wrap(err, "getting status")
+		}
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		w.apiStatus = status
+		return w.statusFromAPI(status), nil
+	}
+
+	milliAmps, _, err := w.rapiCli.GetChargeCurrentAndVoltage()
 	if err != nil {
 		return chargerStatus{}, errors.Wrap(err, "getting charge current and voltage")
 	}
 
-	currentCapacity, err := w.evseCli.GetCurrentCapacityInfo()
+	currentCapacity, err := w.rapiCli.GetCurrentCapacityInfo()
 	if err != nil {
 		return chargerStatus{}, errors.Wrap(err, "getting current capacity info")
 	}
 
-	state, err := w.evseCli.GetState()
+	state, err := w.rapiCli.GetState()
 	if err != nil {
 		return chargerStatus{}, errors.Wrap(err, "getting state")
 	}
@@ -218,25 +419,38 @@ func (w *Worker) fetchStatusFromAPI() (chargerStatus, error) {
 
 	return chargerStatus{
 		currentUsage:      float64(uint64(usage) * w.cfg.ElectricalPresure),
-		currentAmpSetting: currentCapacity.CurrentMaxAmps,
+		currentAmpSetting: w.ampSetting(currentCapacity),
 		enabled:           state.State != 254 && state.State != 255,
+		vehicle:           vehicleState(state.State, state.PilotState),
 	}, nil
 }
 
 func (w *Worker) initState() error {
 	w.mux.Lock()
-	defer w.mux.Unlock()
-
-	if w.stateInitialized {
+	initialized := w.stateInitialized
+	w.mux.Unlock()
+	if initialized {
 		return nil
 	}
 
+	// The station is queried without holding the lock, which the MQTT
+	// message handler needs. The websocket loop, which reads statusAPI, is
+	// not started yet.
+	w.detectStatusAPI()
 	status, err := w.fetchStatusFromAPI()
 	if err != nil {
 		return errors.Wrap(err, "initializing state")
 	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
 	w.status = status
 	w.stateInitialized = true
+
+	if w.statusAPI && !w.wsStarted {
+		w.wsStarted = true
+		go w.loopWebSocket()
+	}
 	return nil
 }
 
@@ -251,6 +465,7 @@ func (w *Worker) loopHTTP() {
 
 	defer func() {
 		timer.Stop()
+		w.releaseClaim()
 		close(w.closed)
 	}()
 	for {
@@ -260,17 +475,36 @@ func (w *Worker) loopHTTP() {
 		case <-w.quit:
 			return
 		case <-timer.C:
+			if err := w.initState(); err != nil {
+				log.Errorf("failed to initialize state: %q", err)
+				continue
+			}
+			if err := w.persistDefaultAmps(); err != nil {
+				log.Errorf("failed to persist default current: %q", err)
+			}
+
 			w.mux.Lock()
-			state, err := w.fetchStatusFromAPI()
+			wsConnected := w.wsConnected
+			w.mux.Unlock()
+			if wsConnected {
+				// We get push updates over the websocket.
+				continue
+			}
+			status, err := w.fetchStatusFromAPI()
 			if err != nil {
-				log.Errorf("failed to fetch status: %q", err)
-				w.mux.Unlock()
+				if httpclient.IsOffline(err) {
+					log.Debugf("failed to fetch status: %q", err)
+				} else {
+					log.Errorf("failed to fetch status: %q", err)
+				}
 				continue
 			}
-			w.status = state
+			w.mux.Lock()
+			w.status = status
+			state := w.localState()
 			w.mux.Unlock()
 
-			if err := w.sendLocalState(); err != nil {
+			if err := w.sendState(state); err != nil {
 				log.Errorf("failed to send state:%q", err)
 			}
 		}
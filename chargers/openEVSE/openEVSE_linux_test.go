@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package openEVSE
+
+import (
+	"testing"
+
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/chargers/openEVSE/fake"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+func TestWorkerSerial(t *testing.T) {
+	t.Parallel()
+	srv := fake.NewServer("", "")
+	defer srv.Close()
+	srv.SetVehicleConnected(true)
+	port, err := srv.ServeSerial()
+	if err != nil {
+		t.Skipf("pseudo terminals are not available: %v", err)
+	}
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		OpenEVSE: config.OpenEVSECharger{
+			SerialPort: port,
+		},
+	}
+	if err := cfg.OpenEVSE.Validate(); err != nil {
+		t.Fatalf("validating config: %v", err)
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	if !state.Active || state.CurrentAmpSetting != 16 || state.Vehicle != params.VehicleCharging {
+		t.Errorf("unexpected initial state: %+v", state)
+	}
+
+	// The current we set is reported from the pilot, without being saved
+	// to EEPROM.
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	state = commontest.WaitForState(t, stateChan, "new current", func(state params.ChargerState) bool {
+		return state.CurrentAmpSetting == 10
+	})
+	if state.EEPROMWrites != 0 || srv.EEPROMWrites() != 0 {
+		t.Errorf("expected no EEPROM writes, got %d reported, %d on the station", state.EEPROMWrites, srv.EEPROMWrites())
+	}
+}
@@ -0,0 +1,186 @@
+package openEVSE
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/chargers/openEVSE/fake"
+	"solar-ev-charger/config"
+	mqttfake "solar-ev-charger/mqttclient/fake"
+	"solar-ev-charger/params"
+)
+
+func TestWorkerHTTPAPI(t *testing.T) {
+	t.Parallel()
+	srv := fake.NewServer("admin", "secret")
+	t.Cleanup(srv.Close)
+	srv.SetVehicleConnected(true)
+	// The claim is handed back to the station once the worker stops.
+	t.Cleanup(func() {
+		if claims := srv.Claims(); len(claims) != 0 {
+			t.Errorf("expected the claim to be released, got %+v", claims)
+		}
+	})
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		OpenEVSE: config.OpenEVSECharger{
+			Address:  srv.Addr(),
+			Username: "admin",
+			Password: "secret",
+			API:      config.OpenEVSEHTTP,
+		},
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	if !state.Active || state.CurrentAmpSetting != 16 || state.Vehicle != params.VehicleCharging {
+		t.Errorf("unexpected initial state: %+v", state)
+	}
+
+	// Changes to our claim are pushed over the websocket.
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "new current", func(state params.ChargerState) bool {
+		return state.CurrentAmpSetting == 10 && state.CurrentUsage == 10*230
+	})
+
+	// A manual override wins over our claim, and is reported so the
+	// worker leaves the station alone.
+	srv.SetOverride(&client.Claim{State: client.ClaimStateActive, ChargeCurrent: 20})
+	commontest.WaitForState(t, stateChan, "manual override", func(state params.ChargerState) bool {
+		return state.ManualOverride && state.CurrentAmpSetting == 20
+	})
+	srv.SetOverride(nil)
+	commontest.WaitForState(t, stateChan, "cleared override", func(state params.ChargerState) bool {
+		return !state.ManualOverride && state.CurrentAmpSetting == 10
+	})
+
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "disabled state", func(state params.ChargerState) bool {
+		return !state.Active && state.Vehicle == params.VehicleConnected
+	})
+
+	expected := client.Claim{
+		State:         client.ClaimStateDisabled,
+		ChargeCurrent: 10,
+		Priority:      client.DefaultClaimPriority,
+	}
+	if got := srv.Claims()[client.DefaultClaimClientID]; got != expected {
+		t.Errorf("expected claim %+v, got %+v", expected, got)
+	}
+}
+
+func TestWorkerMQTTCommands(t *testing.T) {
+	t.Parallel()
+	broker := mqttfake.NewBroker()
+	t.Cleanup(func() { broker.Close() })
+	port, err := broker.Listen("tcp", nil)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+	srv := fake.NewServer("admin", "secret")
+	t.Cleanup(srv.Close)
+	srv.SetVehicleConnected(true)
+	srv.ServeMQTT(broker, "openevse")
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		OpenEVSE: config.OpenEVSECharger{
+			// The station is only reachable through the broker.
+			Address:         commontest.FreeAddress(t),
+			Username:        "admin",
+			Password:        "secret",
+			BaseTopic:       "openevse",
+			UseMQTT:         true,
+			UseMQTTCommands: true,
+			MQTT: config.MQTTSettings{
+				Broker: "127.0.0.1",
+				Port:   port,
+			},
+		},
+	}
+	if err := cfg.OpenEVSE.MQTT.Validate(); err != nil {
+		t.Fatalf("validating mqtt settings: %v", err)
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	if !state.Active || state.CurrentAmpSetting != 16 || state.Vehicle != params.VehicleCharging {
+		t.Errorf("unexpected initial state: %+v", state)
+	}
+
+	if err := cli.SetAmp(10); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "new current", func(state params.ChargerState) bool {
+		return state.CurrentAmpSetting == 10
+	})
+	var sent bool
+	for _, msg := range broker.Published() {
+		if msg.Topic == "openevse/rapi/in/$SC" && string(msg.Payload) == "10 V" {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Errorf("expected the current to be set over mqtt, got %+v", broker.Published())
+	}
+}
+
+func TestStateSentWithoutLock(t *testing.T) {
+	t.Parallel()
+	srv := fake.NewServer("admin", "secret")
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		OpenEVSE: config.OpenEVSECharger{
+			Address:  srv.Addr(),
+			Username: "admin",
+			Password: "secret",
+			API:      config.OpenEVSEHTTP,
+		},
+	}
+	// The state is only read when the test asks for it, as if the worker
+	// was busy.
+	stateChan := make(chan params.ChargerState)
+	bw, err := NewWorker(context.Background(), cfg, stateChan)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	w := bw.(*Worker)
+	if err := w.Start(); err != nil {
+		t.Fatalf("starting worker: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := w.Stop(); err != nil {
+			t.Errorf("stopping worker: %v", err)
+		}
+	})
+	commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+
+	// Plugging in is pushed over the websocket, and the state waits for
+	// the worker. Meanwhile, the lock is free for MQTT updates.
+	srv.SetVehicleConnected(true)
+	time.Sleep(200 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		w.mux.Lock()
+		w.mux.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("the lock is held while sending the state")
+	}
+	commontest.WaitForState(t, stateChan, "plugged in vehicle", func(state params.ChargerState) bool {
+		return state.Vehicle == params.VehicleCharging
+	})
+}
@@ -0,0 +1,190 @@
+package openEVSE
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"solar-ev-charger/chargers/openEVSE/client"
+	"solar-ev-charger/params"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// detectStatusAPI checks whether the firmware exposes the /status JSON
+// endpoint. If it does, we use it instead of making three RAPI calls for
+// every status update. Must be called before the websocket loop starts.
+func (w *Worker) detectStatusAPI() {
+	if w.cfg.OpenEVSE.SerialPort != "" {
+		// The controller is not connected to a WiFi module.
+		w.statusAPI = false
+		return
+	}
+	if w.cfg.OpenEVSE.UseMQTTCommands {
+		// The station may only be reachable through the broker.
+		w.statusAPI = false
+		return
+	}
+	if _, err := w.apiCli.GetStatus(); err != nil {
+		log.Infof("/status is not available (%q); falling back to RAPI", err)
+		w.statusAPI = false
+		return
+	}
+	log.Infof("using /status JSON API")
+	w.statusAPI = true
+}
+
+func (w *Worker) statusFromAPI(status client.Status) chargerStatus {
+	var usage float64
+	if status.Amp > 0 {
+		usage = status.Amp / 1000
+	}
+	// The pilot state is not part of the status. Derive it from the
+	// vehicle flag, for when the EVSE is sleeping or disabled.
+	pilotState := evseStateNotConnected
+	if status.Vehicle == 1 {
+		pilotState = evseStateConnected
+	}
+	return chargerStatus{
+		currentUsage:      float64(uint64(usage) * w.cfg.ElectricalPresure),
+		currentAmpSetting: status.Pilot,
+		enabled:           status.State != 254 && status.State != 255,
+		sessionEnergy:     status.SessionEnergy,
+		vehicle:           vehicleState(status.State, pilotState),
+		manualOverride:    status.ManualOverride == 1,
+	}
+}
+
+// EVSE states, as reported by RAPI $GS. States between
+// evseStateCharging and evseStateSleeping are faults.
+const (
+	evseStateNotConnected uint64 = 1
+	evseStateConnected    uint64 = 2
+	evseStateCharging     uint64 = 3
+	evseStateSleeping     uint64 = 254
+	evseStateDisabled     uint64 = 255
+)
+
+// vehicleState maps the EVSE state to a vehicle state. While the EVSE is
+// sleeping or disabled, the pilot state tells whether a vehicle is plugged
+// in.
+func vehicleState(evseState, pilotState uint64) params.VehicleState {
+	if evseState == evseStateSleeping || evseState == evseStateDisabled {
+		evseState = pilotState
+	}
+	switch {
+	case evseState == evseStateNotConnected:
+		return params.VehicleDisconnected
+	case evseState == evseStateConnected:
+		return params.VehicleConnected
+	case evseState == evseStateCharging:
+		return params.VehicleCharging
+	case evseState > evseStateCharging && evseState < evseStateSleeping:
+		return params.VehicleError
+	}
+	return params.VehicleUnknown
+}
+
+func (w *Worker) connectWebSocket() (*websocket.Conn, error) {
+	header := http.Header{}
+	if w.cfg.OpenEVSE.Username != "" {
+		creds := fmt.Sprintf("%s:%s", w.cfg.OpenEVSE.Username, w.cfg.OpenEVSE.Password)
+		header.Set("Authorization", fmt.Sprintf("Basic %s", b64.StdEncoding.EncodeToString([]byte(creds))))
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+	}
+	conn, _, err := dialer.DialContext(w.ctx, fmt.Sprintf("ws://%s/ws", w.cfg.OpenEVSE.Address), header)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to websocket")
+	}
+	return conn, nil
+}
+
+// handleWebSocketMessage applies a push update to the local status. The
+// firmware only sends the keys that changed, so we decode the message over
+// the last known status.
+func (w *Worker) handleWebSocketMessage(msg []byte) error {
+	w.mux.Lock()
+	status := w.apiStatus
+	if err := json.Unmarshal(msg, &status); err != nil {
+		w.mux.Unlock()
+		return errors.Wrap(err, "decoding message")
+	}
+	if status == w.apiStatus {
+		w.mux.Unlock()
+		return nil
+	}
+	w.apiStatus = status
+
+	newStatus := w.statusFromAPI(status)
+	if w.cfg.OpenEVSE.UseMQTT {
+		// Usage, state and vehicle are also published over MQTT.
+		w.status.currentAmpSetting = newStatus.currentAmpSetting
+		w.status.sessionEnergy = newStatus.sessionEnergy
+		w.status.manualOverride = newStatus.manualOverride
+	} else {
+		w.status = newStatus
+	}
+	state := w.localState()
+	w.mux.Unlock()
+
+	if err := w.sendState(state); err != nil {
+		return errors.Wrap(err, "sending state")
+	}
+	return nil
+}
+
+func (w *Worker) setWebSocketConnected(connected bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.wsConnected = connected
+}
+
+// loopWebSocket receives status updates pushed by the firmware over /ws.
+// While the websocket is connected, the regular polling is paused.
+func (w *Worker) loopWebSocket() {
+	for {
+		conn, err := w.connectWebSocket()
+		if err != nil {
+			log.Errorf("failed to connect to websocket: %q", err)
+		} else {
+			log.Infof("receiving status updates over websocket")
+			w.setWebSocketConnected(true)
+
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-w.ctx.Done():
+				case <-w.quit:
+				case <-done:
+				}
+				conn.Close()
+			}()
+
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					log.Infof("websocket connection closed: %q", err)
+					break
+				}
+				if err := w.handleWebSocketMessage(msg); err != nil {
+					log.Errorf("failed to handle websocket message: %q", err)
+				}
+			}
+			close(done)
+			w.setWebSocketConnected(false)
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package relay
+
+import "solar-ev-charger/chargers/common"
+
+// relayClient switches the charger on and off.
+type relayClient struct {
+	relay relaySwitch
+	// current is the current the charger draws while switched on, in Amps,
+	// as if it was drawn from a single phase.
+	current float64
+}
+
+func (r *relayClient) Start() error {
+	return r.relay.Set(true)
+}
+
+func (r *relayClient) Stop() error {
+	return r.relay.Set(false)
+}
+
+// SetAmp is a no-op. The charger draws a fixed current.
+func (r *relayClient) SetAmp(amp float64) error {
+	return nil
+}
+
+// Capabilities reports a charger which can only be switched on and off,
+// drawing the configured current. The current is the configured power
+// divided by the voltage of a single phase, so it is reported as drawn from
+// one phase whatever charger_phases is set to.
+func (r *relayClient) Capabilities() (common.Capabilities, error) {
+	return common.Capabilities{
+		MinCurrent: r.current,
+		MaxCurrent: r.current,
+		Phases:     1,
+		Toggle:     true,
+	}, nil
+}
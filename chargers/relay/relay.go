@@ -0,0 +1,138 @@
+// Package relay implements a driver for chargers without an adjustable
+// current, which are switched on and off by a Victron GX relay or a Shelly.
+package relay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/httpclient"
+	"solar-ev-charger/params"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.relay")
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "Relay",
+		ConfigSection: "Relay",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.Relay },
+		Validate:      func(cfg *config.Config) error { return cfg.Relay.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.Relay.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating relay config")
+	}
+	relay, err := newRelaySwitch(cfg.Relay, cfg.ChargerHTTP)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating relay")
+	}
+	return &Worker{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		relay:        relay,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+	}, nil
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	cfg          config.Config
+	relay        relaySwitch
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &relayClient{
+		relay:   w.relay,
+		current: w.cfg.Relay.PowerDraw / float64(w.cfg.ElectricalPresure),
+	}, nil
+}
+
+func (w *Worker) poll() error {
+	on, err := w.relay.Get()
+	if err != nil {
+		return errors.Wrap(err, "reading relay state")
+	}
+
+	// We can't measure the power drawn by the charger. Assume it draws
+	// the configured power while switched on.
+	state := params.ChargerState{
+		Active:            on,
+		CurrentAmpSetting: w.cfg.Relay.PowerDraw / float64(w.cfg.ElectricalPresure),
+	}
+	if on {
+		state.CurrentUsage = w.cfg.Relay.PowerDraw
+	}
+
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) loop() {
+	timer := time.NewTicker(time.Duration(w.cfg.Relay.PollInterval) * time.Second)
+	defer func() {
+		timer.Stop()
+		w.relay.Close()
+		close(w.closed)
+	}()
+
+	if err := w.poll(); err != nil {
+		if httpclient.IsOffline(err) {
+			log.Debugf("failed to poll relay: %q", err)
+		} else {
+			log.Errorf("failed to poll relay: %q", err)
+		}
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if err := w.poll(); err != nil {
+				if httpclient.IsOffline(err) {
+					log.Debugf("failed to poll relay: %q", err)
+				} else {
+					log.Errorf("failed to poll relay: %q", err)
+				}
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// shelly serves the relay API of a gen1 and a gen2 Shelly.
+type shelly struct {
+	mux      sync.Mutex
+	on       bool
+	requests []string
+	// body overrides the response if not empty.
+	body string
+}
+
+func (s *shelly) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	request := req.URL.Path
+	if req.URL.RawQuery != "" {
+		request += "?" + req.URL.RawQuery
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		request = user + ":" + password + "@" + request
+	}
+	s.requests = append(s.requests, request)
+
+	query := req.URL.Query()
+	switch req.URL.Path {
+	case "/relay/0":
+		switch query.Get("turn") {
+		case "on":
+			s.on = true
+		case "off":
+			s.on = false
+		}
+		if s.body == "" {
+			fmt.Fprintf(rw, `{"ison": %v, "has_timer": false}`, s.on)
+			return
+		}
+	case "/rpc/Switch.GetStatus":
+		if s.body == "" {
+			fmt.Fprintf(rw, `{"id": 0, "output": %v, "apower": 0}`, s.on)
+			return
+		}
+	case "/rpc/Switch.Set":
+		wasOn := s.on
+		s.on = query.Get("on") == "true"
+		fmt.Fprintf(rw, `{"was_on": %v}`, wasOn)
+		return
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+	fmt.Fprint(rw, s.body)
+}
+
+func (s *shelly) takeRequests() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ret := s.requests
+	s.requests = nil
+	return ret
+}
+
+// newShellyRelay returns a relay controlling the Shelly served by srv.
+func newShellyRelay(t *testing.T, srv *httptest.Server, generation uint, username string) relaySwitch {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parsing URL: %v", err)
+	}
+	httpSettings := config.HTTPClientSettings{Attempts: 1}
+	if err := httpSettings.Validate(); err != nil {
+		t.Fatalf("validating HTTP settings: %v", err)
+	}
+	relay, err := newRelaySwitch(config.RelayCharger{
+		Type:             config.ShellyRelay,
+		ShellyAddress:    u.Host,
+		ShellyGeneration: generation,
+		Username:         username,
+		Password:         "secret",
+	}, httpSettings)
+	if err != nil {
+		t.Fatalf("creating relay: %v", err)
+	}
+	return relay
+}
+
+func TestShellyRelay(t *testing.T) {
+	tests := []struct {
+		generation uint
+		username   string
+		requests   []string
+	}{
+		{
+			generation: 1,
+			requests: []string{
+				"/relay/0",
+				"/relay/0?turn=on",
+				"/relay/0",
+				"/relay/0?turn=off",
+				"/relay/0",
+			},
+		}, {
+			generation: 1,
+			username:   "admin",
+			requests: []string{
+				"admin:secret@/relay/0",
+				"admin:secret@/relay/0?turn=on",
+				"admin:secret@/relay/0",
+				"admin:secret@/relay/0?turn=off",
+				"admin:secret@/relay/0",
+			},
+		}, {
+			generation: 2,
+			requests: []string{
+				"/rpc/Switch.GetStatus?id=0",
+				"/rpc/Switch.Set?id=0&on=true",
+				"/rpc/Switch.GetStatus?id=0",
+				"/rpc/Switch.Set?id=0&on=false",
+				"/rpc/Switch.GetStatus?id=0",
+			},
+		},
+	}
+	for _, tc := range tests {
+		name := fmt.Sprintf("gen%d %q", tc.generation, tc.username)
+		sh := &shelly{}
+		srv := httptest.NewServer(sh)
+		relay := newShellyRelay(t, srv, tc.generation, tc.username)
+
+		for i, on := range []bool{false, true, false} {
+			if i > 0 {
+				if err := relay.Set(on); err != nil {
+					t.Errorf("%s: switching to %v: %v", name, on, err)
+				}
+			}
+			got, err := relay.Get()
+			if err != nil {
+				t.Errorf("%s: reading relay: %v", name, err)
+			} else if got != on {
+				t.Errorf("%s: expected the relay to be %v, got %v", name, on, got)
+			}
+		}
+		if got := sh.takeRequests(); strings.Join(got, " ") != strings.Join(tc.requests, " ") {
+			t.Errorf("%s: expected requests %v, got %v", name, tc.requests, got)
+		}
+		relay.Close()
+		srv.Close()
+	}
+}
+
+func TestShellyRelayErrors(t *testing.T) {
+	tests := []struct {
+		generation uint
+		body       string
+		err        string
+	}{
+		{1, `{"has_timer": false}`, "missing ison in shelly response"},
+		{2, `{"id": 0}`, "missing output in shelly response"},
+		{1, `not json`, "decoding"},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(&shelly{body: tc.body})
+		relay := newShellyRelay(t, srv, tc.generation, "")
+		if _, err := relay.Get(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("gen%d %s: expected an error containing %q, got %v", tc.generation, tc.body, tc.err, err)
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if err := newShellyRelay(t, srv, 1, "").Set(true); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	sh := &shelly{}
+	srv := httptest.NewServer(sh)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parsing URL: %v", err)
+	}
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		ChargerPhases:     3,
+		Relay: config.RelayCharger{
+			Type:          config.ShellyRelay,
+			ShellyAddress: u.Host,
+			PowerDraw:     2300,
+			PollInterval:  1,
+		},
+	}
+	if err := cfg.ChargerHTTP.Validate(); err != nil {
+		t.Fatalf("validating HTTP settings: %v", err)
+	}
+	_, cli, stateChan := commontest.StartWorker(t, NewWorker, cfg)
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	expected := params.ChargerState{CurrentAmpSetting: 10}
+	if state != expected {
+		t.Errorf("expected initial state %+v, got %+v", expected, state)
+	}
+
+	// The current is derived from the power over a single phase, so the
+	// charger is reported as single phase whatever charger_phases is.
+	caps, err := cli.Capabilities()
+	if err != nil {
+		t.Fatalf("fetching capabilities: %v", err)
+	}
+	if caps.MinCurrent != 10 || caps.MaxCurrent != 10 || caps.Phases != 1 || caps.Adjustable() || !caps.Toggle {
+		t.Errorf("unexpected capabilities: %+v", caps)
+	}
+
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "switched on", func(state params.ChargerState) bool {
+		return state.Active && state.CurrentUsage == 2300
+	})
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	commontest.WaitForState(t, stateChan, "switched off", func(state params.ChargerState) bool {
+		return !state.Active && state.CurrentUsage == 0
+	})
+}
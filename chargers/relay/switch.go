@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/dbus"
+	"solar-ev-charger/httpclient"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// relaySwitch is a relay we can read and switch.
+type relaySwitch interface {
+	Get() (bool, error)
+	Set(on bool) error
+	Close() error
+}
+
+func newRelaySwitch(cfg config.RelayCharger, httpSettings config.HTTPClientSettings) (relaySwitch, error) {
+	switch cfg.Type {
+	case config.GXRelay:
+		conn, err := godbus.ConnectSystemBus()
+		if err != nil {
+			return nil, errors.Wrap(err, "creating dbus connection")
+		}
+		return &gxRelay{
+			conn: conn,
+			path: fmt.Sprintf("/Relay/%d/State", cfg.RelayIndex),
+		}, nil
+	case config.ShellyRelay:
+		return &shellyRelay{
+			cfg: cfg,
+			cli: httpclient.New("Shelly", httpSettings),
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid relay type: %q", cfg.Type)
+}
+
+// gxService is the dbus service exposing the relays of a GX device. The
+// relay function must be set to "Manual" in the GX settings.
+const gxService = "com.victronenergy.system"
+
+type gxRelay struct {
+	conn *godbus.Conn
+	path string
+}
+
+func (g *gxRelay) Get() (bool, error) {
+	ret, err := dbus.GetValue(g.conn, gxService, g.path)
+	if err != nil {
+		return false, err
+	}
+	val, err := dbus.ValueAsFloat(ret)
+	if err != nil {
+		return false, errors.Wrapf(err, "converting %s to float64", g.path)
+	}
+	return val == 1, nil
+}
+
+func (g *gxRelay) Set(on bool) error {
+	var val int32
+	if on {
+		val = 1
+	}
+	return dbus.SetValue(g.conn, gxService, g.path, val)
+}
+
+func (g *gxRelay) Close() error {
+	return g.conn.Close()
+}
+
+type shellyRelay struct {
+	cfg config.RelayCharger
+	cli *httpclient.Client
+}
+
+// shellyStatus holds the relay state returned by both API generations.
+type shellyStatus struct {
+	// IsOn is returned by gen1 devices.
+	IsOn *bool `json:"ison"`
+	// Output is returned by gen2 devices.
+	Output *bool `json:"output"`
+}
+
+func (s *shellyRelay) do(path string, query url.Values) (shellyStatus, error) {
+	var status shellyStatus
+	u := url.URL{
+		Scheme:   "http",
+		Host:     s.cfg.ShellyAddress,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return status, errors.Wrap(err, "creating request")
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return status, err
+	}
+	if err := resp.DecodeJSON(&status); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+func (s *shellyRelay) Get() (bool, error) {
+	var status shellyStatus
+	var err error
+	if s.cfg.ShellyGeneration == 2 {
+		status, err = s.do("/rpc/Switch.GetStatus", url.Values{"id": {fmt.Sprint(s.cfg.RelayIndex)}})
+		if err != nil {
+			return false, err
+		}
+		if status.Output == nil {
+			return false, fmt.Errorf("missing output in shelly response")
+		}
+		return *status.Output, nil
+	}
+	status, err = s.do(fmt.Sprintf("/relay/%d", s.cfg.RelayIndex), nil)
+	if err != nil {
+		return false, err
+	}
+	if status.IsOn == nil {
+		return false, fmt.Errorf("missing ison in shelly response")
+	}
+	return *status.IsOn, nil
+}
+
+func (s *shellyRelay) Set(on bool) error {
+	if s.cfg.ShellyGeneration == 2 {
+		_, err := s.do("/rpc/Switch.Set", url.Values{
+			"id": {fmt.Sprint(s.cfg.RelayIndex)},
+			"on": {fmt.Sprint(on)},
+		})
+		return err
+	}
+	turn := "off"
+	if on {
+		turn = "on"
+	}
+	_, err := s.do(fmt.Sprintf("/relay/%d", s.cfg.RelayIndex), url.Values{"turn": {turn}})
+	return err
+}
+
+func (s *shellyRelay) Close() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+package victronEVCS
+
+import (
+	"math"
+
+	"solar-ev-charger/chargers/common"
+
+	"github.com/pkg/errors"
+)
+
+// evcsClient controls the charger polled by the worker.
+type evcsClient struct {
+	worker *Worker
+}
+
+func (c *evcsClient) setValue(path string, value int32) error {
+	w := c.worker
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if err := w.initialize(); err != nil {
+		return errors.Wrap(err, "initializing charger")
+	}
+	return w.setValue(path, value)
+}
+
+func (c *evcsClient) Start() error {
+	return c.setValue("/StartStop", startCharging)
+}
+
+func (c *evcsClient) Stop() error {
+	return c.setValue("/StartStop", stopCharging)
+}
+
+func (c *evcsClient) SetAmp(amp float64) error {
+	return c.setValue("/SetCurrent", int32(math.Round(amp)))
+}
+
+// Capabilities reads the current limit configured on the charger from
+// /MaxCurrent.
+func (c *evcsClient) Capabilities() (common.Capabilities, error) {
+	w := c.worker
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if err := w.initialize(); err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "initializing charger")
+	}
+	maxCurrent, err := w.getFloat("/MaxCurrent")
+	if err != nil {
+		return common.Capabilities{}, errors.Wrap(err, "fetching max current")
+	}
+	return common.Capabilities{
+		MinCurrent:    6,
+		MaxCurrent:    maxCurrent,
+		CurrentStep:   1,
+		Toggle:        true,
+		PlugDetection: true,
+	}, nil
+}
@@ -0,0 +1,290 @@
+// Package victronEVCS implements a driver for Victron EV Charging Stations,
+// controlled through the dbus service Venus OS exposes for them.
+package victronEVCS
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/dbus"
+	"solar-ev-charger/params"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.victronEVCS")
+
+// servicePrefix is the prefix of the dbus services of EV chargers.
+const servicePrefix = "com.victronenergy.evcharger."
+
+// modeManual is the value of /Mode which allows us to control the charger.
+const modeManual int32 = 0
+
+// Values of /StartStop.
+const (
+	stopCharging  int32 = 0
+	startCharging int32 = 1
+)
+
+// Values of /Status. Values above statusLowSOC are faults.
+const (
+	statusDisconnected   = 0
+	statusConnected      = 1
+	statusCharging       = 2
+	statusCharged        = 3
+	statusWaitingForRFID = 5
+	statusLowSOC         = 7
+)
+
+func init() {
+	common.RegisterDriver(common.Driver{
+		Name:          "VictronEVCS",
+		ConfigSection: "VictronEVCS",
+		Settings:      func(cfg *config.Config) interface{} { return &cfg.VictronEVCS },
+		Validate:      func(cfg *config.Config) error { return cfg.VictronEVCS.Validate() },
+		New:           common.ProviderFactory(NewWorker),
+	})
+}
+
+func NewWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+	if err := cfg.VictronEVCS.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating VictronEVCS config")
+	}
+
+	conn, err := godbus.ConnectSystemBus()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating dbus connection")
+	}
+	return newWorker(ctx, cfg, stateChan, &systemBus{conn: conn}), nil
+}
+
+func newWorker(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState, bus busItems) *Worker {
+	return &Worker{
+		stateChanged: stateChan,
+		ctx:          ctx,
+		cfg:          *cfg,
+		bus:          bus,
+		service:      cfg.VictronEVCS.Service,
+		closed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+	}
+}
+
+// busItems reads and writes the BusItems of dbus services.
+type busItems interface {
+	FindServices(prefix string) ([]string, error)
+	GetValue(service, path string) (interface{}, error)
+	SetValue(service, path string, value interface{}) error
+	Close() error
+}
+
+// systemBus implements busItems over the system bus.
+type systemBus struct {
+	conn *godbus.Conn
+}
+
+func (b *systemBus) FindServices(prefix string) ([]string, error) {
+	return dbus.FindServices(b.conn, prefix)
+}
+
+func (b *systemBus) GetValue(service, path string) (interface{}, error) {
+	return dbus.GetValue(b.conn, service, path)
+}
+
+func (b *systemBus) SetValue(service, path string, value interface{}) error {
+	return dbus.SetValue(b.conn, service, path, value)
+}
+
+func (b *systemBus) Close() error {
+	return b.conn.Close()
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	stateChanged chan params.ChargerState
+	cfg          config.Config
+	bus          busItems
+
+	mux         sync.Mutex
+	service     string
+	initialized bool
+}
+
+// ChargerClient implements common.ClientProvider.
+func (w *Worker) ChargerClient() (common.Client, error) {
+	return &evcsClient{worker: w}, nil
+}
+
+// initialize finds the service of the charger, if not configured, and
+// switches it to manual mode. Must be called with the lock held.
+func (w *Worker) initialize() error {
+	if w.initialized {
+		return nil
+	}
+	if w.service == "" {
+		services, err := w.bus.FindServices(servicePrefix)
+		if err != nil {
+			return err
+		}
+		if len(services) == 0 {
+			return fmt.Errorf("no EV charger found on dbus")
+		}
+		if len(services) > 1 {
+			log.Warningf("found %d EV chargers, using %s", len(services), services[0])
+		}
+		w.service = services[0]
+		log.Infof("using EV charger %s", w.service)
+	}
+
+	mode, err := w.getFloat("/Mode")
+	if err != nil {
+		return err
+	}
+	if int32(mode) != modeManual {
+		// In auto mode, the charger decides the current on its own.
+		log.Infof("switching EV charger to manual mode")
+		if err := w.setValue("/Mode", modeManual); err != nil {
+			return err
+		}
+	}
+	w.initialized = true
+	return nil
+}
+
+func (w *Worker) getFloat(path string) (float64, error) {
+	ret, err := w.bus.GetValue(w.service, path)
+	if err != nil {
+		return 0, err
+	}
+	val, err := dbus.ValueAsFloat(ret)
+	if err != nil {
+		return 0, errors.Wrapf(err, "converting %s to float64", path)
+	}
+	return val, nil
+}
+
+func (w *Worker) setValue(path string, value interface{}) error {
+	return w.bus.SetValue(w.service, path, value)
+}
+
+func (w *Worker) readState() (params.ChargerState, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	var state params.ChargerState
+	if err := w.initialize(); err != nil {
+		return state, errors.Wrap(err, "initializing charger")
+	}
+
+	startStop, err := w.getFloat("/StartStop")
+	if err != nil {
+		return state, err
+	}
+	state.Active = int32(startStop) == startCharging
+
+	setting, err := w.getFloat("/SetCurrent")
+	if err != nil {
+		return state, err
+	}
+	state.CurrentAmpSetting = setting
+
+	// Invalid values are published as empty arrays, for example while
+	// no vehicle is connected.
+	if power, err := w.getFloat("/Ac/Power"); err == nil {
+		state.CurrentUsage = power
+	} else if current, err := w.getFloat("/Current"); err == nil {
+		state.CurrentUsage = current * float64(w.cfg.ElectricalPresure)
+	}
+	// The charger also publishes /Ac/Energy/Forward, but it is not
+	// documented whether it counts the current session only, so we do not
+	// report a session energy.
+
+	status, err := w.getFloat("/Status")
+	if err != nil {
+		return state, err
+	}
+	log.Tracef("charger status is %v", status)
+	state.Vehicle = vehicleState(int(status))
+	if status == statusWaitingForRFID {
+		log.Warningf("EV charger is waiting for RFID authorization")
+	}
+	return state, nil
+}
+
+// vehicleState maps the value of /Status to a vehicle state.
+func vehicleState(status int) params.VehicleState {
+	switch {
+	case status == statusDisconnected:
+		return params.VehicleDisconnected
+	case status == statusCharging:
+		return params.VehicleCharging
+	case status == statusCharged:
+		return params.VehicleFinished
+	case status > statusLowSOC:
+		return params.VehicleError
+	}
+	return params.VehicleConnected
+}
+
+func (w *Worker) poll() error {
+	state, err := w.readState()
+	if err != nil {
+		return err
+	}
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) loop() {
+	timer := time.NewTicker(time.Duration(w.cfg.VictronEVCS.PollInterval) * time.Second)
+	defer func() {
+		timer.Stop()
+		w.bus.Close()
+		close(w.closed)
+	}()
+
+	if err := w.poll(); err != nil {
+		log.Errorf("failed to poll charger: %q", err)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if err := w.poll(); err != nil {
+				log.Errorf("failed to poll charger: %q", err)
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
@@ -0,0 +1,331 @@
+package victronEVCS
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/chargers/common/commontest"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// fakeBus holds the BusItems of the services on a fake system bus.
+type fakeBus struct {
+	mux      sync.Mutex
+	services map[string]map[string]interface{}
+	writes   []string
+	closed   bool
+}
+
+func newFakeBus(services ...string) *fakeBus {
+	b := &fakeBus{services: map[string]map[string]interface{}{}}
+	for _, service := range services {
+		b.services[service] = map[string]interface{}{
+			"/Mode":       int32(1),
+			"/StartStop":  int32(0),
+			"/SetCurrent": int32(16),
+			"/MaxCurrent": int32(32),
+			"/Status":     int32(statusDisconnected),
+			// Invalid values are published as empty arrays.
+			"/Ac/Power": []interface{}{},
+			"/Current":  []interface{}{},
+		}
+	}
+	return b
+}
+
+func (b *fakeBus) FindServices(prefix string) ([]string, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var ret []string
+	for service := range b.services {
+		if strings.HasPrefix(service, prefix) {
+			ret = append(ret, service)
+		}
+	}
+	return ret, nil
+}
+
+func (b *fakeBus) GetValue(service, path string) (interface{}, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	val, ok := b.services[service][path]
+	if !ok {
+		return nil, fmt.Errorf("%s has no %s", service, path)
+	}
+	return val, nil
+}
+
+func (b *fakeBus) SetValue(service, path string, value interface{}) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.services[service][path]; !ok {
+		return fmt.Errorf("%s has no %s", service, path)
+	}
+	b.services[service][path] = value
+	b.writes = append(b.writes, fmt.Sprintf("%s=%v", path, value))
+	return nil
+}
+
+func (b *fakeBus) Close() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *fakeBus) set(service, path string, value interface{}) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.services[service][path] = value
+}
+
+func (b *fakeBus) takeWrites() []string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ret := b.writes
+	b.writes = nil
+	return ret
+}
+
+const testService = "com.victronenergy.evcharger.ttyS0"
+
+func newTestWorker(bus *fakeBus, service string) *Worker {
+	cfg := &config.Config{
+		ElectricalPresure: 230,
+		VictronEVCS:       config.VictronEVCSCharger{Service: service, PollInterval: 60},
+	}
+	return newWorker(context.Background(), cfg, make(chan params.ChargerState, 10), bus)
+}
+
+func TestVehicleState(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected params.VehicleState
+	}{
+		{statusDisconnected, params.VehicleDisconnected},
+		{statusConnected, params.VehicleConnected},
+		{statusCharging, params.VehicleCharging},
+		{statusCharged, params.VehicleFinished},
+		{4, params.VehicleConnected},
+		{statusWaitingForRFID, params.VehicleConnected},
+		{statusLowSOC, params.VehicleConnected},
+		{8, params.VehicleError},
+		{24, params.VehicleError},
+	}
+	for _, tc := range tests {
+		if got := vehicleState(tc.status); got != tc.expected {
+			t.Errorf("vehicleState(%d) = %v, expected %v", tc.status, got, tc.expected)
+		}
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	tests := []struct {
+		name       string
+		services   []string
+		configured string
+		mode       int32
+		service    string
+		writes     []string
+		err        string
+	}{
+		{
+			name:     "discovered service",
+			services: []string{testService},
+			mode:     1,
+			service:  testService,
+			writes:   []string{"/Mode=0"},
+		}, {
+			name:     "already in manual mode",
+			services: []string{testService},
+			mode:     modeManual,
+			service:  testService,
+		}, {
+			name:       "configured service",
+			services:   []string{testService, "com.victronenergy.evcharger.ttyS1"},
+			configured: "com.victronenergy.evcharger.ttyS1",
+			mode:       1,
+			service:    "com.victronenergy.evcharger.ttyS1",
+			writes:     []string{"/Mode=0"},
+		}, {
+			name:     "no charger",
+			services: []string{"com.victronenergy.battery.ttyS0"},
+			err:      "no EV charger found on dbus",
+		}, {
+			name:       "missing configured service",
+			services:   []string{testService},
+			configured: "com.victronenergy.evcharger.ttyS1",
+			err:        "com.victronenergy.evcharger.ttyS1 has no /Mode",
+		},
+	}
+	for _, tc := range tests {
+		bus := newFakeBus(tc.services...)
+		for _, service := range tc.services {
+			bus.set(service, "/Mode", tc.mode)
+		}
+		w := newTestWorker(bus, tc.configured)
+		err := w.initialize()
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			if w.initialized {
+				t.Errorf("%s: expected the worker not to be initialized", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if w.service != tc.service {
+			t.Errorf("%s: expected service %s, got %s", tc.name, tc.service, w.service)
+		}
+		if got := bus.takeWrites(); fmt.Sprint(got) != fmt.Sprint(tc.writes) {
+			t.Errorf("%s: expected writes %v, got %v", tc.name, tc.writes, got)
+		}
+		// Once initialized, the mode is not checked again.
+		bus.set(tc.service, "/Mode", int32(1))
+		if err := w.initialize(); err != nil || len(bus.takeWrites()) != 0 {
+			t.Errorf("%s: expected initializing again to be a no-op, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestReadState(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		expected params.ChargerState
+		err      bool
+	}{
+		{
+			name: "disconnected",
+			expected: params.ChargerState{
+				CurrentAmpSetting: 16,
+				Vehicle:           params.VehicleDisconnected,
+			},
+		}, {
+			name: "charging",
+			values: map[string]interface{}{
+				"/StartStop":         int32(1),
+				"/SetCurrent":        int32(10),
+				"/Ac/Power":          float64(2300),
+				"/Current":           float64(10),
+				"/Ac/Energy/Forward": float64(1.5),
+				"/Status":            int32(statusCharging),
+			},
+			expected: params.ChargerState{
+				Active:            true,
+				CurrentAmpSetting: 10,
+				CurrentUsage:      2300,
+				Vehicle:           params.VehicleCharging,
+			},
+		}, {
+			name: "usage from the current",
+			values: map[string]interface{}{
+				"/StartStop":  int32(1),
+				"/SetCurrent": int32(10),
+				"/Current":    float64(9),
+				"/Status":     int32(statusCharging),
+			},
+			expected: params.ChargerState{
+				Active:            true,
+				CurrentAmpSetting: 10,
+				CurrentUsage:      9 * 230,
+				Vehicle:           params.VehicleCharging,
+			},
+		}, {
+			name: "fault",
+			values: map[string]interface{}{
+				"/Status": int32(10),
+			},
+			expected: params.ChargerState{
+				CurrentAmpSetting: 16,
+				Vehicle:           params.VehicleError,
+			},
+		}, {
+			name: "invalid setting",
+			values: map[string]interface{}{
+				"/SetCurrent": []interface{}{},
+			},
+			err: true,
+		},
+	}
+	for _, tc := range tests {
+		bus := newFakeBus(testService)
+		for path, value := range tc.values {
+			bus.set(testService, path, value)
+		}
+		w := newTestWorker(bus, "")
+		state, err := w.readState()
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.name, state)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if state != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, state)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	bus := newFakeBus(testService)
+	// Cleanups run in reverse order, so this runs after the worker stops.
+	t.Cleanup(func() {
+		if !bus.closed {
+			t.Errorf("expected the bus connection to be closed")
+		}
+	})
+	_, cli, stateChan := commontest.StartWorker(t, func(ctx context.Context, cfg *config.Config, stateChan chan params.ChargerState) (common.BasicWorker, error) {
+		return newWorker(ctx, cfg, stateChan, bus), nil
+	}, &config.Config{
+		ElectricalPresure: 230,
+		VictronEVCS:       config.VictronEVCSCharger{PollInterval: 60},
+	})
+
+	state := commontest.WaitForState(t, stateChan, "initial state", commontest.AnyState)
+	if state.Active || state.Vehicle != params.VehicleDisconnected {
+		t.Errorf("unexpected initial state: %+v", state)
+	}
+
+	caps, err := cli.Capabilities()
+	if err != nil {
+		t.Fatalf("fetching capabilities: %v", err)
+	}
+	expected := common.Capabilities{
+		MinCurrent:    6,
+		MaxCurrent:    32,
+		CurrentStep:   1,
+		Toggle:        true,
+		PlugDetection: true,
+	}
+	if caps != expected {
+		t.Errorf("expected capabilities %+v, got %+v", expected, caps)
+	}
+
+	if err := cli.SetAmp(10.6); err != nil {
+		t.Fatalf("setting current: %v", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := cli.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	expectedWrites := []string{"/Mode=0", "/SetCurrent=11", "/StartStop=1", "/StartStop=0"}
+	if got := bus.takeWrites(); fmt.Sprint(got) != fmt.Sprint(expectedWrites) {
+		t.Errorf("expected writes %v, got %v", expectedWrites, got)
+	}
+}
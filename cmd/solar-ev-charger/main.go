@@ -8,11 +8,12 @@ import (
 
 	"github.com/juju/loggo"
 
+	"solar-ev-charger/api"
+	_ "solar-ev-charger/chargers/all"
 	"solar-ev-charger/chargers/common"
-	"solar-ev-charger/chargers/eCharger"
-	"solar-ev-charger/chargers/openEVSE"
 	"solar-ev-charger/config"
 	"solar-ev-charger/dbus"
+	"solar-ev-charger/httpsource"
 	"solar-ev-charger/params"
 	"solar-ev-charger/util"
 	"solar-ev-charger/worker"
@@ -64,6 +65,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := common.ValidateDriverConfig(cfg); err != nil {
+		log.Errorf("error validating charger config: %q", err)
+		os.Exit(1)
+	}
+
 	statusUpdates := make(chan params.DBusState, 10)
 	chargerStatus := make(chan params.ChargerState, 10)
 	// go func() {
@@ -81,27 +87,33 @@ func main() {
 	// 	}
 	// }()
 
-	dbusWorker, err := dbus.NewDBusWorker(ctx, cfg, statusUpdates)
-	if err != nil {
-		log.Errorf("error creating worker: %q", err)
-		os.Exit(1)
+	if cfg.HasDBusSensors() {
+		dbusWorker, err := dbus.NewDBusWorker(ctx, cfg, statusUpdates)
+		if err != nil {
+			log.Errorf("error creating worker: %q", err)
+			os.Exit(1)
+		}
+
+		if err := dbusWorker.Start(); err != nil {
+			log.Errorf("starting dbus worker: %+v", err)
+			os.Exit(1)
+		}
 	}
 
-	if err := dbusWorker.Start(); err != nil {
-		log.Errorf("starting dbus worker: %+v", err)
-		os.Exit(1)
+	for _, source := range cfg.HTTPSources {
+		sourceWorker, err := httpsource.NewWorker(ctx, source, statusUpdates)
+		if err != nil {
+			log.Errorf("error creating http source worker: %q", err)
+			os.Exit(1)
+		}
+
+		if err := sourceWorker.Start(); err != nil {
+			log.Errorf("starting http source worker %s: %q", source.Name, err)
+			os.Exit(1)
+		}
 	}
 
-	var chargerWorker common.BasicWorker
-	switch cfg.ConfiguredCharger {
-	case "OpenEVSE":
-		chargerWorker, err = openEVSE.NewWorker(ctx, cfg, chargerStatus)
-	case "eCharger":
-		chargerWorker, err = eCharger.NewWorker(ctx, cfg, chargerStatus)
-	default:
-		log.Errorf("invalid charger type: %s", cfg.ConfiguredCharger)
-		os.Exit(1)
-	}
+	chargerWorker, chargerClient, err := common.NewCharger(ctx, cfg, chargerStatus)
 	if err != nil {
 		log.Errorf("error creating charger worker: %q", err)
 		os.Exit(1)
@@ -112,7 +124,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	stateWorker, err := worker.NewWorker(ctx, cfg, statusUpdates, chargerStatus)
+	stateWorker, err := worker.NewWorker(ctx, cfg, chargerClient, statusUpdates, chargerStatus)
 	if err != nil {
 		log.Errorf("error creating state worker: %q", err)
 		os.Exit(1)
@@ -123,5 +135,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.API.Enabled {
+		apiServer, err := api.NewServer(ctx, cfg, stateWorker)
+		if err != nil {
+			log.Errorf("error creating api server: %q", err)
+			os.Exit(1)
+		}
+
+		if err := apiServer.Start(); err != nil {
+			log.Errorf("starting api server: %q", err)
+			os.Exit(1)
+		}
+	}
+
 	<-ctx.Done()
 }
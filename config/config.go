@@ -1,8 +1,17 @@
 package config
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -34,12 +43,19 @@ func NewConfig(cfgFile string) (*Config, error) {
 type Config struct {
 	// ElectricalPresure is the output Voltage.
 	ElectricalPresure uint64 `toml:"electrical_presure"`
+	// ChargerPhases is the number of phases the charger is connected to.
+	// It is used for chargers that do not report it. Defaults to 1.
+	ChargerPhases uint `toml:"charger_phases"`
 	// InputSensors is list of dbus services that can be used to gauge
 	// power production.
 	InputSensors []InputSensor `toml:"input_sensors"`
 	// Consumers is a list of dbus services exposed by fornius that can
 	// be used to gauge power consumption.
 	Consumers []Consumer `toml:"consumers"`
+	// HTTPSources is a list of HTTP endpoints returning JSON, which are
+	// polled for power production and consumption values. They can be used
+	// alongside, or instead of the dbus input sensors and consumers.
+	HTTPSources []HTTPSource `toml:"http_sources"`
 	// MaxAmpLimit is the maximum aperage we can set on the EV charging
 	// station.
 	MaxAmpLimit uint `toml:"max_amp_limit"`
@@ -61,6 +77,19 @@ type Config struct {
 	// values can vary quite a lot based on cloud cover. We don't want to
 	// change amperage to the charging station too frequently.
 	BackoffThreshold uint `toml:"backoff_interval"`
+	// CommandVerifyTimeout is the amount of time in seconds we wait for the
+	// charger to report that a command took effect. Defaults to 60.
+	CommandVerifyTimeout uint `toml:"command_verify_timeout"`
+	// CommandRetries is the number of consecutive commands the charger may
+	// fail to apply, before we flag it as faulted. Defaults to 3.
+	CommandRetries uint `toml:"command_retries"`
+	// DriftPolicy decides what we do when the current is changed on the
+	// charger, for example from its app. Defaults to "correct".
+	DriftPolicy DriftPolicy `toml:"drift_policy"`
+	// DriftHoldTime is the amount of time in seconds we leave a current
+	// changed on the charger in place, when drift_policy is "respect". Zero
+	// means until the vehicle is unplugged.
+	DriftHoldTime uint `toml:"drift_hold_time"`
 
 	// LogFile is the path to the log on disk
 	LogFile string `toml:"log_file"`
@@ -68,48 +97,145 @@ type Config struct {
 	// ConfiguredCharger is the charger type we want to automate.
 	ConfiguredCharger string `toml:"configured_charger"`
 
+	// ChargerHTTP holds the settings of the HTTP client used to talk to
+	// chargers with an HTTP API.
+	ChargerHTTP HTTPClientSettings `toml:"charger_http"`
+
+	// API holds the settings of the local REST API.
+	API APISettings `toml:"api"`
+
 	// Charger holds the config for the charger
 	Charger Charger `toml:"eCharger"`
 
 	// OpenEVSE holds config options for OpenEVSE
 	OpenEVSE OpenEVSECharger `toml:"OpenEVSE"`
 
+	// OCPP holds config options for chargers controlled over OCPP 1.6J
+	OCPP OCPPCharger `toml:"OCPP"`
+
+	// Modbus holds config options for chargers controlled over Modbus-TCP
+	Modbus ModbusCharger `toml:"Modbus"`
+
+	// VictronEVCS holds config options for Victron EV Charging Stations
+	// controlled over dbus
+	VictronEVCS VictronEVCSCharger `toml:"VictronEVCS"`
+
+	// KEBA holds config options for KEBA KeContact P20/P30 chargers
+	KEBA KEBACharger `toml:"KEBA"`
+
+	// Relay holds config options for chargers switched on and off by a relay
+	Relay RelayCharger `toml:"Relay"`
+
+	// Generic holds config options for chargers described entirely in config
+	Generic GenericCharger `toml:"Generic"`
+
 	// LogLevel sets the logging output to desired level.
 	LogLevel LogLevel `toml:"log_level"`
 }
 
 func (c *Config) Validate() error {
-	if c.Consumers == nil || len(c.Consumers) == 0 {
-		return fmt.Errorf("no consumers defined")
-	}
-
 	if c.ElectricalPresure == 0 {
 		return fmt.Errorf("electrical_presure needs to be non zero")
 	}
 
-	for _, consumer := range c.Consumers {
-		if err := consumer.Validate(); err != nil {
+	if c.ChargerPhases == 0 {
+		c.ChargerPhases = 1
+	}
+	if c.ChargerPhases > 3 {
+		return fmt.Errorf("invalid charger_phases: %d", c.ChargerPhases)
+	}
+
+	if err := c.ChargerHTTP.Validate(); err != nil {
+		return errors.Wrap(err, "validating charger_http")
+	}
+
+	if err := c.API.Validate(); err != nil {
+		return errors.Wrap(err, "validating api")
+	}
+
+	if c.CommandVerifyTimeout == 0 {
+		c.CommandVerifyTimeout = 60
+	}
+	if c.CommandRetries == 0 {
+		c.CommandRetries = 3
+	}
+	if c.DriftPolicy == "" {
+		c.DriftPolicy = DriftCorrect
+	}
+	switch c.DriftPolicy {
+	case DriftCorrect, DriftRespect:
+	default:
+		return fmt.Errorf("invalid drift_policy: %q", c.DriftPolicy)
+	}
+
+	var hasConsumers, hasProducers bool
+	for idx := range c.Consumers {
+		if err := c.Consumers[idx].Validate(); err != nil {
 			return errors.Wrap(err, "validating consumer")
 		}
+		hasConsumers = true
 	}
 
-	if c.InputSensors == nil || len(c.InputSensors) == 0 {
-		return fmt.Errorf("no input sensors defined")
+	for idx := range c.InputSensors {
+		if err := c.InputSensors[idx].Validate(); err != nil {
+			return errors.Wrap(err, "validation sensor")
+		}
+		hasProducers = true
 	}
 
-	for _, sensor := range c.InputSensors {
-		if err := sensor.Validate(); err != nil {
-			return errors.Wrap(err, "validation sensor")
+	names := map[string]bool{}
+	for idx := range c.HTTPSources {
+		source := &c.HTTPSources[idx]
+		if err := source.Validate(); err != nil {
+			return errors.Wrapf(err, "validating http source %s", source.Name)
+		}
+		if names[source.Name] {
+			return fmt.Errorf("duplicate http source name: %s", source.Name)
+		}
+		names[source.Name] = true
+		for _, val := range source.Values {
+			switch val.Type {
+			case ProducerValue:
+				hasProducers = true
+			case ConsumerValue:
+				hasConsumers = true
+			}
 		}
 	}
 
-	if err := c.Charger.Validate(); err != nil {
-		return errors.Wrap(err, "validating charger")
+	if !hasConsumers {
+		return fmt.Errorf("no consumers defined")
+	}
+
+	if !hasProducers {
+		return fmt.Errorf("no input sensors defined")
 	}
 
 	return nil
 }
 
+// HasDBusSensors returns true if any input sensor or consumer is read
+// from dbus.
+func (c *Config) HasDBusSensors() bool {
+	return len(c.InputSensors) > 0 || len(c.Consumers) > 0
+}
+
+// DBusSource is the source name of the values read from dbus.
+const DBusSource = "dbus"
+
+// StateSources returns the source names of all configured producers and
+// consumers. We only control the charger once all of them reported.
+func (c *Config) StateSources() []string {
+	var sources []string
+	if c.HasDBusSensors() {
+		sources = append(sources, DBusSource)
+	}
+	for _, source := range c.HTTPSources {
+		sources = append(sources, source.SourceName())
+	}
+	return sources
+}
+
 type InputSensor struct {
 	Interface string `toml:"dbus_interface"`
 	Path      string `toml:"path"`
@@ -146,6 +272,218 @@ func (c *Consumer) Validate() error {
 	return nil
 }
 
+type SourceValueType string
+
+const (
+	// ProducerValue marks a value as a source of information for power production.
+	ProducerValue SourceValueType = "producer"
+	// ConsumerValue marks a value as a source of information for power consumption.
+	ConsumerValue SourceValueType = "consumer"
+)
+
+type HTTPSource struct {
+	// Name uniquely identifies this source. It is used to build the default
+	// label of the values extracted from the response.
+	Name string `toml:"name"`
+	// URL is the endpoint we poll. It must return a JSON document.
+	URL string `toml:"url"`
+	// PollInterval is the interval in seconds between two requests.
+	PollInterval uint `toml:"poll_interval"`
+	// Timeout is the maximum amount of time in seconds we wait for a response.
+	Timeout uint `toml:"timeout"`
+	// Auth holds the credentials used when polling this source.
+	Auth HTTPAuth `toml:"auth"`
+	// Values is the list of values we extract from the response.
+	Values []HTTPSourceValue `toml:"values"`
+}
+
+// SourceName returns the source name of the values read from this endpoint.
+func (h *HTTPSource) SourceName() string {
+	return "http:" + h.Name
+}
+
+func (h *HTTPSource) Validate() error {
+	if h.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+
+	parsed, err := url.Parse(h.URL)
+	if err != nil {
+		return errors.Wrap(err, "parsing url")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid url scheme: %q", parsed.Scheme)
+	}
+
+	if h.PollInterval == 0 {
+		h.PollInterval = 5
+	}
+
+	if h.Timeout == 0 {
+		h.Timeout = 3
+	}
+
+	if err := h.Auth.Validate(); err != nil {
+		return errors.Wrap(err, "validating auth")
+	}
+
+	if len(h.Values) == 0 {
+		return fmt.Errorf("no values defined")
+	}
+
+	for idx := range h.Values {
+		if err := h.Values[idx].Validate(); err != nil {
+			return errors.Wrap(err, "validating value")
+		}
+		if h.Values[idx].Label == "" {
+			h.Values[idx].Label = fmt.Sprintf("%s:%s", h.Name, h.Values[idx].Path)
+		}
+	}
+	return nil
+}
+
+type HTTPSourceValue struct {
+	// Label is the name under which this value is tracked. Defaults to
+	// <source name>:<path>.
+	Label string `toml:"label"`
+	// Path is the path to the value inside the JSON document. Object keys
+	// are separated by dots and array elements are selected with brackets.
+	// Example: data.meters[0].power
+	Path string `toml:"path"`
+	// Type is either "producer" or "consumer".
+	Type SourceValueType `toml:"type"`
+	// Multiplier is applied to the extracted value. Defaults to 1.
+	Multiplier float64 `toml:"multiplier"`
+	// Offset is added to the extracted value, after the multiplier is applied.
+	Offset float64 `toml:"offset"`
+}
+
+func (h *HTTPSourceValue) Validate() error {
+	if h.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+
+	switch h.Type {
+	case ProducerValue, ConsumerValue:
+	default:
+		return fmt.Errorf("invalid value type %q for %s", h.Type, h.Path)
+	}
+
+	if h.Multiplier == 0 {
+		h.Multiplier = 1
+	}
+	return nil
+}
+
+type HTTPAuthType string
+
+const (
+	NoAuth     HTTPAuthType = ""
+	BasicAuth  HTTPAuthType = "basic"
+	BearerAuth HTTPAuthType = "bearer"
+)
+
+// HTTPClientSettings configures the timeouts, retries and circuit breaker
+// of the HTTP client used to talk to chargers.
+type HTTPClientSettings struct {
+	// Timeout is the maximum amount of time in seconds a single request
+	// may take. Defaults to 5.
+	Timeout uint `toml:"timeout"`
+	// Attempts is the number of times we send an idempotent request
+	// before giving up. Defaults to 3.
+	Attempts uint `toml:"attempts"`
+	// FailureThreshold is the number of consecutive failed requests after
+	// which we consider the charger offline. Defaults to 3.
+	FailureThreshold uint `toml:"failure_threshold"`
+	// OfflineInterval is the amount of time in seconds we wait before
+	// contacting an offline charger again. Defaults to 30.
+	OfflineInterval uint `toml:"offline_interval"`
+}
+
+func (h *HTTPClientSettings) Validate() error {
+	if h.Timeout == 0 {
+		h.Timeout = 5
+	}
+	if h.Attempts == 0 {
+		h.Attempts = 3
+	}
+	if h.FailureThreshold == 0 {
+		h.FailureThreshold = 3
+	}
+	if h.OfflineInterval == 0 {
+		h.OfflineInterval = 30
+	}
+	return nil
+}
+
+// HTTPAuth holds the credentials used to authenticate against an HTTP endpoint.
+type HTTPAuth struct {
+	// Type is the authentication type. Options are "basic" and "bearer".
+	// Leave empty to disable authentication.
+	Type     HTTPAuthType `toml:"type"`
+	Username string       `toml:"username"`
+	Password string       `toml:"password"`
+	Token    string       `toml:"token"`
+}
+
+func (h *HTTPAuth) Validate() error {
+	switch h.Type {
+	case NoAuth:
+	case BasicAuth:
+		if h.Username == "" {
+			return fmt.Errorf("missing username for basic auth")
+		}
+	case BearerAuth:
+		if h.Token == "" {
+			return fmt.Errorf("missing token for bearer auth")
+		}
+	default:
+		return fmt.Errorf("invalid auth type: %q", h.Type)
+	}
+	return nil
+}
+
+// Apply sets the authentication headers on the request.
+func (h *HTTPAuth) Apply(req *http.Request) {
+	switch h.Type {
+	case BasicAuth:
+		req.SetBasicAuth(h.Username, h.Password)
+	case BearerAuth:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.Token))
+	}
+}
+
+// APISettings configures the local REST API, which exposes the state of
+// the charger and allows changing the mode.
+type APISettings struct {
+	// Enabled turns on the API.
+	Enabled bool `toml:"enabled"`
+	// ListenAddress is the address the API listens on. Defaults to
+	// 127.0.0.1:8089, which only allows access from this host.
+	ListenAddress string `toml:"listen_address"`
+	// Interface is the name of a network interface, like eth0. If set, the
+	// API listens on the addresses of this interface only, using the port
+	// of listen_address.
+	Interface string `toml:"interface"`
+	// Token is the bearer token clients must send in the Authorization
+	// header. Leave empty to disable authentication.
+	Token string `toml:"token"`
+}
+
+func (a *APISettings) Validate() error {
+	if a.ListenAddress == "" {
+		a.ListenAddress = "127.0.0.1:8089"
+	}
+	_, port, err := net.SplitHostPort(a.ListenAddress)
+	if err != nil {
+		return errors.Wrap(err, "parsing listen_address")
+	}
+	if a.Interface != "" && port == "" {
+		return fmt.Errorf("listen_address must have a port when interface is set")
+	}
+	return nil
+}
+
 type OpenEVSECharger struct {
 	Address  string `toml:"address"`
 	Username string `toml:"username"`
@@ -154,12 +492,110 @@ type OpenEVSECharger struct {
 	BaseTopic string `toml:"base_topic"`
 	// MQTT represents the MQTT settings used by the station. We need
 	// to use the same settings in this worker to be able to communicate
-	// with the station via MQTT.
+	// with the station via MQTT. If no broker is set, the broker the
+	// station is configured to use is fetched from the station.
 	MQTT    MQTTSettings `toml:"mqtt"`
 	UseMQTT bool         `toml:"use_mqtt"`
+	// API selects how we control the station. Options are:
+	//   * rapi - RAPI commands sent through the WiFi module (default)
+	//   * http - the REST API of the OpenEVSE WiFi firmware v4+, using claims
+	API OpenEVSEAPI `toml:"api"`
+	// ClaimClientID is the client ID of the claim we make when using the
+	// http API.
+	ClaimClientID uint32 `toml:"claim_client_id"`
+	// ClaimPriority is the priority of our claim. Manual overrides set from
+	// the OpenEVSE UI or app have a priority of 1000. Keep this value lower
+	// if you want manual overrides to take precedence.
+	ClaimPriority uint `toml:"claim_priority"`
+	// UseMQTTCommands sends RAPI commands to the station over MQTT instead
+	// of HTTP. Requires UseMQTT.
+	UseMQTTCommands bool `toml:"use_mqtt_commands"`
+	// SerialPort is the serial port connected to the RAPI port of the
+	// controller (eg: /dev/ttyUSB0). If set, RAPI commands are sent over
+	// this port instead of the WiFi module.
+	SerialPort string `toml:"serial_port"`
+	// SerialBaudRate is the baud rate of the serial port. Defaults to 115200.
+	SerialBaudRate int `toml:"serial_baud_rate"`
+	// SerialTimeout is the amount of time in seconds we wait for a response
+	// on the serial port. Defaults to 2.
+	SerialTimeout uint `toml:"serial_timeout"`
+	// PersistDefaultAmps is the current saved to EEPROM at startup. The
+	// station reverts to this value when it restarts. Current changes made
+	// while running are not saved to EEPROM. Set to 0 to leave the value
+	// saved on the station unchanged.
+	PersistDefaultAmps uint64 `toml:"persist_default_amps"`
+	// EEPROMCurrentWrites saves every current change to EEPROM. Only enable
+	// this for old firmware that does not support volatile current changes,
+	// as it wears the flash of the controller.
+	EEPROMCurrentWrites bool `toml:"eeprom_current_writes"`
+	// Mode selects how we integrate with the station. Options are:
+	//   * control - we set the current and state of the station (default)
+	//   * divert - we feed power production and grid import/export readings
+	//     to the built in solar divert (eco mode) of the station, which sets
+	//     the current itself.
+	Mode OpenEVSEMode `toml:"mode"`
+	// DivertFeed selects the reading we send in divert mode. Options are
+	// "grid_ie" (default) and "solar".
+	DivertFeed DivertFeed `toml:"divert_feed"`
+	// DivertSolarTopic is the MQTT topic the station reads solar production
+	// from. If UseMQTT is set, we publish readings on this topic instead of
+	// using the HTTP API.
+	DivertSolarTopic string `toml:"divert_solar_topic"`
+	// DivertGridIETopic is the MQTT topic the station reads grid
+	// import/export from. If UseMQTT is set, we publish readings on this
+	// topic instead of using the HTTP API.
+	DivertGridIETopic string `toml:"divert_grid_ie_topic"`
 }
 
+// DriftPolicy decides what we do when the current is changed on the charger
+// by someone else.
+type DriftPolicy string
+
+const (
+	// DriftCorrect sets the current we decided on again.
+	DriftCorrect DriftPolicy = "correct"
+	// DriftRespect leaves the current alone, for drift_hold_time.
+	DriftRespect DriftPolicy = "respect"
+)
+
+type OpenEVSEMode string
+
+const (
+	OpenEVSEControl OpenEVSEMode = "control"
+	OpenEVSEDivert  OpenEVSEMode = "divert"
+)
+
+type DivertFeed string
+
+const (
+	DivertFeedGridIE DivertFeed = "grid_ie"
+	DivertFeedSolar  DivertFeed = "solar"
+)
+
+type OpenEVSEAPI string
+
+const (
+	OpenEVSERAPI OpenEVSEAPI = "rapi"
+	OpenEVSEHTTP OpenEVSEAPI = "http"
+)
+
 func (o *OpenEVSECharger) Validate() error {
+	if o.SerialPort != "" {
+		if o.UseMQTT || o.API == OpenEVSEHTTP || o.Mode == OpenEVSEDivert {
+			return fmt.Errorf("serial_port can only be used with the rapi api and without mqtt")
+		}
+		o.API = OpenEVSERAPI
+		o.Mode = OpenEVSEControl
+		if o.SerialBaudRate == 0 {
+			// The baud rate of the RAPI port on OpenEVSE controllers.
+			o.SerialBaudRate = 115200
+		}
+		if o.SerialTimeout == 0 {
+			o.SerialTimeout = 2
+		}
+		return nil
+	}
+
 	ip := net.ParseIP(o.Address)
 	if ip == nil {
 		return fmt.Errorf("invalid station IP address: %s", o.Address)
@@ -169,6 +605,39 @@ func (o *OpenEVSECharger) Validate() error {
 		return fmt.Errorf("missing required username and password")
 	}
 
+	switch o.API {
+	case "":
+		o.API = OpenEVSERAPI
+	case OpenEVSERAPI, OpenEVSEHTTP:
+	default:
+		return fmt.Errorf("invalid api: %q", o.API)
+	}
+
+	if o.UseMQTTCommands {
+		if !o.UseMQTT {
+			return fmt.Errorf("use_mqtt_commands requires use_mqtt")
+		}
+		if o.API != OpenEVSERAPI {
+			return fmt.Errorf("use_mqtt_commands requires the rapi api")
+		}
+	}
+
+	switch o.Mode {
+	case "":
+		o.Mode = OpenEVSEControl
+	case OpenEVSEControl, OpenEVSEDivert:
+	default:
+		return fmt.Errorf("invalid mode: %q", o.Mode)
+	}
+
+	switch o.DivertFeed {
+	case "":
+		o.DivertFeed = DivertFeedGridIE
+	case DivertFeedGridIE, DivertFeedSolar:
+	default:
+		return fmt.Errorf("invalid divert_feed: %q", o.DivertFeed)
+	}
+
 	if o.UseMQTT {
 		if err := o.MQTT.Validate(); err != nil {
 			return errors.Wrap(err, "validating mqtt settings")
@@ -177,14 +646,582 @@ func (o *OpenEVSECharger) Validate() error {
 	return nil
 }
 
+// OCPPCharger holds the settings of the local OCPP 1.6J central system. The
+// charge point must be configured to connect to
+// ws://<this host><listen_address>/<charge_point_id>.
+type OCPPCharger struct {
+	// ListenAddress is the address the central system listens on. Set it
+	// to the address of this host on the network of the charge point.
+	// Defaults to 127.0.0.1:8887.
+	ListenAddress string `toml:"listen_address"`
+	// ChargePointID is the identity of the charge point we accept.
+	ChargePointID string `toml:"charge_point_id"`
+	// Password is the password charge points must use to authenticate
+	// (OCPP security profile 1). Leave empty to disable authentication.
+	Password string `toml:"password"`
+	// ConnectorID is the connector we control. Defaults to 1.
+	ConnectorID int `toml:"connector_id"`
+	// IDTag is the identifier used to start transactions remotely.
+	// Defaults to solar-ev-charger.
+	IDTag string `toml:"id_tag"`
+	// HeartbeatInterval is the interval in seconds at which the charge
+	// point sends heartbeats. Defaults to 60.
+	HeartbeatInterval uint `toml:"heartbeat_interval"`
+	// MeterValueInterval is the interval in seconds at which we ask the
+	// charge point to send meter values. Defaults to 10.
+	MeterValueInterval uint `toml:"meter_value_interval"`
+}
+
+func (o *OCPPCharger) Validate() error {
+	if o.ListenAddress == "" {
+		o.ListenAddress = "127.0.0.1:8887"
+	}
+	if _, _, err := net.SplitHostPort(o.ListenAddress); err != nil {
+		return errors.Wrap(err, "parsing listen_address")
+	}
+	if o.ChargePointID == "" {
+		return fmt.Errorf("missing charge_point_id")
+	}
+	if o.ConnectorID == 0 {
+		o.ConnectorID = 1
+	}
+	if o.IDTag == "" {
+		o.IDTag = "solar-ev-charger"
+	}
+	if o.HeartbeatInterval == 0 {
+		o.HeartbeatInterval = 60
+	}
+	if o.MeterValueInterval == 0 {
+		o.MeterValueInterval = 10
+	}
+	return nil
+}
+
+// ModbusCharger holds the settings of chargers controlled over Modbus-TCP.
+type ModbusCharger struct {
+	// Address is the address of the charger, optionally followed by the
+	// port. The port defaults to 502.
+	Address string `toml:"address"`
+	// UnitID is the Modbus unit ID of the charger. Defaults to the unit
+	// ID used by the selected model.
+	UnitID uint8 `toml:"unit_id"`
+	// Model selects the register map of the charger.
+	Model ModbusModel `toml:"model"`
+	// PollInterval is the interval in seconds at which we read the
+	// status of the charger. Defaults to 5.
+	PollInterval uint `toml:"poll_interval"`
+	// Timeout is the maximum amount of time in seconds we wait for a
+	// response. Defaults to 3.
+	Timeout uint `toml:"timeout"`
+	// Registers is the register map used when model is "custom".
+	Registers ModbusRegisterMap `toml:"registers"`
+}
+
+type ModbusModel string
+
+const (
+	ModbusAlfen   ModbusModel = "alfen"
+	ModbusVictron ModbusModel = "victron"
+	ModbusPhoenix ModbusModel = "phoenix"
+	ModbusCustom  ModbusModel = "custom"
+)
+
+func (m *ModbusCharger) Validate() error {
+	if m.Address == "" {
+		return fmt.Errorf("missing address")
+	}
+	if m.PollInterval == 0 {
+		m.PollInterval = 5
+	}
+	if m.Timeout == 0 {
+		m.Timeout = 3
+	}
+	switch m.Model {
+	case ModbusAlfen, ModbusVictron, ModbusPhoenix:
+	case ModbusCustom:
+		if err := m.Registers.Validate(); err != nil {
+			return errors.Wrap(err, "validating registers")
+		}
+	default:
+		return fmt.Errorf("invalid model: %q", m.Model)
+	}
+	return nil
+}
+
+type ModbusRegisterType string
+
+const (
+	HoldingRegister ModbusRegisterType = "holding"
+	InputRegister   ModbusRegisterType = "input"
+	Coil            ModbusRegisterType = "coil"
+)
+
+type ModbusRegisterFormat string
+
+const (
+	Uint16Format  ModbusRegisterFormat = "uint16"
+	Int16Format   ModbusRegisterFormat = "int16"
+	Uint32Format  ModbusRegisterFormat = "uint32"
+	Int32Format   ModbusRegisterFormat = "int32"
+	Float32Format ModbusRegisterFormat = "float32"
+	// StringFormat holds ASCII text, two characters per register.
+	StringFormat ModbusRegisterFormat = "string"
+)
+
+// ModbusRegister describes a value held by one or more registers, or by a
+// coil.
+type ModbusRegister struct {
+	Address uint16 `toml:"address"`
+	// Type is the register type. Defaults to holding.
+	Type ModbusRegisterType `toml:"type"`
+	// Format is the format of the value. Defaults to uint16. Ignored for
+	// coils.
+	Format ModbusRegisterFormat `toml:"format"`
+	// WordSwap is set for 32 bit values stored low word first.
+	WordSwap bool `toml:"word_swap"`
+	// Length is the number of registers holding a string value.
+	Length uint16 `toml:"length"`
+	// Scale is multiplied with the raw value to get Amps or Watts.
+	// Defaults to 1.
+	Scale float64 `toml:"scale"`
+}
+
+func (m *ModbusRegister) Validate() error {
+	if m.Type == "" {
+		m.Type = HoldingRegister
+	}
+	switch m.Type {
+	case HoldingRegister, InputRegister, Coil:
+	default:
+		return fmt.Errorf("invalid register type: %q", m.Type)
+	}
+	if m.Format == "" {
+		m.Format = Uint16Format
+	}
+	switch m.Format {
+	case Uint16Format, Int16Format, Uint32Format, Int32Format, Float32Format:
+	case StringFormat:
+		if m.Length == 0 {
+			return fmt.Errorf("missing length for string register %d", m.Address)
+		}
+	default:
+		return fmt.Errorf("invalid register format: %q", m.Format)
+	}
+	if m.Scale == 0 {
+		m.Scale = 1
+	}
+	return nil
+}
+
+// Words returns the number of registers holding the value.
+func (m *ModbusRegister) Words() uint16 {
+	switch m.Format {
+	case Uint32Format, Int32Format, Float32Format:
+		return 2
+	case StringFormat:
+		return m.Length
+	default:
+		return 1
+	}
+}
+
+// ModbusWrite is a value written to a register.
+type ModbusWrite struct {
+	ModbusRegister
+	Value float64 `toml:"value"`
+}
+
+// ModbusRegisterMap describes the registers used to monitor and control a
+// charger.
+type ModbusRegisterMap struct {
+	// SetCurrent is the register we write the current limit to.
+	SetCurrent *ModbusRegister `toml:"set_current"`
+	// CurrentSetting is the register holding the current limit applied by
+	// the charger. Defaults to set_current.
+	CurrentSetting *ModbusRegister `toml:"current_setting"`
+	// Current is the register holding the current drawn by the vehicle.
+	Current *ModbusRegister `toml:"current"`
+	// Power is the register holding the power drawn by the vehicle.
+	Power *ModbusRegister `toml:"power"`
+	// Enable is the register used to enable or disable charging. If not
+	// set, charging is disabled by setting the current limit to zero.
+	Enable *ModbusRegister `toml:"enable"`
+	// EnableValue is the value of the enable register while charging is
+	// enabled. Defaults to 1.
+	EnableValue float64 `toml:"enable_value"`
+	// DisableValue is the value of the enable register while charging is
+	// disabled.
+	DisableValue float64 `toml:"disable_value"`
+	// Status is the register holding the state of the charger.
+	Status *ModbusRegister `toml:"status"`
+	// DisconnectedStatus lists the values of the status register which
+	// mean no vehicle is connected. Numeric values are written in decimal.
+	// Values not listed anywhere leave the vehicle state unknown.
+	DisconnectedStatus []string `toml:"disconnected_status"`
+	// ConnectedStatus lists the values of the status register which mean
+	// a vehicle is connected.
+	ConnectedStatus []string `toml:"connected_status"`
+	// ChargingStatus lists the values of the status register which mean
+	// the vehicle is charging.
+	ChargingStatus []string `toml:"charging_status"`
+	// FinishedStatus lists the values of the status register which mean
+	// the vehicle finished charging.
+	FinishedStatus []string `toml:"finished_status"`
+	// ErrorStatus lists the values of the status register which mean the
+	// charger is faulted.
+	ErrorStatus []string `toml:"error_status"`
+	// RefreshInterval is the interval in seconds at which we write the
+	// current limit again, for chargers that fall back to a safe current
+	// unless the limit is refreshed. Zero disables refreshing.
+	RefreshInterval uint `toml:"refresh_interval"`
+	// Init holds values written at startup, for example to switch the
+	// charger to a mode where it accepts remote control.
+	Init []ModbusWrite `toml:"init"`
+}
+
+func (m *ModbusRegisterMap) Validate() error {
+	if m.SetCurrent == nil {
+		return fmt.Errorf("missing set_current register")
+	}
+	if m.SetCurrent.Type == InputRegister {
+		return fmt.Errorf("set_current must be writable")
+	}
+	if m.Enable != nil && m.Enable.Type == InputRegister {
+		return fmt.Errorf("enable must be writable")
+	}
+	if m.Status == nil && (len(m.ConnectedStatus) > 0 || len(m.DisconnectedStatus) > 0) {
+		return fmt.Errorf("connected_status and disconnected_status require a status register")
+	}
+	for _, reg := range []*ModbusRegister{m.SetCurrent, m.CurrentSetting, m.Current, m.Power, m.Enable, m.Status} {
+		if reg == nil {
+			continue
+		}
+		if err := reg.Validate(); err != nil {
+			return err
+		}
+	}
+	for idx := range m.Init {
+		if m.Init[idx].Type == InputRegister {
+			return fmt.Errorf("init registers must be writable")
+		}
+		if err := m.Init[idx].Validate(); err != nil {
+			return err
+		}
+	}
+	if m.Enable != nil && m.EnableValue == 0 {
+		m.EnableValue = 1
+	}
+	return nil
+}
+
+// VictronEVCSCharger holds the settings of a Victron EV Charging Station
+// controlled through the dbus service Venus OS exposes for it.
+type VictronEVCSCharger struct {
+	// Service is the dbus service of the charger. Leave empty to use the
+	// first com.victronenergy.evcharger service found.
+	Service string `toml:"service"`
+	// PollInterval is the interval in seconds at which we read the status
+	// of the charger. Defaults to 5.
+	PollInterval uint `toml:"poll_interval"`
+}
+
+func (v *VictronEVCSCharger) Validate() error {
+	if v.Service != "" && !strings.HasPrefix(v.Service, "com.victronenergy.evcharger.") {
+		return fmt.Errorf("invalid service: %s", v.Service)
+	}
+	if v.PollInterval == 0 {
+		v.PollInterval = 5
+	}
+	return nil
+}
+
+// KEBACharger holds the settings of KEBA KeContact P20/P30 chargers,
+// controlled over their local UDP protocol.
+type KEBACharger struct {
+	// Address is the IP address of the charger, optionally followed by the
+	// port. The port defaults to 7090.
+	Address string `toml:"address"`
+	// ListenAddress is the local address we receive responses and
+	// broadcasts on. The charger always sends them to port 7090, so only
+	// change this if you forward that port. Defaults to :7090.
+	ListenAddress string `toml:"listen_address"`
+	// PollInterval is the interval in seconds at which we request reports
+	// from the charger. Defaults to 10.
+	PollInterval uint `toml:"poll_interval"`
+	// Timeout is the maximum amount of time in seconds we wait for a
+	// response. Defaults to 2.
+	Timeout uint `toml:"timeout"`
+	// EnergyLimit is the energy in kWh after which the charger stops the
+	// session, set every time charging is enabled. Zero disables the limit.
+	EnergyLimit float64 `toml:"energy_limit"`
+}
+
+func (k *KEBACharger) Validate() error {
+	if k.Address == "" {
+		return fmt.Errorf("missing address")
+	}
+	if k.ListenAddress == "" {
+		k.ListenAddress = ":7090"
+	}
+	if _, _, err := net.SplitHostPort(k.ListenAddress); err != nil {
+		return errors.Wrap(err, "parsing listen_address")
+	}
+	if k.PollInterval == 0 {
+		k.PollInterval = 10
+	}
+	if k.Timeout == 0 {
+		k.Timeout = 2
+	}
+	if k.EnergyLimit < 0 {
+		return fmt.Errorf("energy_limit must not be negative")
+	}
+	return nil
+}
+
+type RelayType string
+
+const (
+	// GXRelay is a relay of a Victron GX device, switched over dbus.
+	GXRelay RelayType = "gx"
+	// ShellyRelay is a Shelly relay, switched over its local HTTP API.
+	ShellyRelay RelayType = "shelly"
+)
+
+// RelayCharger holds the settings of chargers which can only be switched on
+// and off, by a relay.
+type RelayCharger struct {
+	// Type is the type of relay.
+	Type RelayType `toml:"type"`
+	// RelayIndex is the index of the relay. Defaults to 0.
+	RelayIndex uint `toml:"relay_index"`
+	// PowerDraw is the power in Watts the charger draws while switched on.
+	PowerDraw float64 `toml:"power_draw"`
+	// PollInterval is the interval in seconds at which we read the state
+	// of the relay. Defaults to 5.
+	PollInterval uint `toml:"poll_interval"`
+
+	// ShellyAddress is the IP address of the Shelly.
+	ShellyAddress string `toml:"shelly_address"`
+	// ShellyGeneration is the generation of the Shelly API. Gen1 devices
+	// use 1, Plus and Pro devices use 2. Defaults to 1.
+	ShellyGeneration uint `toml:"shelly_generation"`
+	// Username and Password are used for basic auth on Gen1 devices.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+func (r *RelayCharger) Validate() error {
+	if r.PowerDraw <= 0 {
+		return fmt.Errorf("power_draw must be positive")
+	}
+	if r.PollInterval == 0 {
+		r.PollInterval = 5
+	}
+	switch r.Type {
+	case GXRelay:
+	case ShellyRelay:
+		if r.ShellyAddress == "" {
+			return fmt.Errorf("missing shelly_address")
+		}
+		if r.ShellyGeneration == 0 {
+			r.ShellyGeneration = 1
+		}
+		if r.ShellyGeneration > 2 {
+			return fmt.Errorf("invalid shelly_generation: %d", r.ShellyGeneration)
+		}
+		if r.ShellyGeneration == 2 && r.Username != "" {
+			return fmt.Errorf("authentication is only supported on gen1 devices")
+		}
+	default:
+		return fmt.Errorf("invalid relay type: %q", r.Type)
+	}
+	return nil
+}
+
+// GenericCharger describes how to control and monitor a charger using HTTP
+// requests or MQTT messages.
+type GenericCharger struct {
+	// PollInterval is the interval in seconds at which we poll the status
+	// over HTTP. Defaults to 5.
+	PollInterval uint `toml:"poll_interval"`
+	// Timeout is the maximum amount of time in seconds we wait for an HTTP
+	// response. Defaults to 3.
+	Timeout uint `toml:"timeout"`
+	// Auth holds the credentials used for HTTP requests.
+	Auth HTTPAuth `toml:"auth"`
+	// MQTT holds the broker settings, used if any request is an MQTT
+	// message.
+	MQTT MQTTSettings `toml:"mqtt"`
+	// MinCurrent is the lowest current in Amps the charger accepts. Zero
+	// means no limit besides minimum_amp_threshold.
+	MinCurrent float64 `toml:"min_current"`
+	// MaxCurrent is the highest current in Amps the charger accepts. Zero
+	// means no limit besides max_amp_limit.
+	MaxCurrent float64 `toml:"max_current"`
+	// CurrentStep is the granularity of the current limit, in Amps.
+	// Defaults to 1.
+	CurrentStep float64 `toml:"current_step"`
+
+	Start      GenericRequest `toml:"start"`
+	Stop       GenericRequest `toml:"stop"`
+	SetCurrent GenericRequest `toml:"set_current"`
+	Status     GenericStatus  `toml:"status"`
+}
+
+// UsesMQTT returns true if any request is an MQTT message.
+func (g *GenericCharger) UsesMQTT() bool {
+	for _, req := range []GenericRequest{g.Start, g.Stop, g.SetCurrent, g.Status.GenericRequest} {
+		if req.Topic != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GenericCharger) Validate() error {
+	if g.PollInterval == 0 {
+		g.PollInterval = 5
+	}
+	if g.Timeout == 0 {
+		g.Timeout = 3
+	}
+	if g.CurrentStep < 0 || g.MinCurrent < 0 || g.MaxCurrent < 0 {
+		return fmt.Errorf("current limits must not be negative")
+	}
+	if g.CurrentStep == 0 {
+		g.CurrentStep = 1
+	}
+	if g.MaxCurrent > 0 && g.MinCurrent > g.MaxCurrent {
+		return fmt.Errorf("min_current (%v) is larger than max_current (%v)", g.MinCurrent, g.MaxCurrent)
+	}
+	if err := g.Auth.Validate(); err != nil {
+		return errors.Wrap(err, "validating auth")
+	}
+	if g.UsesMQTT() {
+		if err := g.MQTT.Validate(); err != nil {
+			return errors.Wrap(err, "validating mqtt")
+		}
+	}
+	requests := map[string]*GenericRequest{
+		"start":       &g.Start,
+		"stop":        &g.Stop,
+		"set_current": &g.SetCurrent,
+		"status":      &g.Status.GenericRequest,
+	}
+	for name, req := range requests {
+		if err := req.Validate(); err != nil {
+			return errors.Wrapf(err, "validating %s", name)
+		}
+	}
+	return g.Status.Validate()
+}
+
+// GenericRequest is either an HTTP request, or an MQTT message. The url,
+// header values, body and payload are Go templates, which can use:
+//   - {{.Amps}}: the current limit in Amps
+//   - {{.MilliAmps}}: the current limit in milliamps
+//   - {{.Watts}}: the current limit converted to Watts
+type GenericRequest struct {
+	// Method is the HTTP method. Defaults to GET, or POST if a body is set.
+	Method  string            `toml:"method"`
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+	Body    string            `toml:"body"`
+
+	// Topic is the MQTT topic we publish to. For the status, it is the
+	// topic we subscribe to.
+	Topic   string `toml:"topic"`
+	Payload string `toml:"payload"`
+	Retain  bool   `toml:"retain"`
+}
+
+func (g *GenericRequest) Validate() error {
+	if (g.URL == "") == (g.Topic == "") {
+		return fmt.Errorf("exactly one of url or topic must be set")
+	}
+	if g.Method == "" {
+		g.Method = http.MethodGet
+		if g.Body != "" {
+			g.Method = http.MethodPost
+		}
+	}
+	return nil
+}
+
+// GenericStatus describes where to get the status of the charger, and how
+// to extract values from it. The status must be a JSON document. Paths use
+// dots to separate object keys and brackets to select array elements.
+type GenericStatus struct {
+	GenericRequest
+
+	// ActivePath is the path of the value telling whether charging is
+	// enabled. Required.
+	ActivePath string `toml:"active_path"`
+	// ActiveValues are the values which mean charging is enabled. If
+	// empty, any non zero number or true means charging is enabled.
+	ActiveValues []string `toml:"active_values"`
+	// PowerPath is the path of the power drawn by the vehicle.
+	PowerPath       string  `toml:"power_path"`
+	PowerMultiplier float64 `toml:"power_multiplier"`
+	// CurrentPath is the path of the current drawn by the vehicle, used
+	// if power_path is not set.
+	CurrentPath       string  `toml:"current_path"`
+	CurrentMultiplier float64 `toml:"current_multiplier"`
+	// CurrentSettingPath is the path of the current limit. Required.
+	CurrentSettingPath       string  `toml:"current_setting_path"`
+	CurrentSettingMultiplier float64 `toml:"current_setting_multiplier"`
+	// ConnectedPath is the path of the value telling whether a vehicle is
+	// connected.
+	ConnectedPath string `toml:"connected_path"`
+	// ConnectedValues are the values which mean a vehicle is connected.
+	// If empty, any non zero number or true means a vehicle is connected.
+	ConnectedValues []string `toml:"connected_values"`
+	// DisconnectedValues are the values which mean no vehicle is
+	// connected. If both lists are empty, zero or false means no vehicle
+	// is connected. Other values leave the vehicle state unknown.
+	DisconnectedValues []string `toml:"disconnected_values"`
+	// ChargingValues are the values of connected_path which mean the
+	// vehicle is charging.
+	ChargingValues []string `toml:"charging_values"`
+	// FinishedValues are the values of connected_path which mean the
+	// vehicle finished charging.
+	FinishedValues []string `toml:"finished_values"`
+	// ErrorValues are the values of connected_path which mean the charger
+	// is faulted.
+	ErrorValues []string `toml:"error_values"`
+}
+
+func (g *GenericStatus) Validate() error {
+	if g.ActivePath == "" {
+		return fmt.Errorf("missing active_path")
+	}
+	if g.CurrentSettingPath == "" {
+		return fmt.Errorf("missing current_setting_path")
+	}
+	if g.PowerMultiplier == 0 {
+		g.PowerMultiplier = 1
+	}
+	if g.CurrentMultiplier == 0 {
+		g.CurrentMultiplier = 1
+	}
+	if g.CurrentSettingMultiplier == 0 {
+		g.CurrentSettingMultiplier = 1
+	}
+	return nil
+}
+
 type Charger struct {
 	// StationAddress is the API endpoint of the charging station.
 	StationAddress string `toml:"station_ip"`
 	// MQTT represents the MQTT settings used by the station. We need
 	// to use the same settings in this worker to be able to communicate
-	// with the station via MQTT.
+	// with the station via MQTT. If no broker is set, the broker the
+	// station is configured to use is fetched from the station.
 	MQTT    MQTTSettings `toml:"mqtt"`
 	UseMQTT bool         `toml:"use_mqtt"`
+	// UseMQTTCommands sends commands to the station over the MQTT connection
+	// instead of HTTP. Requires UseMQTT.
+	UseMQTTCommands bool `toml:"use_mqtt_commands"`
 }
 
 func (c *Charger) Validate() error {
@@ -193,7 +1230,13 @@ func (c *Charger) Validate() error {
 		return fmt.Errorf("invalid station IP address: %s", c.StationAddress)
 	}
 
-	if c.UseMQTT {
+	if c.UseMQTTCommands && !c.UseMQTT {
+		return fmt.Errorf("use_mqtt_commands requires use_mqtt")
+	}
+
+	// Without a broker, the settings of the station are validated once we
+	// fetch them.
+	if c.UseMQTT && c.MQTT.Broker != "" {
 		if err := c.MQTT.Validate(); err != nil {
 			return errors.Wrap(err, "validating mqtt settings")
 		}
@@ -201,11 +1244,71 @@ func (c *Charger) Validate() error {
 	return nil
 }
 
+// MQTTScheme is the transport used to connect to an MQTT broker.
+type MQTTScheme string
+
+const (
+	// MQTTTCP connects to the broker over plain TCP.
+	MQTTTCP MQTTScheme = "tcp"
+	// MQTTSSL connects to the broker over TLS.
+	MQTTSSL MQTTScheme = "ssl"
+	// MQTTWS connects to the broker over a WebSocket.
+	MQTTWS MQTTScheme = "ws"
+	// MQTTWSS connects to the broker over a WebSocket secured with TLS.
+	MQTTWSS MQTTScheme = "wss"
+)
+
+// secure returns true if the scheme uses TLS.
+func (m MQTTScheme) secure() bool {
+	return m == MQTTSSL || m == MQTTWSS
+}
+
+// websocket returns true if the scheme uses a WebSocket.
+func (m MQTTScheme) websocket() bool {
+	return m == MQTTWS || m == MQTTWSS
+}
+
+// defaultPort returns the port brokers usually listen on for the scheme.
+func (m MQTTScheme) defaultPort() int {
+	switch m {
+	case MQTTSSL:
+		return 8883
+	case MQTTWS:
+		return 80
+	case MQTTWSS:
+		return 443
+	}
+	return 1883
+}
+
 type MQTTSettings struct {
 	Broker   string `toml:"broker"`
 	Port     int    `toml:"port"`
 	Username string `toml:"username"`
 	Password string `toml:"password"`
+	// ClientID is the client ID we use when connecting to the broker. It
+	// must be unique among the clients of the broker. Defaults to
+	// solar-ev-charger, followed by a random suffix.
+	ClientID string `toml:"client_id"`
+	// Scheme is the transport used to connect to the broker. Defaults to tcp.
+	Scheme MQTTScheme `toml:"scheme"`
+	// Path is the path of the WebSocket endpoint, for the ws and wss
+	// schemes. Defaults to /mqtt.
+	Path string `toml:"path"`
+
+	// CAFile is a PEM bundle of the certificate authorities we trust to
+	// sign the certificate of the broker. Defaults to the system roots.
+	CAFile string `toml:"ca_file"`
+	// CertFile and KeyFile are the PEM encoded client certificate and key
+	// we authenticate with, if the broker requires one.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// ServerName overrides the host name we expect in the certificate of
+	// the broker. Useful when connecting by IP address.
+	ServerName string `toml:"server_name"`
+	// InsecureSkipVerify disables verification of the certificate of the
+	// broker. Only use this for testing.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
 }
 
 func (m *MQTTSettings) BrokerURI() (string, error) {
@@ -213,8 +1316,47 @@ func (m *MQTTSettings) BrokerURI() (string, error) {
 		return "", errors.Wrap(err, "fetching broker URI")
 	}
 
-	uri := fmt.Sprintf("tcp://%s:%d", m.Broker, m.Port)
-	return uri, nil
+	uri := url.URL{
+		Scheme: string(m.Scheme),
+		Host:   net.JoinHostPort(m.Broker, strconv.Itoa(m.Port)),
+	}
+	if m.Scheme.websocket() {
+		uri.Path = m.Path
+	}
+	return uri.String(), nil
+}
+
+// TLSConfig returns the TLS configuration used for the ssl and wss schemes,
+// or nil for the others.
+func (m *MQTTSettings) TLSConfig() (*tls.Config, error) {
+	if !m.Scheme.secure() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         m.ServerName,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if m.CAFile != "" {
+		bundle, err := os.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading ca_file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", m.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if m.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 func (m *MQTTSettings) ClientOptions() (*mqtt.ClientOptions, error) {
@@ -222,15 +1364,32 @@ func (m *MQTTSettings) ClientOptions() (*mqtt.ClientOptions, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "creating mqtt options")
 	}
+	tlsConfig, err := m.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating mqtt options")
+	}
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(brokerURI)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	if m.Username != "" {
 		opts.SetUsername(m.Username)
 	}
 	if m.Password != "" {
 		opts.SetPassword(m.Password)
 	}
-	opts.SetClientID(ClientID)
+	clientID := m.ClientID
+	if clientID == "" {
+		// Brokers disconnect a client when another one connects with the
+		// same ID, so each connection gets its own.
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, errors.Wrap(err, "generating client id")
+		}
+		clientID = fmt.Sprintf("%s-%s", ClientID, hex.EncodeToString(suffix))
+	}
+	opts.SetClientID(clientID)
 	return opts, nil
 }
 
@@ -239,8 +1398,34 @@ func (m *MQTTSettings) Validate() error {
 		return fmt.Errorf("broker cannot be empty when mqtt is used")
 	}
 
+	if m.Scheme == "" {
+		m.Scheme = MQTTTCP
+	}
+	switch m.Scheme {
+	case MQTTTCP, MQTTSSL, MQTTWS, MQTTWSS:
+	default:
+		return fmt.Errorf("invalid scheme: %q", m.Scheme)
+	}
+
 	if m.Port == 0 {
-		m.Port = 1883
+		m.Port = m.Scheme.defaultPort()
+	}
+
+	if m.Scheme.websocket() && m.Path == "" {
+		m.Path = "/mqtt"
+	}
+
+	if (m.CertFile == "") != (m.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if !m.Scheme.secure() {
+		if m.CAFile != "" || m.CertFile != "" || m.ServerName != "" || m.InsecureSkipVerify {
+			return fmt.Errorf("tls settings require the ssl or wss scheme")
+		}
+		return nil
+	}
+	if _, err := m.TLSConfig(); err != nil {
+		return errors.Wrap(err, "loading tls settings")
 	}
 	return nil
 }
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"solar-ev-charger/mqttclient/fake"
+)
+
+func TestMQTTBrokerURI(t *testing.T) {
+	tests := []struct {
+		settings MQTTSettings
+		expected string
+	}{
+		{MQTTSettings{Broker: "10.0.0.1"}, "tcp://10.0.0.1:1883"},
+		{MQTTSettings{Broker: "10.0.0.1", Scheme: MQTTSSL}, "ssl://10.0.0.1:8883"},
+		{MQTTSettings{Broker: "10.0.0.1", Scheme: MQTTWS}, "ws://10.0.0.1:80/mqtt"},
+		{MQTTSettings{Broker: "broker", Scheme: MQTTWSS, Port: 8443, Path: "/ws"}, "wss://broker:8443/ws"},
+		{MQTTSettings{Broker: "::1", Port: 1884}, "tcp://[::1]:1884"},
+	}
+	for _, tc := range tests {
+		got, err := tc.settings.BrokerURI()
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.settings, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%+v: got %s, expected %s", tc.settings, got, tc.expected)
+		}
+	}
+}
+
+func TestMQTTTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := fake.GenerateCertificates(dir)
+	if err != nil {
+		t.Fatalf("generating certificates: %v", err)
+	}
+
+	settings := MQTTSettings{Broker: "10.0.0.1"}
+	tlsConfig, err := settings.TLSConfig()
+	if err != nil || tlsConfig != nil {
+		t.Errorf("tcp: expected no tls config, got %v, %v", tlsConfig, err)
+	}
+
+	settings = MQTTSettings{Broker: "10.0.0.1", Scheme: MQTTSSL}
+	tlsConfig, err = settings.TLSConfig()
+	if err != nil {
+		t.Fatalf("ssl: unexpected error: %v", err)
+	}
+	if tlsConfig.RootCAs != nil || len(tlsConfig.Certificates) != 0 || tlsConfig.InsecureSkipVerify {
+		t.Errorf("ssl: expected the system roots and no client certificate, got %+v", tlsConfig)
+	}
+
+	settings = MQTTSettings{
+		Broker:             "10.0.0.1",
+		Scheme:             MQTTWSS,
+		CAFile:             certs.CAFile,
+		CertFile:           certs.ClientCertFile,
+		KeyFile:            certs.ClientKeyFile,
+		ServerName:         fake.ServerName,
+		InsecureSkipVerify: true,
+	}
+	tlsConfig, err = settings.TLSConfig()
+	if err != nil {
+		t.Fatalf("wss: unexpected error: %v", err)
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Errorf("wss: expected the ca to be loaded")
+	}
+	if len(tlsConfig.Certificates) != 1 {
+		t.Errorf("wss: expected the client certificate to be loaded, got %d certificates", len(tlsConfig.Certificates))
+	}
+	if tlsConfig.ServerName != fake.ServerName {
+		t.Errorf("wss: expected server name %s, got %s", fake.ServerName, tlsConfig.ServerName)
+	}
+	if !tlsConfig.InsecureSkipVerify {
+		t.Errorf("wss: expected verification to be skipped")
+	}
+
+	opts, err := settings.ClientOptions()
+	if err != nil {
+		t.Fatalf("wss: unexpected error creating options: %v", err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.ServerName != fake.ServerName {
+		t.Errorf("wss: expected the tls config to be passed on, got %+v", opts.TLSConfig)
+	}
+	if len(opts.Servers) != 1 || opts.Servers[0].String() != "wss://10.0.0.1:443/mqtt" {
+		t.Errorf("wss: unexpected servers %v", opts.Servers)
+	}
+}
+
+func TestMQTTSettingsValidate(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := fake.GenerateCertificates(dir)
+	if err != nil {
+		t.Fatalf("generating certificates: %v", err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings MQTTSettings
+		valid    bool
+	}{
+		{"no broker", MQTTSettings{}, false},
+		{"invalid scheme", MQTTSettings{Broker: "b", Scheme: "http"}, false},
+		{"tls settings on tcp", MQTTSettings{Broker: "b", CAFile: certs.CAFile}, false},
+		{"insecure on ws", MQTTSettings{Broker: "b", Scheme: MQTTWS, InsecureSkipVerify: true}, false},
+		{"cert without key", MQTTSettings{Broker: "b", Scheme: MQTTSSL, CertFile: certs.ClientCertFile}, false},
+		{"missing ca", MQTTSettings{Broker: "b", Scheme: MQTTSSL, CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"ca without certificates", MQTTSettings{Broker: "b", Scheme: MQTTSSL, CAFile: notPEM}, false},
+		{"mismatched key", MQTTSettings{Broker: "b", Scheme: MQTTSSL, CertFile: certs.ClientCertFile, KeyFile: certs.ServerKeyFile}, false},
+		{"client certificate", MQTTSettings{Broker: "b", Scheme: MQTTSSL, CAFile: certs.CAFile, CertFile: certs.ClientCertFile, KeyFile: certs.ClientKeyFile}, true},
+	}
+	for _, tc := range tests {
+		err := tc.settings.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestOCPPChargerValidate(t *testing.T) {
+	cfg := OCPPCharger{}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("expected an error without charge_point_id")
+	}
+	cfg.ChargePointID = "wallbox"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ListenAddress != "127.0.0.1:8887" {
+		t.Errorf("expected to listen on loopback by default, got %s", cfg.ListenAddress)
+	}
+}
+
+func TestOpenEVSEChargerValidate(t *testing.T) {
+	cfg := OpenEVSECharger{SerialPort: "/dev/ttyUSB0"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SerialBaudRate != 115200 || cfg.SerialTimeout != 2 {
+		t.Errorf("expected the serial defaults, got %d baud and %d seconds", cfg.SerialBaudRate, cfg.SerialTimeout)
+	}
+	if cfg.API != OpenEVSERAPI || cfg.Mode != OpenEVSEControl {
+		t.Errorf("expected rapi in control mode, got %s in %s mode", cfg.API, cfg.Mode)
+	}
+
+	cfg = OpenEVSECharger{SerialPort: "/dev/ttyUSB0", API: OpenEVSEHTTP}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("expected an error using the http api over the serial port")
+	}
+}
@@ -3,6 +3,8 @@ package dbus
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,11 +13,14 @@ import (
 	"github.com/pkg/errors"
 
 	"solar-ev-charger/config"
+	"solar-ev-charger/metrics"
 	"solar-ev-charger/params"
 )
 
 var log = loggo.GetLogger("sevc.dbus")
 
+var signalsProcessed = metrics.NewCounterVec("sevc_dbus_signals_total", "Number of D-Bus signals processed.")
+
 func NewDBusWorker(ctx context.Context, cfg *config.Config, stateChan chan params.DBusState) (*Worker, error) {
 	conn, err := dbus.ConnectSystemBus()
 	if err != nil {
@@ -34,6 +39,7 @@ func NewDBusWorker(ctx context.Context, cfg *config.Config, stateChan chan param
 	state := params.DBusState{
 		Consumers: map[string]float64{},
 		Producers: map[string]float64{},
+		Source:    config.DBusSource,
 	}
 
 	worker := &Worker{
@@ -80,11 +86,12 @@ func (w *Worker) initState() error {
 		if err != nil {
 			return errors.Wrap(err, "fetching value from dbus")
 		}
-		val, err := valueAsFloat(ret)
+		val, err := ValueAsFloat(ret)
 		if err != nil {
 			return errors.Wrap(err, "converting value to float64")
 		}
 		w.state.Consumers[consumer.Path] = val
+		metrics.SensorAge.Touch(consumer.Path)
 	}
 
 	for _, sensor := range w.inputSensors {
@@ -92,11 +99,12 @@ func (w *Worker) initState() error {
 		if err != nil {
 			return errors.Wrap(err, "fetching value from dbus")
 		}
-		val, err := valueAsFloat(ret)
+		val, err := ValueAsFloat(ret)
 		if err != nil {
 			return errors.Wrap(err, "converting value to float64")
 		}
 		w.state.Producers[sensor.Path] = val * sensor.InputMultiplier
+		metrics.SensorAge.Touch(sensor.Path)
 	}
 	w.initialized = true
 	w.stateChanged <- w.state
@@ -104,8 +112,13 @@ func (w *Worker) initState() error {
 }
 
 func (w *Worker) fetchValueFromDBus(dbusInterface, path string) (interface{}, error) {
+	return GetValue(w.cmdConn, dbusInterface, path)
+}
+
+// GetValue fetches the value of a Victron BusItem from dbus.
+func GetValue(conn *dbus.Conn, dbusInterface, path string) (interface{}, error) {
 	var ret interface{}
-	obj := w.cmdConn.Object(dbusInterface, dbus.ObjectPath(path))
+	obj := conn.Object(dbusInterface, dbus.ObjectPath(path))
 	err := obj.Call("com.victronenergy.BusItem.GetValue", 0).Store(&ret)
 	if err != nil {
 		return ret, errors.Wrapf(err, "fetching %s from dbus", path)
@@ -114,14 +127,57 @@ func (w *Worker) fetchValueFromDBus(dbusInterface, path string) (interface{}, er
 	return ret, nil
 }
 
-func valueAsFloat(val interface{}) (float64, error) {
+// SetValue sets the value of a Victron BusItem on dbus.
+func SetValue(conn *dbus.Conn, dbusInterface, path string, value interface{}) error {
+	var ret int32
+	obj := conn.Object(dbusInterface, dbus.ObjectPath(path))
+	err := obj.Call("com.victronenergy.BusItem.SetValue", 0, dbus.MakeVariant(value)).Store(&ret)
+	if err != nil {
+		return errors.Wrapf(err, "setting %s on dbus", path)
+	}
+	if ret != 0 {
+		return fmt.Errorf("setting %s to %v failed with code %d", path, value, ret)
+	}
+	log.Debugf("set %s to %v", path, value)
+	return nil
+}
+
+// FindServices returns the names of the services on the bus starting with
+// prefix.
+func FindServices(conn *dbus.Conn, prefix string) ([]string, error) {
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		return nil, errors.Wrap(err, "listing dbus services")
+	}
+	var services []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// ValueAsFloat converts a value fetched from dbus to float64.
+func ValueAsFloat(val interface{}) (float64, error) {
 	switch consumerValue := val.(type) {
 	case int:
 		return float64(consumerValue), nil
+	case int16:
+		return float64(consumerValue), nil
 	case int32:
 		return float64(consumerValue), nil
 	case int64:
 		return float64(consumerValue), nil
+	case uint8:
+		return float64(consumerValue), nil
+	case uint16:
+		return float64(consumerValue), nil
+	case uint32:
+		return float64(consumerValue), nil
+	case uint64:
+		return float64(consumerValue), nil
 	case float64:
 		return consumerValue, nil
 	case float32:
@@ -159,6 +215,7 @@ func (w *Worker) dbusLoop() {
 			if msg.Type != dbus.TypeSignal {
 				continue
 			}
+			signalsProcessed.Inc()
 			w.mut.Lock()
 			var changed bool
 			for _, message := range msg.Body {
@@ -187,11 +244,12 @@ func (w *Worker) dbusLoop() {
 					val := value["Value"].Value()
 					for _, consumer := range w.consumers {
 						if consumer.Path == key {
-							consumerValue, err := valueAsFloat(val)
+							consumerValue, err := ValueAsFloat(val)
 							if err != nil {
 								log.Warningf("invalid type for %s: %T (%s)", key, val, err)
 								continue
 							}
+							metrics.SensorAge.Touch(key)
 							if currentValue, ok := w.state.Consumers[key]; ok && currentValue != consumerValue {
 								w.state.Consumers[key] = consumerValue
 								changed = true
@@ -202,11 +260,12 @@ func (w *Worker) dbusLoop() {
 
 					for _, producer := range w.inputSensors {
 						if producer.Path == key {
-							consumerValue, err := valueAsFloat(val)
+							consumerValue, err := ValueAsFloat(val)
 							if err != nil {
 								log.Warningf("invalid type for %s: %T (%s)", key, val, err)
 								continue
 							}
+							metrics.SensorAge.Touch(key)
 							newValue := consumerValue * producer.InputMultiplier
 							if currentValue, ok := w.state.Producers[key]; ok && currentValue != newValue {
 								w.state.Producers[key] = newValue
@@ -6,13 +6,13 @@ require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/juju/loggo v1.0.0
 	github.com/pkg/errors v0.9.1
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
 	golang.org/x/net v0.9.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -0,0 +1,96 @@
+// Package health keeps track of the state of the components talking to the
+// outside world, like the connection to the charger. Components report
+// their state, and the state of all components is exported for monitoring.
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a component.
+type State string
+
+const (
+	// StateOK means the component works as expected.
+	StateOK State = "ok"
+	// StateDegraded means the component had errors, but is still in use.
+	StateDegraded State = "degraded"
+	// StateOffline means the component is not usable. For example, the
+	// charger does not respond.
+	StateOffline State = "offline"
+)
+
+// Status is the last state reported by a component.
+type Status struct {
+	Name  string `json:"name"`
+	State State  `json:"state"`
+	// Error is the last error reported, if the state is not ok.
+	Error string `json:"error,omitempty"`
+	// Since is the time the component entered its current state.
+	Since time.Time `json:"since"`
+	// Updated is the time the component last reported its state.
+	Updated time.Time `json:"updated"`
+}
+
+var (
+	mux        sync.Mutex
+	components = map[string]Status{}
+)
+
+// Set records the state of a component. The error is ignored if the state
+// is ok.
+func Set(name string, state State, err error) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	now := time.Now()
+	status, ok := components[name]
+	if !ok || status.State != state {
+		status.Since = now
+	}
+	status.Name = name
+	status.State = state
+	status.Updated = now
+	status.Error = ""
+	if err != nil && state != StateOK {
+		status.Error = err.Error()
+	}
+	components[name] = status
+}
+
+// Get returns the status of a component.
+func Get(name string) (Status, bool) {
+	mux.Lock()
+	defer mux.Unlock()
+	status, ok := components[name]
+	return status, ok
+}
+
+// All returns the status of all components, sorted by name.
+func All() []Status {
+	mux.Lock()
+	defer mux.Unlock()
+
+	ret := make([]Status, 0, len(components))
+	for _, status := range components {
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Healthy returns true if no component is offline.
+func Healthy() bool {
+	mux.Lock()
+	defer mux.Unlock()
+	for _, status := range components {
+		if status.State == StateOffline {
+			return false
+		}
+	}
+	return true
+}
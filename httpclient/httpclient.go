@@ -0,0 +1,317 @@
+// Package httpclient implements the HTTP client shared by the chargers with
+// an HTTP API. Requests are bounded by a timeout, idempotent requests are
+// retried with jittered backoff, and a circuit breaker marks the charger
+// offline after repeated failures, so an unreachable charger fails fast
+// instead of blocking its callers. Changes of the breaker state are logged,
+// and reported to the health package, which the local API serves on
+// /api/v1/health.
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/health"
+)
+
+var log = loggo.GetLogger("sevc.httpclient")
+
+// maxBodySize is the maximum size of a response body we read.
+const maxBodySize = 1 << 20
+
+// retryDelay is the delay before the first retry. It is doubled after each
+// attempt, and up to half of it is added as jitter.
+const retryDelay = 250 * time.Millisecond
+
+// Response is an HTTP response, with the body read.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// StatusError is returned for responses with a status code outside the
+// 2xx range.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s %s: %s", s.StatusCode, s.Method, s.URL, s.Body)
+}
+
+// IsStatus returns true if err was caused by a response with the given
+// status code.
+func IsStatus(err error, code int) bool {
+	statusErr, ok := errors.Cause(err).(*StatusError)
+	return ok && statusErr.StatusCode == code
+}
+
+// OfflineError is returned without sending the request, while the circuit
+// breaker considers the remote end offline.
+type OfflineError struct {
+	Name  string
+	Until time.Time
+	Err   error
+}
+
+func (o *OfflineError) Error() string {
+	return fmt.Sprintf("%s is offline until %s: %s", o.Name, o.Until.Format(time.RFC3339), o.Err)
+}
+
+// IsOffline returns true if err was returned because the remote end is
+// considered offline.
+func IsOffline(err error) bool {
+	_, ok := errors.Cause(err).(*OfflineError)
+	return ok
+}
+
+// New returns a new client. The name identifies the remote end in logs
+// and in the health information.
+func New(name string, settings config.HTTPClientSettings) *Client {
+	// Make sure we have sane defaults, even if the settings were not
+	// validated.
+	settings.Validate()
+	health.Set(name, health.StateOK, nil)
+	return &Client{
+		name:     name,
+		settings: settings,
+		cli:      &http.Client{},
+	}
+}
+
+// Client is an HTTP client with timeouts, retries and a circuit breaker.
+// It is safe for concurrent use.
+type Client struct {
+	name     string
+	settings config.HTTPClientSettings
+	cli      *http.Client
+
+	mux sync.Mutex
+	// failures is the number of consecutive failed requests.
+	failures uint
+	lastErr  error
+	// openUntil is the time until which the breaker is open. While open,
+	// requests fail without being sent.
+	openUntil time.Time
+	// probing is set while a request tests whether the remote end is
+	// back online.
+	probing bool
+}
+
+// Name returns the name of the client.
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Online returns false while the circuit breaker considers the remote end
+// offline.
+func (c *Client) Online() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.openUntil.IsZero()
+}
+
+// allow returns an error if the breaker is open. Once the offline interval
+// has passed, a single request is let through to probe the remote end.
+func (c *Client) allow() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return &OfflineError{Name: c.name, Until: c.openUntil, Err: c.lastErr}
+	}
+	log.Infof("checking whether %s is back online", c.name)
+	c.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of a request.
+func (c *Client) record(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.probing = false
+	if err == nil {
+		if c.failures > 0 {
+			log.Infof("%s is responding again", c.name)
+			health.Set(c.name, health.StateOK, nil)
+		}
+		c.failures = 0
+		c.lastErr = nil
+		c.openUntil = time.Time{}
+		return
+	}
+
+	c.failures++
+	c.lastErr = err
+	if c.failures < c.settings.FailureThreshold {
+		if c.failures == 1 {
+			log.Warningf("request to %s failed, considering it offline after %d failed requests: %s", c.name, c.settings.FailureThreshold, err)
+		}
+		health.Set(c.name, health.StateDegraded, err)
+		return
+	}
+	c.openUntil = time.Now().Add(time.Duration(c.settings.OfflineInterval) * time.Second)
+	if c.failures == c.settings.FailureThreshold {
+		log.Warningf("%s is offline after %d failed requests, checking again at %s: %s", c.name, c.failures, c.openUntil.Format(time.RFC3339), err)
+	} else {
+		log.Infof("%s is still offline, checking again at %s: %s", c.name, c.openUntil.Format(time.RFC3339), err)
+	}
+	health.Set(c.name, health.StateOffline, err)
+}
+
+// idempotent returns true for requests which are safe to send more than
+// once.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// retryable returns true if a request which failed with err may succeed if
+// sent again.
+func retryable(err error) bool {
+	statusErr, ok := errors.Cause(err).(*StatusError)
+	if !ok {
+		// Network errors and timeouts.
+		return true
+	}
+	return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+}
+
+// Do sends the request and reads the response. Responses with a status
+// code outside the 2xx range are returned along with a *StatusError.
+// Idempotent requests are retried on network errors and server errors.
+func (c *Client) Do(req *http.Request) (*Response, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+
+	attempts := c.settings.Attempts
+	if !idempotent(req) {
+		attempts = 1
+	}
+
+	var resp *Response
+	var err error
+	delay := retryDelay
+	for attempt := uint(1); ; attempt++ {
+		resp, err = c.attempt(req)
+		if err == nil || attempt >= attempts || !retryable(err) {
+			break
+		}
+		log.Debugf("request to %s failed (attempt %d of %d): %s", c.name, attempt, attempts, err)
+		wait := delay + time.Duration(rand.Int63n(int64(delay/2)))
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+		}
+		if req.Context().Err() != nil {
+			break
+		}
+		delay *= 2
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				err = errors.Wrap(bodyErr, "rewinding request body")
+				break
+			}
+			req.Body = body
+		}
+	}
+
+	switch {
+	case req.Context().Err() != nil:
+		// The caller gave up. This tells us nothing about the remote end.
+		c.mux.Lock()
+		c.probing = false
+		c.mux.Unlock()
+	case err != nil && retryable(err):
+		c.record(err)
+	default:
+		// The remote end responded.
+		c.record(nil)
+	}
+	return resp, err
+}
+
+// attempt sends the request once, bounded by the timeout.
+func (c *Client) attempt(req *http.Request) (*Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(c.settings.Timeout)*time.Second)
+	defer cancel()
+
+	httpResp, err := c.cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "sending request")
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxBodySize))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+	resp := &Response{
+		StatusCode: httpResp.StatusCode,
+		Header:     httpResp.Header,
+		Body:       body,
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := body
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		return resp, &StatusError{
+			Method:     req.Method,
+			URL:        req.URL.Redacted(),
+			StatusCode: resp.StatusCode,
+			Body:       string(msg),
+		}
+	}
+	return resp, nil
+}
+
+// Get sends a GET request to url.
+func (c *Client) Get(ctx context.Context, url string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	return c.Do(req)
+}
+
+// GetJSON sends a GET request to url, and decodes the JSON response into
+// target.
+func (c *Client) GetJSON(ctx context.Context, url string, target interface{}) error {
+	resp, err := c.Get(ctx, url)
+	if err != nil {
+		return err
+	}
+	return resp.DecodeJSON(target)
+}
+
+// DecodeJSON decodes the body of the response into target.
+func (r *Response) DecodeJSON(target interface{}) error {
+	if err := json.Unmarshal(r.Body, target); err != nil {
+		return errors.Wrap(err, "decoding response")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package httpclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/health"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	cli := New("breaker test", config.HTTPClientSettings{Attempts: 1, FailureThreshold: 2})
+	ctx := context.Background()
+	expectState := func(expected health.State) {
+		t.Helper()
+		if status, _ := health.Get("breaker test"); status.State != expected {
+			t.Errorf("expected health state %s, got %s", expected, status.State)
+		}
+	}
+
+	if _, err := cli.Get(ctx, srv.URL); !IsStatus(err, http.StatusServiceUnavailable) {
+		t.Fatalf("expected a 503 error, got %v", err)
+	}
+	expectState(health.StateDegraded)
+	if _, err := cli.Get(ctx, srv.URL); !IsStatus(err, http.StatusServiceUnavailable) {
+		t.Fatalf("expected a 503 error, got %v", err)
+	}
+	expectState(health.StateOffline)
+	if cli.Online() {
+		t.Errorf("expected the client to be offline")
+	}
+
+	// While offline, requests fail without being sent.
+	if _, err := cli.Get(ctx, srv.URL); !IsOffline(err) {
+		t.Errorf("expected an offline error, got %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("expected 2 requests to be sent, got %d", got)
+	}
+
+	// Once the offline interval passed, a request probes the server.
+	atomic.StoreInt32(&failing, 0)
+	cli.mux.Lock()
+	cli.openUntil = time.Now().Add(-time.Second)
+	cli.mux.Unlock()
+	if _, err := cli.Get(ctx, srv.URL); err != nil {
+		t.Fatalf("unexpected error probing: %v", err)
+	}
+	expectState(health.StateOK)
+	if !cli.Online() {
+		t.Errorf("expected the client to be online")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.Write([]byte(`{"ok": true}`))
+	}))
+	defer srv.Close()
+
+	cli := New("retry test", config.HTTPClientSettings{Attempts: 3})
+	var resp struct {
+		OK bool `json:"ok"`
+	}
+	if err := cli.GetJSON(context.Background(), srv.URL, &resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); !resp.OK || got != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d requests", resp.OK, got)
+	}
+
+	// Requests that are not idempotent are sent once.
+	atomic.StoreInt32(&requests, 0)
+	req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Do(req); !IsStatus(err, http.StatusBadGateway) {
+		t.Errorf("expected a 502 error, got %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("expected a single request, got %d", got)
+	}
+}
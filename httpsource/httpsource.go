@@ -0,0 +1,194 @@
+package httpsource
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/jsonpath"
+	"solar-ev-charger/metrics"
+	"solar-ev-charger/params"
+)
+
+var log = loggo.GetLogger("sevc.httpsource")
+
+// NewWorker returns a new worker that periodically polls the HTTP endpoint
+// defined in source, and sends the extracted producer and consumer values
+// on stateChan.
+func NewWorker(ctx context.Context, source config.HTTPSource, stateChan chan params.DBusState) (*Worker, error) {
+	if err := source.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating source")
+	}
+
+	values := make([]value, len(source.Values))
+	for idx, val := range source.Values {
+		path, err := jsonpath.Parse(val.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing path for %s", val.Label)
+		}
+		values[idx] = value{
+			cfg:  val,
+			path: path,
+		}
+	}
+
+	return &Worker{
+		ctx:    ctx,
+		closed: make(chan struct{}),
+		quit:   make(chan struct{}),
+		source: source,
+		values: values,
+		cli: &http.Client{
+			Timeout: time.Duration(source.Timeout) * time.Second,
+		},
+		stateChanged: stateChan,
+	}, nil
+}
+
+type value struct {
+	cfg  config.HTTPSourceValue
+	path jsonpath.Path
+}
+
+type Worker struct {
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	source config.HTTPSource
+	values []value
+	cli    *http.Client
+
+	stateChanged chan params.DBusState
+}
+
+func (w *Worker) fetch() (interface{}, error) {
+	ctx, cancel := context.WithTimeout(w.ctx, w.cli.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.source.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Accept", "application/json")
+	w.source.Auth.Apply(req)
+
+	resp, err := w.cli.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, w.source.Name)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+
+	doc, err := jsonpath.Decode(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding response")
+	}
+	return doc, nil
+}
+
+// readState fetches the document and extracts the configured values.
+func (w *Worker) readState() (params.DBusState, error) {
+	doc, err := w.fetch()
+	if err != nil {
+		return params.DBusState{}, errors.Wrapf(err, "fetching %s", w.source.Name)
+	}
+
+	state := params.DBusState{
+		Consumers: map[string]float64{},
+		Producers: map[string]float64{},
+		Source:    w.source.SourceName(),
+	}
+	for _, val := range w.values {
+		raw, err := val.path.LookupFloat(doc)
+		if err != nil {
+			return params.DBusState{}, errors.Wrapf(err, "extracting %s", val.cfg.Label)
+		}
+		newValue := raw*val.cfg.Multiplier + val.cfg.Offset
+		log.Debugf("got %v for %s (raw: %v)", newValue, val.cfg.Label, raw)
+		metrics.SensorAge.Touch(val.cfg.Label)
+		switch val.cfg.Type {
+		case config.ProducerValue:
+			state.Producers[val.cfg.Label] = newValue
+		case config.ConsumerValue:
+			state.Consumers[val.cfg.Label] = newValue
+		}
+	}
+	return state, nil
+}
+
+func (w *Worker) send(state params.DBusState) error {
+	select {
+	case w.stateChanged <- state:
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("sending state timed out after 30 seconds")
+	}
+	return nil
+}
+
+func (w *Worker) poll() error {
+	state, err := w.readState()
+	if err != nil {
+		// The values we sent before are outdated, and must not be used
+		// to control the charger until we read them again.
+		if sendErr := w.send(params.DBusState{Source: w.source.SourceName(), Unavailable: true}); sendErr != nil {
+			log.Errorf("failed to report %s as unavailable: %q", w.source.Name, sendErr)
+		}
+		return err
+	}
+	return w.send(state)
+}
+
+func (w *Worker) loop() {
+	timer := time.NewTicker(time.Duration(w.source.PollInterval) * time.Second)
+	defer func() {
+		timer.Stop()
+		close(w.closed)
+	}()
+
+	if err := w.poll(); err != nil {
+		log.Errorf("failed to poll source: %q", err)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if err := w.poll(); err != nil {
+				log.Errorf("failed to poll source: %q", err)
+			}
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Worker) Start() error {
+	go w.loop()
+	return nil
+}
+
+func (w *Worker) Stop() error {
+	close(w.quit)
+	select {
+	case <-w.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for worker to exit")
+	}
+}
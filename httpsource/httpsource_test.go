@@ -0,0 +1,126 @@
+package httpsource
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// newMeter returns a server answering with body to requests carrying the
+// expected Authorization header.
+func newMeter(t *testing.T, authorization, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestWorker(t *testing.T, source config.HTTPSource) (*Worker, chan params.DBusState) {
+	t.Helper()
+	stateChan := make(chan params.DBusState, 1)
+	w, err := NewWorker(context.Background(), source, stateChan)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	return w, stateChan
+}
+
+func TestValues(t *testing.T) {
+	srv := newMeter(t, "", `{"grid": {"power": 1.5}, "pv": [{"power": "-2000"}]}`)
+	w, stateChan := newTestWorker(t, config.HTTPSource{
+		Name: "meter",
+		URL:  srv.URL,
+		Values: []config.HTTPSourceValue{
+			// Kilowatts to Watts.
+			{Path: "grid.power", Type: config.ConsumerValue, Multiplier: 1000},
+			// Inverters reporting production as a negative value.
+			{Label: "pv", Path: "pv[0].power", Type: config.ProducerValue, Multiplier: -1, Offset: 50},
+		},
+	})
+
+	if err := w.poll(); err != nil {
+		t.Fatalf("polling: %v", err)
+	}
+	state := <-stateChan
+	if state.Source != "http:meter" || state.Unavailable {
+		t.Errorf("unexpected source %q (unavailable: %v)", state.Source, state.Unavailable)
+	}
+	if got := state.Consumers["meter:grid.power"]; len(state.Consumers) != 1 || got != 1500 {
+		t.Errorf("expected a consumer value of 1500, got %v", state.Consumers)
+	}
+	if got := state.Producers["pv"]; len(state.Producers) != 1 || got != 2050 {
+		t.Errorf("expected a producer value of 2050, got %v", state.Producers)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		auth          config.HTTPAuth
+		valid         bool
+	}{
+		{"none", "", config.HTTPAuth{}, true},
+		{"basic", "Basic YWRtaW46c2VjcmV0", config.HTTPAuth{Type: config.BasicAuth, Username: "admin", Password: "secret"}, true},
+		{"bearer", "Bearer token", config.HTTPAuth{Type: config.BearerAuth, Token: "token"}, true},
+		{"wrong password", "Basic YWRtaW46c2VjcmV0", config.HTTPAuth{Type: config.BasicAuth, Username: "admin", Password: "wrong"}, false},
+		{"missing token", "Bearer token", config.HTTPAuth{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newMeter(t, tc.authorization, `{"power": 100}`)
+			w, stateChan := newTestWorker(t, config.HTTPSource{
+				Name:   "meter",
+				URL:    srv.URL,
+				Auth:   tc.auth,
+				Values: []config.HTTPSourceValue{{Path: "power", Type: config.ConsumerValue}},
+			})
+
+			err := w.poll()
+			state := <-stateChan
+			if tc.valid {
+				if err != nil || state.Unavailable || state.Consumers["meter:power"] != 100 {
+					t.Errorf("expected a consumer value of 100, got %+v, %v", state, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			// Failures drop the values sent before.
+			if !state.Unavailable || state.Source != "http:meter" {
+				t.Errorf("expected the source to be reported unavailable, got %+v", state)
+			}
+		})
+	}
+}
+
+func TestMissingValue(t *testing.T) {
+	srv := newMeter(t, "", `{"power": 100}`)
+	w, stateChan := newTestWorker(t, config.HTTPSource{
+		Name: "meter",
+		URL:  srv.URL,
+		Values: []config.HTTPSourceValue{
+			{Path: "power", Type: config.ConsumerValue},
+			{Path: "pv.power", Type: config.ProducerValue},
+		},
+	})
+
+	if err := w.poll(); err == nil {
+		t.Errorf("expected an error")
+	}
+	if state := <-stateChan; !state.Unavailable {
+		t.Errorf("expected the source to be reported unavailable, got %+v", state)
+	}
+}
@@ -0,0 +1,156 @@
+// Package jsonpath implements a small subset of JSONPath, sufficient to
+// extract single values from JSON documents returned by energy meters and
+// charging stations.
+//
+// A path is a list of object keys separated by dots, optionally followed by
+// array indexes in brackets. A leading "$" or "$." is accepted and ignored.
+// Examples:
+//
+//	power
+//	$.data.meters[0].power
+//	nrg[11]
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type segment struct {
+	key   string
+	index int
+	// isIndex is true if this segment is an array index.
+	isIndex bool
+}
+
+// Path is a parsed path expression.
+type Path struct {
+	expr     string
+	segments []segment
+}
+
+// String returns the original path expression.
+func (p Path) String() string {
+	return p.expr
+}
+
+// Parse parses a path expression.
+func Parse(expr string) (Path, error) {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(expr, "$"), ".")
+	if trimmed == "" {
+		return Path{}, fmt.Errorf("empty path")
+	}
+
+	var segments []segment
+	for _, part := range strings.Split(trimmed, ".") {
+		key := part
+		var indexes []int
+		if idx := strings.Index(part, "["); idx >= 0 {
+			key = part[:idx]
+			rest := part[idx:]
+			for rest != "" {
+				if rest[0] != '[' {
+					return Path{}, fmt.Errorf("invalid path %q: unexpected %q", expr, rest)
+				}
+				end := strings.Index(rest, "]")
+				if end < 0 {
+					return Path{}, fmt.Errorf("invalid path %q: missing closing bracket", expr)
+				}
+				index, err := strconv.Atoi(rest[1:end])
+				if err != nil || index < 0 {
+					return Path{}, fmt.Errorf("invalid path %q: invalid index %q", expr, rest[1:end])
+				}
+				indexes = append(indexes, index)
+				rest = rest[end+1:]
+			}
+		}
+		if key == "" && len(indexes) == 0 {
+			return Path{}, fmt.Errorf("invalid path %q: empty key", expr)
+		}
+		if key != "" {
+			segments = append(segments, segment{key: key})
+		}
+		for _, index := range indexes {
+			segments = append(segments, segment{index: index, isIndex: true})
+		}
+	}
+	return Path{
+		expr:     expr,
+		segments: segments,
+	}, nil
+}
+
+// Lookup returns the value found at this path inside doc. The doc is
+// expected to be the result of decoding JSON into an interface{}.
+func (p Path) Lookup(doc interface{}) (interface{}, error) {
+	current := doc
+	for _, seg := range p.segments {
+		if seg.isIndex {
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: expected array, got %T", p.expr, current)
+			}
+			if seg.index >= len(arr) {
+				return nil, fmt.Errorf("%s: index %d out of range (length %d)", p.expr, seg.index, len(arr))
+			}
+			current = arr[seg.index]
+			continue
+		}
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected object, got %T", p.expr, current)
+		}
+		val, ok := obj[seg.key]
+		if !ok {
+			return nil, fmt.Errorf("%s: key %q not found", p.expr, seg.key)
+		}
+		current = val
+	}
+	return current, nil
+}
+
+// LookupFloat returns the value found at this path as a float64. Numbers,
+// numeric strings and booleans are accepted.
+func (p Path) LookupFloat(doc interface{}) (float64, error) {
+	val, err := p.Lookup(doc)
+	if err != nil {
+		return 0, err
+	}
+	return AsFloat(val)
+}
+
+// AsFloat converts a decoded JSON value to float64.
+func AsFloat(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing %q", v)
+		}
+		return f, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid type %T --> %v", val, val)
+	}
+}
+
+// Decode decodes a JSON document into a value suitable for Lookup.
+func Decode(data []byte) (interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "decoding json")
+	}
+	return doc, nil
+}
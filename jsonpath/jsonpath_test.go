@@ -0,0 +1,94 @@
+package jsonpath
+
+import (
+	"testing"
+)
+
+const doc = `{
+	"power": 1200,
+	"text": " 42.5 ",
+	"on": true,
+	"data": {"meters": [{"power": -300}, {"power": 150.5}]},
+	"nrg": [230, 231, 229, 0, 0, 0, 0, 0, 0, 0, 0, 4100],
+	"matrix": [[1, 2], [3, 4]]
+}`
+
+func TestLookupFloat(t *testing.T) {
+	decoded, err := Decode([]byte(doc))
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected float64
+	}{
+		{"power", 1200},
+		{"$.power", 1200},
+		{"$power", 1200},
+		{"text", 42.5},
+		{"on", 1},
+		{"data.meters[0].power", -300},
+		{"$.data.meters[1].power", 150.5},
+		{"nrg[11]", 4100},
+		{"matrix[1][0]", 3},
+	}
+	for _, tc := range tests {
+		path, err := Parse(tc.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing: %v", tc.path, err)
+			continue
+		}
+		got, err := path.LookupFloat(decoded)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.path, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%s: got %v, expected %v", tc.path, got, tc.expected)
+		}
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	decoded, err := Decode([]byte(doc))
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	tests := []string{
+		"missing",
+		"power.value",
+		"nrg[12]",
+		"data[0]",
+		"data.meters",
+	}
+	for _, expr := range tests {
+		path, err := Parse(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing: %v", expr, err)
+			continue
+		}
+		if got, err := path.LookupFloat(decoded); err == nil {
+			t.Errorf("%s: expected an error, got %v", expr, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"$",
+		"$.",
+		"data..power",
+		"nrg[",
+		"nrg[a]",
+		"nrg[-1]",
+		"nrg[0]x",
+	}
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
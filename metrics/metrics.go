@@ -0,0 +1,271 @@
+// Package metrics keeps the counters and gauges exposed to Prometheus, and
+// writes them in the Prometheus text format. It is deliberately small, to
+// keep the memory footprint low on GX devices.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the content type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type kind string
+
+const (
+	counter kind = "counter"
+	gauge   kind = "gauge"
+)
+
+var (
+	mux      sync.Mutex
+	families = map[string]*Vec{}
+)
+
+type entry struct {
+	labelValues []string
+	value       float64
+	// touched is the time of the last update, for vectors reporting their
+	// age.
+	touched time.Time
+}
+
+// Vec is a metric, partitioned by labels.
+type Vec struct {
+	name       string
+	help       string
+	kind       kind
+	labelNames []string
+	// age makes the vector report the seconds since each entry was
+	// touched.
+	age bool
+
+	mux     sync.Mutex
+	entries map[string]*entry
+}
+
+func register(name, help string, k kind, age bool, labelNames []string) *Vec {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if _, ok := families[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	v := &Vec{
+		name:       name,
+		help:       help,
+		kind:       k,
+		labelNames: labelNames,
+		age:        age,
+		entries:    map[string]*entry{},
+	}
+	families[name] = v
+	return v
+}
+
+// NewCounterVec registers a new counter.
+func NewCounterVec(name, help string, labelNames ...string) *Vec {
+	return register(name, help, counter, false, labelNames)
+}
+
+// NewGaugeVec registers a new gauge.
+func NewGaugeVec(name, help string, labelNames ...string) *Vec {
+	return register(name, help, gauge, false, labelNames)
+}
+
+// NewAgeVec registers a new gauge reporting the seconds since each set of
+// labels was last touched.
+func NewAgeVec(name, help string, labelNames ...string) *Vec {
+	return register(name, help, gauge, true, labelNames)
+}
+
+// get returns the entry for labelValues, creating it if needed. It must be
+// called with the lock held.
+func (v *Vec) get(labelValues []string) *entry {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	e, ok := v.entries[key]
+	if !ok {
+		e = &entry{labelValues: append([]string(nil), labelValues...)}
+		v.entries[key] = e
+	}
+	return e
+}
+
+// Add adds delta to the value for labelValues.
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.get(labelValues).value += delta
+}
+
+// Inc increments the value for labelValues.
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set sets the value for labelValues.
+func (v *Vec) Set(val float64, labelValues ...string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.get(labelValues).value = val
+}
+
+// SetBool sets the value for labelValues to 1 if val is true, 0 otherwise.
+func (v *Vec) SetBool(val bool, labelValues ...string) {
+	if val {
+		v.Set(1, labelValues...)
+		return
+	}
+	v.Set(0, labelValues...)
+}
+
+// Touch records that labelValues were updated now.
+func (v *Vec) Touch(labelValues ...string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.get(labelValues).touched = time.Now()
+}
+
+// Reset removes all values. It is used by gauges set at scrape time, so
+// values which are gone are not reported anymore.
+func (v *Vec) Reset() {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.entries = map[string]*entry{}
+}
+
+func escapeLabel(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	val = strings.ReplaceAll(val, "\n", `\n`)
+	return strings.ReplaceAll(val, `"`, `\"`)
+}
+
+func formatValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func writeFamily(w *bufio.Writer, name, help string, k kind) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, k)
+}
+
+func (v *Vec) write(w *bufio.Writer, now time.Time) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	writeFamily(w, v.name, v.help, v.kind)
+	keys := make([]string, 0, len(v.entries))
+	for key := range v.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e := v.entries[key]
+		w.WriteString(v.name)
+		if len(v.labelNames) > 0 {
+			w.WriteByte('{')
+			for idx, name := range v.labelNames {
+				if idx > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, `%s="%s"`, name, escapeLabel(e.labelValues[idx]))
+			}
+			w.WriteByte('}')
+		}
+		val := e.value
+		if v.age {
+			val = now.Sub(e.touched).Seconds()
+		}
+		fmt.Fprintf(w, " %s\n", formatValue(val))
+	}
+}
+
+// writeRuntime writes the memory and goroutine statistics of the process.
+func writeRuntime(w *bufio.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(stats.Alloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(stats.Sys)},
+		{"go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(stats.HeapAlloc)},
+		{"go_memstats_heap_sys_bytes", "Number of heap bytes obtained from the system.", float64(stats.HeapSys)},
+		{"go_memstats_heap_idle_bytes", "Number of heap bytes waiting to be used.", float64(stats.HeapIdle)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(stats.HeapInuse)},
+		{"go_memstats_heap_released_bytes", "Number of heap bytes released to the OS.", float64(stats.HeapReleased)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", float64(stats.HeapObjects)},
+		{"go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", float64(stats.StackInuse)},
+		{"go_memstats_next_gc_bytes", "Number of heap bytes when the next garbage collection will take place.", float64(stats.NextGC)},
+	}
+	for _, g := range gauges {
+		writeFamily(w, g.name, g.help, gauge)
+		fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value))
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(stats.TotalAlloc)},
+		{"go_memstats_mallocs_total", "Total number of mallocs.", float64(stats.Mallocs)},
+		{"go_memstats_frees_total", "Total number of frees.", float64(stats.Frees)},
+		{"go_gc_cycles_total", "Number of completed GC cycles.", float64(stats.NumGC)},
+	}
+	for _, c := range counters {
+		writeFamily(w, c.name, c.help, counter)
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.value))
+	}
+}
+
+// Write writes all registered metrics, followed by the runtime statistics,
+// in the Prometheus text format.
+func Write(out io.Writer) error {
+	mux.Lock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vecs := make([]*Vec, 0, len(names))
+	for _, name := range names {
+		vecs = append(vecs, families[name])
+	}
+	mux.Unlock()
+
+	w := bufio.NewWriter(out)
+	now := time.Now()
+	for _, v := range vecs {
+		v.write(w, now)
+	}
+	writeRuntime(w)
+	return w.Flush()
+}
+
+// SensorAge reports the seconds since each power sensor was last read.
+var SensorAge = NewAgeVec("sevc_sensor_age_seconds", "Seconds since the sensor was last read.", "sensor")
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// render returns the text format of the vectors, as of now.
+func render(now time.Time, vecs ...*Vec) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, v := range vecs {
+		v.write(w, now)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func TestWriteVec(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Number of requests,\nby path.", "method", "path")
+	requests.Inc("GET", "/api/v1/state")
+	requests.Add(2.5, "GET", "/api/v1/state")
+	requests.Inc("POST", `C:\path with "quotes"`+"\nand a newline")
+	requests.Inc("DELETE", "/api/v1/override")
+
+	temperature := NewGaugeVec("test_temperature_celsius", "Temperature.")
+	temperature.Set(-3.25)
+
+	connected := NewGaugeVec("test_connected", "Whether we are connected.", "name")
+	connected.SetBool(true, "broker")
+	connected.SetBool(false, "station")
+
+	limits := NewGaugeVec("test_limit", "Limits.", "kind")
+	limits.Set(math.Inf(1), "max")
+	limits.Set(math.Inf(-1), "min")
+	limits.Set(math.NaN(), "unknown")
+	limits.Set(1e21, "large")
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	age := NewAgeVec("test_age_seconds", "Seconds since the sensor was last read.", "sensor")
+	age.Touch("grid")
+	age.Touch("solar")
+	age.mux.Lock()
+	age.entries["grid"].touched = now.Add(-1500 * time.Millisecond)
+	age.entries["solar"].touched = now.Add(-time.Minute)
+	age.mux.Unlock()
+
+	expected := `# HELP test_requests_total Number of requests, by path.
+# TYPE test_requests_total counter
+test_requests_total{method="DELETE",path="/api/v1/override"} 1
+test_requests_total{method="GET",path="/api/v1/state"} 3.5
+test_requests_total{method="POST",path="C:\\path with \"quotes\"\nand a newline"} 1
+# HELP test_temperature_celsius Temperature.
+# TYPE test_temperature_celsius gauge
+test_temperature_celsius -3.25
+# HELP test_connected Whether we are connected.
+# TYPE test_connected gauge
+test_connected{name="broker"} 1
+test_connected{name="station"} 0
+# HELP test_limit Limits.
+# TYPE test_limit gauge
+test_limit{kind="large"} 1e+21
+test_limit{kind="max"} +Inf
+test_limit{kind="min"} -Inf
+test_limit{kind="unknown"} NaN
+# HELP test_age_seconds Seconds since the sensor was last read.
+# TYPE test_age_seconds gauge
+test_age_seconds{sensor="grid"} 1.5
+test_age_seconds{sensor="solar"} 60
+`
+	if got := render(now, requests, temperature, connected, limits, age); got != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	// Gauges set at scrape time are reset, so values which are gone are
+	// not reported anymore.
+	connected.Reset()
+	connected.Set(1, "broker")
+	expected = `# HELP test_connected Whether we are connected.
+# TYPE test_connected gauge
+test_connected{name="broker"} 1
+`
+	if got := render(now, connected); got != expected {
+		t.Errorf("unexpected output after reset:\n%s\nexpected:\n%s", got, expected)
+	}
+	age.Reset()
+	expected = `# HELP test_age_seconds Seconds since the sensor was last read.
+# TYPE test_age_seconds gauge
+`
+	if got := render(now, age); got != expected {
+		t.Errorf("unexpected output after reset:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestWriteOrder(t *testing.T) {
+	NewGaugeVec("test_order_b", "B.")
+	NewCounterVec("test_order_a", "A.")
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("writing metrics: %v", err)
+	}
+	out := buf.String()
+
+	// Families are sorted by name, and followed by the runtime
+	// statistics.
+	families := []string{
+		"# TYPE sevc_sensor_age_seconds gauge\n",
+		"# TYPE test_order_a counter\n",
+		"# TYPE test_order_b gauge\n",
+		"# TYPE go_goroutines gauge\n",
+		"# TYPE go_gc_cycles_total counter\n",
+	}
+	last := -1
+	for _, family := range families {
+		idx := strings.Index(out, family)
+		if idx < 0 {
+			t.Fatalf("expected %q in the output:\n%s", family, out)
+		}
+		if idx < last {
+			t.Errorf("expected %q to come after the previous families", family)
+		}
+		last = idx
+	}
+	if !strings.HasSuffix(out, "\n") {
+		t.Errorf("expected the output to end with a newline")
+	}
+}
+
+func TestRegistrationPanics(t *testing.T) {
+	expectPanic := func(what string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected %s to panic", what)
+			}
+		}()
+		fn()
+	}
+
+	v := NewCounterVec("test_panics_total", "Panics.", "label")
+	expectPanic("registering twice", func() { NewGaugeVec("test_panics_total", "Again.") })
+	expectPanic("missing labels", func() { v.Inc() })
+	expectPanic("extra labels", func() { v.Inc("a", "b") })
+}
@@ -0,0 +1,150 @@
+package fake
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServerName is the host name in the certificate of the broker, besides
+// localhost and 127.0.0.1.
+const ServerName = "broker.test"
+
+// ClientName is the common name of the client certificate.
+const ClientName = "solar-ev-charger"
+
+// Certificates holds the paths to a certificate authority, and to a server
+// and a client certificate it signed, along with their keys. All are PEM
+// encoded.
+type Certificates struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	ca *x509.Certificate
+}
+
+// GenerateCertificates creates a certificate authority, and a server and a
+// client certificate signed by it, in dir.
+func GenerateCertificates(dir string) (*Certificates, error) {
+	certs := &Certificates{
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		ServerCertFile: filepath.Join(dir, "server.pem"),
+		ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		ClientCertFile: filepath.Join(dir, "client.pem"),
+		ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "solar-ev-charger test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ca, caKey, err := certs.generate(caTemplate, nil, nil, certs.CAFile, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "generating ca")
+	}
+	certs.ca = ca
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: ServerName},
+		DNSNames:    []string{ServerName, "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, _, err := certs.generate(serverTemplate, ca, caKey, certs.ServerCertFile, certs.ServerKeyFile); err != nil {
+		return nil, errors.Wrap(err, "generating server certificate")
+	}
+
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: ClientName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, _, err := certs.generate(clientTemplate, ca, caKey, certs.ClientCertFile, certs.ClientKeyFile); err != nil {
+		return nil, errors.Wrap(err, "generating client certificate")
+	}
+	return certs, nil
+}
+
+// generate creates a certificate from template, signed by parent. If parent
+// is nil, the certificate is self signed.
+func (c *Certificates) generate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+	if keyFile != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, key, nil
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(path, data, 0600)
+}
+
+// ServerTLSConfig returns the TLS config of a broker presenting the server
+// certificate. If requireClientCert is true, clients must present a
+// certificate signed by the certificate authority.
+func (c *Certificates) ServerTLSConfig(requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.ServerCertFile, c.ServerKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading server certificate")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if requireClientCert {
+		pool := x509.NewCertPool()
+		pool.AddCert(c.ca)
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
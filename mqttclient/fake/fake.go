@@ -0,0 +1,489 @@
+// Package fake implements a small MQTT 3.1.1 broker, listening over plain
+// TCP, TLS, WebSockets and WebSockets secured with TLS. It is meant to be
+// used in tests, and when developing without access to a real broker. It
+// delivers every message with QoS 0 and keeps no sessions.
+package fake
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketPath is the path the ws and wss listeners accept connections on.
+const WebSocketPath = "/mqtt"
+
+// Message is a message published to the broker.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// NewBroker returns a new broker. It accepts connections once a listener is
+// added with Listen.
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  map[*client]struct{}{},
+		retained: map[string]Message{},
+	}
+}
+
+type Broker struct {
+	mux       sync.Mutex
+	listeners []io.Closer
+	clients   map[*client]struct{}
+	retained  map[string]Message
+	published []Message
+	connects  []Connect
+	// handlers are called with the messages clients publish.
+	handlers []handler
+	// username and password are the credentials clients must present, if
+	// set.
+	username string
+	password string
+}
+
+// Connect describes a connection accepted by the broker.
+type Connect struct {
+	ClientID string
+	Username string
+	// Scheme is the listener the client connected through.
+	Scheme string
+	// PeerCertificates holds the certificates the client presented over
+	// TLS.
+	PeerCertificates []string
+}
+
+// handler is a function registered with Handle.
+type handler struct {
+	filter string
+	fn     func(Message)
+}
+
+// Handle calls fn with every message a client publishes on a topic matching
+// filter, once it was delivered to the subscribers. It lets tests play the
+// part of other clients, like a device answering commands.
+func (b *Broker) Handle(filter string, fn func(Message)) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.handlers = append(b.handlers, handler{filter: filter, fn: fn})
+}
+
+// SetCredentials makes the broker refuse clients that do not present these
+// credentials.
+func (b *Broker) SetCredentials(username, password string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.username, b.password = username, password
+}
+
+// Listen starts accepting connections on a random local port, over the tcp,
+// ssl, ws or wss scheme. tlsConfig is required by the ssl and wss schemes.
+// It returns the port the broker listens on.
+func (b *Broker) Listen(scheme string, tlsConfig *tls.Config) (int, error) {
+	secure := scheme == "ssl" || scheme == "wss"
+	if secure && tlsConfig == nil {
+		return 0, fmt.Errorf("scheme %s requires a tls config", scheme)
+	}
+
+	var listener net.Listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	if secure {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	switch scheme {
+	case "tcp", "ssl":
+		b.mux.Lock()
+		b.listeners = append(b.listeners, listener)
+		b.mux.Unlock()
+		go b.accept(scheme, listener)
+	case "ws", "wss":
+		srv := &http.Server{Handler: b.websocketHandler(scheme)}
+		b.mux.Lock()
+		b.listeners = append(b.listeners, srv)
+		b.mux.Unlock()
+		go srv.Serve(listener)
+	default:
+		listener.Close()
+		return 0, fmt.Errorf("invalid scheme: %s", scheme)
+	}
+	return port, nil
+}
+
+// Close stops the listeners and drops all clients.
+func (b *Broker) Close() error {
+	b.mux.Lock()
+	listeners := b.listeners
+	b.listeners = nil
+	b.mux.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	b.DropClients()
+	return nil
+}
+
+// DropClients closes the connection of every client, without closing the
+// listeners. Clients are able to connect again.
+func (b *Broker) DropClients() {
+	b.mux.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mux.Unlock()
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// Connects returns the connections accepted so far.
+func (b *Broker) Connects() []Connect {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]Connect(nil), b.connects...)
+}
+
+// Published returns the messages published by clients so far.
+func (b *Broker) Published() []Message {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]Message(nil), b.published...)
+}
+
+// Subscribed returns true if a client is subscribed to topic.
+func (b *Broker) Subscribed(topic string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for c := range b.clients {
+		if c.subscribed(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends a message to the clients subscribed to topic.
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	b.route(Message{Topic: topic, Payload: payload, Retained: retained})
+}
+
+func (b *Broker) route(msg Message) {
+	b.mux.Lock()
+	if msg.Retained {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	var targets []*client
+	for c := range b.clients {
+		if c.subscribed(msg.Topic) {
+			targets = append(targets, c)
+		}
+	}
+	b.mux.Unlock()
+
+	for _, c := range targets {
+		// Messages routed to existing subscriptions are not flagged as
+		// retained.
+		c.deliver(Message{Topic: msg.Topic, Payload: msg.Payload})
+	}
+}
+
+// handle calls the handlers registered for the topic of msg.
+func (b *Broker) handle(msg Message) {
+	b.mux.Lock()
+	var fns []func(Message)
+	for _, h := range b.handlers {
+		if matches(h.filter, msg.Topic) {
+			fns = append(fns, h.fn)
+		}
+	}
+	b.mux.Unlock()
+
+	for _, fn := range fns {
+		fn(msg)
+	}
+}
+
+func (b *Broker) accept(scheme string, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(scheme, conn)
+	}
+}
+
+func (b *Broker) websocketHandler(scheme string) http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		CheckOrigin:  func(*http.Request) bool { return true },
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != WebSocketPath {
+			http.NotFound(rw, req)
+			return
+		}
+		ws, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		b.serve(scheme, &wsConn{ws: ws, state: req.TLS})
+	})
+}
+
+// serve handles the packets of a client, until it disconnects.
+func (b *Broker) serve(scheme string, conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{conn: conn, subscriptions: map[string]struct{}{}}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	b.mux.Lock()
+	if connack.ReturnCode == packets.Accepted && b.username != "" {
+		if connect.Username != b.username || string(connect.Password) != b.password {
+			connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+		}
+	}
+	if connack.ReturnCode == packets.Accepted {
+		b.clients[c] = struct{}{}
+		b.connects = append(b.connects, Connect{
+			ClientID:         connect.ClientIdentifier,
+			Username:         connect.Username,
+			Scheme:           scheme,
+			PeerCertificates: peerCertificates(conn),
+		})
+	}
+	b.mux.Unlock()
+	if err := c.write(connack); err != nil || connack.ReturnCode != packets.Accepted {
+		return
+	}
+	defer func() {
+		b.mux.Lock()
+		delete(b.clients, c)
+		b.mux.Unlock()
+	}()
+
+	for {
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			msg := Message{Topic: p.TopicName, Payload: p.Payload, Retained: p.Retain}
+			b.mux.Lock()
+			b.published = append(b.published, msg)
+			b.mux.Unlock()
+			switch p.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID = p.MessageID
+				c.write(pubrec)
+			}
+			b.route(msg)
+			b.handle(msg)
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			c.write(pubcomp)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			var retained []Message
+			b.mux.Lock()
+			for _, topic := range p.Topics {
+				c.subscribe(topic)
+				// We only deliver with QoS 0.
+				suback.ReturnCodes = append(suback.ReturnCodes, 0)
+				for name, msg := range b.retained {
+					if matches(topic, name) {
+						retained = append(retained, msg)
+					}
+				}
+			}
+			b.mux.Unlock()
+			c.write(suback)
+			for _, msg := range retained {
+				c.deliver(msg)
+			}
+		case *packets.UnsubscribePacket:
+			b.mux.Lock()
+			for _, topic := range p.Topics {
+				c.unsubscribe(topic)
+			}
+			b.mux.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func peerCertificates(conn net.Conn) []string {
+	var state *tls.ConnectionState
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.Handshake(); err != nil {
+			return nil
+		}
+		s := c.ConnectionState()
+		state = &s
+	case *wsConn:
+		state = c.state
+	}
+	if state == nil {
+		return nil
+	}
+	var ret []string
+	for _, cert := range state.PeerCertificates {
+		ret = append(ret, cert.Subject.CommonName)
+	}
+	return ret
+}
+
+// client is a connected client. Its subscriptions are guarded by the lock
+// of the broker.
+type client struct {
+	conn          net.Conn
+	writeMux      sync.Mutex
+	subscriptions map[string]struct{}
+}
+
+func (c *client) subscribe(filter string) {
+	c.subscriptions[filter] = struct{}{}
+}
+
+func (c *client) unsubscribe(filter string) {
+	delete(c.subscriptions, filter)
+}
+
+func (c *client) subscribed(topic string) bool {
+	for filter := range c.subscriptions {
+		if matches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) deliver(msg Message) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = msg.Topic
+	publish.Payload = msg.Payload
+	publish.Retain = msg.Retained
+	c.write(publish)
+}
+
+// write sends pkt in a single write, so it fits in a single WebSocket
+// message.
+func (c *client) write(pkt packets.ControlPacket) error {
+	var buf bytes.Buffer
+	if err := pkt.Write(&buf); err != nil {
+		return err
+	}
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// matches returns true if topic matches the subscription filter.
+func matches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for idx, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if idx >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[idx] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// wsConn exposes a WebSocket as a stream of bytes.
+type wsConn struct {
+	ws     *websocket.Conn
+	state  *tls.ConnectionState
+	reader io.Reader
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for {
+		if w.reader == nil {
+			_, reader, err := w.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.reader = reader
+		}
+		n, err := w.reader.Read(p)
+		if err == io.EOF {
+			w.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	if err := w.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) Close() error                       { return w.ws.Close() }
+func (w *wsConn) LocalAddr() net.Addr                { return w.ws.LocalAddr() }
+func (w *wsConn) RemoteAddr() net.Addr               { return w.ws.RemoteAddr() }
+func (w *wsConn) SetDeadline(t time.Time) error      { return w.ws.UnderlyingConn().SetDeadline(t) }
+func (w *wsConn) SetReadDeadline(t time.Time) error  { return w.ws.SetReadDeadline(t) }
+func (w *wsConn) SetWriteDeadline(t time.Time) error { return w.ws.SetWriteDeadline(t) }
@@ -0,0 +1,321 @@
+// Package mqttclient maintains the MQTT connections used by the charger
+// drivers. A Manager reconnects with exponential backoff when the broker
+// goes away, restores the subscriptions once connected again, and reports
+// the state of the connection through the health package.
+package mqttclient
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/health"
+	"solar-ev-charger/metrics"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("sevc.mqttclient")
+
+var (
+	reconnects     = metrics.NewCounterVec("sevc_mqtt_reconnects_total", "Number of times we connected to the broker again.", "connection")
+	connectedGauge = metrics.NewGaugeVec("sevc_mqtt_connected", "Whether we are connected to the broker.", "connection")
+)
+
+const (
+	// minBackoff is the time we wait before the first reconnect attempt.
+	minBackoff = time.Second
+	// maxBackoff caps the time between two reconnect attempts.
+	maxBackoff = 2 * time.Minute
+	// stableConnection is how long a connection must last before a loss
+	// resets the backoff. This keeps us from hammering a broker that
+	// accepts the connection and drops it right away.
+	stableConnection = time.Minute
+	// operationTimeout bounds connecting, subscribing and publishing.
+	operationTimeout = 10 * time.Second
+	// quiesce is the time in milliseconds we give in flight messages on
+	// disconnect.
+	quiesce = 250
+)
+
+// ErrNotConnected is returned by Publish while we are not connected to the
+// broker.
+var ErrNotConnected = fmt.Errorf("not connected to mqtt broker")
+
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// Manager maintains a connection to an MQTT broker.
+type Manager struct {
+	name   string
+	broker string
+	opts   *mqtt.ClientOptions
+
+	mux           sync.Mutex
+	client        mqtt.Client
+	connected     bool
+	connectedAt   time.Time
+	everConnected bool
+	subscriptions map[string]subscription
+	onConnect     []func()
+	started       bool
+	stopped       bool
+
+	lost   chan struct{}
+	quit   chan struct{}
+	closed chan struct{}
+}
+
+// New returns a new manager for the broker in settings. The name identifies
+// the connection in logs and in the health status. The connection is made
+// once Start is called.
+func New(name string, settings config.MQTTSettings) (*Manager, error) {
+	opts, err := settings.ClientOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching client options")
+	}
+	// We reconnect ourselves, so we can back off and resubscribe.
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(operationTimeout)
+
+	m := &Manager{
+		name:          name,
+		broker:        settings.Broker,
+		opts:          opts,
+		subscriptions: map[string]subscription{},
+		lost:          make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	opts.SetConnectionLostHandler(m.connectionLost)
+	health.Set(name, health.StateOffline, fmt.Errorf("not connected yet"))
+	connectedGauge.Set(0, name)
+	return m, nil
+}
+
+// Name returns the name of the connection.
+func (m *Manager) Name() string {
+	return m.name
+}
+
+// Connected returns true if we are connected to the broker.
+func (m *Manager) Connected() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.connected
+}
+
+// OnConnect registers fn to be called after every successful connection,
+// once the subscriptions are in place. fn is called from the goroutine that
+// maintains the connection, and must not block for long.
+func (m *Manager) OnConnect(fn func()) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.onConnect = append(m.onConnect, fn)
+}
+
+// Subscribe subscribes to topic. The subscription is restored every time we
+// reconnect. If we are not connected, the subscription is made once we are.
+func (m *Manager) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.subscriptions[topic] = subscription{
+		qos:     qos,
+		handler: handler,
+	}
+	if !m.connected {
+		return nil
+	}
+	return subscribe(m.client, topic, qos, handler)
+}
+
+// Publish publishes payload on topic.
+func (m *Manager) Publish(topic string, qos byte, retained bool, payload interface{}) error {
+	m.mux.Lock()
+	client := m.client
+	connected := m.connected
+	m.mux.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(operationTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	if token.Error() != nil {
+		return errors.Wrapf(token.Error(), "publishing to %s", topic)
+	}
+	return nil
+}
+
+func subscribe(client mqtt.Client, topic string, qos byte, handler mqtt.MessageHandler) error {
+	log.Infof("subscribing to %s", topic)
+	token := client.Subscribe(topic, qos, handler)
+	if !token.WaitTimeout(operationTimeout) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	}
+	if token.Error() != nil {
+		return errors.Wrapf(token.Error(), "subscribing to %s", topic)
+	}
+	return nil
+}
+
+func (m *Manager) connectionLost(client mqtt.Client, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if client != m.client || !m.connected {
+		return
+	}
+	log.Warningf("connection to %s (%s) has been lost: %q", m.broker, m.name, err)
+	m.connected = false
+	connectedGauge.Set(0, m.name)
+	health.Set(m.name, health.StateOffline, err)
+	select {
+	case m.lost <- struct{}{}:
+	default:
+	}
+}
+
+// connect connects to the broker and restores the subscriptions.
+func (m *Manager) connect() error {
+	client := mqtt.NewClient(m.opts)
+	token := client.Connect()
+	if !token.WaitTimeout(operationTimeout) {
+		client.Disconnect(0)
+		return fmt.Errorf("timed out connecting to %s", m.broker)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	m.mux.Lock()
+	for topic, sub := range m.subscriptions {
+		if err := subscribe(client, topic, sub.qos, sub.handler); err != nil {
+			m.mux.Unlock()
+			client.Disconnect(0)
+			return err
+		}
+	}
+	m.client = client
+	m.connected = true
+	m.connectedAt = time.Now()
+	if m.everConnected {
+		reconnects.Inc(m.name)
+	}
+	m.everConnected = true
+	connectedGauge.Set(1, m.name)
+	onConnect := append([]func(){}, m.onConnect...)
+	m.mux.Unlock()
+
+	log.Infof("connected to %s (%s)", m.broker, m.name)
+	health.Set(m.name, health.StateOK, nil)
+	for _, fn := range onConnect {
+		fn()
+	}
+	return nil
+}
+
+func (m *Manager) disconnect() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.client != nil && m.connected {
+		m.client.Disconnect(quiesce)
+	}
+	m.client = nil
+	m.connected = false
+	connectedGauge.Set(0, m.name)
+}
+
+// backoff returns the delay with up to 50% jitter added.
+func backoff(delay time.Duration) time.Duration {
+	return delay + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+func (m *Manager) loop() {
+	defer close(m.closed)
+
+	delay := minBackoff
+	for {
+		if err := m.connect(); err != nil {
+			health.Set(m.name, health.StateOffline, err)
+			wait := backoff(delay)
+			log.Errorf("failed to connect to %s (%s): %q; retrying in %v", m.broker, m.name, err, wait.Round(time.Second))
+			select {
+			case <-time.After(wait):
+			case <-m.quit:
+				return
+			}
+			if delay *= 2; delay > maxBackoff {
+				delay = maxBackoff
+			}
+			continue
+		}
+
+		select {
+		case <-m.lost:
+			m.mux.Lock()
+			stable := time.Since(m.connectedAt) >= stableConnection
+			m.mux.Unlock()
+			if stable {
+				delay = minBackoff
+			}
+			wait := backoff(delay)
+			select {
+			case <-time.After(wait):
+			case <-m.quit:
+				m.disconnect()
+				return
+			}
+			if delay *= 2; delay > maxBackoff {
+				delay = maxBackoff
+			}
+		case <-m.quit:
+			m.disconnect()
+			return
+		}
+	}
+}
+
+// Start connects to the broker in the background, and keeps the connection
+// up until Stop is called.
+func (m *Manager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.started {
+		return fmt.Errorf("%s is already started", m.name)
+	}
+	m.started = true
+	go m.loop()
+	return nil
+}
+
+// Stop disconnects from the broker. The manager can not be started again.
+func (m *Manager) Stop() error {
+	m.mux.Lock()
+	if !m.started || m.stopped {
+		m.mux.Unlock()
+		return nil
+	}
+	m.stopped = true
+	close(m.quit)
+	m.mux.Unlock()
+
+	select {
+	case <-m.closed:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timeout waiting for mqtt connection to close")
+	}
+}
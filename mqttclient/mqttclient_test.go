@@ -0,0 +1,211 @@
+package mqttclient
+
+import (
+	"testing"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/mqttclient/fake"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// waitFor polls cond until it returns true, or fails the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerSchemes(t *testing.T) {
+	certs, err := fake.GenerateCertificates(t.TempDir())
+	if err != nil {
+		t.Fatalf("generating certificates: %v", err)
+	}
+	serverTLS, err := certs.ServerTLSConfig(true)
+	if err != nil {
+		t.Fatalf("loading server tls config: %v", err)
+	}
+
+	tests := []struct {
+		scheme   config.MQTTScheme
+		settings config.MQTTSettings
+	}{
+		{config.MQTTTCP, config.MQTTSettings{}},
+		{config.MQTTWS, config.MQTTSettings{}},
+		{config.MQTTSSL, config.MQTTSettings{
+			CAFile:   certs.CAFile,
+			CertFile: certs.ClientCertFile,
+			KeyFile:  certs.ClientKeyFile,
+		}},
+		// We connect by IP address, and verify the name in the
+		// certificate of the broker instead.
+		{config.MQTTWSS, config.MQTTSettings{
+			CAFile:     certs.CAFile,
+			CertFile:   certs.ClientCertFile,
+			KeyFile:    certs.ClientKeyFile,
+			ServerName: fake.ServerName,
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.scheme), func(t *testing.T) {
+			broker := fake.NewBroker()
+			defer broker.Close()
+			broker.SetCredentials("user", "secret")
+			port, err := broker.Listen(string(tc.scheme), serverTLS)
+			if err != nil {
+				t.Fatalf("starting broker: %v", err)
+			}
+
+			settings := tc.settings
+			settings.Broker = "127.0.0.1"
+			settings.Port = port
+			settings.Scheme = tc.scheme
+			settings.Username = "user"
+			settings.Password = "secret"
+			mgr, err := New("test-"+string(tc.scheme), settings)
+			if err != nil {
+				t.Fatalf("creating manager: %v", err)
+			}
+
+			received := make(chan string, 1)
+			err = mgr.Subscribe("station/status", 0, func(_ mqtt.Client, msg mqtt.Message) {
+				received <- string(msg.Payload())
+			})
+			if err != nil {
+				t.Fatalf("subscribing: %v", err)
+			}
+			if err := mgr.Start(); err != nil {
+				t.Fatalf("starting manager: %v", err)
+			}
+			defer mgr.Stop()
+
+			waitFor(t, 5*time.Second, "subscription", func() bool {
+				return broker.Subscribed("station/status")
+			})
+			broker.Publish("station/status", []byte("charging"), false)
+			select {
+			case payload := <-received:
+				if payload != "charging" {
+					t.Errorf("expected charging, got %s", payload)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for message")
+			}
+
+			if err := mgr.Publish("station/set", 1, false, "16"); err != nil {
+				t.Fatalf("publishing: %v", err)
+			}
+			published := broker.Published()
+			if len(published) != 1 || published[0].Topic != "station/set" || string(published[0].Payload) != "16" {
+				t.Errorf("unexpected messages published: %+v", published)
+			}
+
+			connects := broker.Connects()
+			if len(connects) != 1 {
+				t.Fatalf("expected a single connection, got %+v", connects)
+			}
+			if connects[0].Username != "user" || connects[0].Scheme != string(tc.scheme) {
+				t.Errorf("unexpected connection: %+v", connects[0])
+			}
+			if tc.settings.CertFile != "" {
+				if len(connects[0].PeerCertificates) == 0 || connects[0].PeerCertificates[0] != fake.ClientName {
+					t.Errorf("expected client certificate %s, got %v", fake.ClientName, connects[0].PeerCertificates)
+				}
+			}
+		})
+	}
+}
+
+func TestManagerUntrustedBroker(t *testing.T) {
+	certs, err := fake.GenerateCertificates(t.TempDir())
+	if err != nil {
+		t.Fatalf("generating certificates: %v", err)
+	}
+	serverTLS, err := certs.ServerTLSConfig(false)
+	if err != nil {
+		t.Fatalf("loading server tls config: %v", err)
+	}
+	broker := fake.NewBroker()
+	defer broker.Close()
+	port, err := broker.Listen("ssl", serverTLS)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+
+	// Without the CA, the certificate of the broker is rejected.
+	mgr, err := New("test-untrusted", config.MQTTSettings{
+		Broker: "127.0.0.1",
+		Port:   port,
+		Scheme: config.MQTTSSL,
+	})
+	if err != nil {
+		t.Fatalf("creating manager: %v", err)
+	}
+	if err := mgr.connect(); err == nil {
+		t.Fatalf("expected the connection to fail")
+	}
+	if len(broker.Connects()) != 0 {
+		t.Errorf("expected no accepted connections")
+	}
+
+	// Skipping verification lets us through.
+	mgr, err = New("test-insecure", config.MQTTSettings{
+		Broker:             "127.0.0.1",
+		Port:               port,
+		Scheme:             config.MQTTSSL,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("creating manager: %v", err)
+	}
+	if err := mgr.connect(); err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	mgr.disconnect()
+}
+
+func TestManagerReconnects(t *testing.T) {
+	broker := fake.NewBroker()
+	defer broker.Close()
+	port, err := broker.Listen("tcp", nil)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+
+	mgr, err := New("test-reconnect", config.MQTTSettings{Broker: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatalf("creating manager: %v", err)
+	}
+	connected := make(chan struct{}, 2)
+	mgr.OnConnect(func() { connected <- struct{}{} })
+	if err := mgr.Subscribe("station/#", 0, func(mqtt.Client, mqtt.Message) {}); err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	if err := mgr.Start(); err != nil {
+		t.Fatalf("starting manager: %v", err)
+	}
+	defer mgr.Stop()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for connection %d", attempt+1)
+		}
+		if !broker.Subscribed("station/status") {
+			t.Errorf("connection %d: expected the subscription to be restored", attempt+1)
+		}
+		if attempt == 0 {
+			broker.DropClients()
+		}
+	}
+	if len(broker.Connects()) != 2 {
+		t.Errorf("expected two connections, got %d", len(broker.Connects()))
+	}
+}
@@ -1,12 +1,78 @@
 package params
 
 type DBusState struct {
-	Consumers map[string]float64
-	Producers map[string]float64
+	Consumers map[string]float64 `json:"consumers"`
+	Producers map[string]float64 `json:"producers"`
+	// Source names the worker which sent the state. Each state holds all
+	// the values of its source, and replaces the one it sent before.
+	Source string `json:"-"`
+	// Unavailable is set by sources which failed to read their values.
+	// The values sent before are dropped until the source recovers.
+	Unavailable bool `json:"-"`
+}
+
+// VehicleState is the state of the vehicle connected to a charger,
+// normalized across chargers.
+type VehicleState string
+
+const (
+	// VehicleUnknown is reported by chargers unable to detect a vehicle.
+	VehicleUnknown VehicleState = ""
+	// VehicleDisconnected means no vehicle is plugged in.
+	VehicleDisconnected VehicleState = "disconnected"
+	// VehicleConnected means a vehicle is plugged in, but not charging.
+	VehicleConnected VehicleState = "connected"
+	// VehicleCharging means the vehicle is drawing power.
+	VehicleCharging VehicleState = "charging"
+	// VehicleFinished means the vehicle is plugged in, and stopped
+	// charging on its own. Usually because the battery is full.
+	VehicleFinished VehicleState = "finished"
+	// VehicleError means the charger reports a fault.
+	VehicleError VehicleState = "error"
+)
+
+func (v VehicleState) String() string {
+	if v == VehicleUnknown {
+		return "unknown"
+	}
+	return string(v)
+}
+
+// PluggedIn returns true if a vehicle is plugged in.
+func (v VehicleState) PluggedIn() bool {
+	switch v {
+	case VehicleConnected, VehicleCharging, VehicleFinished:
+		return true
+	}
+	return false
+}
+
+// Controllable returns true if the charger should be controlled while the
+// vehicle is in this state. Chargers unable to detect a vehicle are always
+// controlled.
+func (v VehicleState) Controllable() bool {
+	switch v {
+	case VehicleUnknown, VehicleConnected, VehicleCharging:
+		return true
+	}
+	return false
 }
 
 type ChargerState struct {
-	Active            bool
-	CurrentUsage      float64
-	CurrentAmpSetting float64
+	Active            bool    `json:"active"`
+	CurrentUsage      float64 `json:"current_usage"`
+	CurrentAmpSetting float64 `json:"current_amp_setting"`
+	// Vehicle is the state of the vehicle. Only set by chargers able to
+	// detect it.
+	Vehicle VehicleState `json:"vehicle"`
+	// SessionEnergy is the energy in Wh charged since the vehicle was
+	// plugged in. Only set by chargers able to report it.
+	SessionEnergy float64 `json:"session_energy"`
+	// EEPROMWrites is the number of writes to the EEPROM of the charger we
+	// triggered since startup, for chargers that persist settings to flash.
+	EEPROMWrites uint64 `json:"eeprom_writes"`
+	// ManualOverride is set while the current and state were overridden
+	// by hand on the charger, which ignores our commands until the
+	// override is cleared.
+	ManualOverride bool `json:"manual_override"`
 }
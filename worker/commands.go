@@ -0,0 +1,218 @@
+package worker
+
+import (
+	"math"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// commandKind identifies a command sent to the charger.
+type commandKind string
+
+const (
+	commandStart  commandKind = "start"
+	commandStop   commandKind = "stop"
+	commandSetAmp commandKind = "set current"
+)
+
+// maxRetryDelay caps the amount of time we wait before sending commands
+// again, after the charger failed to apply them.
+const maxRetryDelay = 10 * time.Minute
+
+// defaultDriftHold is the amount of time we leave a current changed on the
+// charger in place, for chargers which can not tell us when the vehicle is
+// unplugged.
+const defaultDriftHold = time.Hour
+
+// pendingCommand is a command the charger did not yet report as applied.
+type pendingCommand struct {
+	kind   commandKind
+	amps   float64
+	issued time.Time
+}
+
+// applied returns true if state shows the command took effect.
+func (p pendingCommand) applied(state params.ChargerState, step float64) bool {
+	switch p.kind {
+	case commandStart:
+		return state.Active
+	case commandStop:
+		return !state.Active
+	case commandSetAmp:
+		return math.Abs(state.CurrentAmpSetting-p.amps) < step/2
+	}
+	return false
+}
+
+// awaiting returns true if we are waiting for the charger to apply the same
+// command. Sending it again would not help.
+func (w *Worker) awaiting(kind commandKind, amps float64) bool {
+	cmd, ok := w.pending[kind]
+	return ok && cmd.amps == amps
+}
+
+// send runs a command, and tracks it until the charger reports it applied.
+func (w *Worker) send(kind commandKind, amps float64, now time.Time, fn func() error) error {
+	commandsSent.Inc(string(kind))
+	if err := fn(); err != nil {
+		commandsFailed.Inc(string(kind))
+		w.commandFailed(now)
+		return err
+	}
+	// Start and stop cancel each other out.
+	switch kind {
+	case commandStart:
+		delete(w.pending, commandStop)
+	case commandStop:
+		delete(w.pending, commandStart)
+	}
+	w.pending[kind] = pendingCommand{
+		kind:   kind,
+		amps:   amps,
+		issued: now,
+	}
+	return nil
+}
+
+// verifyCommands checks the pending commands against the last state the
+// charger reported. Commands not applied within command_verify_timeout
+// count as failures.
+func (w *Worker) verifyCommands(now time.Time, step float64) {
+	timeout := time.Duration(w.cfg.CommandVerifyTimeout) * time.Second
+	for kind, cmd := range w.pending {
+		// Only a state reported after we sent the command tells us
+		// whether it was applied.
+		if w.chargerStateAt.After(cmd.issued) && cmd.applied(w.chargerState, step) {
+			log.Debugf("charger applied %s", kind)
+			delete(w.pending, kind)
+			if kind == commandSetAmp {
+				w.ampsSet = cmd.amps
+				w.ampsSetKnown = true
+			}
+			w.commandSucceeded()
+			continue
+		}
+		if now.Sub(cmd.issued) >= timeout {
+			log.Warningf("charger did not apply %s within %v", kind, timeout)
+			delete(w.pending, kind)
+			commandsFailed.Inc(string(kind))
+			w.commandFailed(now)
+		}
+	}
+}
+
+func (w *Worker) commandSucceeded() {
+	w.failures = 0
+	w.retryAt = time.Time{}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.faulted {
+		log.Infof("charger is applying commands again")
+		w.faulted = false
+	}
+}
+
+// commandFailed delays the next commands, waiting longer after each
+// consecutive failure, and flags the charger as faulted after
+// command_retries failures.
+func (w *Worker) commandFailed(now time.Time) {
+	w.failures++
+	delay := time.Duration(w.cfg.CommandVerifyTimeout) * time.Second
+	for i := uint(1); i < w.failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	w.retryAt = now.Add(delay)
+	log.Infof("sending commands again in %v", delay)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.failures >= w.cfg.CommandRetries && !w.faulted {
+		log.Errorf("charger failed %d commands in a row; flagging it as faulted", w.failures)
+		w.faulted = true
+	}
+}
+
+// Faulted returns true if the charger repeatedly failed to apply our
+// commands.
+func (w *Worker) Faulted() bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.faulted
+}
+
+// checkDrift detects a current changed on the charger by someone else, and
+// applies the drift policy.
+func (w *Worker) checkDrift(now time.Time, caps common.Capabilities) {
+	if w.driftHeld {
+		if w.driftUntil.IsZero() || now.Before(w.driftUntil) {
+			return
+		}
+		log.Infof("taking back control of the current")
+		w.driftHeld = false
+	}
+	if !w.ampsSetKnown {
+		return
+	}
+	if _, ok := w.pending[commandSetAmp]; ok {
+		return
+	}
+	current := w.chargerState.CurrentAmpSetting
+	if math.Abs(current-w.ampsSet) < caps.CurrentStep/2 {
+		return
+	}
+	log.Infof("current was changed on the charger from %v to %v", w.ampsSet, current)
+	w.ampsSetKnown = false
+	if w.cfg.DriftPolicy != config.DriftRespect {
+		return
+	}
+
+	hold := time.Duration(w.cfg.DriftHoldTime) * time.Second
+	if hold == 0 && !caps.PlugDetection {
+		hold = defaultDriftHold
+	}
+	w.driftHeld = true
+	w.driftUntil = time.Time{}
+	if hold > 0 {
+		w.driftUntil = now.Add(hold)
+		log.Infof("leaving the current alone for %v", hold)
+	} else {
+		log.Infof("leaving the current alone until the vehicle is unplugged")
+	}
+}
+
+// checkManualOverride returns true while the charger reports a manual
+// override, set by the user on the charger itself. The charger ignores our
+// commands until the override is cleared, whatever the drift policy, so
+// pending commands are dropped instead of being counted as failures.
+func (w *Worker) checkManualOverride() bool {
+	if !w.chargerState.ManualOverride {
+		if w.manualOverride {
+			log.Infof("manual override was cleared on the charger; taking back control")
+			w.manualOverride = false
+		}
+		return false
+	}
+	if !w.manualOverride {
+		log.Infof("charger was manually overridden; leaving it alone until the override is cleared")
+		w.manualOverride = true
+	}
+	w.pending = map[commandKind]pendingCommand{}
+	// The current applied at our request is lost once the override ends.
+	w.ampsSetKnown = false
+	return true
+}
+
+// releaseDrift ends a drift hold lasting until the vehicle is unplugged.
+func (w *Worker) releaseDrift() {
+	if w.driftHeld && w.driftUntil.IsZero() {
+		log.Infof("vehicle unplugged; taking back control of the current")
+		w.driftHeld = false
+	}
+}
@@ -0,0 +1,428 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// fakeClient records the commands it receives. The states the charger
+// reports are scripted by the tests.
+type fakeClient struct {
+	caps     common.Capabilities
+	commands []string
+}
+
+func (c *fakeClient) Start() error {
+	c.commands = append(c.commands, string(commandStart))
+	return nil
+}
+
+func (c *fakeClient) Stop() error {
+	c.commands = append(c.commands, string(commandStop))
+	return nil
+}
+
+func (c *fakeClient) SetAmp(amps float64) error {
+	c.commands = append(c.commands, fmt.Sprintf("%s %v A", commandSetAmp, amps))
+	return nil
+}
+
+func (c *fakeClient) Capabilities() (common.Capabilities, error) {
+	return c.caps, nil
+}
+
+// takeCommands returns the commands received since the last call.
+func (c *fakeClient) takeCommands() []string {
+	ret := c.commands
+	c.commands = nil
+	return ret
+}
+
+var testCaps = common.Capabilities{
+	MinCurrent:    6,
+	MaxCurrent:    32,
+	CurrentStep:   1,
+	Toggle:        true,
+	PlugDetection: true,
+}
+
+// newTestWorker returns a worker controlling a fake charger, with 10 A of
+// solar surplus available. The command settings are taken from cfg.
+func newTestWorker(t *testing.T, cfg config.Config, caps common.Capabilities) (*Worker, *fakeClient) {
+	t.Helper()
+	cfg.ElectricalPresure = 230
+	cfg.MaxAmpLimit = 32
+	cfg.MinAmpThreshold = 6
+	cfg.EnableChargingThreshold = 6
+	cfg.DisableChargingThreshold = 4
+	cli := &fakeClient{caps: caps}
+	w, err := NewWorker(context.Background(), &cfg, cli, nil, nil)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+	w.dbusState.Producers["/Ac/Power"] = 10 * 230
+	w.dbusStateReceived = true
+	return w, cli
+}
+
+// report simulates a state reported by the charger at now.
+func report(w *Worker, now time.Time, state params.ChargerState) {
+	w.chargerState = state
+	w.chargerStateAt = now
+	w.chargerStateReceived = true
+}
+
+func TestManualOverride(t *testing.T) {
+	for _, policy := range []config.DriftPolicy{config.DriftCorrect, config.DriftRespect} {
+		cfg := config.Config{CommandVerifyTimeout: 10, CommandRetries: 2, DriftPolicy: policy}
+		w, cli := newTestWorker(t, cfg, testCaps)
+		now := time.Now()
+
+		report(w, now, params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging})
+		var d Decision
+		if err := w.decide(now, control{mode: ModeSolar}, &d); err != nil {
+			t.Fatalf("%s: deciding: %v", policy, err)
+		}
+		if got := cli.takeCommands(); len(got) != 1 || got[0] != "set current 10 A" {
+			t.Fatalf("%s: expected the current to be set to 10 A, got %v", policy, got)
+		}
+
+		// The user overrides the current on the charger before it applies
+		// ours. The override is left alone for longer than the charger
+		// has to apply commands, without flagging it as faulted.
+		for i := 1; i <= 5; i++ {
+			now = now.Add(10 * time.Second)
+			report(w, now, params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging, ManualOverride: true})
+			d = Decision{}
+			if err := w.decide(now, control{mode: ModeMax}, &d); err != nil {
+				t.Fatalf("%s: deciding: %v", policy, err)
+			}
+			if !d.DriftHeld || d.Reason != "the charger is manually overridden" {
+				t.Errorf("%s: expected the override to be held, got %+v", policy, d)
+			}
+		}
+		if got := cli.takeCommands(); len(got) != 0 {
+			t.Errorf("%s: expected no commands during the override, got %v", policy, got)
+		}
+		if w.failures != 0 || w.Faulted() {
+			t.Errorf("%s: expected no failures, got %d (faulted: %v)", policy, w.failures, w.Faulted())
+		}
+
+		// Once the override is cleared, the charger is controlled again.
+		now = now.Add(10 * time.Second)
+		report(w, now, params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging})
+		d = Decision{}
+		if err := w.decide(now, control{mode: ModeSolar}, &d); err != nil {
+			t.Fatalf("%s: deciding: %v", policy, err)
+		}
+		if got := cli.takeCommands(); len(got) != 1 || got[0] != "set current 10 A" {
+			t.Errorf("%s: expected the current to be set again, got %v", policy, got)
+		}
+	}
+}
+
+func TestVerifyCommands(t *testing.T) {
+	issued := time.Now()
+	tests := []struct {
+		name  string
+		cmd   pendingCommand
+		state params.ChargerState
+		// stateAt and now are offsets from the time the command was
+		// issued.
+		stateAt  time.Duration
+		now      time.Duration
+		pending  bool
+		failures uint
+		ampsSet  float64
+	}{
+		{
+			name:    "applied current",
+			cmd:     pendingCommand{kind: commandSetAmp, amps: 10},
+			state:   params.ChargerState{CurrentAmpSetting: 10},
+			stateAt: time.Second,
+			now:     time.Second,
+			ampsSet: 10,
+		},
+		{
+			name:    "current within half a step",
+			cmd:     pendingCommand{kind: commandSetAmp, amps: 10},
+			state:   params.ChargerState{CurrentAmpSetting: 10.4},
+			stateAt: time.Second,
+			now:     time.Second,
+			ampsSet: 10,
+		},
+		{
+			name:    "state older than the command",
+			cmd:     pendingCommand{kind: commandSetAmp, amps: 10},
+			state:   params.ChargerState{CurrentAmpSetting: 10},
+			stateAt: -time.Second,
+			now:     time.Second,
+			pending: true,
+		},
+		{
+			name:    "not applied yet",
+			cmd:     pendingCommand{kind: commandStart},
+			state:   params.ChargerState{Active: false},
+			stateAt: time.Second,
+			now:     59 * time.Second,
+			pending: true,
+		},
+		{
+			name:     "not applied in time",
+			cmd:      pendingCommand{kind: commandStart},
+			state:    params.ChargerState{Active: false},
+			stateAt:  time.Second,
+			now:      60 * time.Second,
+			failures: 1,
+		},
+		{
+			name:    "applied stop",
+			cmd:     pendingCommand{kind: commandStop},
+			state:   params.ChargerState{Active: false},
+			stateAt: time.Second,
+			now:     time.Second,
+		},
+	}
+	for _, tc := range tests {
+		w, _ := newTestWorker(t, config.Config{CommandVerifyTimeout: 60, CommandRetries: 3}, testCaps)
+		tc.cmd.issued = issued
+		w.pending[tc.cmd.kind] = tc.cmd
+		report(w, issued.Add(tc.stateAt), tc.state)
+
+		w.verifyCommands(issued.Add(tc.now), 1)
+		if _, ok := w.pending[tc.cmd.kind]; ok != tc.pending {
+			t.Errorf("%s: expected pending %v, got %v", tc.name, tc.pending, ok)
+		}
+		if w.failures != tc.failures {
+			t.Errorf("%s: expected %d failures, got %d", tc.name, tc.failures, w.failures)
+		}
+		if w.ampsSetKnown != (tc.ampsSet != 0) || w.ampsSet != tc.ampsSet {
+			t.Errorf("%s: expected %v A applied, got %v (known: %v)", tc.name, tc.ampsSet, w.ampsSet, w.ampsSetKnown)
+		}
+	}
+}
+
+func TestCommandFailed(t *testing.T) {
+	tests := []struct {
+		failures uint
+		delay    time.Duration
+		faulted  bool
+	}{
+		{1, time.Minute, false},
+		{2, 2 * time.Minute, false},
+		{3, 4 * time.Minute, true},
+		{4, 8 * time.Minute, true},
+		{5, maxRetryDelay, true},
+		{10, maxRetryDelay, true},
+	}
+	for _, tc := range tests {
+		w, _ := newTestWorker(t, config.Config{CommandVerifyTimeout: 60, CommandRetries: 3}, testCaps)
+		now := time.Now()
+		for i := uint(0); i < tc.failures; i++ {
+			w.commandFailed(now)
+		}
+		if delay := w.retryAt.Sub(now); delay != tc.delay {
+			t.Errorf("%d failures: expected a delay of %v, got %v", tc.failures, tc.delay, delay)
+		}
+		if w.Faulted() != tc.faulted {
+			t.Errorf("%d failures: expected faulted %v, got %v", tc.failures, tc.faulted, w.Faulted())
+		}
+
+		w.commandSucceeded()
+		if w.failures != 0 || !w.retryAt.IsZero() || w.Faulted() {
+			t.Errorf("%d failures: expected a success to reset the failures", tc.failures)
+		}
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	noPlugDetection := testCaps
+	noPlugDetection.PlugDetection = false
+	tests := []struct {
+		name     string
+		policy   config.DriftPolicy
+		holdTime uint
+		caps     common.Capabilities
+		current  float64
+		held     bool
+		hold     time.Duration
+	}{
+		{
+			name:    "no drift",
+			policy:  config.DriftRespect,
+			caps:    testCaps,
+			current: 10,
+		},
+		{
+			name:    "drift corrected",
+			policy:  config.DriftCorrect,
+			caps:    testCaps,
+			current: 16,
+		},
+		{
+			name:    "drift respected until unplugged",
+			policy:  config.DriftRespect,
+			caps:    testCaps,
+			current: 16,
+			held:    true,
+		},
+		{
+			name:     "drift respected for the hold time",
+			policy:   config.DriftRespect,
+			holdTime: 600,
+			caps:     testCaps,
+			current:  16,
+			held:     true,
+			hold:     10 * time.Minute,
+		},
+		{
+			name:    "drift respected without plug detection",
+			policy:  config.DriftRespect,
+			caps:    noPlugDetection,
+			current: 16,
+			held:    true,
+			hold:    defaultDriftHold,
+		},
+	}
+	for _, tc := range tests {
+		cfg := config.Config{CommandVerifyTimeout: 60, CommandRetries: 3, DriftPolicy: tc.policy, DriftHoldTime: tc.holdTime}
+		w, _ := newTestWorker(t, cfg, tc.caps)
+		now := time.Now()
+		w.ampsSet, w.ampsSetKnown = 10, true
+		report(w, now, params.ChargerState{CurrentAmpSetting: tc.current})
+
+		w.checkDrift(now, tc.caps)
+		if w.driftHeld != tc.held {
+			t.Errorf("%s: expected held %v, got %v", tc.name, tc.held, w.driftHeld)
+		}
+		if tc.held && tc.hold == 0 && !w.driftUntil.IsZero() {
+			t.Errorf("%s: expected the drift to be held until unplugged, got %v", tc.name, w.driftUntil)
+		}
+		if tc.hold != 0 && w.driftUntil.Sub(now) != tc.hold {
+			t.Errorf("%s: expected the drift to be held for %v, got %v", tc.name, tc.hold, w.driftUntil.Sub(now))
+		}
+		if drifted := tc.current != 10; w.ampsSetKnown == drifted {
+			t.Errorf("%s: expected the applied current to be forgotten after a drift", tc.name)
+		}
+
+		// A timed hold ends once the time passed, and the current is
+		// ours to set again.
+		if tc.hold != 0 {
+			w.checkDrift(now.Add(tc.hold), tc.caps)
+			if w.driftHeld {
+				t.Errorf("%s: expected the hold to end after %v", tc.name, tc.hold)
+			}
+		}
+	}
+}
+
+func TestReleaseDrift(t *testing.T) {
+	tests := []struct {
+		name       string
+		driftUntil time.Time
+		held       bool
+	}{
+		{"held until unplugged", time.Time{}, false},
+		{"held for some time", time.Now().Add(time.Hour), true},
+	}
+	for _, tc := range tests {
+		w, _ := newTestWorker(t, config.Config{CommandVerifyTimeout: 60, CommandRetries: 3}, testCaps)
+		w.driftHeld, w.driftUntil = true, tc.driftUntil
+		w.releaseDrift()
+		if w.driftHeld != tc.held {
+			t.Errorf("%s: expected held %v after unplugging, got %v", tc.name, tc.held, w.driftHeld)
+		}
+	}
+}
+
+// step is a state reported by the charger, and the commands we expect in
+// response.
+type step struct {
+	// at is the offset of the state from the start of the test.
+	at       time.Duration
+	state    params.ChargerState
+	commands []string
+}
+
+// runSteps feeds the states to decide, and checks the commands sent to the
+// charger.
+func runSteps(t *testing.T, name string, w *Worker, cli *fakeClient, steps []step) {
+	t.Helper()
+	start := time.Now()
+	for i, s := range steps {
+		now := start.Add(s.at)
+		report(w, now, s.state)
+		if err := w.decide(now, control{mode: ModeSolar}, &Decision{}); err != nil {
+			t.Fatalf("%s: step %d: deciding: %v", name, i, err)
+		}
+		if got := cli.takeCommands(); fmt.Sprint(got) != fmt.Sprint(s.commands) {
+			t.Errorf("%s: step %d: expected commands %v, got %v", name, i, s.commands, got)
+		}
+	}
+}
+
+func TestDecideDrift(t *testing.T) {
+	charging := func(amps float64) params.ChargerState {
+		return params.ChargerState{Active: true, CurrentAmpSetting: amps, Vehicle: params.VehicleCharging}
+	}
+	tests := []struct {
+		policy config.DriftPolicy
+		steps  []step
+	}{
+		{
+			policy: config.DriftCorrect,
+			steps: []step{
+				{0, charging(16), []string{"set current 10 A"}},
+				{10 * time.Second, charging(10), nil},
+				// The current is changed on the charger, and set back.
+				{20 * time.Second, charging(16), []string{"set current 10 A"}},
+				{30 * time.Second, charging(10), nil},
+			},
+		},
+		{
+			policy: config.DriftRespect,
+			steps: []step{
+				{0, charging(16), []string{"set current 10 A"}},
+				{10 * time.Second, charging(10), nil},
+				// The current is changed on the charger, and left alone.
+				{20 * time.Second, charging(16), nil},
+				{time.Hour, charging(16), nil},
+			},
+		},
+	}
+	for _, tc := range tests {
+		cfg := config.Config{CommandVerifyTimeout: 60, CommandRetries: 3, DriftPolicy: tc.policy}
+		w, cli := newTestWorker(t, cfg, testCaps)
+		runSteps(t, string(tc.policy), w, cli, tc.steps)
+	}
+}
+
+func TestDecideRetries(t *testing.T) {
+	// The charger never applies the current.
+	state := params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging}
+	cfg := config.Config{CommandVerifyTimeout: 60, CommandRetries: 2}
+	w, cli := newTestWorker(t, cfg, testCaps)
+	runSteps(t, "retries", w, cli, []step{
+		{0, state, []string{"set current 10 A"}},
+		// We wait for the charger to apply the current, without
+		// sending it again.
+		{30 * time.Second, state, nil},
+		// The command timed out; we wait another minute.
+		{60 * time.Second, state, nil},
+		{119 * time.Second, state, nil},
+		{120 * time.Second, state, []string{"set current 10 A"}},
+		// The second failure doubles the delay.
+		{180 * time.Second, state, nil},
+		{299 * time.Second, state, nil},
+		{300 * time.Second, state, []string{"set current 10 A"}},
+	})
+	if !w.Faulted() {
+		t.Errorf("expected the charger to be faulted after %d failures", w.failures)
+	}
+}
@@ -0,0 +1,236 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/params"
+)
+
+// Mode decides how the charge current is chosen.
+type Mode string
+
+const (
+	// ModeSolar charges with the surplus of solar production. This is the
+	// default.
+	ModeSolar Mode = "solar"
+	// ModeMax charges at the maximum current, regardless of production.
+	ModeMax Mode = "max"
+	// ModeOff keeps the charger switched off.
+	ModeOff Mode = "off"
+)
+
+// Validate returns an error if the mode is unknown.
+func (m Mode) Validate() error {
+	switch m {
+	case ModeSolar, ModeMax, ModeOff:
+		return nil
+	}
+	return fmt.Errorf("invalid mode: %q", m)
+}
+
+// Override is a fixed current set for a limited amount of time. It takes
+// precedence over the mode.
+type Override struct {
+	// Current is the current in Amps we charge with. Zero switches the
+	// charger off.
+	Current float64 `json:"current"`
+	// Until is the time the override expires.
+	Until time.Time `json:"until"`
+}
+
+// Decision records the outcome of a sync, along with its inputs.
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Mode     Mode      `json:"mode"`
+	Override *Override `json:"override,omitempty"`
+	Paused   bool      `json:"paused"`
+	// Reason explains why the charger was left alone, if it was.
+	Reason string `json:"reason,omitempty"`
+	// Error is set if a command failed.
+	Error string `json:"error,omitempty"`
+
+	// Production, Consumption, ChargerUsage and Available are in Watts.
+	Production   float64 `json:"production"`
+	Consumption  float64 `json:"consumption"`
+	ChargerUsage float64 `json:"charger_usage"`
+	Available    float64 `json:"available"`
+	// AvailableAmps is the surplus converted to a current the charger
+	// accepts.
+	AvailableAmps float64 `json:"available_amps"`
+	// MinCurrent and MaxCurrent are the limits we set the current within.
+	MinCurrent float64 `json:"min_current"`
+	MaxCurrent float64 `json:"max_current"`
+	// TargetActive and TargetAmps are the state we want the charger in.
+	TargetActive bool    `json:"target_active"`
+	TargetAmps   float64 `json:"target_amps"`
+	// DriftHeld is set while we leave a current changed on the charger
+	// in place.
+	DriftHeld bool `json:"drift_held"`
+	// Commands lists the commands sent to the charger.
+	Commands []string `json:"commands,omitempty"`
+}
+
+// Status is a snapshot of the state of the worker.
+type Status struct {
+	DBus           params.DBusState     `json:"dbus"`
+	Charger        params.ChargerState  `json:"charger"`
+	ChargerUpdated time.Time            `json:"charger_updated"`
+	Capabilities   *common.Capabilities `json:"capabilities,omitempty"`
+	Mode           Mode                 `json:"mode"`
+	Override       *Override            `json:"override,omitempty"`
+	Paused         bool                 `json:"paused"`
+	Faulted        bool                 `json:"faulted"`
+	// Decision is the outcome of the last sync.
+	Decision *Decision `json:"decision,omitempty"`
+}
+
+// control holds the settings changed through the API.
+type control struct {
+	mode     Mode
+	override *Override
+	paused   bool
+}
+
+// explicit returns true if the user asked for a specific state, instead of
+// leaving it to the solar production.
+func (c control) explicit() bool {
+	return c.override != nil || c.mode != ModeSolar
+}
+
+// currentControl returns the control settings, dropping an expired
+// override. It must be called with the lock held.
+func (w *Worker) currentControl(now time.Time) control {
+	if w.override != nil && !now.Before(w.override.Until) {
+		log.Infof("override of %v A expired", w.override.Current)
+		w.override = nil
+	}
+	ret := control{
+		mode:   w.mode,
+		paused: w.paused,
+	}
+	if w.override != nil {
+		override := *w.override
+		ret.override = &override
+	}
+	return ret
+}
+
+// Status returns a snapshot of the state of the worker.
+func (w *Worker) Status() Status {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	ctl := w.currentControl(time.Now())
+	status := Status{
+		DBus: params.DBusState{
+			Consumers: map[string]float64{},
+			Producers: map[string]float64{},
+		},
+		Charger:        w.chargerState,
+		ChargerUpdated: w.chargerStateAt,
+		Mode:           ctl.mode,
+		Override:       ctl.override,
+		Paused:         ctl.paused,
+		Faulted:        w.faulted,
+	}
+	for key, val := range w.dbusState.Consumers {
+		status.DBus.Consumers[key] = val
+	}
+	for key, val := range w.dbusState.Producers {
+		status.DBus.Producers[key] = val
+	}
+	if w.capsFetched {
+		caps := w.caps
+		status.Capabilities = &caps
+	}
+	if !w.decision.Time.IsZero() {
+		decision := w.decision
+		status.Decision = &decision
+	}
+	return status
+}
+
+// SetMode changes the mode.
+func (w *Worker) SetMode(mode Mode) error {
+	if err := mode.Validate(); err != nil {
+		return err
+	}
+	w.mux.Lock()
+	w.mode = mode
+	w.mux.Unlock()
+
+	log.Infof("mode set to %s", mode)
+	w.wakeUp()
+	return nil
+}
+
+// SetOverride charges with a fixed current for the given duration. A zero
+// current switches the charger off.
+func (w *Worker) SetOverride(current float64, duration time.Duration) (Override, error) {
+	if current < 0 {
+		return Override{}, fmt.Errorf("invalid current: %v", current)
+	}
+	if duration <= 0 {
+		return Override{}, fmt.Errorf("invalid duration: %v", duration)
+	}
+	override := Override{
+		Current: current,
+		Until:   time.Now().Add(duration),
+	}
+	w.mux.Lock()
+	w.override = &override
+	w.mux.Unlock()
+
+	log.Infof("overriding the current with %v A until %s", current, override.Until.Format(time.RFC3339))
+	w.wakeUp()
+	return override, nil
+}
+
+// ClearOverride removes the override, if any.
+func (w *Worker) ClearOverride() {
+	w.mux.Lock()
+	cleared := w.override != nil
+	w.override = nil
+	w.mux.Unlock()
+
+	if cleared {
+		log.Infof("override cleared")
+		w.wakeUp()
+	}
+}
+
+// Pause stops sending commands to the charger, until Resume is called.
+func (w *Worker) Pause() {
+	w.mux.Lock()
+	paused := w.paused
+	w.paused = true
+	w.mux.Unlock()
+
+	if !paused {
+		log.Infof("control paused")
+		w.wakeUp()
+	}
+}
+
+// Resume resumes control of the charger.
+func (w *Worker) Resume() {
+	w.mux.Lock()
+	paused := w.paused
+	w.paused = false
+	w.mux.Unlock()
+
+	if paused {
+		log.Infof("control resumed")
+		w.wakeUp()
+	}
+}
+
+// wakeUp makes the worker sync right away.
+func (w *Worker) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,176 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+// woken returns true if the worker was asked to sync, and resets the
+// request.
+func woken(w *Worker) bool {
+	select {
+	case <-w.wake:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	tests := []struct {
+		mode  Mode
+		valid bool
+	}{
+		{ModeSolar, true},
+		{ModeMax, true},
+		{ModeOff, true},
+		{"turbo", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		w, _ := newTestWorker(t, config.Config{}, testCaps)
+		w.mode = ModeMax
+		err := w.SetMode(tc.mode)
+		if tc.valid != (err == nil) {
+			t.Errorf("%q: expected valid %v, got error %v", tc.mode, tc.valid, err)
+		}
+		expected := ModeMax
+		if tc.valid {
+			expected = tc.mode
+		}
+		if got := w.Status().Mode; got != expected {
+			t.Errorf("%q: expected mode %s, got %s", tc.mode, expected, got)
+		}
+		if woken(w) != tc.valid {
+			t.Errorf("%q: expected a valid mode to wake the worker", tc.mode)
+		}
+	}
+}
+
+func TestSetOverride(t *testing.T) {
+	tests := []struct {
+		current  float64
+		duration time.Duration
+		valid    bool
+	}{
+		{16, time.Hour, true},
+		{0, time.Minute, true},
+		{-1, time.Hour, false},
+		{16, 0, false},
+		{16, -time.Minute, false},
+	}
+	for _, tc := range tests {
+		w, _ := newTestWorker(t, config.Config{}, testCaps)
+		before := time.Now()
+		override, err := w.SetOverride(tc.current, tc.duration)
+		if tc.valid != (err == nil) {
+			t.Errorf("%v A for %v: expected valid %v, got error %v", tc.current, tc.duration, tc.valid, err)
+			continue
+		}
+		status := w.Status()
+		if !tc.valid {
+			if status.Override != nil || woken(w) {
+				t.Errorf("%v A for %v: expected no override, got %+v", tc.current, tc.duration, status.Override)
+			}
+			continue
+		}
+		if override.Current != tc.current || override.Until.Before(before.Add(tc.duration)) {
+			t.Errorf("%v A for %v: unexpected override %+v", tc.current, tc.duration, override)
+		}
+		if status.Override == nil || *status.Override != override {
+			t.Errorf("%v A for %v: expected override %+v, got %+v", tc.current, tc.duration, override, status.Override)
+		}
+		if !woken(w) {
+			t.Errorf("%v A for %v: expected the override to wake the worker", tc.current, tc.duration)
+		}
+	}
+}
+
+func TestClearOverride(t *testing.T) {
+	w, _ := newTestWorker(t, config.Config{}, testCaps)
+	if _, err := w.SetOverride(16, time.Hour); err != nil {
+		t.Fatalf("setting override: %v", err)
+	}
+	woken(w)
+
+	w.ClearOverride()
+	if w.Status().Override != nil {
+		t.Errorf("expected the override to be cleared")
+	}
+	if !woken(w) {
+		t.Errorf("expected clearing the override to wake the worker")
+	}
+	// Clearing again is a no-op.
+	w.ClearOverride()
+	if woken(w) {
+		t.Errorf("expected clearing a missing override not to wake the worker")
+	}
+}
+
+func TestOverrideExpiry(t *testing.T) {
+	w, _ := newTestWorker(t, config.Config{}, testCaps)
+	override, err := w.SetOverride(16, time.Hour)
+	if err != nil {
+		t.Fatalf("setting override: %v", err)
+	}
+
+	w.mux.Lock()
+	ctl := w.currentControl(override.Until.Add(-time.Second))
+	w.mux.Unlock()
+	if ctl.override == nil || !ctl.explicit() {
+		t.Errorf("expected the override to apply before it expires")
+	}
+
+	w.mux.Lock()
+	ctl = w.currentControl(override.Until)
+	w.mux.Unlock()
+	if ctl.override != nil || ctl.explicit() {
+		t.Errorf("expected the override to expire, got %+v", ctl.override)
+	}
+	if w.Status().Override != nil {
+		t.Errorf("expected the expired override to be dropped")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	w, cli := newTestWorker(t, config.Config{CommandVerifyTimeout: 60, CommandRetries: 3}, testCaps)
+	now := time.Now()
+	report(w, now, params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging})
+
+	w.Pause()
+	if !w.Status().Paused || !woken(w) {
+		t.Errorf("expected the worker to be paused and woken up")
+	}
+	w.Pause()
+	if woken(w) {
+		t.Errorf("expected pausing again not to wake the worker")
+	}
+
+	if err := w.syncState(); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if got := cli.takeCommands(); len(got) != 0 {
+		t.Errorf("expected no commands while paused, got %v", got)
+	}
+	if d := w.Status().Decision; d == nil || !d.Paused || d.Reason != "control is paused" {
+		t.Errorf("unexpected decision while paused: %+v", d)
+	}
+
+	w.Resume()
+	if w.Status().Paused || !woken(w) {
+		t.Errorf("expected the worker to be resumed and woken up")
+	}
+	w.Resume()
+	if woken(w) {
+		t.Errorf("expected resuming again not to wake the worker")
+	}
+	if err := w.syncState(); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if got := cli.takeCommands(); len(got) != 1 || got[0] != "set current 10 A" {
+		t.Errorf("expected the current to be set once resumed, got %v", got)
+	}
+}
@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"time"
+
+	"solar-ev-charger/metrics"
+)
+
+var (
+	commandsSent   = metrics.NewCounterVec("sevc_charger_commands_total", "Number of commands sent to the charger.", "command")
+	commandsFailed = metrics.NewCounterVec("sevc_charger_command_failures_total", "Number of commands the charger failed to run or apply.", "command")
+
+	producerWatts = metrics.NewGaugeVec("sevc_producer_watts", "Power reported by each producer, in Watts.", "sensor")
+	consumerWatts = metrics.NewGaugeVec("sevc_consumer_watts", "Power reported by each consumer, in Watts.", "sensor")
+
+	chargerActive         = metrics.NewGaugeVec("sevc_charger_active", "Whether the charger is switched on.")
+	chargerPower          = metrics.NewGaugeVec("sevc_charger_power_watts", "Power drawn by the charger, in Watts.")
+	chargerCurrentSetting = metrics.NewGaugeVec("sevc_charger_current_setting_amps", "Current the charger is set to, in Amps.")
+	chargerSessionEnergy  = metrics.NewGaugeVec("sevc_charger_session_energy_watthours", "Energy charged in the current session, in Wh.")
+	chargerFaulted        = metrics.NewGaugeVec("sevc_charger_faulted", "Whether the charger repeatedly failed to apply commands.")
+	chargerStateAge       = metrics.NewGaugeVec("sevc_charger_state_age_seconds", "Seconds since the charger last reported its state.")
+
+	availableWatts = metrics.NewGaugeVec("sevc_available_surplus_watts", "Surplus available to the charger at the last decision, in Watts.")
+	availableAmps  = metrics.NewGaugeVec("sevc_available_amps", "Surplus available to the charger at the last decision, in Amps.")
+	decidedAmps    = metrics.NewGaugeVec("sevc_decided_amps", "Current decided for the charger at the last decision, in Amps.")
+	decidedActive  = metrics.NewGaugeVec("sevc_decided_active", "Whether the charger should be switched on, as of the last decision.")
+
+	controlMode   = metrics.NewGaugeVec("sevc_control_mode", "The current mode, as a 1 for the active mode.", "mode")
+	controlPaused = metrics.NewGaugeVec("sevc_control_paused", "Whether control of the charger is paused.")
+)
+
+// CollectMetrics updates the metrics derived from the state of the worker.
+// It is called before metrics are scraped.
+func (w *Worker) CollectMetrics() {
+	status := w.Status()
+
+	// Sensors may go away when the config changes; only report the ones
+	// we know about now.
+	producerWatts.Reset()
+	for label, val := range status.DBus.Producers {
+		producerWatts.Set(val, label)
+	}
+	consumerWatts.Reset()
+	for label, val := range status.DBus.Consumers {
+		consumerWatts.Set(val, label)
+	}
+
+	if !status.ChargerUpdated.IsZero() {
+		chargerActive.SetBool(status.Charger.Active)
+		chargerPower.Set(status.Charger.CurrentUsage)
+		chargerCurrentSetting.Set(status.Charger.CurrentAmpSetting)
+		chargerSessionEnergy.Set(status.Charger.SessionEnergy)
+		chargerStateAge.Set(time.Since(status.ChargerUpdated).Seconds())
+	}
+	chargerFaulted.SetBool(status.Faulted)
+
+	if decision := status.Decision; decision != nil {
+		availableWatts.Set(decision.Available)
+		availableAmps.Set(decision.AvailableAmps)
+		decidedAmps.Set(decision.TargetAmps)
+		decidedActive.SetBool(decision.TargetActive)
+	}
+
+	for _, mode := range []Mode{ModeSolar, ModeMax, ModeOff} {
+		controlMode.SetBool(status.Mode == mode, string(mode))
+	}
+	controlPaused.SetBool(status.Paused)
+}
@@ -11,31 +11,34 @@ import (
 	"github.com/pkg/errors"
 
 	"solar-ev-charger/chargers/common"
-	eChargerClient "solar-ev-charger/chargers/eCharger/client"
-	openEVSEClient "solar-ev-charger/chargers/openEVSE/client"
 	"solar-ev-charger/config"
 	"solar-ev-charger/params"
 )
 
 var log = loggo.GetLogger("sevc.worker")
 
-func NewWorker(ctx context.Context, cfg *config.Config, dbusChanges chan params.DBusState, chargerChanges chan params.ChargerState) (*Worker, error) {
-	var chargerClient common.Client
-	switch cfg.ConfiguredCharger {
-	case "OpenEVSE":
-		chargerClient = openEVSEClient.NewChargerClient(cfg.OpenEVSE.Address, cfg.OpenEVSE.Username, cfg.OpenEVSE.Password)
-	case "eCharger":
-		chargerClient = eChargerClient.NewChargerClient(cfg.Charger.StationAddress)
+func NewWorker(ctx context.Context, cfg *config.Config, chargerClient common.Client, dbusChanges chan params.DBusState, chargerChanges chan params.ChargerState) (*Worker, error) {
+	if chargerClient == nil {
+		return nil, fmt.Errorf("missing client for charger %s", cfg.ConfiguredCharger)
 	}
 
 	return &Worker{
 		dbusChanges:    dbusChanges,
 		chargerChanges: chargerChanges,
-		closed:         make(chan struct{}),
-		quit:           make(chan struct{}),
-		ctx:            ctx,
-		cfg:            *cfg,
-		chargerClient:  chargerClient,
+		dbusState: params.DBusState{
+			Consumers: map[string]float64{},
+			Producers: map[string]float64{},
+		},
+		sources:         map[string]params.DBusState{},
+		expectedSources: cfg.StateSources(),
+		closed:          make(chan struct{}),
+		quit:            make(chan struct{}),
+		ctx:             ctx,
+		cfg:             *cfg,
+		chargerClient:   chargerClient,
+		pending:         map[commandKind]pendingCommand{},
+		mode:            ModeSolar,
+		wake:            make(chan struct{}, 1),
 	}, nil
 }
 
@@ -45,28 +48,105 @@ type Worker struct {
 
 	dbusState    params.DBusState
 	chargerState params.ChargerState
+	// sources holds the last values of each source, which are merged
+	// into dbusState.
+	sources map[string]params.DBusState
+	// expectedSources are the names of the configured sources.
+	expectedSources []string
 
 	chargerStateReceived bool
 	dbusStateReceived    bool
 
 	chargerClient common.Client
+	// caps are the capabilities of the charger, once fetched.
+	caps        common.Capabilities
+	capsFetched bool
+	// minAmps and maxAmps are the configured limits, intersected with the
+	// limits of the charger.
+	minAmps float64
+	maxAmps float64
+
+	// chargerStateAt is the time we received the last charger state.
+	chargerStateAt time.Time
+	// pending holds the commands the charger did not yet report as
+	// applied.
+	pending map[commandKind]pendingCommand
+	// failures is the number of consecutive commands the charger failed
+	// to apply.
+	failures uint
+	// retryAt is the time after which we may send commands again, after
+	// the charger failed to apply one.
+	retryAt time.Time
+	// faulted is set once the charger failed command_retries commands in
+	// a row. Guarded by mux.
+	faulted bool
+	// ampsSet is the last current the charger applied at our request. It
+	// is used to detect a current changed by someone else.
+	ampsSet      float64
+	ampsSetKnown bool
+	// driftHeld is set while we leave a current changed on the charger in
+	// place, until driftUntil. A zero driftUntil means until the vehicle
+	// is unplugged.
+	driftHeld  bool
+	driftUntil time.Time
+	// manualOverride is set while the charger reports a manual override.
+	manualOverride bool
+	// stoppedOnRequest is set if we switched the charger off because of
+	// the mode or an override.
+	stoppedOnRequest bool
+
+	// mode, override and paused are set through the API. decision is the
+	// outcome of the last sync. Guarded by mux.
+	mode     Mode
+	override *Override
+	paused   bool
+	decision Decision
 
 	cfg config.Config
 
 	ctx    context.Context
 	closed chan struct{}
 	quit   chan struct{}
+	// wake makes the loop sync right away, after the user changed the
+	// settings.
+	wake chan struct{}
 
 	mux sync.Mutex
 }
 
 func (w *Worker) syncState() error {
+	now := time.Now()
+	w.mux.Lock()
+	ctl := w.currentControl(now)
+	w.mux.Unlock()
+
+	decision := Decision{
+		Time:     now,
+		Mode:     ctl.mode,
+		Override: ctl.override,
+		Paused:   ctl.paused,
+	}
+	err := w.decide(now, ctl, &decision)
+	if err != nil {
+		decision.Error = err.Error()
+	}
+
+	w.mux.Lock()
+	w.decision = decision
+	w.mux.Unlock()
+	return err
+}
+
+// decide brings the charger in the state we want, and records how it got
+// there in d.
+func (w *Worker) decide(now time.Time, ctl control, d *Decision) error {
 	if !w.chargerStateReceived || !w.dbusStateReceived {
 		log.Infof("Empty charger or dbus state. Waiting for metrics.")
+		d.Reason = "waiting for charger and dbus state"
 		return nil
 	}
-	var stationAmps uint64
-	var availableAmps uint64
+	var stationAmps float64
+	var availableAmps float64
 	// initialize desired state with current state.
 	var desiredState bool = w.chargerState.Active
 
@@ -81,6 +161,73 @@ func (w *Worker) syncState() error {
 	for _, val := range w.dbusState.Producers {
 		totalProduction += val
 	}
+	d.Production = totalProduction
+	d.Consumption = totalConsumption
+	d.ChargerUsage = chargerConsumption
+
+	if ctl.paused {
+		log.Debugf("control is paused; not controlling the charger")
+		d.Reason = "control is paused"
+		// Commands sent before the pause are of no interest anymore.
+		w.pending = map[commandKind]pendingCommand{}
+		return nil
+	}
+
+	if feeder, ok := w.chargerClient.(common.SurplusFeeder); ok {
+		// The charger decides the current itself. We only feed it readings.
+		gridImport := totalConsumption - totalProduction
+		log.Debugf("feeding charger production: %.2f, grid import: %.2f", totalProduction, gridImport)
+		d.Reason = "the charger decides the current itself"
+		if ctl.explicit() {
+			d.Reason += "; mode and override are ignored"
+		}
+		if err := feeder.FeedSurplus(totalProduction, gridImport); err != nil {
+			return errors.Wrap(err, "feeding surplus to charger")
+		}
+		return nil
+	}
+
+	if !w.chargerState.Vehicle.Controllable() {
+		// There is no point in adjusting the charger while no vehicle
+		// is connected, or while the vehicle does not take any power.
+		// Chargers may not apply commands in this state either.
+		log.Debugf("vehicle is %s; not controlling the charger", w.chargerState.Vehicle)
+		d.Reason = fmt.Sprintf("vehicle is %s", w.chargerState.Vehicle)
+		w.pending = map[commandKind]pendingCommand{}
+		return nil
+	}
+
+	caps := w.capabilities()
+	d.MinCurrent, d.MaxCurrent = w.minAmps, w.maxAmps
+	if !caps.Adjustable() && !caps.Toggle {
+		log.Debugf("charger can neither be switched nor adjusted")
+		d.Reason = "charger can neither be switched nor adjusted"
+		return nil
+	}
+
+	if w.checkManualOverride() {
+		d.DriftHeld = true
+		d.Reason = "the charger is manually overridden"
+		return nil
+	}
+	w.verifyCommands(now, caps.CurrentStep)
+	if caps.Adjustable() {
+		w.checkDrift(now, caps)
+	}
+	if now.Before(w.retryAt) {
+		log.Debugf("charger failed to apply a command; waiting until %s", w.retryAt.Format(time.RFC3339))
+		d.Reason = fmt.Sprintf("charger failed to apply a command; waiting until %s", w.retryAt.Format(time.RFC3339))
+		return nil
+	}
+
+	step := caps.CurrentStep
+	phases := caps.Phases
+	if phases < 1 {
+		phases = int(w.cfg.ChargerPhases)
+	}
+	if phases < 1 {
+		phases = 1
+	}
 
 	householdConsumption := totalConsumption - chargerConsumption
 	// available watts after we substract household usage. We round that down.
@@ -91,73 +238,230 @@ func (w *Worker) syncState() error {
 		// We're consuming more than we're producing
 		availableAmps = 0
 	} else {
-		// We have some excess. Convert to amps.
-		availableAmps = uint64(available) / w.cfg.ElectricalPresure
+		// We have some excess. Convert to amps, and round down to a value
+		// the charger accepts.
+		availableAmps = roundDown(available/float64(w.cfg.ElectricalPresure*uint64(phases)), step)
 	}
 
-	var curAmpSetting uint64
-	if w.chargerState.CurrentAmpSetting >= 0 {
-		curAmpSetting = uint64(w.chargerState.CurrentAmpSetting)
-	}
-
-	if availableAmps > uint64(w.cfg.MaxAmpLimit) {
-		// We have more power than we can set on the station. Cap it to configured maximum.
-		availableAmps = uint64(w.cfg.MaxAmpLimit)
+	if availableAmps > w.maxAmps {
+		// We have more power than we can set on the station. Cap it to the maximum.
+		availableAmps = w.maxAmps
 	}
+	d.Available = available
+	d.AvailableAmps = availableAmps
 
 	// The current state of the station is not modified if the current available amps
 	// stays within the usage range defined by the disable and the enable thresholds.
 	// it is a buffer zone to prevent station flapping.
-	if availableAmps <= uint64(w.cfg.DisableChargingThreshold) {
+	if availableAmps <= float64(w.cfg.DisableChargingThreshold) {
 		// if we dip bellow the disable threshold, we turn off the station.
 		// Above this threshold we leave it on, even if we drain the batteries
 		// a bit.
 		desiredState = false
-	} else if availableAmps >= uint64(w.cfg.EnableChargingThreshold) {
+	} else if availableAmps >= float64(w.cfg.EnableChargingThreshold) {
 		// if the station is off and the available amps are above the enable threshold
 		// we turn it back on.
 		desiredState = true
 	}
 
 	stationAmps = availableAmps
-	if stationAmps < uint64(w.cfg.MinAmpThreshold) {
-		// We're producing less than the minimum we want to set on the station.
-		stationAmps = uint64(w.cfg.MinAmpThreshold)
+	if stationAmps < w.minAmps {
+		// We're producing less than the minimum we can set on the station.
+		stationAmps = w.minAmps
+	}
+
+	// An override takes precedence over the mode, which takes precedence
+	// over the production.
+	switch {
+	case ctl.override != nil:
+		desiredState = ctl.override.Current > 0
+		stationAmps = math.Min(math.Max(roundDown(ctl.override.Current, step), w.minAmps), w.maxAmps)
+	case ctl.mode == ModeMax:
+		desiredState = true
+		stationAmps = w.maxAmps
+	case ctl.mode == ModeOff:
+		desiredState = false
+		stationAmps = w.minAmps
 	}
 
 	log.Tracef("Desired state is %v, available amps is %v (%v), station amps is %v, disable threshold %v, enable_threshold: %v ", desiredState, availableAmps, available, stationAmps, w.cfg.DisableChargingThreshold, w.cfg.EnableChargingThreshold)
 
+	// Chargers without an adjustable current can only be controlled by
+	// switching them on and off. Chargers that can not be switched are
+	// only ever adjusted. A mode or override set by the user switches
+	// any charger that can be switched.
+	toggle := (w.cfg.ToggleStationOnThreshold || !caps.Adjustable() || ctl.explicit()) && caps.Toggle
+	if !toggle && caps.Toggle && w.stoppedOnRequest {
+		// Without toggling the charger is meant to stay on. Switch it
+		// back on, now that the user no longer wants it off.
+		desiredState = true
+		toggle = true
+	}
+	d.TargetActive = desiredState
+	d.TargetAmps = stationAmps
+
 	if desiredState && !w.chargerState.Active {
 		log.Debugf("desired state is %v, current state is %v", desiredState, w.chargerState.Active)
-		if w.cfg.ToggleStationOnThreshold {
+		if toggle && !w.awaiting(commandStart, 0) {
 			log.Infof("enabling charging station; available amps: %v", availableAmps)
-			if err := w.chargerClient.Start(); err != nil {
+			d.Commands = append(d.Commands, string(commandStart))
+			if err := w.send(commandStart, 0, now, w.chargerClient.Start); err != nil {
 				return errors.Wrap(err, "starting charger")
 			}
+			w.stoppedOnRequest = false
 		}
 	}
 
 	if !desiredState && w.chargerState.Active {
 		log.Debugf("desired state is %v, current state is %v", desiredState, w.chargerState.Active)
-		if w.cfg.ToggleStationOnThreshold {
+		if toggle && !w.awaiting(commandStop, 0) {
 			log.Infof("disabling charging station; available amps: %v", availableAmps)
-			if err := w.chargerClient.Stop(); err != nil {
+			d.Commands = append(d.Commands, string(commandStop))
+			if err := w.send(commandStop, 0, now, w.chargerClient.Stop); err != nil {
 				return errors.Wrap(err, "stopping charger")
 			}
+			w.stoppedOnRequest = ctl.explicit()
 		}
 	}
 
-	if curAmpSetting != stationAmps {
-		log.Infof("setting station amp to %d. Previous setting was %d", stationAmps, curAmpSetting)
-		if err := w.chargerClient.SetAmp(stationAmps); err != nil {
+	if !caps.Adjustable() {
+		return nil
+	}
+	if w.driftHeld && !ctl.explicit() {
+		d.DriftHeld = true
+		d.Reason = "leaving the current changed on the charger alone"
+		return nil
+	}
+
+	curAmpSetting := w.chargerState.CurrentAmpSetting
+	// Settings reported by the charger may not fall exactly on a step.
+	if math.Abs(curAmpSetting-stationAmps) >= step/2 && !w.awaiting(commandSetAmp, stationAmps) {
+		log.Infof("setting station amp to %v. Previous setting was %v", stationAmps, curAmpSetting)
+		setAmp := func() error {
+			return w.chargerClient.SetAmp(stationAmps)
+		}
+		d.Commands = append(d.Commands, fmt.Sprintf("%s %v A", commandSetAmp, stationAmps))
+		if err := w.send(commandSetAmp, stationAmps, now, setAmp); err != nil {
 			return errors.Wrap(err, "setting station amps")
 		}
 	}
 	return nil
 }
 
+// capabilities returns the capabilities of the charger, and sets the current
+// limits we use. Capabilities are fetched once. If the charger can not be
+// queried, we use the defaults and try again on the next sync.
+func (w *Worker) capabilities() common.Capabilities {
+	if w.capsFetched {
+		return w.caps
+	}
+
+	caps, err := w.chargerClient.Capabilities()
+	if err != nil {
+		log.Warningf("failed to fetch charger capabilities, using defaults: %s", err)
+		caps = common.DefaultCapabilities()
+	} else {
+		log.Infof("charger capabilities: %+v", caps)
+	}
+	minAmps, maxAmps := currentLimits(w.cfg, caps)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if err == nil {
+		w.caps = caps
+		w.capsFetched = true
+	}
+	w.minAmps, w.maxAmps = minAmps, maxAmps
+	return caps
+}
+
+// currentLimits intersects the configured current limits with the limits
+// of the charger.
+func currentLimits(cfg config.Config, caps common.Capabilities) (float64, float64) {
+	minAmps := float64(cfg.MinAmpThreshold)
+	maxAmps := float64(cfg.MaxAmpLimit)
+	if caps.MinCurrent > minAmps {
+		minAmps = caps.MinCurrent
+	}
+	if caps.MaxCurrent > 0 && caps.MaxCurrent < maxAmps {
+		maxAmps = caps.MaxCurrent
+	}
+	if !caps.Adjustable() {
+		return minAmps, maxAmps
+	}
+	// The limits must be values the charger accepts.
+	minAmps = roundUp(minAmps, caps.CurrentStep)
+	maxAmps = roundDown(maxAmps, caps.CurrentStep)
+	if minAmps > maxAmps {
+		log.Warningf("minimum current %v is larger than maximum current %v; using %v", minAmps, maxAmps, maxAmps)
+		minAmps = maxAmps
+	}
+	return minAmps, maxAmps
+}
+
+// roundDown rounds amps down to a multiple of step. Values are returned
+// unchanged if step is zero.
+func roundDown(amps, step float64) float64 {
+	if step <= 0 {
+		return amps
+	}
+	// Allow for floating point errors, so 0.3 / 0.1 is 3, not 2.
+	return roundStep(math.Floor(amps/step+1e-9), step)
+}
+
+// roundUp rounds amps up to a multiple of step. Values are returned
+// unchanged if step is zero.
+func roundUp(amps, step float64) float64 {
+	if step <= 0 {
+		return amps
+	}
+	return roundStep(math.Ceil(amps/step-1e-9), step)
+}
+
+// roundStep returns steps multiplied by step, without the noise of floating
+// point multiplication (6.6000000000000005).
+func roundStep(steps, step float64) float64 {
+	return math.Round(steps*step*1000) / 1000
+}
+
+// updateSource records the values of one source, and merges the values of
+// all sources into our local state. Must be called with the lock held.
+func (w *Worker) updateSource(change params.DBusState) {
+	if change.Unavailable {
+		if _, ok := w.sources[change.Source]; ok {
+			log.Warningf("dropping values of %s until it recovers", change.Source)
+		}
+		delete(w.sources, change.Source)
+	} else {
+		w.sources[change.Source] = change
+	}
+
+	w.dbusState = params.DBusState{
+		Consumers: map[string]float64{},
+		Producers: map[string]float64{},
+	}
+	for _, source := range w.sources {
+		for key, val := range source.Consumers {
+			w.dbusState.Consumers[key] = val
+		}
+		for key, val := range source.Producers {
+			w.dbusState.Producers[key] = val
+		}
+	}
+
+	// Deciding on a partial state would take missing consumers for
+	// surplus, so we wait until every configured source reported.
+	w.dbusStateReceived = len(w.sources) > 0
+	for _, name := range w.expectedSources {
+		if _, ok := w.sources[name]; !ok {
+			w.dbusStateReceived = false
+		}
+	}
+}
+
 func (w *Worker) loop() {
-	timer := time.NewTicker(time.Duration(w.cfg.BackoffThreshold) * time.Second)
+	interval := time.Duration(w.cfg.BackoffThreshold) * time.Second
+	timer := time.NewTicker(interval)
 	defer func() {
 		timer.Stop()
 		close(w.chargerChanges)
@@ -171,22 +475,49 @@ func (w *Worker) loop() {
 			if err := w.syncState(); err != nil {
 				log.Errorf("failed to sync state: %s", err)
 			}
+		case <-w.wake:
+			timer.Reset(interval)
+			if err := w.syncState(); err != nil {
+				log.Errorf("failed to sync state: %s", err)
+			}
 		case change, ok := <-w.dbusChanges:
 			if !ok {
 				return
 			}
 			w.mux.Lock()
-			w.dbusStateReceived = true
-			w.dbusState = change
+			w.updateSource(change)
 			w.mux.Unlock()
 		case change, ok := <-w.chargerChanges:
 			if !ok {
 				return
 			}
 			w.mux.Lock()
+			previous := w.chargerState.Vehicle
 			w.chargerStateReceived = true
 			w.chargerState = change
+			w.chargerStateAt = time.Now()
 			w.mux.Unlock()
+
+			if change.Vehicle == previous {
+				continue
+			}
+			if change.Vehicle == params.VehicleError {
+				log.Warningf("charger reports an error")
+			} else {
+				log.Infof("vehicle is %s (was %s)", change.Vehicle, previous)
+			}
+			if change.Vehicle == params.VehicleDisconnected {
+				w.releaseDrift()
+			}
+			if previous == params.VehicleDisconnected && change.Vehicle.PluggedIn() {
+				// A new session started. Apply our settings right away,
+				// instead of letting the vehicle charge with the settings
+				// of the previous session until the next tick.
+				timer.Reset(interval)
+				if err := w.syncState(); err != nil {
+					log.Errorf("failed to sync state: %s", err)
+				}
+			}
 		case <-w.quit:
 			return
 		case <-w.ctx.Done():
@@ -0,0 +1,188 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"solar-ev-charger/chargers/common"
+	"solar-ev-charger/config"
+	"solar-ev-charger/params"
+)
+
+type nopClient struct{}
+
+func (nopClient) Start() error         { return nil }
+func (nopClient) Stop() error          { return nil }
+func (nopClient) SetAmp(float64) error { return nil }
+func (nopClient) Capabilities() (common.Capabilities, error) {
+	return common.Capabilities{}, nil
+}
+
+func TestUpdateSource(t *testing.T) {
+	cfg := &config.Config{
+		InputSensors: []config.InputSensor{{Path: "/Ac/Power"}},
+		HTTPSources:  []config.HTTPSource{{Name: "meter"}},
+	}
+	w, err := NewWorker(context.Background(), cfg, nopClient{}, nil, nil)
+	if err != nil {
+		t.Fatalf("creating worker: %v", err)
+	}
+
+	w.updateSource(params.DBusState{
+		Source:    config.DBusSource,
+		Producers: map[string]float64{"/Ac/Power": 3000},
+	})
+	if w.dbusStateReceived {
+		t.Errorf("expected to wait for the http source")
+	}
+
+	w.updateSource(params.DBusState{
+		Source:    "http:meter",
+		Consumers: map[string]float64{"house": 500, "heatpump": 1500},
+	})
+	if !w.dbusStateReceived {
+		t.Errorf("expected the state to be complete")
+	}
+	if len(w.dbusState.Producers) != 1 || len(w.dbusState.Consumers) != 2 {
+		t.Errorf("unexpected merged state: %+v", w.dbusState)
+	}
+
+	// Values missing from a new state of the same source are dropped.
+	w.updateSource(params.DBusState{
+		Source:    "http:meter",
+		Consumers: map[string]float64{"house": 700},
+	})
+	if len(w.dbusState.Consumers) != 1 || w.dbusState.Consumers["house"] != 700 {
+		t.Errorf("expected only the new consumer value, got %+v", w.dbusState.Consumers)
+	}
+
+	// A failing source is waited for again.
+	w.updateSource(params.DBusState{Source: "http:meter", Unavailable: true})
+	if w.dbusStateReceived {
+		t.Errorf("expected to wait for the failing source")
+	}
+	if len(w.dbusState.Consumers) != 0 || w.dbusState.Producers["/Ac/Power"] != 3000 {
+		t.Errorf("expected only the dbus values, got %+v", w.dbusState)
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		amps float64
+		step float64
+		down float64
+		up   float64
+	}{
+		{10, 1, 10, 10},
+		{10.5, 1, 10, 11},
+		{6.66, 0.1, 6.6, 6.7},
+		// 0.3 / 0.1 is slightly less than 3 in floating point.
+		{0.3, 0.1, 0.3, 0.3},
+		{6.6, 0.1, 6.6, 6.6},
+		{7.25, 0.5, 7, 7.5},
+		// A zero step means the current can not be adjusted.
+		{10.57, 0, 10.57, 10.57},
+	}
+	for _, tc := range tests {
+		if got := roundDown(tc.amps, tc.step); got != tc.down {
+			t.Errorf("roundDown(%v, %v) = %v, expected %v", tc.amps, tc.step, got, tc.down)
+		}
+		if got := roundUp(tc.amps, tc.step); got != tc.up {
+			t.Errorf("roundUp(%v, %v) = %v, expected %v", tc.amps, tc.step, got, tc.up)
+		}
+	}
+}
+
+func TestCurrentLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max uint
+		caps     common.Capabilities
+		minAmps  float64
+		maxAmps  float64
+	}{
+		{
+			name:    "configured limits within the charger limits",
+			min:     8,
+			max:     16,
+			caps:    common.Capabilities{MinCurrent: 6, MaxCurrent: 32, CurrentStep: 1},
+			minAmps: 8,
+			maxAmps: 16,
+		},
+		{
+			name:    "charger limits within the configured limits",
+			min:     6,
+			max:     32,
+			caps:    common.Capabilities{MinCurrent: 6.5, MaxCurrent: 20.55, CurrentStep: 0.1},
+			minAmps: 6.5,
+			maxAmps: 20.5,
+		},
+		{
+			name:    "unknown charger limits",
+			min:     6,
+			max:     32,
+			caps:    common.Capabilities{CurrentStep: 1},
+			minAmps: 6,
+			maxAmps: 32,
+		},
+		{
+			name:    "limits rounded to a step",
+			min:     6,
+			max:     16,
+			caps:    common.Capabilities{MinCurrent: 6.2, MaxCurrent: 15.9, CurrentStep: 0.5},
+			minAmps: 6.5,
+			maxAmps: 15.5,
+		},
+		{
+			name:    "minimum above maximum",
+			min:     20,
+			max:     32,
+			caps:    common.Capabilities{MinCurrent: 6, MaxCurrent: 16, CurrentStep: 1},
+			minAmps: 16,
+			maxAmps: 16,
+		},
+		{
+			name:    "non adjustable charger",
+			min:     6,
+			max:     32,
+			caps:    common.Capabilities{MinCurrent: 6.2, MaxCurrent: 15.9, Toggle: true},
+			minAmps: 6.2,
+			maxAmps: 15.9,
+		},
+	}
+	for _, tc := range tests {
+		cfg := config.Config{MinAmpThreshold: tc.min, MaxAmpLimit: tc.max}
+		minAmps, maxAmps := currentLimits(cfg, tc.caps)
+		if minAmps != tc.minAmps || maxAmps != tc.maxAmps {
+			t.Errorf("%s: expected limits %v-%v, got %v-%v", tc.name, tc.minAmps, tc.maxAmps, minAmps, maxAmps)
+		}
+	}
+}
+
+func TestDecideCurrentStep(t *testing.T) {
+	tests := []struct {
+		name   string
+		caps   common.Capabilities
+		phases uint
+		amps   string
+	}{
+		{"whole amps", testCaps, 1, "set current 10 A"},
+		{"0.1 A steps", common.Capabilities{MinCurrent: 6, MaxCurrent: 32, CurrentStep: 0.1, Toggle: true}, 1, "set current 10.4 A"},
+		{"three phases", common.Capabilities{MinCurrent: 6, MaxCurrent: 32, CurrentStep: 0.1, Phases: 3, Toggle: true}, 1, "set current 6 A"},
+		{"configured phases", common.Capabilities{MinCurrent: 6, MaxCurrent: 32, CurrentStep: 0.1, Toggle: true}, 2, "set current 6 A"},
+	}
+	for _, tc := range tests {
+		w, cli := newTestWorker(t, config.Config{CommandVerifyTimeout: 60, CommandRetries: 3, ChargerPhases: tc.phases}, tc.caps)
+		// 10.43 A on a single phase.
+		w.dbusState.Producers["/Ac/Power"] = 2400
+		report(w, time.Now(), params.ChargerState{Active: true, CurrentAmpSetting: 16, Vehicle: params.VehicleCharging})
+		var d Decision
+		if err := w.decide(time.Now(), control{mode: ModeSolar}, &d); err != nil {
+			t.Fatalf("%s: deciding: %v", tc.name, err)
+		}
+		if got := cli.takeCommands(); len(got) != 1 || got[0] != tc.amps {
+			t.Errorf("%s: expected %q, got %v (%+v)", tc.name, tc.amps, got, d)
+		}
+	}
+}